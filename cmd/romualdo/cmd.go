@@ -9,6 +9,7 @@ package main
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/vm"
 )
 
 var rootCmd = &cobra.Command{
@@ -22,7 +23,52 @@ of Interactive Storytelling.`,
 
 func init() {
 	devCmd.AddCommand(devScanCmd, devPrintASTCmd, devTestCmd, devDisassembleCmd, devHashCmd)
-	rootCmd.AddCommand(buildCmd, runCmd, devCmd)
+	rootCmd.AddCommand(buildCmd, releaseCmd, diffReleasesCmd, runCmd, replayCmd, coverageCmd, exploreCmd, stateCmd, serveCmd, lspCmd, debugCmd, devCmd)
 
 	runCmd.Flags().BoolVarP(&runDebugTraceExecution, "trace", "t", false, "debug trace execution")
+	runCmd.Flags().BoolVarP(&runStrict, "strict", "s", false, "treat soft errors as runtime errors")
+	runCmd.Flags().IntVarP(&runMaxInstructions, "max-instructions", "m", 0,
+		"maximum number of instructions to run between inputs (0 means no limit)")
+	runCmd.Flags().StringArrayVarP(&runExternals, "external", "x", nil,
+		"value returned by an external function, as `/fqn=value` (can be repeated)")
+	runCmd.Flags().IntVarP(&runUndo, "undo", "u", 0,
+		"number of choices that can be undone by entering "+vm.UndoCommand+" (0 disables undo)")
+	runCmd.Flags().StringVarP(&runProfile, "profile", "p", "",
+		"file to load the Profile from and save it to (created if needed)")
+	runCmd.Flags().StringVarP(&runCoverage, "coverage", "c", "",
+		"coverage data file to add the coverage of this run to (created if needed)")
+	runCmd.Flags().StringVarP(&runRecord, "record", "r", "", "transcript file to record the playthrough to")
+	runCmd.Flags().StringVarP(&runReplay, "replay", "y", "", "transcript file to take the inputs from")
+	runCmd.Flags().IntVarP(&runInteractiveFrom, "interactive-from", "i", 0,
+		"when replaying, step from which the Player takes over (0 means never)")
+	runCmd.Flags().BoolVarP(&runWatch, "watch", "w", false,
+		"watch the Storyworld source directory, reloading on changes")
+
+	replayCmd.Flags().IntVarP(&replayMaxInstructions, "max-instructions", "m", 1_000_000,
+		"maximum number of instructions to run between steps (0 means no limit)")
+
+	coverageCmd.Flags().StringVarP(&coverageLCOV, "lcov", "l", "", "LCOV file to write")
+	coverageCmd.Flags().StringVarP(&coverageHTML, "html", "w", "", "HTML file to write")
+	coverageCmd.Flags().StringVarP(&coverageSourceRoot, "source-root", "r", ".",
+		"directory relative source file names are relative to (for the HTML page)")
+
+	exploreCmd.Flags().StringVarP(&exploreInputs, "inputs", "i", "",
+		"input dictionary file (by default, tries every string constant in the Storyworld)")
+	exploreCmd.Flags().IntVarP(&exploreMaxDepth, "max-depth", "d", 50,
+		"maximum number of choices on any path (0 means no limit)")
+	exploreCmd.Flags().IntVarP(&exploreMaxStates, "max-states", "n", 100_000,
+		"maximum number of distinct states to explore (0 means no limit)")
+	exploreCmd.Flags().BoolVarP(&exploreDepthFirst, "depth-first", "f", false,
+		"search depth-first instead of breadth-first")
+	exploreCmd.Flags().IntVarP(&exploreWorkers, "workers", "j", 0,
+		"number of states explored in parallel (0 means one per CPU)")
+	exploreCmd.Flags().IntVarP(&exploreMaxInstructions, "max-instructions", "m", 1_000_000,
+		"maximum number of instructions to run between inputs (0 means no limit)")
+	exploreCmd.Flags().StringVarP(&exploreEndingEvent, "ending-event", "e", "",
+		"name of the event marking proper endings (if empty, every end is proper)")
+	exploreCmd.Flags().StringArrayVarP(&exploreExternals, "external", "x", nil,
+		"value returned by an external function, as `/fqn=value` (can be repeated)")
+
+	buildCmd.Flags().StringVarP(&buildOutput, "output", "o", "csw.ras", "compiled Storyworld file to create")
+	releaseCmd.Flags().StringVarP(&buildOutput, "output", "o", "csw.ras", "compiled Storyworld file to create")
 }
@@ -11,43 +11,50 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
-	"github.com/stackedboxes/romualdo/pkg/backend"
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
 	"github.com/stackedboxes/romualdo/pkg/errs"
-	"github.com/stackedboxes/romualdo/pkg/frontend"
 	"github.com/stackedboxes/romualdo/pkg/romutil"
+	"github.com/stackedboxes/romualdo/pkg/vm"
 )
 
+// buildOutput is for the flag --output of the build and release commands.
+var buildOutput string
+
 var buildCmd = &cobra.Command{
 	Use:   "build <path>",
 	Short: "Builds the Storyworld from source",
-	Long:  `Builds the Storyworld from source.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Builds the Storyworld from source.
 
-	Run: func(cmd *cobra.Command, args []string) {
-		swPath := args[0]
-		if isDir, err := romutil.IsDir(swPath); err != nil || !isDir {
-			buErr := errs.NewBadUsage("The build command expects a directory, but %v isn't one", swPath)
-			reportAndExit(buErr)
-		}
+If the output file already exists, the Storyworld is built on top of it, so
+that everything released in it is retained. Everything built is marked as
+unreleased; use the release command to create a proper release.`,
+	Args: cobra.ExactArgs(1),
 
-		swAST, err := frontend.ParseStoryworld(swPath)
-		reportAndExitOnError(err)
+	Run: func(cmd *cobra.Command, args []string) {
+		csw, di := buildOnTopOfOutput(args[0])
+		err := vm.SaveCompiledStoryworldBinaries(csw, di, buildOutput)
+		reportAndExit(err)
+	},
+}
 
-		csw, di, err := backend.GenerateCode(swAST)
+// buildOnTopOfOutput builds the Storyworld at swPath on top of the compiled
+// Storyworld at buildOutput, if it exists. Exits with an error if anything goes
+// wrong.
+func buildOnTopOfOutput(swPath string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo) {
+	if isDir, err := romutil.IsDir(swPath); err != nil || !isDir {
+		buErr := errs.NewBadUsage("Expected a directory, but %v isn't one", swPath)
+		reportAndExit(buErr)
+	}
+
+	var base *bytecode.CompiledStoryworld
+	var baseDI *bytecode.DebugInfo
+	if _, plainErr := os.Stat(buildOutput); plainErr == nil {
+		var err errs.Error
+		base, baseDI, err = vm.LoadCompiledStoryworldBinaries(buildOutput, true)
 		reportAndExitOnError(err)
+	}
 
-		cswFile, plainErr := os.Create("csw.ras")
-		err = csw.Serialize(cswFile)
-		reportAndExitOnError(err)
-		defer cswFile.Close()
-
-		debugInfoFile, plainErr := os.Create("csw.rad")
-		if plainErr != nil {
-			err = errs.NewRomualdoTool("creating debug info file: %v", plainErr)
-			reportAndExit(err)
-		}
-		defer debugInfoFile.Close()
-		err = di.Serialize(debugInfoFile)
-		reportAndExit(err)
-	},
+	csw, di, err := vm.BuildCSW(swPath, base, baseDI)
+	reportAndExitOnError(err)
+	return csw, di
 }
@@ -0,0 +1,81 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// coverageLCOV is for the flag --lcov.
+var coverageLCOV string
+
+// coverageHTML is for the flag --html.
+var coverageHTML string
+
+// coverageSourceRoot is for the flag --source-root.
+var coverageSourceRoot string
+
+var coverageCmd = &cobra.Command{
+	Use:   "coverage <coverage-file>...",
+	Short: "Reports which parts of a Storyworld were exercised",
+	Long: `Reports which parts of a Storyworld were exercised, according to coverage data
+files created by the --coverage flag of the run and dev test commands. If
+several files are given, their data is aggregated.
+
+Prints a summary and lists the Lectures never seen, the branches of if
+statements never taken, and the Procedures never called. Optionally, writes the
+coverage data as an LCOV file, and as an HTML page with the source code
+annotated with hit counts.`,
+	Args: cobra.MinimumNArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		data := coverage.NewData()
+		for _, dataPath := range args {
+			fileData, err := coverage.LoadData(dataPath)
+			reportAndExitOnError(err)
+			data.Merge(fileData)
+		}
+
+		plainErr := data.WriteText(os.Stdout)
+		if plainErr != nil {
+			reportAndExit(errs.NewRomualdoTool("writing the coverage summary: %v", plainErr))
+		}
+
+		if coverageLCOV != "" {
+			err := writeCoverageFile(coverageLCOV, data.WriteLCOV)
+			reportAndExitOnError(err)
+		}
+		if coverageHTML != "" {
+			err := writeCoverageFile(coverageHTML, func(w io.Writer) error {
+				return data.WriteHTML(w, coverageSourceRoot)
+			})
+			reportAndExitOnError(err)
+		}
+	},
+}
+
+// writeCoverageFile creates the file at path and writes a report to it using
+// write.
+func writeCoverageFile(path string, write func(w io.Writer) error) errs.Error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errs.NewRomualdoTool("creating %v: %v", path, err)
+	}
+	defer f.Close()
+
+	err = write(f)
+	if err != nil {
+		return errs.NewRomualdoTool("writing %v: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/dap"
+)
+
+var debugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Runs the debug adapter",
+	Long: `Runs a Debug Adapter Protocol server, speaking over the standard input and
+output. This is meant to be started by editors, not by humans.
+
+The Storyworld to debug (either its source code or a compiled Storyworld with
+its debug information) is given by the editor when launching the debug
+session. The debugger supports line breakpoints, stepping over, into and out
+of Procedures, and inspecting the call stack and the local and global
+variables. See doc/debugger.md for details.`,
+	Args: cobra.NoArgs,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		srv := dap.NewServer(os.Stdout)
+		err := srv.Serve(os.Stdin)
+		reportAndExitOnError(err)
+	},
+}
@@ -28,14 +28,32 @@ var devDisassembleCmd = &cobra.Command{
 
 		// Basic info
 		fmt.Printf("Disassembling %s\n", args[0])
-		fmt.Printf("Total %v constants, %v chunks\n", len(csw.Constants), len(csw.Chunks))
+		fmt.Printf("Total %v constants, %v chunks, %v procedures, %v globals, %v releases\n",
+			len(csw.Constants), len(csw.Chunks), len(csw.Procedures), len(csw.Globals), len(csw.Releases))
 		fmt.Printf("Initial chunk: %v %v\n", csw.InitialChunk, chunkDebugInfo(csw, di, csw.InitialChunk))
 
+		// Releases
+		if len(csw.Releases) > 0 {
+			fmt.Println("\nReleases:")
+			for i, r := range csw.Releases {
+				fmt.Printf("    %5d: %v\n", i, r.Tag)
+			}
+		}
+
 		// Chunks summary
 		fmt.Println("\nChunks summary:")
 		for i, c := range csw.Chunks {
 			chunkDI := chunkDebugInfo(csw, di, i)
-			fmt.Printf("    %5d: %5d bytes long %v\n", i, len(c.Code), chunkDI)
+			latest := ""
+			if csw.Procedures[c.Procedure].Chunk == i {
+				latest = ", latest"
+			}
+			maySuspend := ""
+			if c.MaySuspend {
+				maySuspend = ", may suspend"
+			}
+			fmt.Printf("    %5d: %5d bytes long %v (%v%v%v)\n", i, len(c.Code), chunkDI,
+				csw.ReleaseTag(c.Release), latest, maySuspend)
 		}
 
 		// Constants
@@ -46,6 +64,15 @@ var devDisassembleCmd = &cobra.Command{
 			}
 		}
 
+		// Globals
+		if flagDevDisassembleAll {
+			fmt.Println("\nGlobals:")
+			for i, g := range csw.Globals {
+				fmt.Printf("    %5d: %v = %v (%v)\n", i, g.FQN, g.InitialValue.DebugString(di),
+					csw.ReleaseTag(g.Release))
+			}
+		}
+
 		// Full disassembly of requested Procedures
 		if len(*flagDevDisassembleProcs) == 0 && !flagDevDisassembleAll {
 			return
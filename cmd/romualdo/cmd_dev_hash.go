@@ -9,7 +9,7 @@ package main
 
 import (
 	"fmt"
-	"path/filepath"
+	"sort"
 
 	"github.com/spf13/cobra"
 	"github.com/stackedboxes/romualdo/pkg/errs"
@@ -18,20 +18,22 @@ import (
 )
 
 var devHashCmd = &cobra.Command{
-	Use:   "hash <path>",
+	Use:   "hash <storyworld_path>",
 	Short: "Computes the code hash of procedures and/or globals",
-	Long: `Computes the code hash of procedures and/or globals. If you pass the
-name of a procedure or global variable via the optional --symbol flag, the
-command will print the hash of the requested symbol only. Otherwise, it will print
-the hash of all symbols.`,
+	Long: `Computes the code hash of procedures and/or globals of the Storyworld at
+the given path. If you pass the fully-qualified name of a procedure or global
+variable via the optional --symbol flag, the command will print the hash of the
+requested symbol only. Otherwise, it will print the hash of all symbols, sorted
+by name.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		path := args[0]
-		ast, err := frontend.ParseFile(path, filepath.Dir(path))
+		ast, err := frontend.ParseStoryworld(path)
 		reportAndExitOnError(err)
 
 		hasher := romutil.NewCodeHasher()
 		ast.Walk(hasher)
+		reportAndExitOnError(hasher.Err())
 
 		// Did the user ask for a specific symbol?
 		if flagDevHashSymbol != "" {
@@ -44,8 +46,13 @@ the hash of all symbols.`,
 		}
 
 		// Nope, print hashes for all symbols.
-		for sym, hash := range hasher.Hashes {
-			fmt.Printf("%x  %v\n", hash, sym)
+		symbols := make([]string, 0, len(hasher.Hashes))
+		for sym := range hasher.Hashes {
+			symbols = append(symbols, sym)
+		}
+		sort.Strings(symbols)
+		for _, sym := range symbols {
+			fmt.Printf("%x  %v\n", hasher.Hashes[sym], sym)
 		}
 	},
 }
@@ -48,30 +48,50 @@ func (ap *ASTPrinter) Enter(node ast.Node) {
 	ap.builder.WriteString(indent(ap.indentLevel))
 
 	switch n := node.(type) {
+	case *ast.Assignment:
+		ap.builder.WriteString(fmt.Sprintf("Assignment [%v]\n", identifierString(n.Target)))
 	case *ast.Binary:
 		ap.builder.WriteString(fmt.Sprintf("Binary [%v]\n", n.Operator))
 	case *ast.Block:
 		ap.builder.WriteString("Block\n")
 	case *ast.BoolLiteral:
 		ap.builder.WriteString(fmt.Sprintf("BoolLiteral [%v]\n", n.Value))
+	case *ast.Call:
+		ap.builder.WriteString(fmt.Sprintf("Call [%v args]\n", len(n.Args)))
 	case *ast.Curlies:
 		ap.builder.WriteString("Curlies\n")
+	case *ast.Emit:
+		ap.builder.WriteString(fmt.Sprintf("Emit [%v entries]\n", len(n.Payload)))
 	case *ast.ExpressionStmt:
 		ap.builder.WriteString("ExpressionStmt\n")
+	case *ast.GlobalsBlock:
+		if n.Profile {
+			ap.builder.WriteString("Profile\n")
+		} else {
+			ap.builder.WriteString("Globals\n")
+		}
+	case *ast.Identifier:
+		ap.builder.WriteString(fmt.Sprintf("Identifier [%v]\n", identifierString(n)))
 	case *ast.IfStmt:
 		ap.builder.WriteString("If\n")
+	case *ast.Import:
+		ap.builder.WriteString(fmt.Sprintf("Import [%v as %v]\n", n.Package, n.Alias))
 	case *ast.Lecture:
 		ap.builder.WriteString(fmt.Sprintf("Lecture [%v]\n", romutil.FormatTextForDisplay(n.Text)))
 	case *ast.Listen:
 		ap.builder.WriteString("Listen\n")
 	case *ast.ProcedureDecl:
 		ap.builder.WriteString(fmt.Sprintf("ProcDecl [%v %v(%v):%v]\n", n.Kind, n.Name, n.Parameters, n.ReturnType))
+	case *ast.Return:
+		ap.builder.WriteString("Return\n")
 	case *ast.Say:
 		ap.builder.WriteString("Say\n")
 	case *ast.SourceFile:
 		ap.builder.WriteString("SourceFile\n")
 	case *ast.StringLiteral:
 		ap.builder.WriteString(fmt.Sprintf("StringLiteral [%v]\n", romutil.FormatTextForDisplay(n.Value)))
+	case *ast.VarDecl:
+		ap.builder.WriteString(fmt.Sprintf("VarDecl [%v:%v]\n", n.Name, n.VarType))
 	default:
 		panic(fmt.Sprintf("Unexpected node type: %T", n))
 	}
@@ -87,6 +107,15 @@ func (ap *ASTPrinter) Event(node ast.Node, event ast.EventType) {
 	// Nothing
 }
 
+// identifierString returns a string representation of an identifier, including
+// its qualifier, if any.
+func identifierString(id *ast.Identifier) string {
+	if id.Qualifier != "" {
+		return id.Qualifier + "." + id.Name
+	}
+	return id.Name
+}
+
 // indent returns a string good for indenting code level levels deep.
 func indent(level int) string {
 	return strings.Repeat("\t", level)
@@ -9,6 +9,7 @@ package main
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
 	"github.com/stackedboxes/romualdo/pkg/test"
 )
 
@@ -18,7 +19,17 @@ var devTestCmd = &cobra.Command{
 	Long:  `Run a Romualdo test suite (i.e., meant to test Romualdo itself).`,
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		err := test.ExecuteSuite(flagDevTestSuite)
+		var cov *coverage.Data
+		if flagDevTestCoverage != "" {
+			cov = coverage.NewData()
+		}
+		err := test.ExecuteSuite(flagDevTestSuite, cov)
+		if cov != nil {
+			covErr := cov.AddToFile(flagDevTestCoverage)
+			if err == nil {
+				err = covErr
+			}
+		}
 		reportAndExit(err)
 	},
 }
@@ -26,7 +37,13 @@ var devTestCmd = &cobra.Command{
 // flagDevTestSuite is the value of the --suite flag of the `dev test` command.
 var flagDevTestSuite string
 
+// flagDevTestCoverage is the value of the --coverage flag of the `dev test`
+// command.
+var flagDevTestCoverage string
+
 func init() {
 	devTestCmd.Flags().StringVarP(&flagDevTestSuite, "suite", "s",
 		"./test/suite", "Path to the test suite to run")
+	devTestCmd.Flags().StringVarP(&flagDevTestCoverage, "coverage", "c", "",
+		"Coverage data file to add the coverage of the Storyworlds run to (created if needed)")
 }
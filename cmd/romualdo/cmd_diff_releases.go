@@ -0,0 +1,79 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// flagDiffReleasesJSON is the value of the --json flag of the diff-releases
+// command.
+var flagDiffReleasesJSON bool
+
+var diffReleasesCmd = &cobra.Command{
+	Use:   "diff-releases <old-ras-file> <new-ras-file or storyworld-path>",
+	Short: "Shows what changed between two compiled Storyworlds",
+	Long: `Shows what changed between two compiled Storyworlds: which Procedures got
+new versions, which Procedures and globals were added or removed, and how the
+bytecode size changed.
+
+The new Storyworld can also be a source directory, in which case it is built on
+top of the old one, just like the build command would do. (This requires the
+debug info of the old compiled Storyworld.)
+
+Procedures in which saved states created with the old compiled Storyworld may be
+suspended are flagged. If one of these changed, players loading these saved
+states will keep seeing the old behavior until the Procedure returns.`,
+	Args: cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		newIsDir, plainErr := romutil.IsDir(args[1])
+		if plainErr != nil {
+			reportAndExit(errs.NewBadUsage("Cannot access %v: %v", args[1], plainErr))
+		}
+
+		oldCSW, oldDI, err := vm.LoadCompiledStoryworldBinaries(args[0], newIsDir)
+		reportAndExitOnError(err)
+
+		var newCSW *bytecode.CompiledStoryworld
+		if newIsDir {
+			newCSW, _, err = vm.BuildCSW(args[1], oldCSW, oldDI)
+		} else {
+			newCSW, _, err = vm.LoadCompiledStoryworldBinaries(args[1], false)
+		}
+		reportAndExitOnError(err)
+
+		diff := bytecode.Diff(oldCSW, newCSW)
+
+		if flagDiffReleasesJSON {
+			out, plainErr := json.MarshalIndent(diff, "", "  ")
+			if plainErr != nil {
+				reportAndExit(errs.NewRomualdoTool("encoding JSON: %v", plainErr))
+			}
+			fmt.Println(string(out))
+			return
+		}
+
+		plainErr = diff.WriteText(os.Stdout)
+		if plainErr != nil {
+			reportAndExit(errs.NewRomualdoTool("writing the diff report: %v", plainErr))
+		}
+	},
+}
+
+func init() {
+	diffReleasesCmd.Flags().BoolVarP(&flagDiffReleasesJSON, "json", "j", false, "output the report as JSON")
+}
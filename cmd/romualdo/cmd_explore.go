@@ -0,0 +1,91 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/explore"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// exploreInputs is for the flag --inputs.
+var exploreInputs string
+
+// exploreMaxDepth is for the flag --max-depth.
+var exploreMaxDepth int
+
+// exploreMaxStates is for the flag --max-states.
+var exploreMaxStates int
+
+// exploreDepthFirst is for the flag --depth-first.
+var exploreDepthFirst bool
+
+// exploreWorkers is for the flag --workers.
+var exploreWorkers int
+
+// exploreMaxInstructions is for the flag --max-instructions.
+var exploreMaxInstructions int
+
+// exploreEndingEvent is for the flag --ending-event.
+var exploreEndingEvent string
+
+// exploreExternals is for the flag --external.
+var exploreExternals []string
+
+var exploreCmd = &cobra.Command{
+	Use:   "explore <ras-file or storyworld-path>",
+	Short: "Explores a Storyworld automatically, looking for problems",
+	Long: `Explores the Stories a Storyworld can tell, trying every input from a
+dictionary whenever the Story listens to the Player. Can use either a compiled
+Storyworld (*.ras) or a Storyworld source directory.
+
+Reports runtime errors, soft errors, Stories that end without emitting the
+ending event (if one is given), Stories that run too many instructions without
+listening to the Player, and Lectures never reached. Each problem is reported
+along with the inputs that trigger it.
+
+The input dictionary is a TOML file. If not given, every string constant in the
+Storyworld is tried at every listen. See doc/explore.md for details.`,
+	Args: cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		externals, err := parseExternals(exploreExternals)
+		reportAndExitOnError(err)
+		csw, di, err := vm.CSWFromPath(args[0])
+		reportAndExitOnError(err)
+
+		var inputs *explore.Inputs
+		if exploreInputs != "" {
+			inputs, err = explore.LoadInputs(exploreInputs)
+			reportAndExitOnError(err)
+		}
+
+		report, err := explore.Explore(csw, di, explore.Options{
+			Inputs:            inputs,
+			MaxDepth:          exploreMaxDepth,
+			MaxStates:         exploreMaxStates,
+			DepthFirst:        exploreDepthFirst,
+			Workers:           exploreWorkers,
+			InstructionBudget: exploreMaxInstructions,
+			EndingEvent:       exploreEndingEvent,
+			Externals:         externals,
+		})
+		reportAndExitOnError(err)
+
+		plainErr := report.WriteText(os.Stdout)
+		if plainErr != nil {
+			reportAndExit(errs.NewRomualdoTool("writing the exploration report: %v", plainErr))
+		}
+		if len(report.Findings) > 0 {
+			reportAndExit(errs.NewRomualdoTool("%v problem(s) found", len(report.Findings)))
+		}
+	},
+}
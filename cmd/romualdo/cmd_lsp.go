@@ -0,0 +1,34 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/lsp"
+)
+
+var lspCmd = &cobra.Command{
+	Use:   "lsp",
+	Short: "Runs the language server",
+	Long: `Runs a Language Server Protocol server for Romualdo source code, speaking
+over the standard input and output. This is meant to be started by editors, not
+by humans.
+
+The server provides diagnostics as you type, go-to-definition and
+find-references for Procedures, hover with Procedure signatures, document
+symbols, and semantic tokens. See doc/lsp.md for details.`,
+	Args: cobra.NoArgs,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		srv := lsp.NewServer(os.Stdout)
+		err := srv.Serve(os.Stdin)
+		reportAndExitOnError(err)
+	},
+}
@@ -0,0 +1,44 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/backend"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+var releaseCmd = &cobra.Command{
+	Use:   "release <path> <tag>",
+	Short: "Builds and releases the Storyworld",
+	Long: `Builds the Storyworld from source and turns everything unreleased into a new
+release, identified by the given tag.
+
+Just like the build command, this builds on top of the output file, if it
+exists. Keep the output file under version control: it is needed to create
+future releases that are compatible with the saved states of the current one.
+
+Old versions of Procedures that can never be on the call stack of a saved state
+(because they never, not even indirectly, listen) are removed.`,
+	Args: cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		csw, di := buildOnTopOfOutput(args[0])
+
+		pruned, err := backend.Release(csw, di, args[1])
+		reportAndExitOnError(err)
+		if pruned > 0 {
+			fmt.Printf("Removed %v old procedure version(s) that never suspend.\n", pruned)
+		}
+
+		err = vm.SaveCompiledStoryworldBinaries(csw, di, buildOutput)
+		reportAndExit(err)
+	},
+}
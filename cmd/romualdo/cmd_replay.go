@@ -0,0 +1,65 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/replay"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// replayMaxInstructions is for the flag --max-instructions.
+var replayMaxInstructions int
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <ras-file or storyworld-path> <recording>...",
+	Short: "Replays recorded playthroughs against a Storyworld",
+	Long: `Replays recorded playthroughs against a Storyworld, reporting any divergences
+in the output. Can use either a compiled Storyworld (*.ras) or a Storyworld
+source directory.
+
+Each recording is replayed from the start of the Story. Additionally, for each
+saved state referenced by the recording, the saved state is loaded and the rest
+of the recording is replayed from there. Saved states that cannot be loaded
+(for example, because they are not compatible with the Storyworld) are reported
+as divergences, too. So are runs in which the Storyworld runs too many
+instructions between two steps (see --max-instructions), as that usually means
+it is stuck in a loop.
+
+Recordings are TOML files with an array of steps, each of which with an input
+and the corresponding output. See doc/testing.md for details.`,
+	Args: cobra.MinimumNArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		csw, di, err := vm.CSWFromPath(args[0])
+		reportAndExitOnError(err)
+
+		divergences := 0
+		for _, recPath := range args[1:] {
+			rec, err := replay.LoadRecording(recPath)
+			reportAndExitOnError(err)
+
+			fmt.Printf("Replaying %v\n", recPath)
+			report := replay.Replay(csw, di, rec, replay.Options{
+				InstructionBudget: replayMaxInstructions,
+			})
+			for _, run := range report.Runs {
+				fmt.Printf("    %v\n", &run)
+			}
+			divergences += report.DivergenceCount()
+		}
+
+		if divergences > 0 {
+			reportAndExit(errs.NewRomualdoTool("%v run(s) diverged from the recordings", divergences))
+		}
+		fmt.Println("All recordings replayed successfully.")
+	},
+}
@@ -8,24 +8,195 @@
 package main
 
 import (
+	"os"
+	"strings"
+
 	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/replay"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
 	"github.com/stackedboxes/romualdo/pkg/vm"
 )
 
 // runDebugTraceExecution is for the flag --trace.
 var runDebugTraceExecution bool
 
+// runStrict is for the flag --strict.
+var runStrict bool
+
+// runMaxInstructions is for the flag --max-instructions.
+var runMaxInstructions int
+
+// runExternals is for the flag --external.
+var runExternals []string
+
+// runUndo is for the flag --undo.
+var runUndo int
+
+// runProfile is for the flag --profile.
+var runProfile string
+
+// runCoverage is for the flag --coverage.
+var runCoverage string
+
+// runRecord is for the flag --record.
+var runRecord string
+
+// runReplay is for the flag --replay.
+var runReplay string
+
+// runInteractiveFrom is for the flag --interactive-from.
+var runInteractiveFrom int
+
+// runWatch is for the flag --watch.
+var runWatch bool
+
 var runCmd = &cobra.Command{
 	Use:   "run <ras-file or storyworld-path>",
 	Short: "Runs a Storyworld using the VM-based interpreter",
 	Long: `Runs a Storyworld using the VM-based interpreter. Can run either a compiled
-Storyworld (*.ras) or a Storyworld source directory.`,
+Storyworld (*.ras) or a Storyworld source directory.
+
+With --record, the playthrough is recorded to a transcript: every input and
+output, the values returned by external functions, and the hash of the
+Storyworld. With --replay, the inputs are taken from a transcript instead, and
+the run stops at the first divergence from the recorded outputs (or at the end
+of the transcript, unless --interactive-from tells to switch to interactive
+mode). Transcripts are recordings as used by the replay command.
+
+With --watch, the Storyworld source directory is watched for changes, and
+rebuilt whenever it changes. The Story goes on in the new build from the same
+choice point if the saved state is compatible with it; otherwise, the choices
+made so far are replayed from the start. Compile errors are reported, and the
+previous build keeps running until they are fixed.`,
 	Args: cobra.ExactArgs(1),
 
 	Run: func(cmd *cobra.Command, args []string) {
+		externals, err := parseExternals(runExternals)
+		reportAndExitOnError(err)
+
+		if runWatch {
+			reportAndExit(runWatched(args[0], externals))
+		}
+
 		csw, di, err := vm.CSWFromPath(args[0])
 		reportAndExitOnError(err)
-		err = vm.RunCSW(csw, di, runDebugTraceExecution)
+
+		var transcript vm.Transcript
+		externals, transcript, err = runTranscript(csw, externals)
+		reportAndExitOnError(err)
+
+		var cov *vm.Coverage
+		if runCoverage != "" {
+			if di == nil {
+				reportAndExit(errs.NewBadUsage("Coverage requires DebugInfo."))
+			}
+			cov = vm.NewCoverage(csw)
+		}
+
+		err = vm.RunCSW(csw, di, vm.RunOptions{
+			Trace:             runDebugTraceExecution,
+			Strict:            runStrict,
+			InstructionBudget: runMaxInstructions,
+			Externals:         externals,
+			HistoryDepth:      runUndo,
+			ProfilePath:       runProfile,
+			Coverage:          cov,
+			Transcript:        transcript,
+		})
+
+		// Record the coverage even if the Story failed: knowing how far it
+		// got is useful, too.
+		if cov != nil {
+			covErr := saveRunCoverage(args[0], csw, di, cov)
+			if err == nil {
+				err = covErr
+			}
+		}
 		reportAndExit(err)
 	},
 }
+
+// runWatched runs the Storyworld at swPath in watch mode.
+func runWatched(swPath string, externals map[string]any) errs.Error {
+	if runCoverage != "" || runRecord != "" || runReplay != "" {
+		return errs.NewBadUsage("--watch cannot be used with --coverage, --record or --replay.")
+	}
+	isDir, plainErr := romutil.IsDir(swPath)
+	if plainErr != nil || !isDir {
+		return errs.NewBadUsage("--watch requires a Storyworld source directory.")
+	}
+
+	return vm.WatchCSW(swPath, vm.RunOptions{
+		Trace:             runDebugTraceExecution,
+		Strict:            runStrict,
+		InstructionBudget: runMaxInstructions,
+		Externals:         externals,
+		HistoryDepth:      runUndo,
+		ProfilePath:       runProfile,
+	})
+}
+
+// parseExternals parses the values of the --external flag, which look like
+// `/fqn=value`. Values `true` and `false` are taken as Booleans; anything else
+// is a string.
+func parseExternals(flags []string) (map[string]any, errs.Error) {
+	externals := map[string]any{}
+	for _, flag := range flags {
+		fqn, value, found := strings.Cut(flag, "=")
+		if !found {
+			return nil, errs.NewBadUsage("Expected `<fqn>=<value>` in --external, got '%v'.", flag)
+		}
+		switch value {
+		case "true":
+			externals[fqn] = true
+		case "false":
+			externals[fqn] = false
+		default:
+			externals[fqn] = value
+		}
+	}
+	return externals, nil
+}
+
+// runTranscript creates the Transcript for the flags --record and --replay (nil
+// if neither is given). When replaying, the external functions return the
+// values recorded in the transcript, unless overridden by the ones in
+// externals; the resulting values are returned.
+func runTranscript(csw *bytecode.CompiledStoryworld, externals map[string]any) (
+	map[string]any, vm.Transcript, errs.Error) {
+
+	if runInteractiveFrom != 0 && runReplay == "" {
+		return nil, nil, errs.NewBadUsage("--interactive-from requires --replay.")
+	}
+
+	return replay.NewTranscript(csw, externals, replay.TranscriptOptions{
+		Record:          runRecord,
+		Replay:          runReplay,
+		InteractiveFrom: runInteractiveFrom,
+		Warnings:        os.Stderr,
+	})
+}
+
+// saveRunCoverage adds the coverage recorded in cov while running csw (loaded
+// from swPath) to the coverage data file given by --coverage. If swPath is a
+// Storyworld source directory, source files are recorded with their paths from
+// the current directory. For compiled Storyworlds, where the source code is
+// nowhere to be known, they are recorded relative to the Storyworld root.
+func saveRunCoverage(swPath string, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo,
+	cov *vm.Coverage) errs.Error {
+
+	sourceRoot := ""
+	if isDir, plainErr := romutil.IsDir(swPath); plainErr == nil && isDir {
+		sourceRoot = swPath
+	}
+
+	data := coverage.NewData()
+	err := data.Add(csw, di, cov, sourceRoot)
+	if err != nil {
+		return err
+	}
+	return data.AddToFile(runCoverage)
+}
@@ -0,0 +1,115 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/server"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// flagServeAddr is the value of the --addr flag of the serve command.
+var flagServeAddr string
+
+// flagServeDir is the value of the --dir flag of the serve command.
+var flagServeDir string
+
+// flagServeStrict is the value of the --strict flag of the serve command.
+var flagServeStrict bool
+
+// flagServeMaxInstructions is the value of the --max-instructions flag of the
+// serve command.
+var flagServeMaxInstructions int
+
+// flagServeExternals is the value of the --external flag of the serve command.
+var flagServeExternals []string
+
+// flagServeCompress is the value of the --compress flag of the serve command.
+var flagServeCompress bool
+
+// flagServeKeyFile is the value of the --key-file flag of the serve command.
+var flagServeKeyFile string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve <ras-file or storyworld-path>",
+	Short: "Serves a Storyworld over HTTP",
+	Long: `Runs a local HTTP/JSON story server, which lets Driver Programs create any
+number of sessions (Stories) of a Storyworld, step them with the Player
+choices, and save and load their states. Can serve either a compiled Storyworld
+(*.ras) or a Storyworld source directory.
+
+Sessions live in memory, unless a directory is passed with --dir: in this case,
+the state and the Profile of each session are saved there after each change,
+and the sessions found there are loaded when the server starts.
+
+Pass a file containing the signing key with --key-file to sign the binary saved
+states sent to clients, and to verify the ones received from them. Use
+--compress to compress them.
+
+See doc/server.md for the API.`,
+	Args: cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		externals, err := parseExternals(flagServeExternals)
+		reportAndExitOnError(err)
+		csw, di, err := vm.CSWFromPath(args[0])
+		reportAndExitOnError(err)
+
+		opts := server.Options{
+			Strict:            flagServeStrict,
+			InstructionBudget: flagServeMaxInstructions,
+			Externals:         externals,
+			SavedStateOptions: vm.SavedStateOptions{Compress: flagServeCompress},
+			Dir:               flagServeDir,
+			Warnings:          os.Stderr,
+		}
+		if flagServeKeyFile != "" {
+			key, plainErr := os.ReadFile(flagServeKeyFile)
+			if plainErr != nil {
+				reportAndExit(errs.NewRomualdoTool("reading %v: %v", flagServeKeyFile, plainErr))
+			}
+			opts.SavedStateOptions.Key = key
+			opts.SavedStateOptions.RequireSignature = true
+		}
+		if flagServeDir != "" {
+			plainErr := os.MkdirAll(flagServeDir, 0755)
+			if plainErr != nil {
+				reportAndExit(errs.NewRomualdoTool("creating %v: %v", flagServeDir, plainErr))
+			}
+		}
+
+		srv, err := server.New(csw, di, opts)
+		reportAndExitOnError(err)
+
+		fmt.Printf("Serving %v on http://%v/sessions\n", args[0], flagServeAddr)
+		plainErr := http.ListenAndServe(flagServeAddr, srv)
+		reportAndExit(errs.NewRomualdoTool("serving: %v", plainErr))
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVarP(&flagServeAddr, "addr", "a", "localhost:8080",
+		"address to listen on")
+	serveCmd.Flags().StringVarP(&flagServeDir, "dir", "d", "",
+		"directory to persist the sessions to (created if needed)")
+	serveCmd.Flags().BoolVarP(&flagServeStrict, "strict", "s", false,
+		"treat soft errors as runtime errors")
+	serveCmd.Flags().IntVarP(&flagServeMaxInstructions, "max-instructions", "m", 0,
+		"maximum number of instructions to run per request (0 means no limit)")
+	serveCmd.Flags().StringArrayVarP(&flagServeExternals, "external", "x", nil,
+		"value returned by an external function, as `/fqn=value` (can be repeated)")
+	serveCmd.Flags().BoolVarP(&flagServeCompress, "compress", "z", false,
+		"compress the binary saved states")
+	serveCmd.Flags().StringVarP(&flagServeKeyFile, "key-file", "k", "",
+		"file with the key used to sign and verify binary saved states")
+}
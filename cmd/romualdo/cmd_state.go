@@ -0,0 +1,109 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// flagStateOutput is the value of the --output flag of the state command.
+var flagStateOutput string
+
+// flagStateStoryworld is the value of the --storyworld flag of the state
+// command.
+var flagStateStoryworld string
+
+// flagStateCompress is the value of the --compress flag of the state command.
+var flagStateCompress bool
+
+// flagStateKeyFile is the value of the --key-file flag of the state command.
+var flagStateKeyFile string
+
+var stateCmd = &cobra.Command{
+	Use:   "state <saved-state>",
+	Short: "Pretty-prints or converts a saved state",
+	Long: `Pretty-prints a saved state, or converts it between the binary and the JSON
+formats. The format of the input is detected automatically.
+
+By default, the saved state is printed as JSON to the standard output. With
+--output, it is converted to the other format (binary saved states become JSON,
+and JSON ones become binary) and written to the given file.
+
+Pass the Storyworld (either a compiled Storyworld or a source directory) with
+--storyworld to annotate the call frames with their source code locations. For
+compiled Storyworlds, this requires the debug info.
+
+Pass a file containing the signing key with --key-file to verify the signature
+of binary saved states being read, and to sign the binary saved states being
+written. Use --compress to compress them.`,
+	Args: cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		data, plainErr := os.ReadFile(args[0])
+		if plainErr != nil {
+			reportAndExit(errs.NewRomualdoTool("reading %v: %v", args[0], plainErr))
+		}
+
+		opts := vm.SavedStateOptions{Compress: flagStateCompress}
+		if flagStateKeyFile != "" {
+			opts.Key, plainErr = os.ReadFile(flagStateKeyFile)
+			if plainErr != nil {
+				reportAndExit(errs.NewRomualdoTool("reading %v: %v", flagStateKeyFile, plainErr))
+			}
+		}
+
+		var ss *vm.SavedState
+		var err errs.Error
+		isJSON := bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+		if isJSON {
+			ss, err = vm.DecodeSavedStateJSON(bytes.NewReader(data))
+		} else {
+			ss, err = vm.DecodeSavedState(bytes.NewReader(data), opts)
+		}
+		reportAndExitOnError(err)
+
+		if flagStateStoryworld != "" {
+			csw, di, err := vm.CSWFromPath(flagStateStoryworld)
+			reportAndExitOnError(err)
+			ss.Annotate(csw, di)
+		}
+
+		out := &bytes.Buffer{}
+		if flagStateOutput != "" && isJSON {
+			err = ss.Encode(out, opts)
+		} else {
+			err = ss.EncodeJSON(out)
+		}
+		reportAndExitOnError(err)
+
+		if flagStateOutput == "" {
+			os.Stdout.Write(out.Bytes())
+			return
+		}
+		plainErr = os.WriteFile(flagStateOutput, out.Bytes(), 0644)
+		if plainErr != nil {
+			reportAndExit(errs.NewRomualdoTool("writing %v: %v", flagStateOutput, plainErr))
+		}
+	},
+}
+
+func init() {
+	stateCmd.Flags().StringVarP(&flagStateOutput, "output", "o", "",
+		"file to write the converted saved state to")
+	stateCmd.Flags().StringVarP(&flagStateStoryworld, "storyworld", "w", "",
+		"Storyworld used to annotate call frames with source code locations")
+	stateCmd.Flags().BoolVarP(&flagStateCompress, "compress", "z", false,
+		"compress the binary saved state written")
+	stateCmd.Flags().StringVarP(&flagStateKeyFile, "key-file", "k", "",
+		"file with the key used to verify and sign binary saved states")
+}
@@ -7,7 +7,10 @@
 
 package ast
 
-import "fmt"
+import (
+	"fmt"
+	"path"
+)
 
 // BaseNode contains the functionality common to all AST nodes.
 type BaseNode struct {
@@ -84,7 +87,8 @@ func (n *SourceFile) Walk(v Visitor) {
 
 // ProcedureDecl is an AST node representing the declaration (and the
 // definition, Romualdo doesn't have this distinction) of a Procedure. A
-// Procedure can be either a Function or a Passage.
+// Procedure can be either a Function or a Passage. Migrations are also
+// represented as Procedures, though they cannot be called by user code.
 type ProcedureDecl struct {
 	BaseNode
 
@@ -95,9 +99,18 @@ type ProcedureDecl struct {
 	// Package is the absolute path of the package this Procedure belongs to.
 	Package string
 
-	// Name is the Procedure name.
+	// Name is the Procedure name. For migrations, this is generated from the
+	// release tag (see MigrationName()).
 	Name string
 
+	// Release is the release tag a migration is tied to. Empty for other kinds
+	// of Procedures.
+	Release string
+
+	// NameOffset is the byte offset of the Procedure name in the source file.
+	// For migrations, this is the offset of the `migrate` keyword.
+	NameOffset int
+
 	// ReturnType contains the return type of this Procedure.
 	ReturnType TypeTag
 
@@ -105,6 +118,7 @@ type ProcedureDecl struct {
 	Parameters []Parameter
 
 	// Block contains the Procedure body (i.e., the statements that make it up).
+	// Nil for external functions, which are implemented by the Driver Program.
 	Body *Block
 
 	//
@@ -116,13 +130,118 @@ type ProcedureDecl struct {
 	ChunkIndex int
 }
 
+// FQN returns the fully-qualified name of this Procedure.
+func (n *ProcedureDecl) FQN() string {
+	return FQN(n.Package, n.Name)
+}
+
 func (n *ProcedureDecl) Type() TypeTag {
 	return TypeVoid
 }
 
 func (n *ProcedureDecl) Walk(v Visitor) {
 	v.Enter(n)
-	n.Body.Walk(v)
+	if n.Body != nil {
+		n.Body.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// Import is an AST node representing a package import.
+type Import struct {
+	BaseNode
+
+	// Path is the path of the imported package, as written in the source
+	// code.
+	Path string
+
+	// Package is the absolute path of the imported package.
+	Package string
+
+	// Alias is the name by which the imported package is referred to in the
+	// importing file. Defaults to the last component of the imported package
+	// path.
+	Alias string
+}
+
+func (n *Import) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *Import) Walk(v Visitor) {
+	v.Enter(n)
+	v.Leave(n)
+}
+
+// GlobalsBlock is an AST node representing a block of global variable
+// declarations.
+type GlobalsBlock struct {
+	BaseNode
+
+	// Profile tells if this is a profile block, declaring profile variables
+	// instead of regular global variables.
+	Profile bool
+
+	// Vars contains the variables declared in this globals block.
+	Vars []*VarDecl
+}
+
+func (n *GlobalsBlock) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *GlobalsBlock) Walk(v Visitor) {
+	v.Enter(n)
+	for _, varDecl := range n.Vars {
+		varDecl.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// VarDecl is an AST node representing a variable declaration. For now, only
+// global variables exist.
+type VarDecl struct {
+	BaseNode
+
+	// Package is the absolute path of the package this variable belongs to.
+	Package string
+
+	// Name is the variable name.
+	Name string
+
+	// NameOffset is the byte offset of the variable name in the source file.
+	NameOffset int
+
+	// VarType is the variable type. If the type was not explicitly given in
+	// the source code, this is set to TypeInvalid by the parser and inferred
+	// from the initializer by the type checker.
+	VarType TypeTag
+
+	// Initializer is the expression used to initialize the variable. May be
+	// nil, in which case the variable is initialized with the default value of
+	// its type.
+	Initializer Node
+
+	// Profile tells if this is a profile variable. Profile variables are
+	// global variables whose values are stored in the Profile instead of in
+	// the Story, and therefore persist across playthroughs.
+	Profile bool
+}
+
+// FQN returns the fully-qualified name of this variable.
+func (n *VarDecl) FQN() string {
+	return FQN(n.Package, n.Name)
+}
+
+func (n *VarDecl) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *VarDecl) Walk(v Visitor) {
+	v.Enter(n)
+	if n.Initializer != nil {
+		n.Initializer.Walk(v)
+	}
 	v.Leave(n)
 }
 
@@ -280,6 +399,45 @@ func (n *Listen) Walk(v Visitor) {
 	v.Leave(n)
 }
 
+// Emit is an AST node representing an "emit" statement, which sends an event
+// to the Driver Program.
+type Emit struct {
+	BaseNode
+
+	// Name is the expression with the event name.
+	Name Node
+
+	// Payload contains the key/value pairs sent along with the event, in the
+	// order they appear in the source code.
+	Payload []MapEntry
+}
+
+func (n *Emit) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *Emit) Walk(v Visitor) {
+	v.Enter(n)
+	n.Name.Walk(v)
+	v.Event(n, EventAfterEmitName)
+	for _, entry := range n.Payload {
+		entry.Key.Walk(v)
+		entry.Value.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// MapEntry is a key/value pair in a map literal. This is not an AST node by
+// itself: its key and value are visited directly by the node containing it.
+type MapEntry struct {
+	// Key is the entry key. Keys written as identifiers are stored as string
+	// literals, too.
+	Key *StringLiteral
+
+	// Value is the entry value.
+	Value Node
+}
+
 // BoolLiteral is an AST node representing a Boolean value literal.
 type BoolLiteral struct {
 	BaseNode
@@ -390,6 +548,145 @@ func (n *Curlies) Walk(v Visitor) {
 	v.Leave(n)
 }
 
+// Identifier is an AST node representing a reference to a named symbol, like a
+// global variable, a parameter or a procedure. The name may be qualified by an
+// import alias, as in `alias.Name`.
+type Identifier struct {
+	BaseNode
+
+	// Qualifier is the import alias qualifying the name. Empty if the name is
+	// unqualified.
+	Qualifier string
+
+	// Name is the name of the symbol referenced.
+	Name string
+
+	// Offset is the byte offset of Name (not of the Qualifier) in the source
+	// file.
+	Offset int
+
+	//
+	// Fields filled by the name resolver
+	//
+
+	// Global points to the declaration of the global variable referenced by
+	// this Identifier, if it refers to one.
+	Global *VarDecl
+
+	// Procedure points to the declaration of the Procedure referenced by this
+	// Identifier, if it refers to one.
+	Procedure *ProcedureDecl
+
+	// Param points to the parameter referenced by this Identifier, if it refers
+	// to one.
+	Param *Parameter
+
+	// ParamIndex is the index of the parameter referenced by this Identifier.
+	// Meaningful only if Param is not nil.
+	ParamIndex int
+}
+
+// FQN returns the fully-qualified name of the symbol this Identifier refers to.
+// Parameters are local to a Procedure and have no fully-qualified name; for
+// them (and for unresolved Identifiers) this returns the empty string.
+func (n *Identifier) FQN() string {
+	switch {
+	case n.Global != nil:
+		return n.Global.FQN()
+	case n.Procedure != nil:
+		return n.Procedure.FQN()
+	default:
+		return ""
+	}
+}
+
+func (n *Identifier) Type() TypeTag {
+	switch {
+	case n.Global != nil:
+		return n.Global.VarType
+	case n.Param != nil:
+		return n.Param.Type
+	default:
+		return TypeInvalid
+	}
+}
+
+func (n *Identifier) Walk(v Visitor) {
+	v.Enter(n)
+	v.Leave(n)
+}
+
+// Call is an AST node representing a procedure call.
+type Call struct {
+	BaseNode
+
+	// Callee is the expression being called. For now, it is always an
+	// Identifier referring to a Procedure.
+	Callee Node
+
+	// Args contains the arguments passed to the call.
+	Args []Node
+}
+
+func (n *Call) Type() TypeTag {
+	if id, ok := n.Callee.(*Identifier); ok && id.Procedure != nil {
+		return id.Procedure.ReturnType
+	}
+	return TypeInvalid
+}
+
+func (n *Call) Walk(v Visitor) {
+	v.Enter(n)
+	n.Callee.Walk(v)
+	v.Event(n, EventAfterCallee)
+	for _, arg := range n.Args {
+		arg.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// Assignment is an AST node representing an assignment.
+type Assignment struct {
+	BaseNode
+
+	// Target is the variable being assigned to. It is not visited when walking
+	// the tree, because it is not evaluated like other expressions.
+	Target *Identifier
+
+	// Value is the value being assigned.
+	Value Node
+}
+
+func (n *Assignment) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *Assignment) Walk(v Visitor) {
+	v.Enter(n)
+	n.Value.Walk(v)
+	v.Leave(n)
+}
+
+// Return is an AST node representing a return statement.
+type Return struct {
+	BaseNode
+
+	// Value is the value being returned. Nil for returns without a value.
+	Value Node
+}
+
+func (n *Return) Type() TypeTag {
+	return TypeVoid
+}
+
+func (n *Return) Walk(v Visitor) {
+	v.Enter(n)
+	if n.Value != nil {
+		n.Value.Walk(v)
+	}
+	v.Leave(n)
+}
+
 //
 // Helper types
 //
@@ -406,12 +703,27 @@ type Parameter struct {
 	Type TypeTag
 }
 
+// FQN returns the fully-qualified name of a symbol called name declared in the
+// package pkg (which must be an absolute package path).
+func FQN(pkg, name string) string {
+	return path.Join(pkg, name)
+}
+
+// MigrationName returns the name of the migration tied to the release tagged
+// tag. It contains a space, so that it can never clash with (or be referenced
+// by) an identifier.
+func MigrationName(tag string) string {
+	return "migrate " + tag
+}
+
 // ProcKind represents what kind of procedure a procedure is.
 type ProcKind int
 
 const (
 	ProcKindFunction ProcKind = iota
 	ProcKindPassage
+	ProcKindMigration
+	ProcKindExternal
 )
 
 func (kind ProcKind) String() string {
@@ -420,6 +732,10 @@ func (kind ProcKind) String() string {
 		return "Function"
 	case ProcKindPassage:
 		return "Passage"
+	case ProcKindMigration:
+		return "Migration"
+	case ProcKindExternal:
+		return "External function"
 	default:
 		return fmt.Sprintf("<Unknown ProcKind: %v>", int(kind))
 	}
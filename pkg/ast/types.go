@@ -40,6 +40,30 @@ const (
 	// TODO: Do we need a TypeLecture here?
 )
 
+// SourceName returns the name of the type as written in the source code, like
+// "bool". Returns an empty string for TypeInvalid, which cannot be written.
+//
+// TODO: This supports only built-in types, but eventually we'll need to
+// support user-defined types.
+func (tag TypeTag) SourceName() string {
+	switch tag {
+	case TypeVoid:
+		return "void"
+	case TypeInt:
+		return "int"
+	case TypeFloat:
+		return "float"
+	case TypeBNum:
+		return "bnum"
+	case TypeBool:
+		return "bool"
+	case TypeString:
+		return "string"
+	default:
+		return ""
+	}
+}
+
 func (tag TypeTag) String() string {
 	switch tag {
 	case TypeInvalid:
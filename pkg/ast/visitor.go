@@ -34,6 +34,14 @@ const (
 	// EventAfterBinaryLHS is emitted right after we visit the left-hand side
 	// (LHS) of a binary operator.
 	EventAfterBinaryLHS
+
+	// EventAfterCallee is emitted right after we visit the callee of a
+	// procedure call, and before visiting its arguments.
+	EventAfterCallee
+
+	// EventAfterEmitName is emitted right after we visit the name of an Emit
+	// node, before its payload.
+	EventAfterEmitName
 )
 
 // A Visitor has all the methods needed to traverse a Romualdo AST.
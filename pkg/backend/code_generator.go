@@ -73,10 +73,24 @@ func (cg *codeGenerator) currentLine() int {
 	return cg.nodeStack[len(cg.nodeStack)-1].Line()
 }
 
+// defaultValue returns the default value for a given type, that is, the value
+// used for variables not explicitly initialized.
+func (cg *codeGenerator) defaultValue(tag ast.TypeTag) bytecode.Value {
+	switch tag {
+	case ast.TypeBool:
+		return bytecode.NewValueBool(false)
+	case ast.TypeString:
+		return bytecode.NewValueString("")
+	default:
+		cg.ice("no default value for type %v", tag)
+		return bytecode.Value{}
+	}
+}
+
 // error panics, reporting an error on the current node with a given error
 // message.
 func (cg *codeGenerator) error(format string, a ...interface{}) {
-	e := errs.CompileTime{
+	e := &errs.CompileTime{
 		Message:  fmt.Sprintf(format, a...),
 		FileName: cg.nodeStackTop().SourceFile(),
 		Line:     cg.currentLine(),
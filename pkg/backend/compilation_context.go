@@ -7,18 +7,45 @@
 
 package backend
 
+import (
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
 // A compilationContext stores information needed throughout different
 // compilation passes.
 type compilationContext struct {
 
 	// procNameToIndex maps a fully-qualified Procedure name to its index into
-	// the slice of Chunks.
+	// the slice of Procedures.
 	procNameToIndex map[string]int
+
+	// globalNameToIndex maps a fully-qualified global variable name to its
+	// index into the slice of Globals.
+	globalNameToIndex map[string]int
+
+	// hashes maps the fully-qualified names of Procedures and global variables
+	// to their code hashes.
+	hashes map[string]romutil.CodeHash
 }
 
-// newCompilationContext creates a new compilationContext.
-func newCompilationContext() *compilationContext {
-	return &compilationContext{
-		procNameToIndex: map[string]int{},
+// newCompilationContext creates a new compilationContext. csw is the
+// CompiledStoryworld being generated, which may already contain (released)
+// Procedures and globals. hashes contains the code hashes of all Procedures
+// and globals in the Storyworld being compiled.
+func newCompilationContext(csw *bytecode.CompiledStoryworld, hashes map[string]romutil.CodeHash) *compilationContext {
+	cc := &compilationContext{
+		procNameToIndex:   map[string]int{},
+		globalNameToIndex: map[string]int{},
+		hashes:            hashes,
 	}
+
+	for i, p := range csw.Procedures {
+		cc.procNameToIndex[p.FQN] = i
+	}
+	for i, g := range csw.Globals {
+		cc.globalNameToIndex[g.FQN] = i
+	}
+
+	return cc
 }
@@ -14,9 +14,14 @@ import (
 	"github.com/stackedboxes/romualdo/pkg/romutil"
 )
 
-// GenerateCode generates the bytecode for a given AST. The file name is used
-// for error messages and debug information.
-func GenerateCode(root ast.Node) (
+// GenerateCode generates the bytecode for a given AST.
+//
+// If base is not nil, the code is generated on top of it: everything that was
+// released in base is retained (so that old saved states keep working), and
+// everything unreleased in base is discarded and generated anew from the AST.
+// baseDI is the DebugInfo corresponding to base, and is required if base is not
+// nil.
+func GenerateCode(root ast.Node, base *bytecode.CompiledStoryworld, baseDI *bytecode.DebugInfo) (
 	csw *bytecode.CompiledStoryworld,
 	debugInfo *bytecode.DebugInfo,
 	err errs.Error) {
@@ -39,21 +44,30 @@ func GenerateCode(root ast.Node) (
 		}
 	}()
 
-	// For the lack of better place at the moment, we'll hash the (source) code
-	// here, before we generate (binary) code. When running the test suite, this
-	// shall catch any Node type we forgot to handle -- but we don't do anything
-	// useful with the hashes for now.
+	// Hash the (source) code before we generate (binary) code. The hashes
+	// identify each version of each Procedure and global variable.
 	codeHasher := romutil.NewCodeHasher()
 	root.Walk(codeHasher)
+	err = codeHasher.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Start from whatever was released in the base Compiled Storyworld.
+	csw, debugInfo, err = releasedPart(base, baseDI)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Now we have the actual code generation.
 	passOne := &codeGeneratorPassOne{
 		codeGenerator: &codeGenerator{
-			csw:                &bytecode.CompiledStoryworld{},
-			debugInfo:          &bytecode.DebugInfo{},
-			compilationContext: newCompilationContext(),
+			csw:                csw,
+			debugInfo:          debugInfo,
+			compilationContext: newCompilationContext(csw, codeHasher.Hashes),
 			nodeStack:          make([]ast.Node, 0, 64),
 		},
+		seenSymbols: map[string]bool{},
 	}
 	root.Walk(passOne)
 
@@ -61,6 +75,11 @@ func GenerateCode(root ast.Node) (
 		return nil, nil, errs.NewICE("node stack not empty between passes")
 	}
 
+	err = passOne.checkReleasedGlobals()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	passTwo := &codeGeneratorPassTwo{
 		codeGenerator: &codeGenerator{
 			csw:                passOne.codeGenerator.csw,
@@ -71,5 +90,102 @@ func GenerateCode(root ast.Node) (
 		currentChunkIndex: -1, // start with an invalid value, for easier debugging
 	}
 	root.Walk(passTwo)
-	return passTwo.codeGenerator.csw, passTwo.codeGenerator.debugInfo, nil
+
+	// No need to worry about a missing `main`: the semantic checker already
+	// verified this.
+	cc := passTwo.codeGenerator.compilationContext
+	csw.InitialChunk = csw.Procedures[cc.procNameToIndex["/main"]].Chunk
+
+	analyzeMaySuspend(csw)
+
+	err = passOne.checkMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return csw, debugInfo, nil
+}
+
+// releasedPart returns a copy of the released part of base and baseDI. In other
+// words, this returns base and baseDI with everything unreleased removed. If
+// base is nil, returns an empty CompiledStoryworld and DebugInfo.
+//
+// This relies on the fact that released things always come before the
+// unreleased ones, so that removing the unreleased ones doesn't change the
+// indices of the released ones (which are referenced by released bytecode).
+func releasedPart(base *bytecode.CompiledStoryworld, baseDI *bytecode.DebugInfo) (
+	*bytecode.CompiledStoryworld, *bytecode.DebugInfo, errs.Error) {
+
+	csw := &bytecode.CompiledStoryworld{}
+	di := &bytecode.DebugInfo{}
+	if base == nil {
+		return csw, di, nil
+	}
+	if baseDI == nil {
+		return nil, nil, errs.NewRomualdoTool("debug info is required to build on top of a previous build")
+	}
+
+	// Releases and constants
+	csw.Releases = append(csw.Releases, base.Releases...)
+	if len(base.Releases) > 0 {
+		constantsCount := base.Releases[len(base.Releases)-1].ConstantsCount
+		csw.Constants = append(csw.Constants, base.Constants[:constantsCount]...)
+	}
+
+	// Chunks
+	for i, c := range base.Chunks {
+		if !c.IsReleased() {
+			continue
+		}
+		if i != len(csw.Chunks) {
+			return nil, nil, errs.NewICE("released chunk %v after an unreleased one", i)
+		}
+		chunk := *c
+		csw.Chunks = append(csw.Chunks, &chunk)
+		di.ChunksNames = append(di.ChunksNames, baseDI.ChunksNames[i])
+		di.ChunksSourceFiles = append(di.ChunksSourceFiles, baseDI.ChunksSourceFiles[i])
+		di.ChunksLines = append(di.ChunksLines, baseDI.ChunksLines[i])
+		di.ChunksLocals = append(di.ChunksLocals, baseDI.ChunksLocals[i])
+	}
+
+	// Procedures. If the latest version of a released Procedure is unreleased,
+	// fall back to its latest released version.
+	for i, p := range base.Procedures {
+		latest := -1
+		if p.Chunk < len(csw.Chunks) {
+			latest = p.Chunk
+		} else {
+			for j, c := range csw.Chunks {
+				if c.Procedure == i {
+					latest = j
+				}
+			}
+		}
+		if latest < 0 {
+			// Procedure was never released.
+			continue
+		}
+		if i != len(csw.Procedures) {
+			return nil, nil, errs.NewICE("released procedure %v after an unreleased one", p.FQN)
+		}
+		csw.Procedures = append(csw.Procedures, bytecode.ProcedureInfo{
+			FQN:          p.FQN,
+			Chunk:        latest,
+			MigrationTag: p.MigrationTag,
+			External:     p.External,
+		})
+	}
+
+	// Globals
+	for i, g := range base.Globals {
+		if !g.IsReleased() {
+			continue
+		}
+		if i != len(csw.Globals) {
+			return nil, nil, errs.NewICE("released global %v after an unreleased one", g.FQN)
+		}
+		csw.Globals = append(csw.Globals, g)
+	}
+
+	return csw, di, nil
 }
@@ -0,0 +1,79 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package backend
+
+import (
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+)
+
+// analyzeMaySuspend computes, for every Chunk in csw, whether running it may
+// suspend the execution of the Story, and stores the result in
+// Chunk.MaySuspend.
+//
+// A Chunk may suspend if it `listen`s, or if it calls some Procedure whose
+// latest version may suspend. Calls always run the latest version of the
+// callee, so this is computed only for the latest version of each Procedure.
+// Older versions can only be running if resumed from a saved state, so their
+// MaySuspend flags are left as they were when they were the latest ones.
+//
+// This works on the call graph implied by the bytecode itself, so that it
+// doesn't matter if a Chunk came from the AST being compiled or from a previous
+// release.
+func analyzeMaySuspend(csw *bytecode.CompiledStoryworld) {
+	latest := make([]bool, len(csw.Chunks))
+	for _, p := range csw.Procedures {
+		latest[p.Chunk] = true
+	}
+
+	// Direct facts: who listens, and who calls whom.
+	suspends := make([]bool, len(csw.Chunks))
+	callees := make([][]int, len(csw.Chunks))
+	for i, chunk := range csw.Chunks {
+		if !latest[i] {
+			continue
+		}
+		for offset := 0; offset < len(chunk.Code); {
+			op := bytecode.OpCode(chunk.Code[offset])
+			switch op {
+			case bytecode.OpListen:
+				suspends[i] = true
+			case bytecode.OpConstant:
+				constant := csw.Constants[bytecode.DecodeUInt31(chunk.Code[offset+1:])]
+				if constant.IsProcedure() {
+					callees[i] = append(callees[i], constant.AsProcedure().Index)
+				}
+			}
+			offset += bytecode.InstructionSize(op)
+		}
+	}
+
+	// Propagate through the call graph until we reach a fixed point.
+	for changed := true; changed; {
+		changed = false
+		for i := range csw.Chunks {
+			if !latest[i] || suspends[i] {
+				continue
+			}
+			for _, callee := range callees[i] {
+				if suspends[csw.Procedures[callee].Chunk] {
+					suspends[i] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// Released Chunks may be on the call stack of a saved state created with
+	// an older release, so once they may suspend, they may suspend forever.
+	for i, chunk := range csw.Chunks {
+		if latest[i] {
+			chunk.MaySuspend = suspends[i] || (chunk.IsReleased() && chunk.MaySuspend)
+		}
+	}
+}
@@ -8,18 +8,32 @@
 package backend
 
 import (
+	"path"
+
 	"github.com/stackedboxes/romualdo/pkg/ast"
 	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
 )
 
 // TODO: Probably rename to something meaningful. create_procedures_pass?
 
 // codeGeneratorPassOne creates the Chunks where the bytecode will be eventually
-// written to.
+// written to. It also creates the global variables.
+//
+// When building on top of a previous build, this is also where we decide which
+// Procedures need a new version (i.e., a new Chunk) and which can keep using a
+// Chunk that was already released.
 //
 // This implements the ast.Visitor interface.
 type codeGeneratorPassOne struct {
 	codeGenerator *codeGenerator
+
+	// seenSymbols contains the fully-qualified names of all Procedures and
+	// globals visited so far.
+	seenSymbols map[string]bool
+
+	// migrations contains all migrations visited so far.
+	migrations []*ast.ProcedureDecl
 }
 
 //
@@ -41,19 +55,115 @@ func (cg *codeGeneratorPassOne) Enter(node ast.Node) {
 		di := cg.codeGenerator.debugInfo
 		cc := cg.codeGenerator.compilationContext
 
-		n.ChunkIndex = len(cg.codeGenerator.csw.Chunks)
-		newChunk := &bytecode.Chunk{}
+		fqn := n.FQN()
+		if cg.seenSymbols[fqn] {
+			cg.codeGenerator.ice("duplicate definition of procedure name '%v' during pass one",
+				n.Name)
+		}
+		cg.seenSymbols[fqn] = true
+
+		procIndex, exists := cc.procNameToIndex[fqn]
+		if !exists {
+			// Migrations exist to fix saved states from before their releases.
+			// If the release was already made, stories started with it would
+			// get migrated, too.
+			if n.Kind == ast.ProcKindMigration && csw.ReleaseByTag(n.Release) >= 0 {
+				panic(errs.NewCompileTime(n.SourceFile(), n.Line(),
+					"Cannot add a migration for release `%v`, which was already made.", n.Release))
+			}
+			procIndex = len(csw.Procedures)
+			csw.Procedures = append(csw.Procedures, bytecode.ProcedureInfo{
+				FQN:          fqn,
+				MigrationTag: n.Release,
+			})
+			cc.procNameToIndex[fqn] = procIndex
+		}
+		csw.Procedures[procIndex].External = n.Kind == ast.ProcKindExternal
+		if n.Kind == ast.ProcKindMigration {
+			cg.migrations = append(cg.migrations, n)
+		}
+
+		// If this exact version of the Procedure was already released, just
+		// use it. Notice that this may be an older version than the one
+		// previously used (e.g., if some change was reverted).
+		//
+		// TODO: Changing the parameters or return type of a released Procedure
+		// should be an error.
+		hash := cc.hashes[fqn]
+		if existing := csw.ChunkByHash(hash); existing >= 0 {
+			n.ChunkIndex = -1 // no code to generate
+			csw.Procedures[procIndex].Chunk = existing
+			return
+		}
+
+		n.ChunkIndex = len(csw.Chunks)
+		newChunk := &bytecode.Chunk{
+			Procedure: procIndex,
+			Hash:      hash,
+			Release:   -1,
+		}
 		csw.Chunks = append(csw.Chunks, newChunk)
-		di.ChunksNames = append(di.ChunksNames, n.Name)
+		csw.Procedures[procIndex].Chunk = n.ChunkIndex
+		di.ChunksNames = append(di.ChunksNames, fqn)
 		di.ChunksSourceFiles = append(di.ChunksSourceFiles, n.SourceFile())
 		di.ChunksLines = append(di.ChunksLines, []int{})
+		locals := make([]string, len(n.Parameters))
+		for i, param := range n.Parameters {
+			locals[i] = param.Name
+		}
+		di.ChunksLocals = append(di.ChunksLocals, locals)
 
-		fqn := n.Package + n.Name
-		if _, exists := cc.procNameToIndex[fqn]; exists {
-			cg.codeGenerator.ice("duplicate definition of procedure name '%v' during pass one",
-				n.Name)
+	case *ast.VarDecl:
+		csw := cg.codeGenerator.csw
+		cc := cg.codeGenerator.compilationContext
+
+		fqn := n.FQN()
+		if cg.seenSymbols[fqn] {
+			cg.codeGenerator.ice("duplicate definition of global '%v' during pass one", fqn)
 		}
-		cc.procNameToIndex[fqn] = n.ChunkIndex
+		cg.seenSymbols[fqn] = true
+
+		// Globals are initialized directly from the initializer value from the
+		// AST (the type checker guarantees it is a literal).
+		var initialValue bytecode.Value
+		switch init := n.Initializer.(type) {
+		case nil:
+			initialValue = cg.codeGenerator.defaultValue(n.VarType)
+		case *ast.BoolLiteral:
+			initialValue = bytecode.NewValueBool(init.Value)
+		case *ast.StringLiteral:
+			initialValue = bytecode.NewValueString(init.Value)
+		default:
+			cg.codeGenerator.ice("unexpected global initializer type: %T", init)
+		}
+
+		hash := cc.hashes[fqn]
+		if index, exists := cc.globalNameToIndex[fqn]; exists {
+			// A released global. Its initial value can change freely, but its
+			// hash (i.e., its type) cannot.
+			g := &csw.Globals[index]
+			if g.Profile != n.Profile {
+				panic(errs.NewCompileTime(n.SourceFile(), n.Line(),
+					"Cannot change global `%v`, which is part of release `%v`, to or from a profile variable.",
+					n.Name, csw.ReleaseTag(g.Release)))
+			}
+			if g.Hash != hash {
+				panic(errs.NewCompileTime(n.SourceFile(), n.Line(),
+					"Cannot change the type of global `%v`, which is part of release `%v`.",
+					n.Name, csw.ReleaseTag(g.Release)))
+			}
+			g.InitialValue = initialValue
+			return
+		}
+
+		cc.globalNameToIndex[fqn] = len(csw.Globals)
+		csw.Globals = append(csw.Globals, bytecode.Global{
+			FQN:          fqn,
+			Hash:         hash,
+			Release:      -1,
+			InitialValue: initialValue,
+			Profile:      n.Profile,
+		})
 	}
 }
 
@@ -70,3 +180,43 @@ func (cg *codeGeneratorPassOne) Leave(node ast.Node) {
 func (cg *codeGeneratorPassOne) Event(node ast.Node, event ast.EventType) {
 	// Nothing
 }
+
+// checkReleasedGlobals checks that all released global variables are still
+// declared in the Storyworld. Must be called after walking the whole AST.
+func (cg *codeGeneratorPassOne) checkReleasedGlobals() errs.Error {
+	csw := cg.codeGenerator.csw
+	for _, g := range csw.Globals {
+		if !cg.seenSymbols[g.FQN] {
+			return errs.NewCompileTimeWithoutLine(path.Dir(g.FQN),
+				"Cannot remove global `%v`, which is part of release `%v`.",
+				path.Base(g.FQN), csw.ReleaseTag(g.Release))
+		}
+	}
+	return nil
+}
+
+// checkMigrations checks that all migrations are valid. Released migrations
+// must still be declared in the Storyworld, and no migration can suspend the
+// execution of the Story (migrations run while loading a saved state, when
+// there is no Player to listen to). Must be called after the may-suspend
+// analysis.
+func (cg *codeGeneratorPassOne) checkMigrations() errs.Error {
+	csw := cg.codeGenerator.csw
+	for _, p := range csw.Procedures {
+		if p.IsMigration() && !cg.seenSymbols[p.FQN] {
+			return errs.NewCompileTimeWithoutLine(path.Dir(p.FQN),
+				"Cannot remove the migration for release `%v`, which is part of release `%v`.",
+				p.MigrationTag, csw.ReleaseTag(csw.Chunks[p.Chunk].Release))
+		}
+	}
+
+	cc := cg.codeGenerator.compilationContext
+	for _, n := range cg.migrations {
+		proc := csw.Procedures[cc.procNameToIndex[n.FQN()]]
+		if csw.Chunks[proc.Chunk].MaySuspend {
+			return errs.NewCompileTime(n.SourceFile(), n.Line(),
+				"The migration for release `%v` may `listen`, which is not allowed.", n.Release)
+		}
+	}
+	return nil
+}
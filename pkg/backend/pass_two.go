@@ -20,7 +20,8 @@ type codeGeneratorPassTwo struct {
 	codeGenerator *codeGenerator
 
 	// currentChunkIndex contains the index of the chunk we are currently
-	// generating code for.
+	// generating code for. Negative if we are not generating code for any
+	// chunk.
 	currentChunkIndex int
 }
 
@@ -37,6 +38,17 @@ func (cg *codeGeneratorPassTwo) Enter(node ast.Node) {
 
 	case *ast.ProcedureDecl:
 		cg.currentChunkIndex = n.ChunkIndex
+	}
+
+	if cg.currentChunkIndex < 0 {
+		// Just like in Leave(): no code to generate outside of Procedures or
+		// inside Procedures that reuse an already released Chunk.
+		return
+	}
+
+	switch node.(type) {
+	case *ast.Curlies:
+		cg.emitBytes(byte(bytecode.OpBeginCurlies))
 
 	default:
 		// nothing
@@ -46,20 +58,41 @@ func (cg *codeGeneratorPassTwo) Enter(node ast.Node) {
 func (cg *codeGeneratorPassTwo) Leave(node ast.Node) {
 	defer cg.codeGenerator.popFromNodeStack()
 
-	switch n := node.(type) {
-	case *ast.Storyworld:
-		break
+	if _, ok := node.(*ast.Block); ok {
+		cg.codeGenerator.endScope()
+	}
+
+	if cg.currentChunkIndex < 0 {
+		// We are either outside of any Procedure (globals are initialized
+		// directly from the AST, in pass one) or inside a Procedure that
+		// reuses an already released Chunk. No code to generate here.
+		return
+	}
 
+	switch n := node.(type) {
 	case *ast.Block:
-		cg.codeGenerator.endScope()
+		break
 
 	case *ast.ProcedureDecl:
-		// No need to worry about duplicate `main`s: the semantic checker
-		// already verified this.
-		//
-		// TODO: Not yet! There's no semantic checker for now.
-		if n.Name == "main" && n.Package == "/" {
-			cg.codeGenerator.csw.InitialChunk = cg.currentChunkIndex
+		// External functions are just stubs that hand the control to the
+		// Driver Program. For non-void ones, the default value of the return
+		// type is used if the Driver Program fails to provide a proper result.
+		// Every other Procedure ends with an implicit return. For non-void
+		// Procedures, return the default value of the return type.
+		if n.Kind == ast.ProcKindExternal {
+			if n.ReturnType == ast.TypeVoid {
+				cg.emitBytes(byte(bytecode.OpExternalVoid))
+				cg.emitBytes(byte(bytecode.OpReturnVoid))
+			} else {
+				cg.emitConstant(cg.codeGenerator.defaultValue(n.ReturnType))
+				cg.emitBytes(byte(bytecode.OpExternal))
+				cg.emitBytes(byte(bytecode.OpReturnValue))
+			}
+		} else if n.ReturnType == ast.TypeVoid {
+			cg.emitBytes(byte(bytecode.OpReturnVoid))
+		} else {
+			cg.emitConstant(cg.codeGenerator.defaultValue(n.ReturnType))
+			cg.emitBytes(byte(bytecode.OpReturnValue))
 		}
 
 		// Leave the current chunk index invalid, as we are outside of any function.
@@ -91,6 +124,11 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) {
 	case *ast.Listen:
 		cg.emitBytes(byte(bytecode.OpListen))
 
+	case *ast.Emit:
+		// The event name and all the payload keys and values are on the stack
+		// now.
+		cg.emitUInt31Instruction(bytecode.OpEmit, len(n.Payload))
+
 	case *ast.ExpressionStmt:
 		// A call to a void Procedure is still an expression statement for
 		// grammar purposes -- but one that does not push anything into the
@@ -111,15 +149,56 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) {
 
 	case *ast.Curlies:
 		// The Curlies expression value shall be on the stack now.
+		cg.emitBytes(byte(bytecode.OpEndCurlies))
 		cg.emitBytes(byte(bytecode.OpToLecture))
 		cg.emitBytes(byte(bytecode.OpSay))
 
+	case *ast.Identifier:
+		cc := cg.codeGenerator.compilationContext
+		switch {
+		case n.Global != nil:
+			cg.emitUInt31Instruction(bytecode.OpGetGlobal, cc.globalNameToIndex[n.FQN()])
+		case n.Param != nil:
+			cg.emitUInt31Instruction(bytecode.OpGetLocal, n.ParamIndex+1)
+		case n.Procedure != nil:
+			cg.emitConstant(bytecode.NewValueProcedure(cc.procNameToIndex[n.FQN()]))
+		default:
+			cg.codeGenerator.ice("unresolved identifier: %v", n.Name)
+		}
+
+	case *ast.Call:
+		// The callee and the arguments are on the stack now.
+		cg.emitUInt31Instruction(bytecode.OpCall, len(n.Args))
+
+	case *ast.Assignment:
+		// The value being assigned is on the stack now.
+		cc := cg.codeGenerator.compilationContext
+		switch {
+		case n.Target.Global != nil:
+			cg.emitUInt31Instruction(bytecode.OpSetGlobal, cc.globalNameToIndex[n.Target.FQN()])
+		case n.Target.Param != nil:
+			cg.emitUInt31Instruction(bytecode.OpSetLocal, n.Target.ParamIndex+1)
+		default:
+			cg.codeGenerator.ice("invalid assignment target: %v", n.Target.Name)
+		}
+
+	case *ast.Return:
+		if n.Value != nil {
+			cg.emitBytes(byte(bytecode.OpReturnValue))
+		} else {
+			cg.emitBytes(byte(bytecode.OpReturnVoid))
+		}
+
 	default:
 		cg.codeGenerator.ice("unknown node type: %T", n)
 	}
 }
 
 func (cg *codeGeneratorPassTwo) Event(node ast.Node, event ast.EventType) {
+	if cg.currentChunkIndex < 0 {
+		return
+	}
+
 	switch n := node.(type) {
 	case *ast.IfStmt:
 		switch event {
@@ -195,20 +274,20 @@ func (cg *codeGeneratorPassTwo) emitBytes(bytes ...byte) {
 
 // emitConstant emits the bytecode for a constant having a given value.
 func (cg *codeGeneratorPassTwo) emitConstant(value bytecode.Value) {
-	// TODO: Not handling globals yet
-	//
-	// if cg.codeGenerator.isInsideGlobalsBlock() {
-	// 	// Globals are initialized directly from the initializer value from the
-	// 	// AST. No need to push the initializer value to the stack.
-	// 	return
-	// }
-
 	constantIndex := cg.makeConstant(value)
 	operandStart := len(cg.currentChunk().Code) + 1
 	cg.emitBytes(byte(bytecode.OpConstant), 0, 0, 0, 0)
 	bytecode.EncodeUInt31(cg.currentChunk().Code[operandStart:], constantIndex)
 }
 
+// emitUInt31Instruction emits the bytecode for an instruction having a single
+// uint31 operand.
+func (cg *codeGeneratorPassTwo) emitUInt31Instruction(op bytecode.OpCode, operand int) {
+	operandStart := len(cg.currentChunk().Code) + 1
+	cg.emitBytes(byte(op), 0, 0, 0, 0)
+	bytecode.EncodeUInt31(cg.currentChunk().Code[operandStart:], operand)
+}
+
 // makeConstant adds value to the pool of constants and returns the index in
 // which it was added. If there is already a constant with this value, its index
 // is returned (hey, we don't need duplicate constants, right? They are
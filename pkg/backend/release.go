@@ -0,0 +1,111 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package backend
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// Release turns everything unreleased in csw into a new release, identified
+// by tag. di is the DebugInfo corresponding to csw, and is updated along with
+// it.
+//
+// This also prunes old versions of Procedures that can't possibly be on the
+// call stack of any saved state (because they never suspend the execution).
+// Returns the number of Chunks pruned.
+//
+// csw and di are modified in place, so they must not be in use by any VM.
+func Release(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, tag string) (int, errs.Error) {
+	if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return 0, errs.NewBadUsage("Release tags must be non-empty and cannot contain spaces, got '%v'.", tag)
+	}
+	if csw.ReleaseByTag(tag) >= 0 {
+		return 0, errs.NewBadUsage("There is already a release tagged '%v'.", tag)
+	}
+
+	// Migrations not yet released must be for this very release.
+	for _, p := range csw.Procedures {
+		if p.IsMigration() && csw.ReleaseByTag(p.MigrationTag) < 0 && p.MigrationTag != tag {
+			return 0, errs.NewBadUsage("Found a migration for release '%v' while releasing '%v'.",
+				p.MigrationTag, tag)
+		}
+	}
+
+	hasChanges := false
+	release := len(csw.Releases)
+	for _, c := range csw.Chunks {
+		if !c.IsReleased() {
+			c.Release = release
+			hasChanges = true
+		}
+	}
+	for i := range csw.Globals {
+		if !csw.Globals[i].IsReleased() {
+			csw.Globals[i].Release = release
+			hasChanges = true
+		}
+	}
+	if !hasChanges {
+		return 0, errs.NewBadUsage("Nothing changed since release '%v'.", csw.ReleaseTag(release-1))
+	}
+
+	csw.Releases = append(csw.Releases, bytecode.Release{
+		Tag:            tag,
+		ConstantsCount: len(csw.Constants),
+	})
+
+	return pruneChunks(csw, di), nil
+}
+
+// pruneChunks removes from csw (and di) the Chunks that are not the latest
+// version of their Procedures and never suspend. Returns the number of Chunks
+// removed.
+func pruneChunks(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) int {
+	latest := make([]bool, len(csw.Chunks))
+	for _, p := range csw.Procedures {
+		latest[p.Chunk] = true
+	}
+
+	newIndices := make([]int, len(csw.Chunks))
+	chunks := make([]*bytecode.Chunk, 0, len(csw.Chunks))
+	names := make([]string, 0, len(csw.Chunks))
+	sourceFiles := make([]string, 0, len(csw.Chunks))
+	lines := make([][]int, 0, len(csw.Chunks))
+	locals := make([][]string, 0, len(csw.Chunks))
+
+	for i, c := range csw.Chunks {
+		if !latest[i] && !c.MaySuspend {
+			newIndices[i] = -1
+			continue
+		}
+		newIndices[i] = len(chunks)
+		chunks = append(chunks, c)
+		names = append(names, di.ChunksNames[i])
+		sourceFiles = append(sourceFiles, di.ChunksSourceFiles[i])
+		lines = append(lines, di.ChunksLines[i])
+		locals = append(locals, di.ChunksLocals[i])
+	}
+
+	pruned := len(csw.Chunks) - len(chunks)
+
+	csw.Chunks = chunks
+	di.ChunksNames = names
+	di.ChunksSourceFiles = sourceFiles
+	di.ChunksLines = lines
+	di.ChunksLocals = locals
+	for i := range csw.Procedures {
+		csw.Procedures[i].Chunk = newIndices[csw.Procedures[i].Chunk]
+	}
+	csw.InitialChunk = newIndices[csw.InitialChunk]
+
+	return pruned
+}
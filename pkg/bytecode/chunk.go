@@ -10,12 +10,12 @@ package bytecode
 import (
 	"encoding/binary"
 	"math"
+
+	"github.com/stackedboxes/romualdo/pkg/romutil"
 )
 
-// A Chunk is a chunk of bytecode. We'll have one Chunk for each procedure in a
-// Storyworld.
-//
-// TODO: In the future, one chunk for each version of each procedure.
+// A Chunk is a chunk of bytecode. We'll have one Chunk for each version of each
+// procedure in a Storyworld.
 //
 // TODO: In the future, probably, chunks for implicitly-defined procedures that
 // initialize globals and stuff.
@@ -23,6 +23,34 @@ type Chunk struct {
 	// The bytecode itself. Includes both OpCodes and immediate arguments needed
 	// by the opcodes.
 	Code []uint8
+
+	// Procedure is the index into CompiledStoryworld.Procedures of the
+	// Procedure this Chunk is a version of.
+	Procedure int
+
+	// Hash is the code hash of the Procedure version this Chunk was compiled
+	// from. It identifies this Chunk across different builds and releases of
+	// the Storyworld (saved states refer to Chunks by their hashes).
+	Hash romutil.CodeHash
+
+	// Release is the index into CompiledStoryworld.Releases of the release in
+	// which this Chunk was first released. Negative values mean the Chunk is
+	// not released yet.
+	Release int
+
+	// MaySuspend tells if running this Chunk may (even if only transitively,
+	// by calling other Procedures) suspend the execution of the Story. In other
+	// words, if this Chunk may ever appear on the call stack of a saved state.
+	//
+	// For released Chunks this is sticky: once true, it remains true on
+	// subsequent builds, because saved states created with an older release
+	// may have this Chunk on their call stacks.
+	MaySuspend bool
+}
+
+// IsReleased checks if the Chunk is part of some release.
+func (c *Chunk) IsReleased() bool {
+	return c.Release >= 0
 }
 
 // Encodes a signed 32-bit integer into the four first bytes of bytecode.
@@ -25,7 +25,9 @@ const (
 	MaxConstants uint32 = 2_147_483_648
 
 	// CSWVersion is the current version of a Romualdo Compiled Storyworld.
-	CSWVersion uint32 = 0
+	// Bump it whenever the layout changes. Version 0 was used before releases,
+	// globals and code hashes were added.
+	CSWVersion uint32 = 1
 )
 
 // CSWMagic is the "magic number" identifying a Romualdo Compiled Storyworld. It
@@ -36,22 +38,159 @@ var CSWMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x43, 0x53, 0x57, 0x1A}
 // CompiledStoryworld is a compiled, binary version of a Romualdo Language
 // Storyworld.
 //
+// A CompiledStoryworld is immutable once built (or loaded): nothing that runs
+// it modifies it, so it can be shared by any number of VMs running
+// concurrently. Building on top of it (see backend.GenerateCode()) creates a
+// new CompiledStoryworld, leaving it unchanged. Releasing it (see
+// backend.Release()) is the only exception, so don't release a
+// CompiledStoryworld while it's being run.
+//
 // TODO: Use a string interner to avoid having duplicate strings in memory.
 // Make some measurements to ensure it's really beneficial.
 type CompiledStoryworld struct {
+	// Releases contains all releases of the Storyworld, from the oldest to the
+	// newest. Chunks and Globals refer to releases by their indices into this
+	// slice.
+	Releases []Release
+
 	// The constant values used in all Chunks.
 	Constants []Value
 
 	// Chunks is a slice with all Chunks of bytecode containing the compiled
-	// data. There is one Chunk for each procedure in the Storyworld.
-	//
-	// TODO: And in the future, one Chunk for every version of every procedure.
+	// data. There is one Chunk for every retained version of every procedure
+	// in the Storyworld.
 	Chunks []*Chunk
 
+	// Procedures contains all the Procedures in the Storyworld. Procedure
+	// values refer to Procedures by their indices into this slice, which are
+	// stable across releases. This extra indirection is what makes the latest
+	// version of a Procedure run whenever it is called, even when called from
+	// an older version of some other Procedure.
+	Procedures []ProcedureInfo
+
 	// InitialChunk indexes the element in Chunks from where the Storyworld
 	// execution starts. In other words, it points to the latest version of the
 	// "/main" chunk.
 	InitialChunk int
+
+	// Globals contains all the global variables in the Storyworld. Bytecode
+	// refers to globals by their index into this slice.
+	Globals []Global
+}
+
+// Release describes one release of a Storyworld.
+type Release struct {
+	// Tag is the user-provided tag identifying the release.
+	Tag string
+
+	// ConstantsCount is the number of constants in the CompiledStoryworld at
+	// the moment of the release. Released Chunks refer only to these
+	// constants, so they must be kept unchanged by subsequent builds.
+	ConstantsCount int
+}
+
+// ProcedureInfo describes a Procedure of a CompiledStoryworld.
+type ProcedureInfo struct {
+	// FQN is the fully-qualified name of the Procedure.
+	FQN string
+
+	// Chunk is the index into CompiledStoryworld.Chunks of the latest version
+	// of the Procedure, which is the one executed when the Procedure is called.
+	Chunk int
+
+	// MigrationTag is the tag of the release this Procedure is a migration
+	// for. Empty if the Procedure is not a migration.
+	MigrationTag string
+
+	// External tells if this Procedure is an external function, implemented
+	// by the Driver Program. The Chunk of an external function is just a stub
+	// that hands the control to the Driver Program.
+	External bool
+}
+
+// IsMigration checks if the Procedure is a migration.
+func (p *ProcedureInfo) IsMigration() bool {
+	return p.MigrationTag != ""
+}
+
+// Global describes a global variable of a CompiledStoryworld.
+type Global struct {
+	// FQN is the fully-qualified name of the global variable.
+	FQN string
+
+	// Hash is the code hash of the global variable. It depends only on the
+	// global's fully-qualified name and type.
+	Hash romutil.CodeHash
+
+	// Release is the index into CompiledStoryworld.Releases of the release in
+	// which the global was first released. Negative values mean the global is
+	// not released yet.
+	Release int
+
+	// InitialValue is the value the global has when the Storyworld starts.
+	InitialValue Value
+
+	// Profile tells if this is a profile variable, whose value is stored in
+	// the Profile instead of in the Story.
+	Profile bool
+}
+
+// IsReleased checks if the global variable is part of some release.
+func (g *Global) IsReleased() bool {
+	return g.Release >= 0
+}
+
+// ChunkByHash returns the index of the Chunk with the given hash, or a negative
+// value if there is no such Chunk.
+func (csw *CompiledStoryworld) ChunkByHash(hash romutil.CodeHash) int {
+	for i, c := range csw.Chunks {
+		if c.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// ProcedureByFQN returns the index of the Procedure with the given
+// fully-qualified name, or a negative value if there is no such Procedure.
+func (csw *CompiledStoryworld) ProcedureByFQN(fqn string) int {
+	for i, p := range csw.Procedures {
+		if p.FQN == fqn {
+			return i
+		}
+	}
+	return -1
+}
+
+// GlobalByHash returns the index of the global variable with the given hash, or
+// a negative value if there is no such global.
+func (csw *CompiledStoryworld) GlobalByHash(hash romutil.CodeHash) int {
+	for i, g := range csw.Globals {
+		if g.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReleaseByTag returns the index of the release with the given tag, or a
+// negative value if there is no such release.
+func (csw *CompiledStoryworld) ReleaseByTag(tag string) int {
+	for i, r := range csw.Releases {
+		if r.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReleaseTag returns the tag of the release with the given index, or
+// "unreleased" if the index is negative.
+func (csw *CompiledStoryworld) ReleaseTag(release int) string {
+	if release < 0 {
+		return "unreleased"
+	}
+	return csw.Releases[release].Tag
 }
 
 // SearchConstant searches the constant pool for a constant with the given
@@ -113,8 +252,25 @@ func (csw *CompiledStoryworld) serializePayload(w io.Writer) (uint32, errs.Error
 	crc := crc32.NewIEEE()
 	mw := io.MultiWriter(w, crc)
 
+	// Releases
+	err := romutil.SerializeU32(mw, uint32(len(csw.Releases)))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range csw.Releases {
+		err = romutil.SerializeString(mw, r.Tag)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeU32(mw, uint32(r.ConstantsCount))
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Constants
-	err := romutil.SerializeU32(mw, uint32(len(csw.Constants)))
+	err = romutil.SerializeU32(mw, uint32(len(csw.Constants)))
 	if err != nil {
 		return 0, err
 	}
@@ -133,6 +289,22 @@ func (csw *CompiledStoryworld) serializePayload(w io.Writer) (uint32, errs.Error
 	}
 
 	for _, chunk := range csw.Chunks {
+		err = romutil.SerializeU32(mw, uint32(chunk.Procedure))
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeCodeHash(mw, chunk.Hash)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeI32(mw, int32(chunk.Release))
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeBool(mw, chunk.MaySuspend)
+		if err != nil {
+			return 0, err
+		}
 		err = romutil.SerializeU32(mw, uint32(len(chunk.Code)))
 		if err != nil {
 			return 0, err
@@ -143,12 +315,66 @@ func (csw *CompiledStoryworld) serializePayload(w io.Writer) (uint32, errs.Error
 		}
 	}
 
+	// Procedures
+	err = romutil.SerializeU32(mw, uint32(len(csw.Procedures)))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range csw.Procedures {
+		err = romutil.SerializeString(mw, p.FQN)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeU32(mw, uint32(p.Chunk))
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeString(mw, p.MigrationTag)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeBool(mw, p.External)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// InitialChunk
 	err = romutil.SerializeU32(mw, uint32(csw.InitialChunk))
 	if err != nil {
 		return 0, err
 	}
 
+	// Globals
+	err = romutil.SerializeU32(mw, uint32(len(csw.Globals)))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, g := range csw.Globals {
+		err = romutil.SerializeString(mw, g.FQN)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeCodeHash(mw, g.Hash)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeI32(mw, int32(g.Release))
+		if err != nil {
+			return 0, err
+		}
+		err = g.InitialValue.Serialize(mw)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeBool(mw, g.Profile)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Voilà!
 	return crc.Sum32(), nil
 }
@@ -216,6 +442,25 @@ func (csw *CompiledStoryworld) deserializePayload(r io.Reader) (uint32, errs.Err
 	crcSummer := crc32.NewIEEE()
 	tr := io.TeeReader(r, crcSummer)
 
+	// Releases
+	lenReleases, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+
+	csw.Releases = make([]Release, lenReleases)
+	for i := range csw.Releases {
+		csw.Releases[i].Tag, err = romutil.DeserializeString(tr)
+		if err != nil {
+			return 0, err
+		}
+		constantsCount, err := romutil.DeserializeU32(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Releases[i].ConstantsCount = int(constantsCount)
+	}
+
 	// Constants
 	lenConstants, err := romutil.DeserializeU32(tr)
 	if err != nil {
@@ -238,17 +483,61 @@ func (csw *CompiledStoryworld) deserializePayload(r io.Reader) (uint32, errs.Err
 	}
 	csw.Chunks = make([]*Chunk, lenChunks)
 	for i := range csw.Chunks {
-		lenChunkCode, err := romutil.DeserializeU32(tr)
+		chunk := &Chunk{}
+		procIndex, err := romutil.DeserializeU32(tr)
 		if err != nil {
 			return 0, err
 		}
-		csw.Chunks[i] = &Chunk{
-			Code: make([]byte, lenChunkCode),
+		chunk.Procedure = int(procIndex)
+		chunk.Hash, err = romutil.DeserializeCodeHash(tr)
+		if err != nil {
+			return 0, err
 		}
-		_, plainErr := io.ReadFull(tr, csw.Chunks[i].Code)
+		release, err := romutil.DeserializeI32(tr)
+		if err != nil {
+			return 0, err
+		}
+		chunk.Release = int(release)
+		chunk.MaySuspend, err = romutil.DeserializeBool(tr)
+		if err != nil {
+			return 0, err
+		}
+		lenChunkCode, err := romutil.DeserializeU32(tr)
+		if err != nil {
+			return 0, err
+		}
+		chunk.Code = make([]byte, lenChunkCode)
+		_, plainErr := io.ReadFull(tr, chunk.Code)
 		if plainErr != nil {
 			return 0, errs.NewRomualdoTool("deserializing chunk code: %v", plainErr)
 		}
+		csw.Chunks[i] = chunk
+	}
+
+	// Procedures
+	lenProcedures, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	csw.Procedures = make([]ProcedureInfo, lenProcedures)
+	for i := range csw.Procedures {
+		csw.Procedures[i].FQN, err = romutil.DeserializeString(tr)
+		if err != nil {
+			return 0, err
+		}
+		chunkIndex, err := romutil.DeserializeU32(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Procedures[i].Chunk = int(chunkIndex)
+		csw.Procedures[i].MigrationTag, err = romutil.DeserializeString(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Procedures[i].External, err = romutil.DeserializeBool(tr)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	// InitialChunk
@@ -258,6 +547,36 @@ func (csw *CompiledStoryworld) deserializePayload(r io.Reader) (uint32, errs.Err
 	}
 	csw.InitialChunk = int(i32)
 
+	// Globals
+	lenGlobals, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	csw.Globals = make([]Global, lenGlobals)
+	for i := range csw.Globals {
+		csw.Globals[i].FQN, err = romutil.DeserializeString(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Globals[i].Hash, err = romutil.DeserializeCodeHash(tr)
+		if err != nil {
+			return 0, err
+		}
+		release, err := romutil.DeserializeI32(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Globals[i].Release = int(release)
+		csw.Globals[i].InitialValue, err = DeserializeValue(tr)
+		if err != nil {
+			return 0, err
+		}
+		csw.Globals[i].Profile, err = romutil.DeserializeBool(tr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Voilà!
 	return crcSummer.Sum32(), nil
 }
@@ -20,6 +20,9 @@ import (
 // DebugInfo contains debug information matching a CompiledStoryworld. All
 // information that is not strictly necessary to run a Storyworld but is useful
 // for debugging, producing better error reporting, etc, belongs here.
+//
+// Just like a CompiledStoryworld, a DebugInfo is immutable once built (or
+// loaded), and can be shared by any number of VMs running concurrently.
 type DebugInfo struct {
 	// ChunksNames contains the names of the procedures on a CompiledStoryworld.
 	// There is one entry for each entry in the corresponding
@@ -42,6 +45,32 @@ type DebugInfo struct {
 	// TODO: Use run-length encoding (RLE) or something like that to spare some
 	// memory and storage.
 	ChunksLines [][]int
+
+	// ChunksLocals contains the names of the local variables of each Chunk,
+	// indexed like CompiledStoryworld.Chunks. ChunksLocals[chunkIndex][i] is
+	// the name of the local at index i+1 of the call frame (index 0 is the
+	// callee itself). For now, the only locals are the Procedure parameters.
+	ChunksLocals [][]string
+}
+
+// CheckMatches checks if the DebugInfo matches csw: it must have the
+// information about every Chunk and every instruction in csw. This doesn't
+// guarantee that both were built together, but a DebugInfo passing this check
+// can at least be used with csw without indexing anything out of range.
+func (di *DebugInfo) CheckMatches(csw *CompiledStoryworld) errs.Error {
+	chunks := len(csw.Chunks)
+	if len(di.ChunksNames) != chunks || len(di.ChunksSourceFiles) != chunks ||
+		len(di.ChunksLines) != chunks || len(di.ChunksLocals) != chunks {
+		return errs.NewRomualdoTool("debug info doesn't match the compiled Storyworld: "+
+			"expected information about %v chunks", chunks)
+	}
+	for i, chunk := range csw.Chunks {
+		if len(di.ChunksLines[i]) != len(chunk.Code) {
+			return errs.NewRomualdoTool("debug info doesn't match the compiled Storyworld: "+
+				"chunk %v has %v bytes of code, but %v lines", i, len(chunk.Code), len(di.ChunksLines[i]))
+		}
+	}
+	return nil
 }
 
 //
@@ -49,8 +78,10 @@ type DebugInfo struct {
 //
 
 const (
-	// DebugInfoVersion is the current version of a Romualdo DebugInfo.
-	DebugInfoVersion uint32 = 0
+	// DebugInfoVersion is the current version of a Romualdo DebugInfo. Bump it
+	// whenever the layout changes. Version 0 was used before the local
+	// variables of each Chunk were added.
+	DebugInfoVersion uint32 = 1
 )
 
 // DebugInfoMagic is the "magic number" identifying a Romualdo DebugInfo. It is
@@ -120,6 +151,18 @@ func (di *DebugInfo) serializePayload(w io.Writer) (uint32, errs.Error) {
 		}
 	}
 
+	// Chunks Locals
+	for _, locals := range di.ChunksLocals {
+		err = romutil.SerializeU32(mw, uint32(len(locals)))
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeStringSliceNoLength(mw, locals)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Voilà!
 	return crc.Sum32(), nil
 }
@@ -209,6 +252,19 @@ func (di *DebugInfo) deserializePayload(r io.Reader) (uint32, error) {
 		}
 	}
 
+	// Chunks Locals
+	di.ChunksLocals = make([][]string, chunksCount)
+	for i := range di.ChunksLocals {
+		localsCount, err := romutil.DeserializeU32(tr)
+		if err != nil {
+			return 0, err
+		}
+		di.ChunksLocals[i], err = romutil.DeserializeStringSliceNoLength(tr, int(localsCount))
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Voilà!
 	return crcSummer.Sum32(), nil
 }
@@ -0,0 +1,301 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DiffStatus tells how something changed between two CompiledStoryworlds.
+type DiffStatus string
+
+const (
+	// DiffAdded means that something exists only in the new
+	// CompiledStoryworld.
+	DiffAdded DiffStatus = "added"
+
+	// DiffRemoved means that something exists only in the old
+	// CompiledStoryworld.
+	DiffRemoved DiffStatus = "removed"
+
+	// DiffChanged means that something exists in both CompiledStoryworlds,
+	// but with different hashes. For Procedures this means a new version; for
+	// global variables, a different type.
+	DiffChanged DiffStatus = "changed"
+
+	// DiffUnchanged means that something exists in both CompiledStoryworlds,
+	// with the same hash.
+	DiffUnchanged DiffStatus = "unchanged"
+)
+
+// StoryworldDiff describes the differences between two CompiledStoryworlds,
+// typically two releases of the same Storyworld.
+type StoryworldDiff struct {
+	// OldReleases contains the release tags of the old CompiledStoryworld.
+	OldReleases []string `json:"oldReleases"`
+
+	// NewReleases contains the release tags of the new CompiledStoryworld.
+	NewReleases []string `json:"newReleases"`
+
+	// Procedures contains one entry for every Procedure present in any of the
+	// CompiledStoryworlds, sorted by fully-qualified name.
+	Procedures []ProcedureDiff `json:"procedures"`
+
+	// Globals contains one entry for every global variable present in any of
+	// the CompiledStoryworlds, sorted by fully-qualified name.
+	Globals []GlobalDiff `json:"globals"`
+
+	// OldSize summarizes the size of the old CompiledStoryworld.
+	OldSize SizeSummary `json:"oldSize"`
+
+	// NewSize summarizes the size of the new CompiledStoryworld.
+	NewSize SizeSummary `json:"newSize"`
+}
+
+// ProcedureDiff describes how a Procedure changed between two
+// CompiledStoryworlds.
+type ProcedureDiff struct {
+	// FQN is the fully-qualified name of the Procedure.
+	FQN string `json:"fqn"`
+
+	// Status tells how the latest version of the Procedure changed.
+	Status DiffStatus `json:"status"`
+
+	// OldSize is the size in bytes of the latest version of the Procedure in
+	// the old CompiledStoryworld. Zero if not present there.
+	OldSize int `json:"oldSize"`
+
+	// NewSize is the size in bytes of the latest version of the Procedure in
+	// the new CompiledStoryworld. Zero if not present there.
+	NewSize int `json:"newSize"`
+
+	// Versions is the number of versions of the Procedure retained in the new
+	// CompiledStoryworld.
+	Versions int `json:"versions"`
+
+	// SavesMaySuspend tells if saved states created with the old
+	// CompiledStoryworld may be suspended inside the Procedure. If the
+	// Procedure changed, these saved states will keep running the old version
+	// until it returns.
+	SavesMaySuspend bool `json:"savesMaySuspend"`
+}
+
+// GlobalDiff describes how a global variable changed between two
+// CompiledStoryworlds.
+type GlobalDiff struct {
+	// FQN is the fully-qualified name of the global variable.
+	FQN string `json:"fqn"`
+
+	// Status tells how the global variable changed.
+	Status DiffStatus `json:"status"`
+
+	// InitialValueChanged tells if the initial value of the global variable
+	// changed. Only meaningful if Status is DiffUnchanged or DiffChanged.
+	InitialValueChanged bool `json:"initialValueChanged"`
+}
+
+// SizeSummary summarizes the size of a CompiledStoryworld.
+type SizeSummary struct {
+	// Chunks is the number of Chunks.
+	Chunks int `json:"chunks"`
+
+	// Bytecode is the total size of all Chunks, in bytes.
+	Bytecode int `json:"bytecode"`
+
+	// Constants is the number of constants.
+	Constants int `json:"constants"`
+}
+
+// Diff compares the CompiledStoryworlds oldCSW and newCSW.
+func Diff(oldCSW, newCSW *CompiledStoryworld) *StoryworldDiff {
+	diff := &StoryworldDiff{
+		OldReleases: oldCSW.releaseTags(),
+		NewReleases: newCSW.releaseTags(),
+		Procedures:  []ProcedureDiff{},
+		Globals:     []GlobalDiff{},
+		OldSize:     oldCSW.sizeSummary(),
+		NewSize:     newCSW.sizeSummary(),
+	}
+
+	// Procedures
+	for _, p := range newCSW.Procedures {
+		pd := ProcedureDiff{
+			FQN:      p.FQN,
+			Status:   DiffAdded,
+			NewSize:  len(newCSW.Chunks[p.Chunk].Code),
+			Versions: newCSW.VersionsCount(p.FQN),
+		}
+		if oldIndex := oldCSW.ProcedureByFQN(p.FQN); oldIndex >= 0 {
+			oldChunk := oldCSW.Chunks[oldCSW.Procedures[oldIndex].Chunk]
+			pd.OldSize = len(oldChunk.Code)
+			pd.SavesMaySuspend = oldCSW.anyVersionMaySuspend(oldIndex)
+			pd.Status = DiffChanged
+			if oldChunk.Hash == newCSW.Chunks[p.Chunk].Hash {
+				pd.Status = DiffUnchanged
+			}
+		}
+		diff.Procedures = append(diff.Procedures, pd)
+	}
+	for i, p := range oldCSW.Procedures {
+		if newCSW.ProcedureByFQN(p.FQN) >= 0 {
+			continue
+		}
+		diff.Procedures = append(diff.Procedures, ProcedureDiff{
+			FQN:             p.FQN,
+			Status:          DiffRemoved,
+			OldSize:         len(oldCSW.Chunks[p.Chunk].Code),
+			SavesMaySuspend: oldCSW.anyVersionMaySuspend(i),
+		})
+	}
+	sort.Slice(diff.Procedures, func(i, j int) bool {
+		return diff.Procedures[i].FQN < diff.Procedures[j].FQN
+	})
+
+	// Globals
+	for _, g := range newCSW.Globals {
+		gd := GlobalDiff{
+			FQN:    g.FQN,
+			Status: DiffAdded,
+		}
+		if oldGlobal := oldCSW.globalByFQN(g.FQN); oldGlobal != nil {
+			gd.Status = DiffChanged
+			if oldGlobal.Hash == g.Hash {
+				gd.Status = DiffUnchanged
+			}
+			gd.InitialValueChanged = !ValuesEqual(oldGlobal.InitialValue, g.InitialValue)
+		}
+		diff.Globals = append(diff.Globals, gd)
+	}
+	for _, g := range oldCSW.Globals {
+		if newCSW.globalByFQN(g.FQN) == nil {
+			diff.Globals = append(diff.Globals, GlobalDiff{
+				FQN:    g.FQN,
+				Status: DiffRemoved,
+			})
+		}
+	}
+	sort.Slice(diff.Globals, func(i, j int) bool {
+		return diff.Globals[i].FQN < diff.Globals[j].FQN
+	})
+
+	return diff
+}
+
+// WriteText writes a human-readable report of diff to w.
+func (diff *StoryworldDiff) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Releases: [%v] -> [%v]\n",
+		strings.Join(diff.OldReleases, ", "), strings.Join(diff.NewReleases, ", "))
+
+	fmt.Fprintln(b, "\nProcedures:")
+	unchanged := 0
+	for _, p := range diff.Procedures {
+		if p.Status == DiffUnchanged {
+			unchanged++
+			continue
+		}
+
+		details := ""
+		switch p.Status {
+		case DiffAdded:
+			details = fmt.Sprintf("%v bytes", p.NewSize)
+		case DiffRemoved:
+			details = fmt.Sprintf("%v bytes", p.OldSize)
+		case DiffChanged:
+			details = fmt.Sprintf("%v -> %v bytes, %v version(s) retained", p.OldSize, p.NewSize, p.Versions)
+		}
+		fmt.Fprintf(b, "    %-9v %v (%v)\n", p.Status, p.FQN, details)
+		if p.SavesMaySuspend && p.Status != DiffAdded {
+			fmt.Fprintln(b, "              Saved states may be suspended here; they will run the old version until it returns.")
+		}
+	}
+	fmt.Fprintf(b, "    %v unchanged\n", unchanged)
+
+	fmt.Fprintln(b, "\nGlobals:")
+	unchanged = 0
+	for _, g := range diff.Globals {
+		switch {
+		case g.Status == DiffUnchanged && !g.InitialValueChanged:
+			unchanged++
+		case g.Status == DiffUnchanged:
+			fmt.Fprintf(b, "    %-9v %v (initial value only)\n", DiffChanged, g.FQN)
+		case g.Status == DiffChanged:
+			fmt.Fprintf(b, "    %-9v %v (type)\n", g.Status, g.FQN)
+		default:
+			fmt.Fprintf(b, "    %-9v %v\n", g.Status, g.FQN)
+		}
+	}
+	fmt.Fprintf(b, "    %v unchanged\n", unchanged)
+
+	fmt.Fprintln(b, "\nSize:")
+	fmt.Fprintf(b, "    Chunks:    %v -> %v\n", diff.OldSize.Chunks, diff.NewSize.Chunks)
+	fmt.Fprintf(b, "    Bytecode:  %v -> %v bytes (%+d)\n", diff.OldSize.Bytecode, diff.NewSize.Bytecode,
+		diff.NewSize.Bytecode-diff.OldSize.Bytecode)
+	fmt.Fprintf(b, "    Constants: %v -> %v\n", diff.OldSize.Constants, diff.NewSize.Constants)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// releaseTags returns the tags of all releases in csw.
+func (csw *CompiledStoryworld) releaseTags() []string {
+	tags := make([]string, len(csw.Releases))
+	for i, r := range csw.Releases {
+		tags[i] = r.Tag
+	}
+	return tags
+}
+
+// sizeSummary returns a summary of the size of csw.
+func (csw *CompiledStoryworld) sizeSummary() SizeSummary {
+	summary := SizeSummary{
+		Chunks:    len(csw.Chunks),
+		Constants: len(csw.Constants),
+	}
+	for _, c := range csw.Chunks {
+		summary.Bytecode += len(c.Code)
+	}
+	return summary
+}
+
+// VersionsCount returns the number of versions (i.e., of Chunks) of the
+// Procedure with the given fully-qualified name.
+func (csw *CompiledStoryworld) VersionsCount(fqn string) int {
+	count := 0
+	for _, c := range csw.Chunks {
+		if csw.Procedures[c.Procedure].FQN == fqn {
+			count++
+		}
+	}
+	return count
+}
+
+// anyVersionMaySuspend checks if any version of the Procedure at index proc
+// into csw.Procedures may suspend the execution of the Story.
+func (csw *CompiledStoryworld) anyVersionMaySuspend(proc int) bool {
+	for _, c := range csw.Chunks {
+		if c.Procedure == proc && c.MaySuspend {
+			return true
+		}
+	}
+	return false
+}
+
+// globalByFQN returns the global variable with the given fully-qualified name,
+// or nil if there is no such global.
+func (csw *CompiledStoryworld) globalByFQN(fqn string) *Global {
+	for i := range csw.Globals {
+		if csw.Globals[i].FQN == fqn {
+			return &csw.Globals[i]
+		}
+	}
+	return nil
+}
@@ -83,6 +83,42 @@ func (csw *CompiledStoryworld) DisassembleInstruction(chunk *Chunk, out io.Write
 	case OpToLecture:
 		return csw.disassembleSimpleInstruction(out, "TO_LECTURE", offset)
 
+	case OpGetGlobal:
+		return csw.disassembleGlobalInstruction(chunk, out, "GET_GLOBAL", offset)
+
+	case OpSetGlobal:
+		return csw.disassembleGlobalInstruction(chunk, out, "SET_GLOBAL", offset)
+
+	case OpGetLocal:
+		return csw.disassembleUInt31Instruction(chunk, out, "GET_LOCAL", offset)
+
+	case OpSetLocal:
+		return csw.disassembleUInt31Instruction(chunk, out, "SET_LOCAL", offset)
+
+	case OpCall:
+		return csw.disassembleUInt31Instruction(chunk, out, "CALL", offset)
+
+	case OpReturnValue:
+		return csw.disassembleSimpleInstruction(out, "RETURN_VALUE", offset)
+
+	case OpReturnVoid:
+		return csw.disassembleSimpleInstruction(out, "RETURN_VOID", offset)
+
+	case OpBeginCurlies:
+		return csw.disassembleSimpleInstruction(out, "BEGIN_CURLIES", offset)
+
+	case OpEndCurlies:
+		return csw.disassembleSimpleInstruction(out, "END_CURLIES", offset)
+
+	case OpExternal:
+		return csw.disassembleSimpleInstruction(out, "EXTERNAL", offset)
+
+	case OpExternalVoid:
+		return csw.disassembleSimpleInstruction(out, "EXTERNAL_VOID", offset)
+
+	case OpEmit:
+		return csw.disassembleUInt31Instruction(chunk, out, "EMIT", offset)
+
 	default:
 		fmt.Fprintf(out, "Unknown opcode %d\n", instruction)
 		return offset + 1
@@ -105,7 +141,12 @@ func (csw *CompiledStoryworld) disassembleSimpleInstruction(out io.Writer, name
 // Returns the offset to the next instruction.
 func (csw *CompiledStoryworld) disassembleConstantInstruction(chunk *Chunk, out io.Writer, name string, offset int, di *DebugInfo) int {
 	index := DecodeUInt31(chunk.Code[offset+1:])
-	fmt.Fprintf(out, "%-16s %4d %v\n", name, index, csw.Constants[index].DebugString(di))
+	constant := csw.Constants[index]
+	procName := ""
+	if constant.IsProcedure() {
+		procName = " " + csw.Procedures[constant.AsProcedure().Index].FQN
+	}
+	fmt.Fprintf(out, "%-16s %4d %v%v\n", name, index, constant.DebugString(di), procName)
 	return offset + 5
 }
 
@@ -116,3 +157,19 @@ func (csw *CompiledStoryworld) disassembleInt32Instruction(chunk *Chunk, out io.
 	fmt.Fprintf(out, "%-16s %4d\n", name, operand)
 	return offset + 5
 }
+
+// disassembleUInt31Instruction disassembles an instruction that has a single
+// uint31 operand.
+func (csw *CompiledStoryworld) disassembleUInt31Instruction(chunk *Chunk, out io.Writer, name string, offset int) int {
+	operand := DecodeUInt31(chunk.Code[offset+1:])
+	fmt.Fprintf(out, "%-16s %4d\n", name, operand)
+	return offset + 5
+}
+
+// disassembleGlobalInstruction disassembles an instruction whose single uint31
+// operand is an index into the table of globals.
+func (csw *CompiledStoryworld) disassembleGlobalInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
+	index := DecodeUInt31(chunk.Code[offset+1:])
+	fmt.Fprintf(out, "%-16s %4d %v\n", name, index, csw.Globals[index].FQN)
+	return offset + 5
+}
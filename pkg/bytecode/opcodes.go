@@ -24,4 +24,28 @@ const (
 	OpNotEqual
 	OpToString
 	OpToLecture
+	OpGetGlobal
+	OpSetGlobal
+	OpGetLocal
+	OpSetLocal
+	OpCall
+	OpReturnValue
+	OpReturnVoid
+	OpBeginCurlies
+	OpEndCurlies
+	OpExternal
+	OpExternalVoid
+	OpEmit
 )
+
+// InstructionSize returns the size in bytes of an instruction with the given
+// opcode, including its immediate operands.
+func InstructionSize(op OpCode) int {
+	switch op {
+	case OpConstant, OpJump, OpJumpIfFalse, OpGetGlobal, OpSetGlobal, OpGetLocal,
+		OpSetLocal, OpCall, OpEmit:
+		return 5
+	default:
+		return 1
+	}
+}
@@ -8,6 +8,7 @@
 package bytecode
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
@@ -37,13 +38,31 @@ const (
 	ValueProcedure
 )
 
+// String converts the ValueKind to a string, using the corresponding Romualdo
+// type names when possible.
+func (kind ValueKind) String() string {
+	switch kind {
+	case ValueBool:
+		return "bool"
+	case ValueString:
+		return "string"
+	case ValueLecture:
+		return "Lecture"
+	case ValueProcedure:
+		return "procedure"
+	default:
+		return fmt.Sprintf("<Unknown ValueKind: %d>", int(kind))
+	}
+}
+
 // Procedure is the runtime representation of a Procedure (i.e., a Passage or a
 // Function). We don't include any sort of information about return and
 // parameter types because type-checking is all done statically at compile-time.
 type Procedure struct {
-	// ChunkIndex points to the Chunk that contains this function's bytecode.
-	// It's an index into the CompiledStoryworld slice of Chunks.
-	ChunkIndex int
+	// Index is the index into CompiledStoryworld.Procedures of this Procedure.
+	// Notice this is not an index into the Chunks, as Procedures can have
+	// multiple versions, each in its own Chunk.
+	Index int
 }
 
 // Lecture is the runtime representation of a Lecture. Lectures are just
@@ -89,12 +108,12 @@ func NewValueLecture(text string) Value {
 	}
 }
 
-// NewValueProcedure creates a new Value of type Procedure, representing a
-// Procedure that will run the code at the given Chunk index.
+// NewValueProcedure creates a new Value of type Procedure, representing the
+// Procedure at the given index into CompiledStoryworld.Procedures.
 func NewValueProcedure(index int) Value {
 	return Value{
 		Value: Procedure{
-			ChunkIndex: index,
+			Index: index,
 		},
 	}
 }
@@ -119,6 +138,22 @@ func (v Value) AsProcedure() Procedure {
 	return v.Value.(Procedure)
 }
 
+// Kind returns the kind of this Value.
+func (v Value) Kind() ValueKind {
+	switch v.Value.(type) {
+	case bool:
+		return ValueBool
+	case string:
+		return ValueString
+	case Lecture:
+		return ValueLecture
+	case Procedure:
+		return ValueProcedure
+	default:
+		panic(fmt.Sprintf("unexpected value type: %T", v.Value))
+	}
+}
+
 // IsBool checks if the value contains a Boolean value.
 func (v Value) IsBool() bool {
 	_, ok := v.Value.(bool)
@@ -168,7 +203,7 @@ func (v Value) String() string {
 		// information around. Hard to access this info from here, though. Could
 		// we easily move these string conversions to the VM or whoever has
 		// access to the debug info?
-		return fmt.Sprintf("<procedure %d>", vv.ChunkIndex)
+		return fmt.Sprintf("<procedure %d>", vv.Index)
 
 	default:
 		return fmt.Sprintf("<Unexpected type %T>", vv)
@@ -196,17 +231,74 @@ func (v Value) DebugString(debugInfo *DebugInfo) string {
 		return fmt.Sprintf("<Lecture: %v>", romutil.FormatTextForDisplay(vv.Text))
 
 	case Procedure:
-		procName := ""
-		if debugInfo != nil {
-			procName = " (" + debugInfo.ChunksSourceFiles[vv.ChunkIndex] + ")"
-		}
-		return fmt.Sprintf("<procedure %v%v>", vv.ChunkIndex, procName)
+		// The Procedure names are in the CompiledStoryworld, which we don't
+		// have here. The disassembler adds them when printing constants.
+		return fmt.Sprintf("<procedure %v>", vv.Index)
 
 	default:
 		return fmt.Sprintf("<Unexpected type %T>", vv)
 	}
 }
 
+// jsonValue is the JSON representation of a Value: its kind, plus its value
+// (the text for Lectures, and the index into CompiledStoryworld.Procedures for
+// Procedures).
+type jsonValue struct {
+	Kind  string          `json:"kind"`
+	Value json.RawMessage `json:"value"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v Value) MarshalJSON() ([]byte, error) {
+	var inner any
+	switch vv := v.Value.(type) {
+	case bool, string:
+		inner = vv
+	case Lecture:
+		inner = vv.Text
+	case Procedure:
+		inner = vv.Index
+	default:
+		return nil, fmt.Errorf("unexpected value type: %T", v.Value)
+	}
+	raw, err := json.Marshal(inner)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue{Kind: v.Kind().String(), Value: raw})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	jv := jsonValue{}
+	err := json.Unmarshal(data, &jv)
+	if err != nil {
+		return err
+	}
+
+	switch jv.Kind {
+	case ValueBool.String():
+		var b bool
+		err = json.Unmarshal(jv.Value, &b)
+		*v = NewValueBool(b)
+	case ValueString.String():
+		var s string
+		err = json.Unmarshal(jv.Value, &s)
+		*v = NewValueString(s)
+	case ValueLecture.String():
+		var s string
+		err = json.Unmarshal(jv.Value, &s)
+		*v = NewValueLecture(s)
+	case ValueProcedure.String():
+		var i int
+		err = json.Unmarshal(jv.Value, &i)
+		*v = NewValueProcedure(i)
+	default:
+		return fmt.Errorf("unknown value kind %q", jv.Kind)
+	}
+	return err
+}
+
 // ValuesEqual checks if a and b are considered equal.
 func ValuesEqual(a, b Value) bool {
 	if reflect.TypeOf(a.Value) != reflect.TypeOf(b.Value) {
@@ -224,7 +316,7 @@ func ValuesEqual(a, b Value) bool {
 		return va.Text == b.Value.(Lecture).Text
 
 	case Procedure:
-		return va.ChunkIndex == b.Value.(Procedure).ChunkIndex
+		return va.Index == b.Value.(Procedure).Index
 
 	default:
 		panic(fmt.Sprintf("Unexpected Value type: %T", va))
@@ -253,6 +345,7 @@ const (
 	cswBNum      byte = 4
 	cswString    byte = 5
 	cswLecture   byte = 6
+	cswProcedure byte = 7
 )
 
 // Serialize serializes the Value to the given io.Writer.
@@ -295,7 +388,14 @@ func (v Value) Serialize(w io.Writer) errs.Error {
 		return err
 
 	case Procedure:
-		return errs.NewICE("cannot serialize procedure values")
+		bs := []byte{cswProcedure}
+		_, plainErr := w.Write(bs)
+		if plainErr != nil {
+			return errs.NewRomualdoTool("serializing procedure: %v", plainErr)
+		}
+
+		err := romutil.SerializeU32(w, uint32(vv.Index))
+		return err
 
 	default:
 		// Can't happen
@@ -333,6 +433,13 @@ func DeserializeValue(r io.Reader) (Value, errs.Error) {
 		}
 		v.Value = Lecture{text}
 
+	case cswProcedure:
+		index, err := romutil.DeserializeU32(r)
+		if err != nil {
+			return v, err
+		}
+		v.Value = Procedure{int(index)}
+
 	default:
 		// Can happen with corrupted or invalid data
 		return v, errs.NewRomualdoTool("unexpected value identifier: %v", b[0])
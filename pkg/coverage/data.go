@@ -0,0 +1,338 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package coverage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// DataVersion is the current version of the coverage data file format.
+const DataVersion = 0
+
+// Data is coverage data aggregated over any number of runs, possibly of
+// different Storyworlds. It is kept by source file and line, so that it makes
+// sense across builds, as long as the source code doesn't change. It mirrors
+// the coverage data JSON file format.
+type Data struct {
+	// Version is the version of the file format.
+	Version int `json:"version"`
+
+	// Files maps the paths of source files to their coverage data.
+	Files map[string]*File `json:"files"`
+}
+
+// File is the coverage data of a single source file.
+type File struct {
+	// Lines maps the lines with code to the number of times they were run.
+	Lines map[int]int `json:"lines"`
+
+	// Lectures contains the Lectures in the file (or, more precisely, the
+	// pieces of literal text between curlies), sorted by line.
+	Lectures []*Lecture `json:"lectures"`
+
+	// Branches contains the `if` statements in the file, sorted by line.
+	Branches []*Branch `json:"branches"`
+
+	// Procedures contains the Procedures declared in the file, sorted by line.
+	Procedures []*Procedure `json:"procedures"`
+}
+
+// Lecture is the coverage data of a piece of literal Lecture text.
+type Lecture struct {
+	// Line is the line where the text starts.
+	Line int `json:"line"`
+
+	// Text is the text itself.
+	Text string `json:"text"`
+
+	// Hits is the number of times the text was said.
+	Hits int `json:"hits"`
+}
+
+// Branch is the coverage data of an `if` statement.
+type Branch struct {
+	// Line is the line of the condition.
+	Line int `json:"line"`
+
+	// Index tells apart the `if` statements on the same line.
+	Index int `json:"index"`
+
+	// Then is the number of times the condition was true.
+	Then int `json:"then"`
+
+	// Else is the number of times the condition was false (whether there is
+	// an `else` block or not).
+	Else int `json:"else"`
+}
+
+// Procedure is the coverage data of a Procedure.
+type Procedure struct {
+	// Name is the fully-qualified name of the Procedure.
+	Name string `json:"name"`
+
+	// Line is the line where the Procedure is declared.
+	Line int `json:"line"`
+
+	// Calls is the number of times the Procedure was called.
+	Calls int `json:"calls"`
+}
+
+// NewData creates a new Data, with no coverage data at all.
+func NewData() *Data {
+	return &Data{Version: DataVersion, Files: map[string]*File{}}
+}
+
+// LoadData loads Data from the JSON file at dataPath.
+func LoadData(dataPath string) (*Data, errs.Error) {
+	source, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("reading coverage data %v: %v", dataPath, err)
+	}
+
+	data := NewData()
+	err = json.Unmarshal(source, data)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("parsing coverage data %v: %v", dataPath, err)
+	}
+	if data.Version != DataVersion {
+		return nil, errs.NewRomualdoTool("coverage data %v has version %v, expected %v",
+			dataPath, data.Version, DataVersion)
+	}
+	return data, nil
+}
+
+// Save saves the Data to a JSON file at dataPath.
+func (d *Data) Save(dataPath string) errs.Error {
+	source, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errs.NewRomualdoTool("encoding coverage data: %v", err)
+	}
+
+	err = os.WriteFile(dataPath, append(source, '\n'), 0644)
+	if err != nil {
+		return errs.NewRomualdoTool("writing coverage data %v: %v", dataPath, err)
+	}
+	return nil
+}
+
+// AddToFile adds d to the coverage data in the JSON file at dataPath, which is
+// created if it doesn't exist yet. This is how coverage data is aggregated
+// across runs.
+func (d *Data) AddToFile(dataPath string) errs.Error {
+	total := NewData()
+	if _, err := os.Stat(dataPath); !errors.Is(err, os.ErrNotExist) {
+		var loadErr errs.Error
+		total, loadErr = LoadData(dataPath)
+		if loadErr != nil {
+			return loadErr
+		}
+	}
+	total.Merge(d)
+	return total.Save(dataPath)
+}
+
+// Add adds the hits recorded by cov, which was attached to VMs running csw, to
+// the coverage data. di must be the DebugInfo of csw, as it is what maps the
+// hits to source lines. The source file paths in di are joined to sourceRoot,
+// which should be the root of the Storyworld source code (use an empty string
+// to keep them relative to it).
+//
+// Only the latest version of each Procedure is considered: older versions
+// (kept for running saved states from previous releases) may not match the
+// source code anymore. External functions, which have no code to cover, are
+// left out.
+func (d *Data) Add(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, cov *vm.Coverage,
+	sourceRoot string) errs.Error {
+
+	if di == nil {
+		return errs.NewBadUsage("Coverage requires DebugInfo.")
+	}
+
+	run := NewData()
+	for _, proc := range csw.Procedures {
+		if proc.External {
+			continue
+		}
+		code := csw.Chunks[proc.Chunk].Code
+		lines := di.ChunksLines[proc.Chunk]
+		hits := cov.Hits[proc.Chunk]
+		if len(code) == 0 || len(lines) != len(code) || len(hits) != len(code) {
+			return errs.NewICE("coverage data doesn't match the chunk of %v", proc.FQN)
+		}
+		file := run.file(filepath.Join(sourceRoot, di.ChunksSourceFiles[proc.Chunk]))
+
+		// Every Procedure ends with an implicit return, whose line is the
+		// line of the Procedure declaration. This return is never run if
+		// there's an explicit one, so count the declaration line as run
+		// whenever the Procedure is called.
+		declLine := lines[len(lines)-1]
+		file.Procedures = append(file.Procedures, &Procedure{
+			Name:  proc.FQN,
+			Line:  declLine,
+			Calls: hits[0],
+		})
+		file.Lines[declLine] = hits[0]
+
+		ifsOnLine := map[int]int{}
+		for ip := 0; ip < len(code); {
+			op := bytecode.OpCode(code[ip])
+			next := ip + bytecode.InstructionSize(op)
+			line := lines[ip]
+
+			// A line is run as many times as its most run instruction.
+			if h, ok := file.Lines[line]; !ok || hits[ip] > h {
+				file.Lines[line] = hits[ip]
+			}
+
+			switch op {
+			case bytecode.OpConstant:
+				value := csw.Constants[bytecode.DecodeUInt31(code[ip+1:])]
+				isSaid := next < len(code) && bytecode.OpCode(code[next]) == bytecode.OpSay
+				if isSaid && value.IsLecture() && strings.TrimSpace(value.AsLecture().Text) != "" {
+					file.Lectures = append(file.Lectures, &Lecture{
+						Line: line,
+						Text: value.AsLecture().Text,
+						Hits: hits[ip],
+					})
+				}
+
+			case bytecode.OpJumpIfFalse:
+				// The "then" block starts right after the jump. An `if` with
+				// an empty "then" block and no "else" jumps right there, too,
+				// so there's nothing to tell apart.
+				target := ip + bytecode.DecodeInt32(code[ip+1:])
+				if target == next {
+					break
+				}
+				then := hits[next]
+				otherwise := hits[ip] - then
+				if otherwise < 0 {
+					otherwise = 0
+				}
+				file.Branches = append(file.Branches, &Branch{
+					Line:  line,
+					Index: ifsOnLine[line],
+					Then:  then,
+					Else:  otherwise,
+				})
+				ifsOnLine[line]++
+			}
+
+			ip = next
+		}
+	}
+
+	d.Merge(run)
+	return nil
+}
+
+// Merge adds the coverage data in other to d.
+func (d *Data) Merge(other *Data) {
+	for name, otherFile := range other.Files {
+		file := d.file(name)
+		for line, hits := range otherFile.Lines {
+			file.Lines[line] += hits
+		}
+
+		type lectureKey struct {
+			line int
+			text string
+		}
+		lectures := map[lectureKey]*Lecture{}
+		for _, l := range file.Lectures {
+			lectures[lectureKey{l.Line, l.Text}] = l
+		}
+		for _, l := range otherFile.Lectures {
+			if existing, ok := lectures[lectureKey{l.Line, l.Text}]; ok {
+				existing.Hits += l.Hits
+			} else {
+				newLecture := *l
+				file.Lectures = append(file.Lectures, &newLecture)
+				lectures[lectureKey{l.Line, l.Text}] = &newLecture
+			}
+		}
+
+		type branchKey struct {
+			line, index int
+		}
+		branches := map[branchKey]*Branch{}
+		for _, b := range file.Branches {
+			branches[branchKey{b.Line, b.Index}] = b
+		}
+		for _, b := range otherFile.Branches {
+			if existing, ok := branches[branchKey{b.Line, b.Index}]; ok {
+				existing.Then += b.Then
+				existing.Else += b.Else
+			} else {
+				newBranch := *b
+				file.Branches = append(file.Branches, &newBranch)
+				branches[branchKey{b.Line, b.Index}] = &newBranch
+			}
+		}
+
+		procedures := map[string]*Procedure{}
+		for _, p := range file.Procedures {
+			procedures[p.Name] = p
+		}
+		for _, p := range otherFile.Procedures {
+			if existing, ok := procedures[p.Name]; ok {
+				existing.Calls += p.Calls
+			} else {
+				newProcedure := *p
+				file.Procedures = append(file.Procedures, &newProcedure)
+				procedures[p.Name] = &newProcedure
+			}
+		}
+
+		sort.SliceStable(file.Lectures, func(i, j int) bool {
+			return file.Lectures[i].Line < file.Lectures[j].Line
+		})
+		sort.SliceStable(file.Branches, func(i, j int) bool {
+			a, b := file.Branches[i], file.Branches[j]
+			return a.Line < b.Line || a.Line == b.Line && a.Index < b.Index
+		})
+		sort.SliceStable(file.Procedures, func(i, j int) bool {
+			return file.Procedures[i].Line < file.Procedures[j].Line
+		})
+	}
+}
+
+// FileNames returns the names of all files with coverage data, sorted.
+func (d *Data) FileNames() []string {
+	names := make([]string, 0, len(d.Files))
+	for name := range d.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// file returns the coverage data of the file with the given name, creating it
+// if needed.
+func (d *Data) file(name string) *File {
+	f, ok := d.Files[name]
+	if !ok {
+		f = &File{
+			Lines:      map[int]int{},
+			Lectures:   []*Lecture{},
+			Branches:   []*Branch{},
+			Procedures: []*Procedure{},
+		}
+		d.Files[name] = f
+	}
+	return f
+}
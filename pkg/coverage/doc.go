@@ -0,0 +1,15 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The coverage package tells which parts of a Storyworld were exercised by
+// some set of playthroughs: which Lectures were seen, which branches of `if`
+// statements were taken, which Procedures were called and which lines were
+// run. It aggregates the hits recorded by vm.Coverage over any number of runs
+// and reports them as a text summary, an LCOV file or an HTML page with the
+// source code annotated with hit counts. It's the machinery behind the
+// `coverage` command and the `--coverage` flags.
+package coverage
@@ -0,0 +1,167 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// htmlLine is a source line, as shown in the HTML report.
+type htmlLine struct {
+	// Number is the line number.
+	Number int
+
+	// Hits is the number of times the line was run, or an empty string if it
+	// has no code.
+	Hits string
+
+	// Class is the CSS class of the line: "hit", "partial", "miss" or empty
+	// (for lines without code).
+	Class string
+
+	// Source is the source code in the line.
+	Source string
+
+	// Notes tell what wasn't covered in the line.
+	Notes string
+}
+
+// htmlFile is a source file, as shown in the HTML report.
+type htmlFile struct {
+	// Name is the file name, as in the coverage data.
+	Name string
+
+	// ID identifies the file section within the page.
+	ID string
+
+	// Summary summarizes the coverage of the file.
+	Summary Summary
+
+	// Lines contains all lines in the file.
+	Lines []htmlLine
+
+	// Missing is set if the source code could not be read.
+	Missing string
+}
+
+// htmlReport is what the HTML template renders.
+type htmlReport struct {
+	// Summary summarizes the coverage of all files.
+	Summary Summary
+
+	// Files contains all files, sorted by name.
+	Files []htmlFile
+}
+
+// WriteHTML writes an HTML page to w, with a summary of the coverage and the
+// source code of every file annotated with hit counts. Relative file names are
+// taken as relative to sourceRoot when reading the source code.
+func (d *Data) WriteHTML(w io.Writer, sourceRoot string) error {
+	report := htmlReport{Summary: d.Summary()}
+	for i, name := range d.FileNames() {
+		report.Files = append(report.Files, d.htmlFile(name, fmt.Sprintf("file%v", i), sourceRoot))
+	}
+	return htmlTemplate.Execute(w, report)
+}
+
+// htmlFile prepares the file with the given name for the HTML report.
+func (d *Data) htmlFile(name, id, sourceRoot string) htmlFile {
+	f := d.Files[name]
+	hf := htmlFile{Name: name, ID: id, Summary: f.Summary()}
+
+	sourcePath := name
+	if !filepath.IsAbs(sourcePath) {
+		sourcePath = filepath.Join(sourceRoot, sourcePath)
+	}
+	source, err := os.ReadFile(sourcePath)
+	if err != nil {
+		hf.Missing = fmt.Sprintf("Cannot read the source code: %v.", err)
+		return hf
+	}
+
+	notes := map[int][]string{}
+	for _, l := range f.Lectures {
+		if l.Hits == 0 {
+			notes[l.Line] = append(notes[l.Line], fmt.Sprintf("never seen: %q", l.Text))
+		}
+	}
+	for _, b := range f.Branches {
+		if b.Then == 0 {
+			notes[b.Line] = append(notes[b.Line], "then never taken")
+		}
+		if b.Else == 0 {
+			notes[b.Line] = append(notes[b.Line], "else never taken")
+		}
+	}
+	for _, p := range f.Procedures {
+		if p.Calls == 0 {
+			notes[p.Line] = append(notes[p.Line], "never called")
+		}
+	}
+
+	for i, text := range strings.Split(strings.TrimRight(string(source), "\n"), "\n") {
+		line := htmlLine{
+			Number: i + 1,
+			Source: strings.TrimRight(text, "\r"),
+			Notes:  strings.Join(notes[i+1], "; "),
+		}
+		if hits, ok := f.Lines[i+1]; ok {
+			line.Hits = fmt.Sprint(hits)
+			switch {
+			case hits == 0:
+				line.Class = "miss"
+			case line.Notes != "":
+				line.Class = "partial"
+			default:
+				line.Class = "hit"
+			}
+		}
+		hf.Lines = append(hf.Lines, line)
+	}
+	return hf
+}
+
+// htmlTemplate is the template of the HTML report.
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Storyworld Coverage</title>
+<style>
+body { font-family: sans-serif; }
+table.summary td, table.summary th { padding: 0.2em 1em; text-align: left; }
+table.source { border-collapse: collapse; font-family: monospace; }
+table.source td { padding: 0 0.5em; white-space: pre; vertical-align: top; }
+td.hits, td.number { text-align: right; color: #666; }
+td.notes { font-family: sans-serif; font-size: smaller; color: #900; }
+tr.hit td.source { background: #dfd; }
+tr.partial td.source { background: #ffc; }
+tr.miss td.source { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Storyworld Coverage</h1>
+<table class="summary">
+<tr><th>File</th><th>Lectures seen</th><th>Branches taken</th><th>Procedures called</th><th>Lines run</th></tr>
+{{range .Files}}<tr><td><a href="#{{.ID}}">{{.Name}}</a></td><td>{{.Summary.Lectures}}</td><td>{{.Summary.Branches}}</td><td>{{.Summary.Procedures}}</td><td>{{.Summary.Lines}}</td></tr>
+{{end}}<tr><th>Total</th><th>{{.Summary.Lectures}}</th><th>{{.Summary.Branches}}</th><th>{{.Summary.Procedures}}</th><th>{{.Summary.Lines}}</th></tr>
+</table>
+{{range .Files}}
+<h2 id="{{.ID}}">{{.Name}}</h2>
+{{if .Missing}}<p>{{.Missing}}</p>{{else}}<table class="source">
+{{range .Lines}}<tr class="{{.Class}}"><td class="hits">{{.Hits}}</td><td class="number">{{.Number}}</td><td class="source">{{.Source}}</td><td class="notes">{{.Notes}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+</body>
+</html>
+`))
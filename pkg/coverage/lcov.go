@@ -0,0 +1,71 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteLCOV writes the coverage data to w in the LCOV tracefile format, which
+// is understood by many tools (like genhtml and editor plugins showing coverage
+// on the source code). Lectures have no place in this format; they are
+// accounted for only as the lines they are on.
+func (d *Data) WriteLCOV(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "TN:")
+	for _, name := range d.FileNames() {
+		f := d.Files[name]
+		s := f.Summary()
+		fmt.Fprintf(b, "SF:%v\n", name)
+
+		for _, p := range f.Procedures {
+			fmt.Fprintf(b, "FN:%v,%v\n", p.Line, p.Name)
+		}
+		for _, p := range f.Procedures {
+			fmt.Fprintf(b, "FNDA:%v,%v\n", p.Calls, p.Name)
+		}
+		fmt.Fprintf(b, "FNF:%v\n", s.Procedures.Total)
+		fmt.Fprintf(b, "FNH:%v\n", s.Procedures.Covered)
+
+		for i, br := range f.Branches {
+			if br.Then+br.Else == 0 {
+				// The condition was never evaluated.
+				fmt.Fprintf(b, "BRDA:%v,%v,0,-\n", br.Line, i)
+				fmt.Fprintf(b, "BRDA:%v,%v,1,-\n", br.Line, i)
+			} else {
+				fmt.Fprintf(b, "BRDA:%v,%v,0,%v\n", br.Line, i, br.Then)
+				fmt.Fprintf(b, "BRDA:%v,%v,1,%v\n", br.Line, i, br.Else)
+			}
+		}
+		fmt.Fprintf(b, "BRF:%v\n", s.Branches.Total)
+		fmt.Fprintf(b, "BRH:%v\n", s.Branches.Covered)
+
+		for _, line := range sortedLines(f) {
+			fmt.Fprintf(b, "DA:%v,%v\n", line, f.Lines[line])
+		}
+		fmt.Fprintf(b, "LF:%v\n", s.Lines.Total)
+		fmt.Fprintf(b, "LH:%v\n", s.Lines.Covered)
+		fmt.Fprintln(b, "end_of_record")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortedLines returns the lines with code of f, sorted.
+func sortedLines(f *File) []int {
+	lines := make([]int, 0, len(f.Lines))
+	for line := range f.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
@@ -0,0 +1,144 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Totals counts how much of something was covered.
+type Totals struct {
+	// Covered is how many were covered.
+	Covered int
+
+	// Total is how many there are.
+	Total int
+}
+
+// String converts the Totals to a string like "3 of 4 (75.0%)".
+func (t Totals) String() string {
+	if t.Total == 0 {
+		return "0 of 0"
+	}
+	return fmt.Sprintf("%v of %v (%.1f%%)", t.Covered, t.Total, 100*float64(t.Covered)/float64(t.Total))
+}
+
+// add adds a single thing, covered if hits is positive.
+func (t *Totals) add(hits int) {
+	t.Total++
+	if hits > 0 {
+		t.Covered++
+	}
+}
+
+// Summary summarizes the coverage of a file (or of many files).
+type Summary struct {
+	// Lectures counts the pieces of Lecture text seen.
+	Lectures Totals
+
+	// Branches counts the branches taken. Each `if` statement has two
+	// branches: the "then" and the "else" (even if there is no `else` block).
+	Branches Totals
+
+	// Procedures counts the Procedures called.
+	Procedures Totals
+
+	// Lines counts the lines run.
+	Lines Totals
+}
+
+// Summary summarizes the coverage of the file.
+func (f *File) Summary() Summary {
+	s := Summary{}
+	for _, l := range f.Lectures {
+		s.Lectures.add(l.Hits)
+	}
+	for _, b := range f.Branches {
+		s.Branches.add(b.Then)
+		s.Branches.add(b.Else)
+	}
+	for _, p := range f.Procedures {
+		s.Procedures.add(p.Calls)
+	}
+	for _, hits := range f.Lines {
+		s.Lines.add(hits)
+	}
+	return s
+}
+
+// Summary summarizes the coverage of all files.
+func (d *Data) Summary() Summary {
+	s := Summary{}
+	for _, f := range d.Files {
+		fs := f.Summary()
+		s.Lectures.Covered += fs.Lectures.Covered
+		s.Lectures.Total += fs.Lectures.Total
+		s.Branches.Covered += fs.Branches.Covered
+		s.Branches.Total += fs.Branches.Total
+		s.Procedures.Covered += fs.Procedures.Covered
+		s.Procedures.Total += fs.Procedures.Total
+		s.Lines.Covered += fs.Lines.Covered
+		s.Lines.Total += fs.Lines.Total
+	}
+	return s
+}
+
+// WriteText writes a text report to w: the overall summary, followed by
+// everything that was not covered (Lectures never seen, branches never taken
+// and Procedures never called).
+func (d *Data) WriteText(w io.Writer) error {
+	s := d.Summary()
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Lectures seen:      %v\n", s.Lectures)
+	fmt.Fprintf(b, "Branches taken:     %v\n", s.Branches)
+	fmt.Fprintf(b, "Procedures called:  %v\n", s.Procedures)
+	fmt.Fprintf(b, "Lines run:          %v\n", s.Lines)
+
+	var lectures, branches, procedures []string
+	for _, name := range d.FileNames() {
+		f := d.Files[name]
+		for _, l := range f.Lectures {
+			if l.Hits == 0 {
+				lectures = append(lectures, fmt.Sprintf("%v:%v: %q", name, l.Line, l.Text))
+			}
+		}
+		for _, br := range f.Branches {
+			if br.Then == 0 {
+				branches = append(branches, fmt.Sprintf("%v:%v: then", name, br.Line))
+			}
+			if br.Else == 0 {
+				branches = append(branches, fmt.Sprintf("%v:%v: else", name, br.Line))
+			}
+		}
+		for _, p := range f.Procedures {
+			if p.Calls == 0 {
+				procedures = append(procedures, fmt.Sprintf("%v:%v: %v", name, p.Line, p.Name))
+			}
+		}
+	}
+
+	writeList(b, "Lectures never seen", lectures)
+	writeList(b, "Branches never taken", branches)
+	writeList(b, "Procedures never called", procedures)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeList writes a titled list of items to b, if there are any items.
+func writeList(b *strings.Builder, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n%v:\n", title)
+	for _, item := range items {
+		fmt.Fprintf(b, "    %v\n", item)
+	}
+}
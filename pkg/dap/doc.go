@@ -0,0 +1,15 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The dap package implements a Debug Adapter Protocol server, which lets
+// editors debug Stories: stop at breakpoints, step through the code, and
+// inspect the call stack and variables. It's the machinery behind the `debug`
+// command.
+//
+// The server is a thin layer over vm.Debugger, which does the real work. Only
+// the parts of the protocol needed for these features are implemented.
+package dap
@@ -0,0 +1,152 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package dap
+
+import "encoding/json"
+
+// This file contains the subset of the DAP types used by the server. Names
+// mirror the ones in the DAP specification.
+
+// request is a request received from the client.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// response is a response sent to the client.
+type response struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+// event is an event sent to the client.
+type event struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// launchArguments are the arguments of the launch request. Besides the
+// program, these are all specific to Romualdo.
+type launchArguments struct {
+	// Program is the Storyworld to debug: either a directory with source code
+	// or a compiled Storyworld (*.ras) file.
+	Program string `json:"program"`
+
+	// SourceRoot is the root directory of the Storyworld source code. Defaults
+	// to Program if it is a directory, or to its directory otherwise.
+	SourceRoot string `json:"sourceRoot"`
+
+	// StopOnEntry makes the execution stop at the first line of the Story.
+	StopOnEntry bool `json:"stopOnEntry"`
+
+	// Choices are the Player choices to make, in order, before asking the
+	// user for them.
+	Choices []string `json:"choices"`
+
+	// Strict makes soft errors behave like runtime errors.
+	Strict bool `json:"strict"`
+
+	// Externals maps the fully-qualified names of the external functions to
+	// the values they shall return.
+	Externals map[string]any `json:"externals"`
+}
+
+// source identifies a source file.
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// setBreakpointsArguments are the arguments of the setBreakpoints request.
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+// sourceBreakpoint is a breakpoint requested by the client.
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+// breakpoint is a breakpoint as set by the server.
+type breakpoint struct {
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line"`
+	Message  string `json:"message,omitempty"`
+}
+
+// thread is a thread of execution. Stories have exactly one.
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// stackFrame is a call frame.
+type stackFrame struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+// scope is a group of variables.
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+// variable is a variable inspected by the client.
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// frameArguments are the arguments of requests about a given call frame, like
+// scopes.
+type frameArguments struct {
+	FrameID int `json:"frameId"`
+}
+
+// variablesArguments are the arguments of the variables request.
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+// evaluateArguments are the arguments of the evaluate request.
+type evaluateArguments struct {
+	Expression string `json:"expression"`
+	FrameID    int    `json:"frameId"`
+	Context    string `json:"context"`
+}
+
+// stoppedEventBody is the body of the stopped event.
+type stoppedEventBody struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	Text              string `json:"text,omitempty"`
+	ThreadID          int    `json:"threadId"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+}
+
+// outputEventBody is the body of the output event.
+type outputEventBody struct {
+	Category string `json:"category"`
+	Output   string `json:"output"`
+}
@@ -0,0 +1,661 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// threadID is the ID of the one and only thread of a Story.
+const threadID = 1
+
+// globalsReference is the variables reference of the global variables. The
+// locals of each call frame use the frame ID plus one.
+const globalsReference = 1
+
+// Server is a Debug Adapter Protocol server, debugging one Story.
+//
+// Messages are handled one at a time, and the Story runs while handling the
+// messages that make it run (like continue), so the server answers nothing
+// else while the Story is running. The exception is the pause request, which
+// Serve() handles right away, as it is meant to stop a running Story.
+type Server struct {
+	// mu guards the fields below, which are also used by the goroutine reading
+	// the messages in Serve().
+	mu sync.Mutex
+
+	// w is where responses and events are written to.
+	w io.Writer
+
+	// seq is the sequence number of the last message sent.
+	seq int
+
+	// writeErr is the first error that happened while writing to w.
+	writeErr error
+
+	// cancel cancels the execution of the Story. Nil when it is not running.
+	cancel context.CancelFunc
+
+	//
+	// The fields below are used only by the goroutine handling the messages.
+	//
+
+	// root is the absolute path to the root of the Storyworld source code.
+	root string
+
+	// di is the DebugInfo of the Storyworld being debugged.
+	di *bytecode.DebugInfo
+
+	// theVM is the VM running the Story. Nil until launched.
+	theVM *vm.VM
+
+	// debugger is the Debugger attached to theVM.
+	debugger *vm.Debugger
+
+	// stopOnEntry tells if the execution shall stop at the first line.
+	stopOnEntry bool
+
+	// atEntry is true while the Story is running to its first line, if
+	// stopOnEntry is set.
+	atEntry bool
+
+	// choices are the Player choices still to make before asking the user.
+	choices []string
+
+	// configured is true once the client finished configuring the session
+	// (that is, setting the breakpoints).
+	configured bool
+
+	// over is true once the Story ended (or failed).
+	over bool
+}
+
+// NewServer creates a new Server that writes its responses and events to w.
+func NewServer(w io.Writer) *Server {
+	return &Server{w: w}
+}
+
+// Serve reads requests from r and handles them, until the client disconnects
+// or r ends.
+func (s *Server) Serve(r io.Reader) errs.Error {
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			content, err := romutil.ReadBaseProtocolMessage(br)
+			if err != nil {
+				readErr <- err
+				close(messages)
+				return
+			}
+			if s.handlePause(content) {
+				continue
+			}
+			messages <- content
+		}
+	}()
+
+	for content := range messages {
+		keepGoing := s.Handle(content)
+		if err := s.writeError(); err != nil {
+			return errs.NewRomualdoTool("writing DAP message: %v", err)
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+
+	err := <-readErr
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return errs.NewRomualdoTool("reading DAP message: %v", err)
+}
+
+// Handle handles a single request, given as its JSON content (without the
+// header of the DAP base protocol). Any responses and events are written
+// before returning. Returns false once the client disconnected.
+func (s *Server) Handle(content []byte) bool {
+	req := &request{}
+	err := json.Unmarshal(content, req)
+	if err != nil || req.Type != "request" {
+		s.sendOutput("stderr", fmt.Sprintf("Ignoring malformed request: %s\n", content))
+		return true
+	}
+
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		})
+	case "launch":
+		s.launch(req)
+	case "setBreakpoints":
+		s.setBreakpoints(req)
+	case "configurationDone":
+		s.respond(req, nil)
+		s.configured = true
+		s.maybeStart()
+	case "threads":
+		s.respond(req, map[string]any{
+			"threads": []thread{{ID: threadID, Name: "Story"}},
+		})
+	case "stackTrace":
+		s.stackTrace(req)
+	case "scopes":
+		s.scopes(req)
+	case "variables":
+		s.variables(req)
+	case "evaluate":
+		s.evaluate(req)
+	case "continue":
+		s.resume(req, (*vm.Debugger).Continue)
+	case "next":
+		s.resume(req, (*vm.Debugger).StepOver)
+	case "stepIn":
+		s.resume(req, (*vm.Debugger).StepInto)
+	case "stepOut":
+		s.resume(req, (*vm.Debugger).StepOut)
+	case "pause":
+		s.pause(req)
+	case "terminate":
+		s.respond(req, nil)
+		s.over = true
+		s.sendEvent("terminated", nil)
+	case "disconnect":
+		s.respond(req, nil)
+		return false
+	default:
+		s.respondError(req, "Unsupported command: %v.", req.Command)
+	}
+	return true
+}
+
+//
+// Session setup
+//
+
+// launch handles the launch request, loading the Storyworld to debug.
+func (s *Server) launch(req *request) {
+	args := &launchArguments{}
+	if !s.decodeArguments(req, args) {
+		return
+	}
+	if s.theVM != nil {
+		s.respondError(req, "A Story is already being debugged.")
+		return
+	}
+	if args.Program == "" {
+		s.respondError(req, "Missing the program (Storyworld) to debug.")
+		return
+	}
+
+	csw, di, err := vm.CSWFromPath(args.Program)
+	if err != nil {
+		s.respondError(req, "%v", err)
+		return
+	}
+
+	theVM := vm.New(csw, di)
+	theVM.Strict = args.Strict
+	theVM.SoftErrorSink = func(e vm.SoftError) {
+		s.sendOutput("stderr", fmt.Sprintln(e))
+	}
+	err = theVM.BindConstantExternals(args.Externals)
+	if err != nil {
+		s.respondError(req, "%v", err)
+		return
+	}
+	debugger, err := vm.NewDebugger(theVM)
+	if err != nil {
+		s.respondError(req, "%v", err)
+		return
+	}
+
+	root := args.SourceRoot
+	if root == "" {
+		root = args.Program
+		if info, plainErr := os.Stat(root); plainErr == nil && !info.IsDir() {
+			root = filepath.Dir(root)
+		}
+	}
+	root, plainErr := filepath.Abs(root)
+	if plainErr != nil {
+		s.respondError(req, "Getting the absolute path of %v: %v", root, plainErr)
+		return
+	}
+
+	s.root = root
+	s.di = di
+	s.theVM = theVM
+	s.debugger = debugger
+	s.stopOnEntry = args.StopOnEntry
+	s.choices = args.Choices
+
+	s.respond(req, nil)
+
+	// Now we are ready to be configured.
+	s.sendEvent("initialized", nil)
+	s.maybeStart()
+}
+
+// setBreakpoints handles the setBreakpoints request.
+func (s *Server) setBreakpoints(req *request) {
+	args := &setBreakpointsArguments{}
+	if !s.decodeArguments(req, args) {
+		return
+	}
+	if s.debugger == nil {
+		s.respondError(req, "No Story is being debugged.")
+		return
+	}
+
+	path, err := filepath.Abs(args.Source.Path)
+	if err == nil {
+		path, err = filepath.Rel(s.root, path)
+	}
+	if err != nil {
+		s.respondError(req, "Source file outside of the Storyworld: %v.", args.Source.Path)
+		return
+	}
+
+	lines := make([]int, len(args.Breakpoints))
+	for i, bp := range args.Breakpoints {
+		lines[i] = bp.Line
+	}
+	verified := s.debugger.SetBreakpoints(path, lines)
+
+	breakpoints := make([]breakpoint, len(lines))
+	for i, line := range lines {
+		breakpoints[i] = breakpoint{Verified: verified[i], Line: line}
+		if !verified[i] {
+			breakpoints[i].Message = "No code at this line."
+		}
+	}
+	s.respond(req, map[string]any{"breakpoints": breakpoints})
+}
+
+// maybeStart starts the Story if it was launched and configured, and not
+// started yet.
+func (s *Server) maybeStart() {
+	if !s.configured || s.theVM == nil || s.theVM.State != vm.StateNew {
+		return
+	}
+	if s.stopOnEntry {
+		s.debugger.StepInto()
+		s.atEntry = true
+	} else {
+		s.debugger.Continue()
+	}
+	s.run(s.theVM.Start)
+}
+
+//
+// Execution control
+//
+
+// resume handles the requests that make a stopped Story run again. step tells
+// how far to go.
+func (s *Server) resume(req *request, step func(*vm.Debugger)) {
+	switch {
+	case s.theVM == nil || s.theVM.State == vm.StateNew:
+		s.respondError(req, "The Story has not started.")
+		return
+	case s.over:
+		s.respond(req, nil)
+		s.sendEvent("terminated", nil)
+		return
+	case s.theVM.State == vm.StateWaitingForInput:
+		s.respondError(req, "The Story is waiting for the Player's choice. Enter it in the debug console.")
+		return
+	}
+
+	if req.Command == "continue" {
+		s.respond(req, map[string]any{"allThreadsContinued": true})
+	} else {
+		s.respond(req, nil)
+	}
+
+	if s.theVM.State == vm.StateError {
+		// Stopped on a runtime error, there's no way forward.
+		s.end(1)
+		return
+	}
+	step(s.debugger)
+	s.run(s.theVM.Resume)
+}
+
+// pause handles the pause request. Interrupts the Story if it is running.
+func (s *Server) pause(req *request) {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.respond(req, nil)
+}
+
+// handlePause handles content if it is a pause request, returning true if it
+// was. Safe to call while the Story is running.
+func (s *Server) handlePause(content []byte) bool {
+	req := &request{}
+	err := json.Unmarshal(content, req)
+	if err != nil || req.Type != "request" || req.Command != "pause" {
+		return false
+	}
+	s.pause(req)
+	return true
+}
+
+// run runs the Story, calling start (which must be one of the VM functions
+// that run the Story, or some wrapper around them), and tells the client
+// where it stopped. If the Story stops to listen and there are choices to
+// make, makes them and keeps running.
+func (s *Server) run(start func(ctx context.Context) (vm.Output, errs.Error)) {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.mu.Lock()
+		s.cancel = cancel
+		s.mu.Unlock()
+
+		out, err := start(ctx)
+
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+		cancel()
+
+		if text := out.TextWithEvents(); text != "" {
+			s.sendOutput("stdout", text)
+		}
+		if err != nil {
+			s.sendOutput("stderr", err.Error()+"\n")
+			if s.theVM.State == vm.StateError {
+				// Stop, so that the user can see where it happened.
+				s.sendStopped("exception", "Runtime error", err.Error())
+			} else {
+				s.end(1)
+			}
+			return
+		}
+
+		switch out.State {
+		case vm.StateWaitingForInput:
+			s.sendOutput("stdout", out.Options+"\n")
+			if len(s.choices) > 0 {
+				choice := s.choices[0]
+				s.choices = s.choices[1:]
+				s.sendOutput("console", fmt.Sprintf("> %v\n", choice))
+				start = func(ctx context.Context) (vm.Output, errs.Error) {
+					return s.theVM.Step(ctx, choice)
+				}
+				continue
+			}
+			s.sendStopped("input", "Waiting for the Player's choice", "")
+
+		case vm.StateEndOfStory:
+			s.sendOutput("stdout", "-- The End --\n")
+			s.end(0)
+
+		case vm.StateInterrupted:
+			switch s.debugger.StopReason() {
+			case vm.StopBreakpoint:
+				s.sendStopped("breakpoint", "", "")
+			case vm.StopStep:
+				if s.atEntry {
+					s.sendStopped("entry", "", "")
+				} else {
+					s.sendStopped("step", "", "")
+				}
+			default:
+				s.sendStopped("pause", "", "")
+			}
+		}
+		s.atEntry = false
+		return
+	}
+}
+
+// end tells the client the Story is over, with the given exit code.
+func (s *Server) end(exitCode int) {
+	s.over = true
+	s.sendEvent("exited", map[string]any{"exitCode": exitCode})
+	s.sendEvent("terminated", nil)
+}
+
+//
+// Inspection
+//
+
+// stackTrace handles the stackTrace request.
+func (s *Server) stackTrace(req *request) {
+	if s.debugger == nil {
+		s.respondError(req, "No Story is being debugged.")
+		return
+	}
+	frames := s.debugger.CallStack()
+	stackFrames := make([]stackFrame, len(frames))
+	for i, frame := range frames {
+		stackFrames[i] = stackFrame{
+			ID:   i + 1,
+			Name: frame.Procedure,
+			Source: &source{
+				Name: filepath.Base(frame.SourceFile),
+				Path: filepath.Join(s.root, frame.SourceFile),
+			},
+			Line:   frame.Line,
+			Column: 1,
+		}
+	}
+	s.respond(req, map[string]any{
+		"stackFrames": stackFrames,
+		"totalFrames": len(stackFrames),
+	})
+}
+
+// scopes handles the scopes request.
+func (s *Server) scopes(req *request) {
+	args := &frameArguments{}
+	if !s.decodeArguments(req, args) {
+		return
+	}
+	s.respond(req, map[string]any{
+		"scopes": []scope{
+			{Name: "Locals", VariablesReference: args.FrameID + 1},
+			{Name: "Globals", VariablesReference: globalsReference},
+		},
+	})
+}
+
+// variables handles the variables request.
+func (s *Server) variables(req *request) {
+	args := &variablesArguments{}
+	if !s.decodeArguments(req, args) {
+		return
+	}
+	if s.debugger == nil {
+		s.respondError(req, "No Story is being debugged.")
+		return
+	}
+
+	var vars []vm.Variable
+	if args.VariablesReference == globalsReference {
+		vars = s.debugger.Globals()
+	} else {
+		// The reference is the frame ID plus one, and the frame ID is the
+		// depth plus one.
+		vars = s.debugger.Locals(args.VariablesReference - 2)
+	}
+
+	variables := make([]variable, len(vars))
+	for i, v := range vars {
+		variables[i] = variable{Name: v.Name, Value: v.Value.DebugString(s.di)}
+	}
+	s.respond(req, map[string]any{"variables": variables})
+}
+
+// evaluate handles the evaluate request. If the Story is waiting for the
+// Player's choice, whatever is entered in the debug console is taken as the
+// choice, and the execution continues. Otherwise, the expression must be the
+// name of a variable, whose value is returned.
+func (s *Server) evaluate(req *request) {
+	args := &evaluateArguments{}
+	if !s.decodeArguments(req, args) {
+		return
+	}
+	if s.debugger == nil {
+		s.respondError(req, "No Story is being debugged.")
+		return
+	}
+
+	if args.Context == "repl" && s.theVM.State == vm.StateWaitingForInput {
+		s.respond(req, map[string]any{"result": "", "variablesReference": 0})
+		s.debugger.Continue()
+		s.run(func(ctx context.Context) (vm.Output, errs.Error) {
+			return s.theVM.Step(ctx, args.Expression)
+		})
+		return
+	}
+
+	name := strings.TrimSpace(args.Expression)
+	if v, ok := s.lookUp(name, args.FrameID); ok {
+		s.respond(req, map[string]any{
+			"result":             v.Value.DebugString(s.di),
+			"variablesReference": 0,
+		})
+		return
+	}
+	s.respondError(req, "Unknown variable: %v.", name)
+}
+
+// lookUp looks up a variable by name: first among the locals of the frame with
+// the given ID, then among the global variables (either by their
+// fully-qualified names or by their plain names).
+func (s *Server) lookUp(name string, frameID int) (vm.Variable, bool) {
+	for _, v := range s.debugger.Locals(frameID - 1) {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	for _, v := range s.debugger.Globals() {
+		if v.Name == name || strings.HasSuffix(v.Name, "/"+name) {
+			return v, true
+		}
+	}
+	return vm.Variable{}, false
+}
+
+//
+// Sending messages
+//
+
+// decodeArguments decodes the arguments of req into args. If they cannot be
+// decoded, responds with an error and returns false.
+func (s *Server) decodeArguments(req *request, args any) bool {
+	if len(req.Arguments) == 0 {
+		return true
+	}
+	err := json.Unmarshal(req.Arguments, args)
+	if err != nil {
+		s.respondError(req, "Invalid arguments for %v: %v.", req.Command, err)
+		return false
+	}
+	return true
+}
+
+// respond sends a successful response to req.
+func (s *Server) respond(req *request, body any) {
+	s.write(&response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    true,
+		Command:    req.Command,
+		Body:       body,
+	})
+}
+
+// respondError sends an error response to req.
+func (s *Server) respondError(req *request, format string, a ...any) {
+	s.write(&response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    false,
+		Command:    req.Command,
+		Message:    fmt.Sprintf(format, a...),
+	})
+}
+
+// sendEvent sends an event to the client.
+func (s *Server) sendEvent(name string, body any) {
+	s.write(&event{Type: "event", Event: name, Body: body})
+}
+
+// sendOutput sends an output event to the client.
+func (s *Server) sendOutput(category, output string) {
+	s.sendEvent("output", &outputEventBody{Category: category, Output: output})
+}
+
+// sendStopped sends a stopped event to the client.
+func (s *Server) sendStopped(reason, description, text string) {
+	s.sendEvent("stopped", &stoppedEventBody{
+		Reason:            reason,
+		Description:       description,
+		Text:              text,
+		ThreadID:          threadID,
+		AllThreadsStopped: true,
+	})
+}
+
+// write writes msg (a response or an event) to the client, setting its
+// sequence number. Remembers the first error.
+func (s *Server) write(msg any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return
+	}
+
+	s.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+
+	content, err := json.Marshal(msg)
+	if err != nil {
+		s.writeErr = err
+		return
+	}
+	s.writeErr = romutil.WriteBaseProtocolMessage(s.w, content)
+}
+
+// writeError returns the first error that happened while writing.
+func (s *Server) writeError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeErr
+}
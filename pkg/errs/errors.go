@@ -195,7 +195,8 @@ func (e *TestSuite) ExitCode() int {
 //
 
 // BadUsage is an error that happened because the romualdo tool was called in
-// the wrong way (like incorrect command-line arguments).
+// the wrong way (like incorrect command-line arguments). Also used when some API
+// (like the VM's) is used in the wrong way.
 type BadUsage struct {
 	// Message contains a message explaining what happened.
 	Message string
@@ -218,6 +219,55 @@ func (e *BadUsage) ExitCode() int {
 	return StatusCodeBadUsage
 }
 
+//
+// GlobalAccess
+//
+
+// GlobalAccessReason tells why a GlobalAccess error happened.
+type GlobalAccessReason int
+
+const (
+	// GlobalAccessUnknown means that there is no global variable with the
+	// requested name.
+	GlobalAccessUnknown GlobalAccessReason = iota
+
+	// GlobalAccessTypeMismatch means that the value given to a global variable
+	// doesn't match its declared type.
+	GlobalAccessTypeMismatch
+)
+
+// GlobalAccess is an error that happened because the Driver Program tried to
+// access a global variable of a Storyworld in an invalid way.
+type GlobalAccess struct {
+	// FQN is the fully-qualified name of the global variable.
+	FQN string
+
+	// Reason tells why the access was invalid.
+	Reason GlobalAccessReason
+
+	// Message contains a message explaining what happened.
+	Message string
+}
+
+// NewGlobalAccess is a handy way to create a GlobalAccess error.
+func NewGlobalAccess(fqn string, reason GlobalAccessReason, format string, a ...any) *GlobalAccess {
+	return &GlobalAccess{
+		FQN:     fqn,
+		Reason:  reason,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// Error converts the GlobalAccess to a string. Fulfills the error interface.
+func (e *GlobalAccess) Error() string {
+	return "Usage error: " + e.Message
+}
+
+// ExitCode fulfills the Error interface.
+func (e *GlobalAccess) ExitCode() int {
+	return StatusCodeBadUsage
+}
+
 //
 // Runtime
 //
@@ -228,6 +278,23 @@ func (e *BadUsage) ExitCode() int {
 type Runtime struct {
 	// Message contains a message explaining what happened.
 	Message string
+
+	// StackTrace contains the call stack at the moment of the error, from the
+	// innermost to the outermost call.
+	StackTrace []StackFrame
+}
+
+// StackFrame describes one entry of the call stack of a running Storyworld.
+type StackFrame struct {
+	// Procedure is the fully-qualified name of the Procedure running.
+	Procedure string
+
+	// SourceFile is the file where the Procedure is defined. Empty if not
+	// known (e.g., if no debug information is available).
+	SourceFile string
+
+	// Line is the line being executed. Zero if not known.
+	Line int
 }
 
 // NewRuntime is a handy way to create a Runtime error.
@@ -237,9 +304,16 @@ func NewRuntime(format string, a ...any) *Runtime {
 	}
 }
 
-// Error converts the Runtime to a string. Fulfills the error interface.
+// Error converts the Runtime to a string, including the stack trace. Fulfills
+// the error interface.
 func (e *Runtime) Error() string {
-	return "Runtime error: " + e.Message
+	s := strings.Builder{}
+	s.WriteString("Runtime error: " + e.Message)
+	for _, frame := range e.StackTrace {
+		s.WriteByte('\n')
+		s.WriteString(frame.String())
+	}
+	return s.String()
 }
 
 // ExitCode fulfills the Error interface.
@@ -247,6 +321,14 @@ func (e *Runtime) ExitCode() int {
 	return statusCodeRuntimeError
 }
 
+// String converts the StackFrame to a string.
+func (f StackFrame) String() string {
+	if f.Line <= 0 {
+		return fmt.Sprintf("[unknown line] in %v", f.Procedure)
+	}
+	return fmt.Sprintf("[%v:%v] in %v", f.SourceFile, f.Line, f.Procedure)
+}
+
 //
 // ICE
 //
@@ -0,0 +1,12 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The explore package explores the Stories a Storyworld can tell, trying every
+// input from a dictionary at every `listen`, looking for runtime errors, soft
+// errors, Stories that end without reaching a proper ending, and Lectures that
+// are never reached. It's the machinery behind the `explore` command.
+package explore
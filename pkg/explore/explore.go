@@ -0,0 +1,499 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package explore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// Options configures an exploration.
+type Options struct {
+	// Inputs is the input dictionary. If nil, DefaultInputs() is used.
+	Inputs *Inputs
+
+	// MaxDepth is the maximum number of choices made on any path. Paths
+	// reaching it are cut short. Zero means no limit.
+	MaxDepth int
+
+	// MaxStates is the maximum number of distinct states explored. Paths
+	// reaching new states after that are cut short. Zero means no limit.
+	MaxStates int
+
+	// DepthFirst makes the search depth-first. Otherwise, it is
+	// breadth-first, which reports problems with the shortest paths that
+	// trigger them.
+	DepthFirst bool
+
+	// Workers is the number of states explored in parallel. Zero means one
+	// per CPU.
+	Workers int
+
+	// InstructionBudget is the maximum number of instructions the Storyworld
+	// can run between two choices. Paths running out of it are reported (it
+	// usually means the Story is stuck in a loop). Zero means no limit.
+	InstructionBudget int
+
+	// EndingEvent is the name of the Event the Storyworld emits to mark a
+	// proper ending. Stories that end without emitting it are reported as dead
+	// ends. If empty, every end is considered proper.
+	EndingEvent string
+
+	// Externals maps the fully-qualified names of the external functions
+	// declared in the Storyworld to the values they shall return.
+	Externals map[string]any
+}
+
+// node is a state of the Story to explore: the Story waiting for input, or
+// (for the root node) not started yet.
+type node struct {
+	// path contains the inputs that led to this state from the start.
+	path []string
+
+	// options are the options the Story is listening with.
+	options string
+
+	// state is the VM saved state. Nil for the root node.
+	state []byte
+
+	// profile is the saved Profile. Nil for the root node.
+	profile []byte
+
+	// ended tells if the ending Event was emitted along path.
+	ended bool
+
+	// key identifies the state, for telling if it was already explored.
+	key [sha256.Size]byte
+}
+
+// expansion is the result of exploring a node.
+type expansion struct {
+	// children contains the states reached, in the order of the inputs that
+	// led to them.
+	children []*node
+
+	// findings contains the problems found.
+	findings []Finding
+
+	// choices is the number of choices tried.
+	choices int
+
+	// endings is the number of proper endings reached.
+	endings int
+
+	// cutShort is the number of paths cut short by MaxDepth.
+	cutShort int
+}
+
+// explorer holds what is shared by all workers of an exploration.
+type explorer struct {
+	csw    *bytecode.CompiledStoryworld
+	di     *bytecode.DebugInfo
+	opts   Options
+	report *Report
+
+	// visited contains the keys of all states already explored (or queued
+	// for exploration).
+	visited map[[sha256.Size]byte]bool
+}
+
+// Explore explores the Stories csw can tell, as configured by opts. di is
+// optional, but without it Lectures never reached are not reported, and
+// problems are reported without source code locations.
+//
+// Every distinct state is explored only once, no matter how many paths lead
+// to it. So, Stories that loop back to where they were don't keep the
+// exploration going forever.
+//
+// The returned error is about the exploration itself going wrong; problems
+// found in the Storyworld are in the Report.
+func Explore(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, opts Options) (*Report, errs.Error) {
+	if opts.Inputs == nil {
+		opts.Inputs = DefaultInputs(csw)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+
+	ex := &explorer{
+		csw:     csw,
+		di:      di,
+		opts:    opts,
+		report:  &Report{States: 1},
+		visited: map[[sha256.Size]byte]bool{},
+	}
+	workers := make([]*worker, opts.Workers)
+	for i := range workers {
+		workers[i] = &worker{ex: ex}
+		if di != nil {
+			workers[i].cov = vm.NewCoverage(csw)
+		}
+	}
+
+	var err errs.Error
+	if opts.DepthFirst {
+		err = ex.depthFirst(workers)
+	} else {
+		err = ex.breadthFirst(workers)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if di != nil {
+		ex.report.Coverage = coverage.NewData()
+		for _, w := range workers {
+			err = ex.report.Coverage.Add(csw, di, w.cov, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	ex.report.sortFindings()
+	return ex.report, nil
+}
+
+// breadthFirst runs a breadth-first search, one level at a time. The states
+// of each level are explored in parallel, but what is found is taken into
+// account in a fixed order, so that the result doesn't depend on which worker
+// finishes first.
+func (ex *explorer) breadthFirst(workers []*worker) errs.Error {
+	level := []*node{{}}
+	for len(level) > 0 {
+		expansions := make([]expansion, len(level))
+		failures := make([]errs.Error, len(workers))
+		next := make(chan int)
+		wg := sync.WaitGroup{}
+		for i, w := range workers {
+			wg.Add(1)
+			go func(i int, w *worker) {
+				defer wg.Done()
+				for j := range next {
+					if failures[i] != nil {
+						continue
+					}
+					expansions[j], failures[i] = w.expand(level[j])
+				}
+			}(i, w)
+		}
+		for j := range level {
+			next <- j
+		}
+		close(next)
+		wg.Wait()
+
+		for _, err := range failures {
+			if err != nil {
+				return err
+			}
+		}
+		level = nil
+		for _, e := range expansions {
+			level = append(level, ex.take(e)...)
+		}
+	}
+	return nil
+}
+
+// depthFirst runs a depth-first search, with all workers taking states from a
+// shared stack. States reachable through several paths are explored through
+// whichever path gets to them first, so with several workers the paths
+// reported may change from one exploration to the next.
+func (ex *explorer) depthFirst(workers []*worker) errs.Error {
+	mu := sync.Mutex{}
+	cond := sync.NewCond(&mu)
+	stack := []*node{{}}
+	busy := 0
+	var firstErr errs.Error
+
+	wg := sync.WaitGroup{}
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			for {
+				for len(stack) == 0 && busy > 0 && firstErr == nil {
+					cond.Wait()
+				}
+				if len(stack) == 0 || firstErr != nil {
+					cond.Broadcast()
+					return
+				}
+				n := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				busy++
+				mu.Unlock()
+
+				e, err := w.expand(n)
+
+				mu.Lock()
+				busy--
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					// Push in reverse order, so that the first input is the
+					// first one explored.
+					children := ex.take(e)
+					for i := len(children) - 1; i >= 0; i-- {
+						stack = append(stack, children[i])
+					}
+				}
+				cond.Broadcast()
+			}
+		}(w)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// take takes an expansion into account, and returns the children that lead to
+// states not explored yet. Not safe for concurrent use.
+func (ex *explorer) take(e expansion) []*node {
+	r := ex.report
+	r.Choices += e.choices
+	r.Endings += e.endings
+	r.CutShort += e.cutShort
+	r.Findings = append(r.Findings, e.findings...)
+
+	var children []*node
+	for _, child := range e.children {
+		if ex.visited[child.key] {
+			continue
+		}
+		if ex.opts.MaxStates > 0 && r.States >= ex.opts.MaxStates {
+			r.CutShort++
+			continue
+		}
+		ex.visited[child.key] = true
+		r.States++
+		children = append(children, child)
+	}
+	return children
+}
+
+// worker explores states. Each worker explores one state at a time, but
+// several workers can run in parallel.
+type worker struct {
+	ex *explorer
+
+	// cov is the coverage of everything this worker ran. Nil if there is no
+	// DebugInfo.
+	cov *vm.Coverage
+
+	// softErrors contains the soft errors reported since the last choice.
+	softErrors []vm.SoftError
+}
+
+// expand explores a node, trying every input from the dictionary on it (or
+// just starting the Story, for the root node).
+func (w *worker) expand(n *node) (expansion, errs.Error) {
+	e := expansion{}
+	if n.state == nil {
+		theVM, err := w.newVM(nil)
+		if err != nil {
+			return e, err
+		}
+		out, err := theVM.Start(context.Background())
+		return e, w.settle(&e, theVM, n, nil, out, err)
+	}
+
+	for _, input := range w.ex.opts.Inputs.For(n.options) {
+		theVM, err := w.newVM(n.profile)
+		if err != nil {
+			return e, err
+		}
+		_, err = theVM.LoadState(context.Background(), bytes.NewReader(n.state))
+		if err != nil {
+			return e, errs.NewICE("loading explored state: %v", err)
+		}
+		path := append(append([]string{}, n.path...), input)
+		out, err := theVM.Step(context.Background(), input)
+		err = w.settle(&e, theVM, n, path, out, err)
+		if err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// settle takes note of what happened after the Story reached by path (from
+// parent) stopped running, adding it to e.
+func (w *worker) settle(e *expansion, theVM *vm.VM, parent *node, path []string, out vm.Output,
+	err errs.Error) errs.Error {
+
+	opts := &w.ex.opts
+	if path != nil {
+		e.choices++
+	}
+	for _, se := range w.softErrors {
+		e.findings = append(e.findings, Finding{Kind: FindingSoftError, Path: path, Message: se.String()})
+	}
+	w.softErrors = nil
+
+	if err != nil {
+		e.findings = append(e.findings, Finding{Kind: FindingRuntimeError, Path: path, Message: errorMessage(err)})
+		return nil
+	}
+
+	ended := parent.ended
+	for _, event := range out.Events {
+		if opts.EndingEvent != "" && event.Name == opts.EndingEvent {
+			ended = true
+		}
+	}
+
+	switch out.State {
+	case vm.StateEndOfStory:
+		if opts.EndingEvent == "" || ended {
+			e.endings++
+			return nil
+		}
+		msg := fmt.Sprintf("the Story ended without emitting %q", opts.EndingEvent)
+		if last := lastLine(out.Text); last != "" {
+			msg += fmt.Sprintf(", right after saying %q", last)
+		}
+		e.findings = append(e.findings, Finding{Kind: FindingDeadEnd, Path: path, Message: msg})
+
+	case vm.StateInterrupted:
+		if out.Interrupt != vm.InterruptBudget {
+			return errs.NewICE("unexpected interruption while exploring: %v", out.Interrupt)
+		}
+		e.findings = append(e.findings, Finding{
+			Kind: FindingBudgetExceeded,
+			Path: path,
+			Message: fmt.Sprintf("ran %v instructions without listening to the Player or ending",
+				opts.InstructionBudget),
+		})
+
+	case vm.StateWaitingForInput:
+		if opts.MaxDepth > 0 && len(path) >= opts.MaxDepth {
+			e.cutShort++
+			return nil
+		}
+		child, err := w.newNode(theVM, path, ended)
+		if err != nil {
+			return err
+		}
+		e.children = append(e.children, child)
+
+	default:
+		return errs.NewICE("unexpected VM state after running: %v", out.State)
+	}
+	return nil
+}
+
+// newVM creates a VM ready to explore the Storyworld, using the given saved
+// Profile (or a new one, if nil).
+func (w *worker) newVM(profile []byte) (*vm.VM, errs.Error) {
+	ex := w.ex
+	theVM := vm.New(ex.csw, ex.di)
+	theVM.InstructionBudget = ex.opts.InstructionBudget
+	theVM.Coverage = w.cov
+	theVM.SoftErrorSink = func(e vm.SoftError) {
+		w.softErrors = append(w.softErrors, e)
+	}
+	if err := theVM.BindConstantExternals(ex.opts.Externals); err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		var err errs.Error
+		theVM.Profile, err = vm.LoadProfile(bytes.NewReader(profile))
+		if err != nil {
+			return nil, errs.NewICE("loading explored Profile: %v", err)
+		}
+	}
+	return theVM, nil
+}
+
+// newNode creates a node with the state of theVM, which was reached by path.
+func (w *worker) newNode(theVM *vm.VM, path []string, ended bool) (*node, errs.Error) {
+	buf := &bytes.Buffer{}
+	err := theVM.SaveState(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata changes every time (it has a timestamp) and doesn't affect
+	// what happens next, so leave it out.
+	ss, err := vm.DecodeSavedState(buf, vm.SavedStateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ss.Metadata = &vm.SaveMetadata{}
+	buf.Reset()
+	err = ss.Encode(buf, vm.SavedStateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	n := &node{
+		path:    path,
+		options: theVM.Options,
+		state:   buf.Bytes(),
+		ended:   ended,
+	}
+
+	profile := &bytes.Buffer{}
+	err = theVM.Profile.Save(profile)
+	if err != nil {
+		return nil, err
+	}
+	n.profile = profile.Bytes()
+
+	// The seen-flags of Lectures are in the Profile, too, but they make no
+	// difference to the Story. Only the profile variables do.
+	h := sha256.New()
+	h.Write(n.state)
+	hashProfileVars(h, theVM)
+	fmt.Fprintf(h, "%v", ended)
+	copy(n.key[:], h.Sum(nil))
+	return n, nil
+}
+
+// hashProfileVars writes the values of the profile variables of theVM to h.
+func hashProfileVars(h hash.Hash, theVM *vm.VM) {
+	for _, g := range theVM.Globals() {
+		if !g.Profile {
+			continue
+		}
+		value, _ := theVM.Global(g.FQN)
+		fmt.Fprintf(h, "%v=%#v\n", g.FQN, value)
+	}
+}
+
+// errorMessage returns a single-line message describing err. For runtime
+// errors, only the innermost stack frame is included.
+func errorMessage(err errs.Error) string {
+	if rtErr, ok := err.(*errs.Runtime); ok {
+		if len(rtErr.StackTrace) == 0 {
+			return "Runtime error: " + rtErr.Message
+		}
+		return fmt.Sprintf("Runtime error: %v %v", rtErr.Message, rtErr.StackTrace[0])
+	}
+	return strings.ReplaceAll(err.Error(), "\n", " ")
+}
+
+// lastLine returns the last non-blank line of text, trimmed.
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,96 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package explore
+
+import (
+	"os"
+	"sort"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// Inputs is the input dictionary: the inputs tried whenever the Story listens
+// to the Player. It mirrors the input dictionary TOML file format.
+type Inputs struct {
+	// Default contains the inputs tried when the options the Story is
+	// listening with are not in Options.
+	Default []string `toml:"default"`
+
+	// Options maps the options the Story is listening with to the inputs to
+	// try for them.
+	Options map[string][]string `toml:"options"`
+}
+
+// LoadInputs loads an input dictionary from the TOML file at inputsPath.
+func LoadInputs(inputsPath string) (*Inputs, errs.Error) {
+	source, err := os.ReadFile(inputsPath)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("reading input dictionary %v: %v", inputsPath, err)
+	}
+
+	inputs := &Inputs{}
+	err = toml.Unmarshal(source, inputs)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("parsing input dictionary %v: %v", inputsPath, err)
+	}
+	return inputs, nil
+}
+
+// DefaultInputs returns the input dictionary used when none is given: every
+// string constant compared (with `==` or `!=`) to something in the latest
+// version of csw, plus an empty input standing for anything else. Stories
+// usually compare the Player choices with string literals, so this tends to
+// cover all choices a Story actually handles (plus a few it doesn't, which are
+// harmless).
+func DefaultInputs(csw *bytecode.CompiledStoryworld) *Inputs {
+	seen := map[string]bool{"": true}
+	inputs := &Inputs{Default: []string{""}}
+	for _, proc := range csw.Procedures {
+		if proc.External {
+			continue
+		}
+		code := csw.Chunks[proc.Chunk].Code
+
+		// The constants loaded by the two latest instructions, if strings.
+		var recent [2]*string
+		for ip := 0; ip < len(code); {
+			op := bytecode.OpCode(code[ip])
+			switch op {
+			case bytecode.OpEqual, bytecode.OpNotEqual:
+				for _, c := range recent {
+					if c != nil && !seen[*c] {
+						seen[*c] = true
+						inputs.Default = append(inputs.Default, *c)
+					}
+				}
+			}
+
+			var loaded *string
+			if op == bytecode.OpConstant {
+				if c := csw.Constants[bytecode.DecodeUInt31(code[ip+1:])]; c.IsString() {
+					str := c.AsString()
+					loaded = &str
+				}
+			}
+			recent[0], recent[1] = recent[1], loaded
+			ip += bytecode.InstructionSize(op)
+		}
+	}
+	sort.Strings(inputs.Default)
+	return inputs
+}
+
+// For returns the inputs to try when the Story listens with the given options.
+func (in *Inputs) For(options string) []string {
+	if inputs, ok := in.Options[options]; ok {
+		return inputs
+	}
+	return in.Default
+}
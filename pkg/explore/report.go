@@ -0,0 +1,206 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package explore
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/coverage"
+)
+
+// FindingKind is the kind of a problem found while exploring a Storyworld.
+type FindingKind int
+
+const (
+	// FindingRuntimeError is a runtime error.
+	FindingRuntimeError FindingKind = iota
+
+	// FindingSoftError is a soft error.
+	FindingSoftError
+
+	// FindingDeadEnd is a Story that ended without emitting the ending Event.
+	FindingDeadEnd
+
+	// FindingBudgetExceeded is a Story that ran out of its instruction budget
+	// before listening to the Player or ending. Usually, an infinite loop.
+	FindingBudgetExceeded
+)
+
+// String converts the FindingKind to a string, as used in report titles.
+func (kind FindingKind) String() string {
+	switch kind {
+	case FindingRuntimeError:
+		return "Runtime errors"
+	case FindingSoftError:
+		return "Soft errors"
+	case FindingDeadEnd:
+		return "Dead ends"
+	case FindingBudgetExceeded:
+		return "Instruction budget exceeded"
+	default:
+		return fmt.Sprintf("<Unknown FindingKind: %d>", int(kind))
+	}
+}
+
+// Finding is a problem found while exploring a Storyworld.
+type Finding struct {
+	// Kind is the kind of problem.
+	Kind FindingKind
+
+	// Path contains the inputs that trigger the problem, from the start of
+	// the Story.
+	Path []string
+
+	// Message describes the problem.
+	Message string
+}
+
+// String converts the Finding to a human-readable string.
+func (f *Finding) String() string {
+	return fmt.Sprintf("%v: %v", pathString(f.Path), f.Message)
+}
+
+// Report is the result of exploring a Storyworld.
+type Report struct {
+	// States is the number of distinct states explored, counting the start of
+	// the Story.
+	States int
+
+	// Choices is the number of choices tried.
+	Choices int
+
+	// Endings is the number of times the Story reached a proper ending.
+	Endings int
+
+	// CutShort is the number of paths not explored further because of the
+	// limits on depth and on the number of states.
+	CutShort int
+
+	// Findings contains the problems found. Problems with the same message are
+	// reported only once, with the shortest path that triggers them.
+	Findings []Finding
+
+	// Coverage is the coverage of the exploration, which tells which Lectures
+	// were never reached. Nil if there was no DebugInfo.
+	Coverage *coverage.Data
+}
+
+// UnreachedLectures returns the Lectures never reached, formatted like
+// "file:line: text". Returns nil if there is no coverage data.
+func (r *Report) UnreachedLectures() []string {
+	if r.Coverage == nil {
+		return nil
+	}
+	var lectures []string
+	for _, name := range r.Coverage.FileNames() {
+		for _, l := range r.Coverage.Files[name].Lectures {
+			if l.Hits == 0 {
+				lectures = append(lectures, fmt.Sprintf("%v:%v: %q", name, l.Line, l.Text))
+			}
+		}
+	}
+	return lectures
+}
+
+// WriteText writes a text report to w: a summary, followed by the problems
+// found and the Lectures never reached.
+func (r *Report) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "States explored:   %v\n", r.States)
+	fmt.Fprintf(b, "Choices tried:     %v\n", r.Choices)
+	fmt.Fprintf(b, "Endings reached:   %v\n", r.Endings)
+	fmt.Fprintf(b, "Paths cut short:   %v\n", r.CutShort)
+
+	for kind := FindingRuntimeError; kind <= FindingBudgetExceeded; kind++ {
+		var items []string
+		for _, f := range r.Findings {
+			if f.Kind == kind {
+				items = append(items, f.String())
+			}
+		}
+		writeList(b, kind.String(), items)
+	}
+
+	if r.Coverage == nil {
+		b.WriteString("\nLectures never reached: unknown (no debug information)\n")
+	} else {
+		writeList(b, "Lectures never reached", r.UnreachedLectures())
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortFindings sorts the findings by kind and path, keeping only the first of
+// the findings with the same kind and message. As paths are compared first by
+// length, the one kept is the shortest.
+func (r *Report) sortFindings() {
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		a, b := r.Findings[i], r.Findings[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return pathLess(a.Path, b.Path)
+	})
+
+	type key struct {
+		kind    FindingKind
+		message string
+	}
+	seen := map[key]bool{}
+	findings := []Finding{}
+	for _, f := range r.Findings {
+		k := key{f.Kind, f.Message}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		findings = append(findings, f)
+	}
+	r.Findings = findings
+}
+
+// pathLess tells if path a comes before path b: shorter paths first, and
+// lexicographic order among paths of the same length.
+func pathLess(a, b []string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// pathString converts a path to a human-readable string.
+func pathString(path []string) string {
+	if len(path) == 0 {
+		return "at the start"
+	}
+	quoted := make([]string, len(path))
+	for i, input := range path {
+		quoted[i] = fmt.Sprintf("%q", input)
+	}
+	return "after " + strings.Join(quoted, ", ")
+}
+
+// writeList writes a titled list of items to b, if there are any items.
+func writeList(b *strings.Builder, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n%v:\n", title)
+	for _, item := range items {
+		fmt.Fprintf(b, "    %v\n", item)
+	}
+}
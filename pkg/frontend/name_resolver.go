@@ -0,0 +1,196 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stackedboxes/romualdo/pkg/ast"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// nameResolver is a node visitor that resolves every Identifier in the
+// Storyworld to the symbol it refers to. It operates at the Storyworld level,
+// and assumes the semantic checker ran successfully before it (so that, for
+// example, there are no duplicate symbols).
+type nameResolver struct {
+	// errors collects the errors for all name resolution errors detected.
+	errors *errs.CompileTimeCollection
+
+	// nodeStack is used to keep track of the nodes being processed. The current
+	// one is on the top.
+	nodeStack []ast.Node
+
+	// symbols maps the fully-qualified name of every symbol declared in the
+	// Storyworld to the node declaring it (either a *ast.ProcedureDecl or a
+	// *ast.VarDecl).
+	symbols map[string]ast.Node
+
+	// imports maps each source file to its imports, which in turn map the
+	// import aliases to the absolute package paths.
+	imports map[string]map[string]string
+
+	// currentProc is the Procedure being currently resolved. Nil if outside of
+	// any Procedure (e.g., in a globals block).
+	currentProc *ast.ProcedureDecl
+}
+
+func NewNameResolver(sw *ast.Storyworld) *nameResolver {
+	nr := &nameResolver{
+		errors:  &errs.CompileTimeCollection{},
+		symbols: make(map[string]ast.Node),
+		imports: make(map[string]map[string]string),
+	}
+
+	for _, decl := range sw.Declarations {
+		switch n := decl.(type) {
+		case *ast.ProcedureDecl:
+			nr.symbols[n.FQN()] = n
+		case *ast.GlobalsBlock:
+			for _, v := range n.Vars {
+				nr.symbols[v.FQN()] = v
+			}
+		case *ast.Import:
+			fileImports, ok := nr.imports[n.SrcFile]
+			if !ok {
+				fileImports = make(map[string]string)
+				nr.imports[n.SrcFile] = fileImports
+			}
+			fileImports[n.Alias] = n.Package
+		}
+	}
+
+	return nr
+}
+
+// The Visitor interface
+func (nr *nameResolver) Enter(node ast.Node) {
+	nr.nodeStack = append(nr.nodeStack, node)
+
+	switch n := node.(type) {
+	case *ast.ProcedureDecl:
+		nr.currentProc = n
+	case *ast.Identifier:
+		nr.resolve(n)
+	case *ast.Assignment:
+		nr.resolve(n.Target)
+	}
+}
+
+func (nr *nameResolver) Leave(node ast.Node) {
+	nr.nodeStack = nr.nodeStack[:len(nr.nodeStack)-1]
+
+	if _, ok := node.(*ast.ProcedureDecl); ok {
+		nr.currentProc = nil
+	}
+}
+
+func (nr *nameResolver) Event(node ast.Node, event ast.EventType) {
+	// Nothing
+}
+
+//
+// Name resolution
+//
+
+// resolve resolves the Identifier id, filling its fields that point to the
+// symbol it refers to.
+func (nr *nameResolver) resolve(id *ast.Identifier) {
+	if id.Qualifier != "" {
+		nr.resolveQualified(id)
+		return
+	}
+
+	// Parameters shadow everything else.
+	if nr.currentProc != nil {
+		for i := range nr.currentProc.Parameters {
+			if nr.currentProc.Parameters[i].Name == id.Name {
+				id.Param = &nr.currentProc.Parameters[i]
+				id.ParamIndex = i
+				return
+			}
+		}
+	}
+
+	// Then, symbols from the same package.
+	pkg := nr.currentPackage(id)
+	if nr.bindSymbol(id, ast.FQN(pkg, id.Name)) {
+		return
+	}
+
+	nr.errorAt(id, "Undefined name `%v`.", id.Name)
+}
+
+// resolveQualified resolves id, which is known to be qualified by an import
+// alias.
+func (nr *nameResolver) resolveQualified(id *ast.Identifier) {
+	pkg, ok := nr.imports[id.SrcFile][id.Qualifier]
+	if !ok && id.Qualifier == "std" {
+		pkg, ok = StdPackage, true
+	}
+	if !ok {
+		nr.errorAt(id, "Unknown package alias `%v`.", id.Qualifier)
+		return
+	}
+
+	if !nr.bindSymbol(id, ast.FQN(pkg, id.Name)) {
+		nr.errorAt(id, "Package `%v` has no symbol named `%v`.", pkg, id.Name)
+		return
+	}
+
+	if pkg != nr.currentPackage(id) && !isExported(id.Name) {
+		nr.errorAt(id, "`%v` is not exported by package `%v`.", id.Name, pkg)
+	}
+}
+
+// bindSymbol binds id to the symbol named fqn. Returns false if there is no such
+// symbol.
+func (nr *nameResolver) bindSymbol(id *ast.Identifier, fqn string) bool {
+	switch n := nr.symbols[fqn].(type) {
+	case *ast.ProcedureDecl:
+		id.Procedure = n
+		return true
+	case *ast.VarDecl:
+		id.Global = n
+		return true
+	default:
+		return false
+	}
+}
+
+// currentPackage returns the package id is being resolved from.
+func (nr *nameResolver) currentPackage(id *ast.Identifier) string {
+	if nr.currentProc != nil {
+		return nr.currentProc.Package
+	}
+
+	// Outside of procedures, the package is the one of the enclosing global.
+	for i := len(nr.nodeStack) - 1; i >= 0; i-- {
+		if v, ok := nr.nodeStack[i].(*ast.VarDecl); ok {
+			return v.Package
+		}
+	}
+	return "/"
+}
+
+// isExported checks if a symbol called name is exported by its package, that
+// is, if its name starts with an uppercase letter.
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+//
+// Error reporting
+//
+
+// errorAt reports an error at a given node.
+func (nr *nameResolver) errorAt(node ast.Node, format string, a ...interface{}) {
+	nr.errors.Add(errs.NewCompileTime(node.SourceFile(), node.Line(), format, a...))
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 
 	"github.com/stackedboxes/romualdo/pkg/ast"
 	"github.com/stackedboxes/romualdo/pkg/errs"
@@ -20,7 +21,9 @@ import (
 
 // ParseStoryworld parses the Storyworld at a given directory swRoot. It
 // recursively looks for Romualdo source files (*.ral), parses each of them
-// concurrently, and places all declarations into an ast.Storyworld.
+// concurrently, and places all declarations into an ast.Storyworld. Then it
+// checks the whole Storyworld semantically, resolves names and type checks
+// it.
 func ParseStoryworld(swRoot string) (*ast.Storyworld, errs.Error) {
 	sourceFiles, err := findRomualdoSourceFiles(swRoot)
 	if err != nil {
@@ -40,13 +43,13 @@ func ParseStoryworld(swRoot string) (*ast.Storyworld, errs.Error) {
 		go parseFileAsync(sourceFile, swRoot, chFiles, chError)
 	}
 
-	sw := &ast.Storyworld{}
+	files := make([]*ast.SourceFile, 0, len(sourceFiles))
 	allErrors := &errs.CompileTimeCollection{}
 
 	for i := 0; i < len(sourceFiles); i++ {
 		select {
 		case sfNode := <-chFiles:
-			sw.Declarations = append(sw.Declarations, sfNode.Declarations...)
+			files = append(files, sfNode)
 		case err := <-chError:
 			compErrs := &errs.CompileTimeCollection{}
 			if errors.As(err, &compErrs) {
@@ -60,6 +63,72 @@ func ParseStoryworld(swRoot string) (*ast.Storyworld, errs.Error) {
 	if !allErrors.IsEmpty() {
 		return nil, allErrors
 	}
+
+	sw, ctErr := CheckStoryworld(swRoot, files)
+	if ctErr != nil {
+		return nil, ctErr
+	}
+	return sw, nil
+}
+
+// CheckStoryworld places the declarations from all the given source files of
+// the Storyworld at swRoot (plus the standard library) into an ast.Storyworld.
+// Then it checks the whole Storyworld semantically, resolves names and type
+// checks it.
+//
+// If errors are found, the Storyworld is returned along with them, checked as
+// far as the checks went. Tools like the language server use this to offer
+// something even for Storyworlds with errors; everybody else should ignore the
+// Storyworld in this case.
+func CheckStoryworld(swRoot string, files []*ast.SourceFile) (*ast.Storyworld, errs.Error) {
+	sw := &ast.Storyworld{}
+	allErrors := &errs.CompileTimeCollection{}
+	for _, sfNode := range files {
+		if isStdSourceFile(sfNode.SourceFile()) {
+			allErrors.Add(errs.NewCompileTimeWithoutLine(sfNode.SourceFile(),
+				"The `std` Package is reserved for the standard library."))
+			continue
+		}
+		sw.Declarations = append(sw.Declarations, sfNode.Declarations...)
+	}
+	if !allErrors.IsEmpty() {
+		return sw, allErrors
+	}
+
+	// The standard library is part of every Storyworld.
+	stdNode, stdErr := parseStd()
+	if stdErr != nil {
+		return nil, stdErr
+	}
+	sw.Declarations = append(sw.Declarations, stdNode.Declarations...)
+
+	// Files were parsed concurrently, so declarations are in some random
+	// order. Sort them so that everything downstream is deterministic.
+	sort.SliceStable(sw.Declarations, func(i, j int) bool {
+		return sw.Declarations[i].SourceFile() < sw.Declarations[j].SourceFile()
+	})
+
+	// Assorted semantic checks (but no type checks)
+	sc := NewSemanticChecker(swRoot, sw)
+	sw.Walk(sc)
+	if !sc.errors.IsEmpty() {
+		return sw, sc.errors
+	}
+
+	// Name resolution
+	nr := NewNameResolver(sw)
+	sw.Walk(nr)
+	if !nr.errors.IsEmpty() {
+		return sw, nr.errors
+	}
+
+	// Type checking
+	tc := NewTypeChecker()
+	sw.Walk(tc)
+	if !tc.errors.IsEmpty() {
+		return sw, tc.errors
+	}
+
 	return sw, nil
 }
 
@@ -76,9 +145,12 @@ func findRomualdoSourceFiles(swRoot string) ([]string, error) {
 	return files, err
 }
 
-// parseFile parses the Romualdo source file located at fileName and returns its
+// ParseFile parses the Romualdo source file located at fileName and returns its
 // corresponding AST. swRoot is the path to the root of the Storyworld, and is
 // used to compute the file name relative to the Storyworld root.
+//
+// This only checks the syntax. Semantic and type checks need the whole
+// Storyworld, so they are done by ParseStoryworld.
 func ParseFile(fileName, swRoot string) (*ast.SourceFile, errs.Error) {
 	source, err := os.ReadFile(fileName)
 	if err != nil {
@@ -93,28 +165,24 @@ func ParseFile(fileName, swRoot string) (*ast.SourceFile, errs.Error) {
 	}
 	fileNameFromSWRoot = filepath.Clean(fileNameFromSWRoot)
 
-	p := newParser(fileNameFromSWRoot, string(source))
+	sfNode, _, ctErr := ParseSource(fileNameFromSWRoot, string(source))
+	return sfNode, ctErr
+}
+
+// ParseSource parses the Romualdo source code in source, as if it came from a
+// file called fileName (relative to the Storyworld root). Besides the AST, it
+// returns all tokens scanned, which tools like the language server use to tell
+// what is where in the source code. If there are syntax errors, the tokens are
+// returned anyway, up to where the parser gave up.
+//
+// Like ParseFile, this only checks the syntax.
+func ParseSource(fileName, source string) (*ast.SourceFile, []*Token, errs.Error) {
+	p := newParser(fileName, source)
 	sfNode, err := p.parse()
 	if err != nil {
-		ctErr := errs.NewCompileTimeWithoutLine(fileNameFromSWRoot, err.Error())
-		return nil, ctErr
+		return nil, p.tokens, p.errors
 	}
-
-	// Assorted semantic checks (but no type checks)
-	sc := NewSemanticChecker(fileName)
-	sfNode.Walk(sc)
-	if !sc.errors.IsEmpty() {
-		return nil, sc.errors
-	}
-
-	// Type checking
-	tc := NewTypeChecker(fileName)
-	sfNode.Walk(tc)
-	if !tc.errors.IsEmpty() {
-		return nil, tc.errors
-	}
-
-	return sfNode, nil
+	return sfNode, p.tokens, nil
 }
 
 // parseFileAsync is a way to call ParseFile with everything wired up for being
@@ -9,7 +9,10 @@ package frontend
 
 import (
 	"fmt"
+	"path"
 	"path/filepath"
+	"strings"
+	"unicode"
 
 	"github.com/stackedboxes/romualdo/pkg/ast"
 	"github.com/stackedboxes/romualdo/pkg/errs"
@@ -78,6 +81,10 @@ type parser struct {
 
 	// scanner is the Scanner from where we get our tokens.
 	scanner *Scanner
+
+	// tokens contains all tokens scanned so far, except for error tokens. Not
+	// used by the parser itself, but handy for tools like the language server.
+	tokens []*Token
 }
 
 // newParser returns a new parser that will parse source. fileName must be
@@ -93,10 +100,23 @@ func newParser(fileName, source string) *parser {
 
 // parse parses p.scanner.source and returns the root of the resulting AST.
 func (p *parser) parse() (*ast.SourceFile, error) {
-	sf := &ast.SourceFile{}
+	sf := &ast.SourceFile{
+		BaseNode: ast.BaseNode{
+			SrcFile: p.fileName,
+		},
+	}
 
 	p.advance()
 
+	for p.match(TokenKindImport) {
+		imp := p.importDecl()
+		if p.hadError() {
+			return nil, p.errors
+		}
+
+		sf.Declarations = append(sf.Declarations, imp)
+	}
+
 	for !p.match(TokenKindEOF) {
 		decl := p.declaration()
 		if p.hadError() {
@@ -128,18 +148,17 @@ func (p *parser) parsePrecedence(prec precedence) ast.Node {
 		node = infixRule(p, node, canAssign)
 	}
 
-	// TODO: Not dealing with assignments yet.
-	// if canAssign && p.match(TokenKindEqual) {
-	// 	p.error("Invalid assignment target.")
-	// }
+	if canAssign && p.match(TokenKindEqual) {
+		p.errorAtPrevious("Invalid assignment target.")
+	}
 
 	return node
 }
 
 // packagePath returns the package path of the file being parsed.
 func (p *parser) packagePath() string {
-	result := "/" + filepath.Dir(p.fileName)
-	return filepath.Clean(result)
+	result := "/" + filepath.ToSlash(filepath.Dir(p.fileName))
+	return path.Clean(result)
 }
 
 //
@@ -154,6 +173,7 @@ func (p *parser) advance() {
 	for {
 		p.currentToken = p.scanner.Token()
 		if p.currentToken.Kind != TokenKindError {
+			p.tokens = append(p.tokens, p.currentToken)
 			break
 		}
 
@@ -192,12 +212,95 @@ func (p *parser) consume(kind TokenKind, format string, a ...any) {
 // Parsing of grammar rules (things that return Nodes)
 //
 
+// importDecl parses an import declaration. The "import" token must have been
+// just consumed.
+func (p *parser) importDecl() *ast.Import {
+	imp := &ast.Import{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+	}
+
+	// Read the path, one segment at a time.
+	segments := []string{}
+	if p.match(TokenKindSlash) {
+		imp.Path = "/"
+	}
+	for {
+		if p.check(TokenKindDotDot) || p.check(TokenKindIdentifier) || isKeyword(p.currentToken.Kind) {
+			p.advance()
+		} else {
+			p.errorAtCurrent("Expected package path segment.")
+			return nil
+		}
+		segments = append(segments, p.previousToken.Lexeme)
+		if !p.check(TokenKindSlash) {
+			break
+		}
+		p.advance()
+
+		// A trailing slash is allowed, as in `import ../`.
+		if !p.check(TokenKindDotDot) && !p.check(TokenKindIdentifier) && !isKeyword(p.currentToken.Kind) {
+			break
+		}
+	}
+	imp.Path += strings.Join(segments, "/")
+
+	// Resolve the path into an absolute package path, making sure we don't go
+	// beyond the Root Package.
+	resolved := []string{}
+	if imp.Path[0] != '/' {
+		resolved = strings.Split(strings.TrimPrefix(p.packagePath(), "/"), "/")
+		if len(resolved) == 1 && resolved[0] == "" {
+			resolved = []string{}
+		}
+	}
+	for _, segment := range segments {
+		if segment != ".." {
+			resolved = append(resolved, segment)
+			continue
+		}
+		if len(resolved) == 0 {
+			p.errorAtPrevious("Import path `%v` goes beyond the Root Package.", imp.Path)
+			return nil
+		}
+		resolved = resolved[:len(resolved)-1]
+	}
+	if len(resolved) == 0 {
+		p.errorAtPrevious("The Root Package cannot be imported.")
+		return nil
+	}
+	imp.Package = "/" + strings.Join(resolved, "/")
+
+	imp.Alias = resolved[len(resolved)-1]
+	if p.match(TokenKindAs) {
+		p.consume(TokenKindIdentifier, "Expected an alias after `as`.")
+		imp.Alias = p.previousToken.Lexeme
+	} else if isKeyword(p.previousToken.Kind) {
+		p.errorAtPrevious("Package name `%v` is not a valid identifier; use `as` to give it an alias.", imp.Alias)
+	}
+
+	return imp
+}
+
 // Parses any kind of top-level declaration, like functions and passages.
 func (p *parser) declaration() ast.Node {
 	if p.match(TokenKindFunction) {
 		return p.functionDecl()
 	} else if p.match(TokenKindPassage) {
 		return p.passageDecl()
+	} else if p.match(TokenKindGlobals) {
+		return p.globalsBlock(false)
+	} else if p.match(TokenKindProfile) {
+		return p.globalsBlock(true)
+	} else if p.match(TokenKindMigrate) {
+		return p.migrateDecl()
+	} else if p.match(TokenKindExternal) {
+		return p.externalDecl()
+	} else if p.check(TokenKindImport) {
+		p.errorAtCurrent("Imports must come before any other declaration.")
+		return nil
 	} else {
 		p.errorAtCurrent("Expected a declaration.")
 		return nil
@@ -218,6 +321,7 @@ func (p *parser) functionDecl() *ast.ProcedureDecl {
 
 	p.consume(TokenKindIdentifier, "Expected the function name.")
 	proc.Name = p.previousToken.Lexeme
+	proc.NameOffset = p.previousToken.Start
 
 	p.consume(TokenKindLeftParen, "Expected '(' after the function name '%v'.", proc.Name)
 	proc.Parameters = p.parseParameterList()
@@ -230,6 +334,91 @@ func (p *parser) functionDecl() *ast.ProcedureDecl {
 	return proc
 }
 
+// externalDecl parses an external function declaration. The "external" token
+// must have been just consumed.
+func (p *parser) externalDecl() *ast.ProcedureDecl {
+	p.consume(TokenKindFunction, "Expected 'function' after 'external'.")
+
+	proc := &ast.ProcedureDecl{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+		Kind:    ast.ProcKindExternal,
+		Package: p.packagePath(),
+	}
+
+	p.consume(TokenKindIdentifier, "Expected the function name.")
+	proc.Name = p.previousToken.Lexeme
+	proc.NameOffset = p.previousToken.Start
+
+	p.consume(TokenKindLeftParen, "Expected '(' after the function name '%v'.", proc.Name)
+	proc.Parameters = p.parseParameterList()
+	p.consume(TokenKindColon, "Expected ':' after parameter list.")
+
+	// External functions are implemented by the Driver Program, so there is no
+	// body.
+	proc.ReturnType = p.parseType()
+
+	return proc
+}
+
+// globalsBlock parses a block of global variable declarations. The "globals"
+// (or, for profile variables, "profile") token must have been just consumed.
+func (p *parser) globalsBlock(profile bool) *ast.GlobalsBlock {
+	block := &ast.GlobalsBlock{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+		Profile: profile,
+	}
+	blockKind := "globals"
+	if profile {
+		blockKind = "profile"
+	}
+
+	for !p.check(TokenKindEnd) && !p.check(TokenKindEOF) {
+		p.consume(TokenKindIdentifier, "Expected a global variable name.")
+		varDecl := &ast.VarDecl{
+			BaseNode: ast.BaseNode{
+				SrcFile:    p.fileName,
+				LineNumber: p.previousToken.Line,
+			},
+			Package:    p.packagePath(),
+			Name:       p.previousToken.Lexeme,
+			NameOffset: p.previousToken.Start,
+			VarType:    ast.TypeInvalid,
+			Profile:    profile,
+		}
+
+		if p.match(TokenKindColon) {
+			varDecl.VarType = p.parseType()
+			if varDecl.VarType == ast.TypeVoid {
+				p.errorAtPrevious("Cannot use 'void' as a variable type.")
+			}
+		}
+
+		if p.match(TokenKindEqual) {
+			varDecl.Initializer = p.expression()
+		}
+
+		if varDecl.VarType == ast.TypeInvalid && varDecl.Initializer == nil {
+			p.errorAtPrevious("Global `%v` needs either a type or an initializer.", varDecl.Name)
+		}
+
+		block.Vars = append(block.Vars, varDecl)
+
+		if p.hadError() {
+			return nil
+		}
+	}
+
+	p.consume(TokenKindEnd, "Expected 'end' to close the %v block started at line %v.", blockKind, block.LineNumber)
+
+	return block
+}
+
 // passageDecl parses a passage declaration. The "passage" token must have been
 // just consumed.
 func (p *parser) passageDecl() *ast.ProcedureDecl {
@@ -244,6 +433,7 @@ func (p *parser) passageDecl() *ast.ProcedureDecl {
 
 	p.consume(TokenKindIdentifier, "Expected the passage name.")
 	proc.Name = p.previousToken.Lexeme
+	proc.NameOffset = p.previousToken.Start
 
 	p.consume(TokenKindLeftParen, "Expected '(' after the passage name '%v'.", proc.Name)
 	proc.Parameters = p.parseParameterList()
@@ -266,6 +456,33 @@ func (p *parser) passageDecl() *ast.ProcedureDecl {
 	return proc
 }
 
+// migrateDecl parses a migration declaration. The "migrate" token must have
+// been just consumed.
+func (p *parser) migrateDecl() *ast.ProcedureDecl {
+	proc := &ast.ProcedureDecl{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+		Kind:       ast.ProcKindMigration,
+		Package:    p.packagePath(),
+		NameOffset: p.previousToken.Start,
+		ReturnType: ast.TypeVoid,
+	}
+
+	p.consume(TokenKindStringLiteral, "Expected the release tag after 'migrate'.")
+	tag := p.previousToken.Lexeme[1 : len(p.previousToken.Lexeme)-1] // remove the quotes
+	if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		p.errorAtPrevious("Release tags must be non-empty and cannot contain spaces.")
+	}
+	proc.Release = tag
+	proc.Name = ast.MigrationName(tag)
+
+	proc.Body = p.block()
+
+	return proc
+}
+
 // ifStatement parses an if statement. The if keyword is expected to have just
 // been consumed.
 func (p *parser) ifStatement() ast.Node {
@@ -319,10 +536,81 @@ func (p *parser) ifStatement() ast.Node {
 	return n
 }
 
+// returnStatement parses a return statement. The return keyword is expected to
+// have been just consumed.
+func (p *parser) returnStatement() ast.Node {
+	n := &ast.Return{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+	}
+
+	// A return value is present unless we are right at the end of a block.
+	// Within Lectures we don't have expressions at all, so a backslashed
+	// return never has a value.
+	if p.check(TokenKindEnd) || p.check(TokenKindElse) || p.check(TokenKindElseif) ||
+		p.check(TokenKindEOF) || p.check(TokenKindLecture) || p.previousToken.IsBackslashed() {
+		return n
+	}
+
+	n.Value = p.expression()
+	return n
+}
+
+// emitStatement parses an emit statement. The "emit" token is expected to have
+// been just consumed.
+func (p *parser) emitStatement() ast.Node {
+	n := &ast.Emit{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+	}
+
+	n.Name = p.expression()
+
+	if !p.match(TokenKindLeftCurly) {
+		return n
+	}
+
+	for !p.check(TokenKindRightCurly) && !p.check(TokenKindEOF) {
+		var key *ast.StringLiteral
+		switch {
+		case p.match(TokenKindIdentifier):
+			key = &ast.StringLiteral{
+				BaseNode: ast.BaseNode{
+					SrcFile:    p.fileName,
+					LineNumber: p.previousToken.Line,
+				},
+				Value: p.previousToken.Lexeme,
+			}
+		case p.match(TokenKindStringLiteral):
+			key = p.stringLiteral(false).(*ast.StringLiteral)
+		default:
+			p.errorAtCurrent("Expected a key in the `emit` payload.")
+			return n
+		}
+
+		entry := ast.MapEntry{Key: key}
+
+		p.consume(TokenKindEqual, "Expected '=' after key `%v` in the `emit` payload.", key.Value)
+		entry.Value = p.expression()
+		n.Payload = append(n.Payload, entry)
+
+		if !p.match(TokenKindComma) {
+			break
+		}
+	}
+
+	p.consume(TokenKindRightCurly, "Expected `}` to close the `emit` payload started at line %v.", n.LineNumber)
+	return n
+}
+
 // listen parses a listen expression. The "listen" token is expected to have
 // been just consumed.
 func (p *parser) listen(canAssign bool) ast.Node {
-	options := p.parsePrecedence(precPrimary)
+	options := p.parsePrecedence(precCall)
 
 	return &ast.Listen{
 		BaseNode: ast.BaseNode{
@@ -399,6 +687,12 @@ func (p *parser) statement() ast.Node {
 	case p.match(TokenKindIf):
 		return p.ifStatement()
 
+	case p.match(TokenKindReturn):
+		return p.returnStatement()
+
+	case p.match(TokenKindEmit):
+		return p.emitStatement()
+
 	case p.check(TokenKindSay):
 		// Notice the use of check() instead of match() above to avoid
 		// prematurely consuming the next token. That's because a "say" token
@@ -481,6 +775,67 @@ func (p *parser) stringLiteral(canAssign bool) ast.Node {
 	}
 }
 
+// identifier parses an identifier, possibly qualified by an import alias (as in
+// `alias.Name`). The identifier token is expected to have been just consumed.
+func (p *parser) identifier(canAssign bool) ast.Node {
+	id := &ast.Identifier{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+		Name:   p.previousToken.Lexeme,
+		Offset: p.previousToken.Start,
+	}
+
+	if p.match(TokenKindDot) {
+		p.consume(TokenKindIdentifier, "Expected a name after '.'.")
+		id.Qualifier = id.Name
+		id.Name = p.previousToken.Lexeme
+		id.Offset = p.previousToken.Start
+	}
+
+	if canAssign && p.match(TokenKindEqual) {
+		return &ast.Assignment{
+			BaseNode: ast.BaseNode{
+				SrcFile:    p.fileName,
+				LineNumber: p.previousToken.Line,
+			},
+			Target: id,
+			Value:  p.expression(),
+		}
+	}
+
+	return id
+}
+
+// call parses a procedure call. The callee and the opening parenthesis are
+// expected to have been just consumed.
+func (p *parser) call(lhs ast.Node, canAssign bool) ast.Node {
+	call := &ast.Call{
+		BaseNode: ast.BaseNode{
+			SrcFile:    p.fileName,
+			LineNumber: p.previousToken.Line,
+		},
+		Callee: lhs,
+		Args:   []ast.Node{},
+	}
+
+	if p.match(TokenKindRightParen) {
+		return call
+	}
+
+	for {
+		call.Args = append(call.Args, p.expression())
+		if !p.match(TokenKindComma) {
+			break
+		}
+	}
+
+	p.consume(TokenKindRightParen, "Expected ',' or ')' after call argument.")
+
+	return call
+}
+
 // binary parses a binary operator expression. The left operand and the operator
 // token are expected to have been just consumed.
 func (p *parser) binary(lhs ast.Node, canAssign bool) ast.Node {
@@ -543,6 +898,11 @@ func (p *parser) parseTypeNoConsume() ast.TypeTag {
 	}
 }
 
+// isKeyword checks if kind is the kind of a keyword token.
+func isKeyword(kind TokenKind) bool {
+	return kind >= TokenKindAs && kind <= TokenKindVoid
+}
+
 // parseParameterList parses a list of parameters. The left parenthesis is
 // supposed to have just been consumed.
 func (p *parser) parseParameterList() []ast.Parameter {
@@ -640,11 +1000,12 @@ func initRules() {
 
 	//                                     prefix                                      infix                          precedence
 	//                                    ---------------------------------------     --------------------------     --------------
-	rules[TokenKindLeftParen] = /*     */ parseRule{nil /*                        */, nil /*                     */, precCall}
+	rules[TokenKindLeftParen] = /*     */ parseRule{nil /*                        */, (*parser).call /*          */, precCall}
 	rules[TokenKindRightParen] = /*    */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindComma] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindColon] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindHat] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindSlash] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
 
 	rules[TokenKindEqual] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindEqualEqual] = /*    */ parseRule{nil /*                        */, (*parser).binary /*        */, precEquality}
@@ -653,23 +1014,33 @@ func initRules() {
 	rules[TokenKindGreater] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindLess] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindLessEqual] = /*     */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindDot] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindDotDot] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
 
-	rules[TokenKindIdentifier] = /*    */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindIdentifier] = /*    */ parseRule{(*parser).identifier /*       */, nil /*                     */, precNone}
 	rules[TokenKindLecture] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindStringLiteral] = /* */ parseRule{(*parser).stringLiteral /*    */, nil /*                     */, precNone}
 
+	rules[TokenKindAs] = /*            */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindBNum] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindBool] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindElse] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindElseif] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindEmit] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindEnd] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindExternal] = /*      */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindFalse] = /*         */ parseRule{(*parser).boolLiteral /*      */, nil /*                     */, precNone}
 	rules[TokenKindFloat] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindFunction] = /*      */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindGlobals] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindIf] = /*            */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindImport] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindInt] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindListen] = /*        */ parseRule{(*parser).listen /*           */, nil /*                     */, precNone}
+	rules[TokenKindMigrate] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindPassage] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindProfile] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[TokenKindReturn] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindSay] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindString] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[TokenKindThen] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
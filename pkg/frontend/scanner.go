@@ -72,6 +72,11 @@ type Scanner struct {
 	// startNewSpacePrefix is set to true to tell the scanner that we are at a
 	// point in which we shall start a new space prefix.
 	startNewSpacePrefix bool
+
+	// codeCurlyDepth is the number of curly braces opened in code mode (as in
+	// the payload of an `emit` statement) and not closed yet. A `}` only puts
+	// us back into lecture mode if this is zero.
+	codeCurlyDepth int
 }
 
 //
@@ -155,7 +160,16 @@ func (s *Scanner) codeModeToken() *Token {
 		return s.makeToken(TokenKindLeftSquare)
 	case ']':
 		return s.makeToken(TokenKindRightSquare)
+	case '{':
+		s.codeCurlyDepth++
+		return s.makeToken(TokenKindLeftCurly)
 	case '}':
+		if s.codeCurlyDepth > 0 {
+			// This closes a curly brace opened in code mode, so we stay in
+			// code mode.
+			s.codeCurlyDepth--
+			return s.makeToken(TokenKindRightCurly)
+		}
 		// This puts us back into Lecture mode.
 		s.SetMode(ScannerModeLecture)
 		return s.makeToken(TokenKindRightCurly)
@@ -165,6 +179,14 @@ func (s *Scanner) codeModeToken() *Token {
 		return s.makeToken(TokenKindComma)
 	case '^':
 		return s.makeToken(TokenKindHat)
+	case '/':
+		return s.makeToken(TokenKindSlash)
+	case '.':
+		if s.match('.') {
+			s.tokenLexeme += "."
+			return s.makeToken(TokenKindDotDot)
+		}
+		return s.makeToken(TokenKindDot)
 	case '!':
 		if s.match('=') {
 			s.tokenLexeme += "="
@@ -335,8 +357,8 @@ func (s *Scanner) lectureModeToken(newSpacePrefix bool) *Token {
 					// just read, and set everything up so that the `end` token
 					// is returned next.
 					s.tokenLexeme = s.tokenLexeme[0:len(s.tokenLexeme)]
-					tok := s.makeToken(TokenKindLecture)
 					s.current -= 1 // the `e` of `end` was consumed; undo that
+					tok := s.makeToken(TokenKindLecture)
 					s.SetMode(ScannerModeCode)
 					s.spacePrefixPop()
 					return tok
@@ -589,6 +611,8 @@ func (s *Scanner) makeToken(kind TokenKind) *Token {
 		Kind:   kind,
 		Lexeme: lexeme,
 		Line:   s.tokenLine,
+		Start:  s.start,
+		End:    s.current,
 	}
 }
 
@@ -599,6 +623,8 @@ func (s *Scanner) errorToken(format string, a ...any) *Token {
 		Kind:   TokenKindError,
 		Lexeme: fmt.Sprintf(format, a...),
 		Line:   s.line,
+		Start:  s.start,
+		End:    s.current,
 	}
 }
 
@@ -623,18 +649,26 @@ func (s *Scanner) identifierKind() TokenKind {
 
 // lexemeToTokenKind maps the keyword lexeme to its corresponding token kind.
 var lexemeToTokenKind = map[string]TokenKind{
+	"as":       TokenKindAs,
 	"bnum":     TokenKindBNum,
 	"bool":     TokenKindBool,
 	"else":     TokenKindElse,
 	"elseif":   TokenKindElseif,
+	"emit":     TokenKindEmit,
 	"end":      TokenKindEnd,
+	"external": TokenKindExternal,
 	"false":    TokenKindFalse,
 	"float":    TokenKindFloat,
 	"function": TokenKindFunction,
+	"globals":  TokenKindGlobals,
 	"if":       TokenKindIf,
+	"import":   TokenKindImport,
 	"int":      TokenKindInt,
 	"listen":   TokenKindListen,
+	"migrate":  TokenKindMigrate,
 	"passage":  TokenKindPassage,
+	"profile":  TokenKindProfile,
+	"return":   TokenKindReturn,
 	"say":      TokenKindSay,
 	"string":   TokenKindString,
 	"then":     TokenKindThen,
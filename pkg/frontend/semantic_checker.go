@@ -8,17 +8,18 @@
 package frontend
 
 import (
+	"fmt"
+
 	"github.com/stackedboxes/romualdo/pkg/ast"
 	"github.com/stackedboxes/romualdo/pkg/errs"
 )
 
 // semanticChecker is a node visitor that implements assorted semantic checks.
-//
-// TODO: This operates at source file level. It should operate at package level,
-// or storyworld level.
+// It operates at the Storyworld level.
 type semanticChecker struct {
-	// fileName is the name of the file being semantically checked.
-	fileName string
+	// swRoot is the path to the root of the Storyworld being checked. Used for
+	// reporting errors that are not associated with any specific file.
+	swRoot string
 
 	// errors collects the errors for all semantic errors detected.
 	errors *errs.CompileTimeCollection
@@ -27,19 +28,40 @@ type semanticChecker struct {
 	// one is on the top.
 	nodeStack []ast.Node
 
-	// proceduresLine contains the line number where a given procedure was
-	// found. The procedure names here do not contain the package name (the
-	// semantic checker operates at one package at a time, so the package name
-	// is not relevant).
-	proceduresLine map[string]int
+	// symbols maps the fully-qualified name of every symbol declared in the
+	// Storyworld to the node declaring it.
+	symbols map[string]ast.Node
+
+	// packages contains the paths of all packages in the Storyworld.
+	packages map[string]bool
+
+	// aliases maps each source file to the set of package aliases it imports.
+	aliases map[string]map[string]bool
 }
 
-func NewSemanticChecker(fileName string) *semanticChecker {
-	return &semanticChecker{
-		fileName:       fileName,
-		errors:         &errs.CompileTimeCollection{},
-		proceduresLine: make(map[string]int),
+func NewSemanticChecker(swRoot string, sw *ast.Storyworld) *semanticChecker {
+	sc := &semanticChecker{
+		swRoot:   swRoot,
+		errors:   &errs.CompileTimeCollection{},
+		symbols:  make(map[string]ast.Node),
+		packages: make(map[string]bool),
+		aliases:  make(map[string]map[string]bool),
 	}
+
+	// Imports can refer to packages declared anywhere, so we need to know all
+	// of them beforehand.
+	for _, decl := range sw.Declarations {
+		switch n := decl.(type) {
+		case *ast.ProcedureDecl:
+			sc.packages[n.Package] = true
+		case *ast.GlobalsBlock:
+			for _, v := range n.Vars {
+				sc.packages[v.Package] = true
+			}
+		}
+	}
+
+	return sc
 }
 
 // The Visitor interface
@@ -48,25 +70,40 @@ func (sc *semanticChecker) Enter(node ast.Node) {
 
 	switch n := node.(type) {
 	case *ast.ProcedureDecl:
-		// TODO: Do this check at Package or Storyworld level.
-		if line, found := sc.proceduresLine[n.Name]; found {
-			sc.errorAtCurrentNode("Duplicate procedure `%v`. First definition at line %v.",
-				n.Name, line)
-			break
+		sc.checkDuplicateSymbol(n, n.FQN(), n.Name)
+
+	case *ast.VarDecl:
+		sc.checkDuplicateSymbol(n, n.FQN(), n.Name)
+
+	case *ast.Emit:
+		sc.checkDuplicateKeys(n.Payload)
+
+	case *ast.Import:
+		if !sc.packages[n.Package] {
+			sc.errorAtCurrentNode("Package `%v` not found.", n.Package)
+		}
+		fileAliases, ok := sc.aliases[n.SrcFile]
+		if !ok {
+			fileAliases = make(map[string]bool)
+			sc.aliases[n.SrcFile] = fileAliases
 		}
-		sc.proceduresLine[n.Name] = n.LineNumber
+		if fileAliases[n.Alias] {
+			sc.errorAtCurrentNode("Duplicate import alias `%v`.", n.Alias)
+		}
+		fileAliases[n.Alias] = true
 	}
 }
 
 func (sc *semanticChecker) Leave(n ast.Node) {
 	sc.nodeStack = sc.nodeStack[:len(sc.nodeStack)-1]
 
-	// TODO: checking for `main` here for now; will need to look at the whole
-	// Root Package when we have proper support for Packages. At which point
-	// we'll want to use `/main` in the message.
-	if _, ok := n.(*ast.SourceFile); ok {
-		if _, found := sc.proceduresLine["main"]; !found {
+	if _, ok := n.(*ast.Storyworld); ok {
+		main, found := sc.symbols["/main"]
+		if !found {
 			sc.errorWithoutLine("Procedure `main` not found.")
+		} else if proc, ok := main.(*ast.ProcedureDecl); ok && proc.Kind == ast.ProcKindExternal {
+			sc.errors.Add(errs.NewCompileTime(proc.SourceFile(), proc.Line(),
+				"Procedure `main` cannot be an external function."))
 		}
 	}
 }
@@ -75,22 +112,65 @@ func (sc *semanticChecker) Event(node ast.Node, event ast.EventType) {
 	// Nothing
 }
 
+//
+// Semantic checks
+//
+
+// checkDuplicateSymbol checks if a symbol with the fully-qualified name fqn was
+// already declared. If not, registers node as the declaration of this symbol.
+// name is the simple name of the symbol, used for error reporting.
+func (sc *semanticChecker) checkDuplicateSymbol(node ast.Node, fqn, name string) {
+	first, found := sc.symbols[fqn]
+	if !found {
+		sc.symbols[fqn] = node
+		return
+	}
+
+	where := fmt.Sprintf("line %v", first.Line())
+	if first.SourceFile() != node.SourceFile() {
+		where = fmt.Sprintf("%v:%v", first.SourceFile(), first.Line())
+	}
+
+	if proc, ok := node.(*ast.ProcedureDecl); ok && proc.Kind == ast.ProcKindMigration {
+		sc.errorAtCurrentNode("Duplicate migration for release `%v`. First definition at %v.", proc.Release, where)
+		return
+	}
+
+	_, firstIsProc := first.(*ast.ProcedureDecl)
+	_, nodeIsProc := node.(*ast.ProcedureDecl)
+	switch {
+	case firstIsProc && nodeIsProc:
+		sc.errorAtCurrentNode("Duplicate procedure `%v`. First definition at %v.", name, where)
+	case !firstIsProc && !nodeIsProc:
+		sc.errorAtCurrentNode("Duplicate global `%v`. First definition at %v.", name, where)
+	default:
+		sc.errorAtCurrentNode("Duplicate symbol `%v`. First definition at %v.", name, where)
+	}
+}
+
+// checkDuplicateKeys checks if the same key appears more than once in a map
+// literal.
+func (sc *semanticChecker) checkDuplicateKeys(entries []ast.MapEntry) {
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if seen[entry.Key.Value] {
+			sc.errorAtCurrentNode("Duplicate key `%v`.", entry.Key.Value)
+		}
+		seen[entry.Key.Value] = true
+	}
+}
+
 //
 // Error reporting
 //
 
 // errorWithoutLine reports an error without a specific line number.
-func (tc *semanticChecker) errorWithoutLine(format string, a ...interface{}) {
-	tc.errors.Add(errs.NewCompileTimeWithoutLine(tc.fileName, format, a...))
+func (sc *semanticChecker) errorWithoutLine(format string, a ...interface{}) {
+	sc.errors.Add(errs.NewCompileTimeWithoutLine(sc.swRoot, format, a...))
 }
 
 // errorAtCurrentNode reports an error at the node we are currently checking.
-func (tc *semanticChecker) errorAtCurrentNode(format string, a ...interface{}) {
-	tc.errors.Add(errs.NewCompileTime(tc.fileName, tc.currentLine(), format, a...))
-}
-
-// currentLine returns the source code line corresponding to whatever we are
-// currently analyzing.
-func (tc *semanticChecker) currentLine() int {
-	return tc.nodeStack[len(tc.nodeStack)-1].Line()
+func (sc *semanticChecker) errorAtCurrentNode(format string, a ...interface{}) {
+	node := sc.nodeStack[len(sc.nodeStack)-1]
+	sc.errors.Add(errs.NewCompileTime(node.SourceFile(), node.Line(), format, a...))
 }
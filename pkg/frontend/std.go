@@ -0,0 +1,48 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/ast"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// StdPackage is the path of the Romualdo standard library Package, which is
+// always available as `std` without the need of importing it.
+const StdPackage = "/std"
+
+// stdFileName is the name used for the standard library source file. It lives
+// in a directory named like the standard library Package, so that the usual
+// rules assign its declarations to StdPackage.
+const stdFileName = "std/std.ral"
+
+// stdSource is the source code of the standard library. Everything in it is
+// declared as external functions, which the VM itself implements.
+const stdSource = `
+\# Sets the name of the current chapter, shown in save menus.
+external function SetChapter(name: string): void
+`
+
+// parseStd parses the standard library.
+func parseStd() (*ast.SourceFile, errs.Error) {
+	p := newParser(stdFileName, stdSource)
+	sfNode, err := p.parse()
+	if err != nil {
+		return nil, errs.NewICE("parsing the standard library: %v", p.errors)
+	}
+	return sfNode, nil
+}
+
+// isStdSourceFile checks if fileName (relative to the Storyworld root) is in
+// the directory reserved for the standard library.
+func isStdSourceFile(fileName string) bool {
+	first, _, _ := strings.Cut(strings.ReplaceAll(fileName, "\\", "/"), "/")
+	return first == "std"
+}
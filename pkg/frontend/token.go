@@ -22,6 +22,7 @@ const (
 	TokenKindComma                        // ,
 	TokenKindColon                        // :
 	TokenKindHat                          // ^
+	TokenKindSlash                        // /
 
 	// One or two character tokens.
 	TokenKindEqual            // =
@@ -35,6 +36,8 @@ const (
 	TokenKindRightCurly       // }
 	TokenKindLeftDoubleCurly  // {{
 	TokenKindRightDoubleCurly // }}
+	TokenKindDot              // .
+	TokenKindDotDot           // ..
 
 	// Literals
 	TokenKindIdentifier
@@ -42,18 +45,26 @@ const (
 	TokenKindStringLiteral
 
 	// Keywords
+	TokenKindAs       // as
 	TokenKindBNum     // bnum
 	TokenKindBool     // bool
 	TokenKindElse     // else
 	TokenKindElseif   // elseif
+	TokenKindEmit     // emit
 	TokenKindEnd      // end
+	TokenKindExternal // external
 	TokenKindFalse    // false
 	TokenKindFloat    // float
 	TokenKindFunction // function
+	TokenKindGlobals  // globals
 	TokenKindIf       // if
+	TokenKindImport   // import
 	TokenKindInt      // int
 	TokenKindListen   // listen
+	TokenKindMigrate  // migrate
 	TokenKindPassage  // passage
+	TokenKindProfile  // profile
+	TokenKindReturn   // return
 	TokenKindSay      // say
 	TokenKindString   // string
 	TokenKindThen     // then
@@ -85,6 +96,8 @@ func (kind TokenKind) String() string {
 		return "TokenKindColon"
 	case TokenKindHat:
 		return "TokenKindHat"
+	case TokenKindSlash:
+		return "TokenKindSlash"
 
 	case TokenKindEqual:
 		return "TokenKindEqual"
@@ -108,6 +121,10 @@ func (kind TokenKind) String() string {
 		return "TokenKindLeftDoubleCurly"
 	case TokenKindRightDoubleCurly:
 		return "TokenKindRightDoubleCurly"
+	case TokenKindDot:
+		return "TokenKindDot"
+	case TokenKindDotDot:
+		return "TokenKindDotDot"
 
 	case TokenKindIdentifier:
 		return "TokenKindIdentifier"
@@ -116,6 +133,8 @@ func (kind TokenKind) String() string {
 	case TokenKindStringLiteral:
 		return "TokenKindStringLiteral"
 
+	case TokenKindAs:
+		return "TokenKindAs"
 	case TokenKindBNum:
 		return "TokenKindBNum"
 	case TokenKindBool:
@@ -126,20 +145,34 @@ func (kind TokenKind) String() string {
 		return "TokenKindElseIf"
 	case TokenKindEnd:
 		return "TokenKindEnd"
+	case TokenKindEmit:
+		return "TokenKindEmit"
+	case TokenKindExternal:
+		return "TokenKindExternal"
 	case TokenKindFalse:
 		return "TokenKindFalse"
 	case TokenKindFloat:
 		return "TokenKindFloat"
 	case TokenKindFunction:
 		return "TokenKindFunction"
+	case TokenKindGlobals:
+		return "TokenKindGlobals"
 	case TokenKindIf:
 		return "TokenKindIf"
+	case TokenKindImport:
+		return "TokenKindImport"
 	case TokenKindInt:
 		return "TokenKindInt"
 	case TokenKindListen:
 		return "TokenKindListen"
+	case TokenKindMigrate:
+		return "TokenKindMigrate"
 	case TokenKindPassage:
 		return "TokenKindPassage"
+	case TokenKindProfile:
+		return "TokenKindProfile"
+	case TokenKindReturn:
+		return "TokenKindReturn"
 	case TokenKindSay:
 		return "TokenKindSay"
 	case TokenKindString:
@@ -178,6 +211,13 @@ type Token struct {
 	// Line is the number where the token came from. In case of multiline
 	// tokens, it refers to the first Line.
 	Line int
+
+	// Start and End are the byte offsets into the source code where the token
+	// starts and ends (exclusive). Unlike Lexeme, these always refer to the
+	// source code as written, which is what tools like the language server
+	// need.
+	Start int
+	End   int
 }
 
 // IsBackslashed checks if the token is escaped by a backslash.
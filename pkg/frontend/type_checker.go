@@ -12,23 +12,24 @@ import (
 	"github.com/stackedboxes/romualdo/pkg/errs"
 )
 
-// typeChecker is a node visitor that implements type checking.
+// typeChecker is a node visitor that implements type checking. It operates at
+// the Storyworld level, and expects names to be already resolved.
 type typeChecker struct {
-	// fileName is the name of the file being type checked.
-	fileName string
-
 	// errors collects the errors for all semantic errors detected.
 	errors *errs.CompileTimeCollection
 
 	// nodeStack is used to keep track of the nodes being processed. The current
 	// one is on the top.
 	nodeStack []ast.Node
+
+	// currentProc is the Procedure being currently type checked. Nil if
+	// outside of any Procedure.
+	currentProc *ast.ProcedureDecl
 }
 
-func NewTypeChecker(fileName string) *typeChecker {
+func NewTypeChecker() *typeChecker {
 	return &typeChecker{
-		fileName: fileName,
-		errors:   &errs.CompileTimeCollection{},
+		errors: &errs.CompileTimeCollection{},
 	}
 }
 
@@ -37,15 +38,44 @@ func (tc *typeChecker) Enter(node ast.Node) {
 	tc.nodeStack = append(tc.nodeStack, node)
 
 	switch n := node.(type) {
+	case *ast.Storyworld:
+		// The types of globals must be known before we check any code using
+		// them, so handle them all beforehand.
+		for _, decl := range n.Declarations {
+			if gb, ok := decl.(*ast.GlobalsBlock); ok {
+				for _, v := range gb.Vars {
+					tc.checkVarDecl(v)
+				}
+			}
+		}
+	case *ast.ProcedureDecl:
+		tc.currentProc = n
+		tc.checkProcedureDecl(n)
 	case *ast.Listen:
 		tc.checkListen(n)
 	case *ast.IfStmt:
 		tc.checkIfStmt(n)
+	case *ast.Identifier:
+		tc.checkIdentifier(n)
+	case *ast.Call:
+		tc.checkCall(n)
+	case *ast.Assignment:
+		tc.checkAssignment(n)
+	case *ast.Return:
+		tc.checkReturn(n)
+	case *ast.Curlies:
+		tc.checkCurlies(n)
+	case *ast.Emit:
+		tc.checkEmit(n)
 	}
 }
 
-func (tc *typeChecker) Leave(ast.Node) {
+func (tc *typeChecker) Leave(node ast.Node) {
 	tc.nodeStack = tc.nodeStack[:len(tc.nodeStack)-1]
+
+	if _, ok := node.(*ast.ProcedureDecl); ok {
+		tc.currentProc = nil
+	}
 }
 
 func (tc *typeChecker) Event(node ast.Node, event ast.EventType) {
@@ -56,11 +86,55 @@ func (tc *typeChecker) Event(node ast.Node, event ast.EventType) {
 // Type checking
 //
 
+// checkVarDecl type checks a variable declaration. Infers the variable type
+// from the initializer if it was not explicitly given.
+func (tc *typeChecker) checkVarDecl(node *ast.VarDecl) {
+	if node.Initializer != nil {
+		switch node.Initializer.(type) {
+		case *ast.BoolLiteral, *ast.StringLiteral:
+			// Fine!
+		default:
+			tc.errorAt(node, "Global `%v` must be initialized with a literal value.", node.Name)
+			return
+		}
+
+		initType := node.Initializer.Type()
+		if node.VarType == ast.TypeInvalid {
+			node.VarType = initType
+		} else if initType != node.VarType {
+			tc.errorAt(node, "Cannot initialize global `%v` of type %v with a %v.",
+				node.Name, node.VarType, initType)
+			return
+		}
+	}
+
+	if !isStorableType(node.VarType) {
+		tc.errorAt(node, "Globals of type %v are not supported yet.", node.VarType)
+	}
+}
+
+// checkProcedureDecl type checks a procedure declaration.
+func (tc *typeChecker) checkProcedureDecl(node *ast.ProcedureDecl) {
+	if node.ReturnType != ast.TypeVoid && !isStorableType(node.ReturnType) {
+		tc.errorAtCurrentNode("Procedures returning %v are not supported yet.", node.ReturnType)
+	}
+
+	// Arguments of external functions are passed to the Driver Program as
+	// plain Go values, so only types with a Go counterpart are allowed.
+	if node.Kind == ast.ProcKindExternal {
+		for _, param := range node.Parameters {
+			if !isStorableType(param.Type) {
+				tc.errorAtCurrentNode("External functions cannot take parameters of type %v.", param.Type)
+			}
+		}
+	}
+}
+
 // checkListen type checks a listen expression.
 func (tc *typeChecker) checkListen(node *ast.Listen) {
 	optionsType := node.Options.Type()
 	if optionsType != ast.TypeString {
-		tc.errorWithoutLine("listen expects a string argument, got a %v.", optionsType)
+		tc.errorAtCurrentNode("listen expects a string argument, got a %v.", optionsType)
 	}
 }
 
@@ -72,18 +146,113 @@ func (tc *typeChecker) checkIfStmt(node *ast.IfStmt) {
 	}
 }
 
-// errorWithoutLine reports an error without a specific line number.
-func (tc *typeChecker) errorWithoutLine(format string, a ...interface{}) {
-	tc.errors.Add(errs.NewCompileTimeWithoutLine(tc.fileName, format, a...))
+// checkIdentifier type checks an identifier. Procedures are not first-class
+// values, so they can only be referenced as the callee of a call.
+func (tc *typeChecker) checkIdentifier(node *ast.Identifier) {
+	if node.Procedure == nil {
+		return
+	}
+
+	if len(tc.nodeStack) >= 2 {
+		if call, ok := tc.nodeStack[len(tc.nodeStack)-2].(*ast.Call); ok && call.Callee == node {
+			return
+		}
+	}
+
+	tc.errorAtCurrentNode("Procedure `%v` can only be called, not used as a value.", node.Name)
 }
 
-// errorAtCurrentNode reports an error at the node we are currently checking.
-func (tc *typeChecker) errorAtCurrentNode(format string, a ...interface{}) {
-	tc.errors.Add(errs.NewCompileTime(tc.fileName, tc.currentLine(), format, a...))
+// checkCall type checks a procedure call.
+func (tc *typeChecker) checkCall(node *ast.Call) {
+	id, ok := node.Callee.(*ast.Identifier)
+	if !ok || id.Procedure == nil {
+		tc.errorAtCurrentNode("Only procedures can be called.")
+		return
+	}
+
+	params := id.Procedure.Parameters
+	if len(params) != len(node.Args) {
+		tc.errorAtCurrentNode("`%v` expects %v argument(s), got %v.", id.Name, len(params), len(node.Args))
+		return
+	}
+
+	for i, arg := range node.Args {
+		if arg.Type() != params[i].Type {
+			tc.errorAtCurrentNode("Argument %v of `%v` must be a %v, got a %v.",
+				i+1, id.Name, params[i].Type, arg.Type())
+		}
+	}
 }
 
-// currentLine returns the source code line corresponding to whatever we are
-// currently analyzing.
-func (tc *typeChecker) currentLine() int {
-	return tc.nodeStack[len(tc.nodeStack)-1].Line()
+// checkAssignment type checks an assignment.
+func (tc *typeChecker) checkAssignment(node *ast.Assignment) {
+	target := node.Target
+	if target.Global == nil && target.Param == nil {
+		tc.errorAtCurrentNode("Cannot assign to `%v`.", target.Name)
+		return
+	}
+
+	if node.Value.Type() != target.Type() {
+		tc.errorAtCurrentNode("Cannot assign a %v to `%v`, which is a %v.",
+			node.Value.Type(), target.Name, target.Type())
+	}
+}
+
+// checkReturn type checks a return statement.
+func (tc *typeChecker) checkReturn(node *ast.Return) {
+	proc := tc.currentProc
+	switch {
+	case node.Value == nil && proc.ReturnType != ast.TypeVoid:
+		tc.errorAtCurrentNode("Procedure `%v` must return a %v.", proc.Name, proc.ReturnType)
+	case node.Value != nil && proc.ReturnType == ast.TypeVoid:
+		tc.errorAtCurrentNode("Procedure `%v` does not return a value.", proc.Name)
+	case node.Value != nil && node.Value.Type() != proc.ReturnType:
+		tc.errorAtCurrentNode("Procedure `%v` must return a %v, got a %v.",
+			proc.Name, proc.ReturnType, node.Value.Type())
+	}
+}
+
+// checkCurlies type checks curlies.
+func (tc *typeChecker) checkCurlies(node *ast.Curlies) {
+	if node.Expr.Type() == ast.TypeVoid {
+		tc.errorAtCurrentNode("Curlies need an expression with a value.")
+	}
+}
+
+// checkEmit type checks an emit statement. The payload is passed to the Driver
+// Program as plain Go values, so only types with a Go counterpart are allowed.
+func (tc *typeChecker) checkEmit(node *ast.Emit) {
+	nameType := node.Name.Type()
+	if nameType != ast.TypeString {
+		tc.errorAtCurrentNode("The event name must be a string, got a %v.", nameType)
+	}
+
+	for _, entry := range node.Payload {
+		valueType := entry.Value.Type()
+		if !isStorableType(valueType) {
+			tc.errorAtCurrentNode("Cannot emit key `%v` with a value of type %v.", entry.Key.Value, valueType)
+		}
+	}
+}
+
+// isStorableType checks if values of type tag can be stored in variables and
+// returned from procedures.
+//
+// TODO: Drop this once we have runtime support for all types.
+func isStorableType(tag ast.TypeTag) bool {
+	return tag == ast.TypeBool || tag == ast.TypeString
+}
+
+//
+// Error reporting
+//
+
+// errorAt reports an error at a given node.
+func (tc *typeChecker) errorAt(node ast.Node, format string, a ...interface{}) {
+	tc.errors.Add(errs.NewCompileTime(node.SourceFile(), node.Line(), format, a...))
+}
+
+// errorAtCurrentNode reports an error at the node we are currently checking.
+func (tc *typeChecker) errorAtCurrentNode(format string, a ...interface{}) {
+	tc.errorAt(tc.nodeStack[len(tc.nodeStack)-1], format, a...)
 }
@@ -0,0 +1,351 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/ast"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/frontend"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+// analysis is what the server knows about the Storyworld at some point in
+// time: the result of parsing and checking all of its source files, taking the
+// unsaved changes in the open documents into account.
+//
+// Storyworlds are small enough that the whole thing is analyzed again after
+// every change.
+type analysis struct {
+	// files contains all source files in the Storyworld, keyed by their
+	// absolute paths.
+	files map[string]*sourceFile
+
+	// filesByName contains the same files, keyed by their paths relative to
+	// the Storyworld root (which is what the AST nodes use).
+	filesByName map[string]*sourceFile
+
+	// diagnostics contains the problems found in each file, keyed by their
+	// absolute paths. Problems that cannot be tied to a file are shown on the
+	// first line of every open document.
+	diagnostics map[string][]diagnostic
+}
+
+// sourceFile is what the server knows about a single source file.
+type sourceFile struct {
+	// path is the absolute path to the file.
+	path string
+
+	// text is the contents of the file.
+	text *text
+
+	// tokens contains the tokens scanned from the file. If there are syntax
+	// errors, these stop where the parser gave up.
+	tokens []*frontend.Token
+
+	// ast is the AST of the file. Nil if there are syntax errors.
+	ast *ast.SourceFile
+
+	// identifiers contains all Identifiers in the file, sorted by offset. They
+	// are resolved only if the Storyworld got past name resolution.
+	identifiers []*ast.Identifier
+
+	// callees contains the offsets of the Identifiers being called.
+	callees map[int]bool
+
+	// procedures contains the Procedures declared in the file.
+	procedures []*ast.ProcedureDecl
+
+	// globals contains the global variables declared in the file.
+	globals []*ast.VarDecl
+}
+
+// analyze analyzes the Storyworld at root. open maps the absolute paths of the
+// open documents to their contents, which take precedence over the contents
+// of the files on disk.
+func analyze(root string, open map[string]string) *analysis {
+	a := &analysis{
+		files:       map[string]*sourceFile{},
+		filesByName: map[string]*sourceFile{},
+		diagnostics: map[string][]diagnostic{},
+	}
+
+	paths := map[string]bool{}
+	romutil.ForEachMatchingFileRecursive(root, regexp.MustCompile(`.*\.ral`),
+		func(path string) errs.Error {
+			paths[filepath.Clean(path)] = true
+			return nil
+		},
+	)
+	for path := range open {
+		if isWithin(root, path) {
+			paths[path] = true
+		}
+	}
+	sortedPaths := make([]string, 0, len(paths))
+	for path := range paths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	sort.Strings(sortedPaths)
+
+	// Parse
+	var asts []*ast.SourceFile
+	var orphans []*errs.CompileTime
+	syntaxErrors := false
+	for _, path := range sortedPaths {
+		src, isOpen := open[path]
+		if !isOpen {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			src = string(data)
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+
+		sfNode, tokens, ctErr := frontend.ParseSource(name, src)
+		f := &sourceFile{
+			path:   path,
+			text:   newText(src),
+			tokens: tokens,
+			ast:    sfNode,
+		}
+		a.files[path] = f
+		a.filesByName[name] = f
+		if ctErr != nil {
+			syntaxErrors = true
+			orphans = append(orphans, a.addDiagnostics(ctErr)...)
+			continue
+		}
+		asts = append(asts, sfNode)
+	}
+
+	// Check. Errors in a file would cause bogus errors elsewhere, so only
+	// syntactically valid Storyworlds are checked.
+	if !syntaxErrors && len(asts) > 0 {
+		_, ctErr := frontend.CheckStoryworld(root, asts)
+		if ctErr != nil {
+			orphans = append(orphans, a.addDiagnostics(ctErr)...)
+		}
+	}
+
+	for _, f := range a.files {
+		if f.ast != nil {
+			f.index()
+		}
+	}
+
+	for path := range open {
+		f := a.files[path]
+		if f == nil {
+			continue
+		}
+		for _, e := range orphans {
+			a.diagnostics[path] = append(a.diagnostics[path], diagnostic{
+				Range:    f.text.rangeOf(0, f.text.lineEnd(0)),
+				Severity: severityError,
+				Source:   "romualdo",
+				Message:  e.Message,
+			})
+		}
+	}
+
+	return a
+}
+
+// addDiagnostics adds the diagnostics corresponding to err. Returns the
+// compile-time errors that could not be tied to a file.
+func (a *analysis) addDiagnostics(err errs.Error) []*errs.CompileTime {
+	var ctErrs []*errs.CompileTime
+	var collection *errs.CompileTimeCollection
+	var single *errs.CompileTime
+	switch {
+	case errors.As(err, &collection):
+		ctErrs = collection.Errors
+	case errors.As(err, &single):
+		ctErrs = []*errs.CompileTime{single}
+	default:
+		ctErrs = []*errs.CompileTime{{Message: err.Error(), Line: -1}}
+	}
+
+	var orphans []*errs.CompileTime
+	for _, e := range ctErrs {
+		f := a.filesByName[e.FileName]
+		if f == nil {
+			orphans = append(orphans, e)
+			continue
+		}
+		a.diagnostics[f.path] = append(a.diagnostics[f.path], diagnostic{
+			Range:    f.errorRange(e),
+			Severity: severityError,
+			Source:   "romualdo",
+			Message:  e.Message,
+		})
+	}
+	return orphans
+}
+
+// errorRange returns the range to highlight for a compile-time error: the
+// offending lexeme, if it can be found in the line, or else the whole line
+// (without indentation).
+func (f *sourceFile) errorRange(e *errs.CompileTime) rng {
+	line := e.Line - 1
+	if line < 0 {
+		line = 0
+	}
+	if line >= f.text.lineCount() {
+		line = f.text.lineCount() - 1
+	}
+	start, end := f.text.lineStarts[line], f.text.lineEnd(line)
+	lineText := f.text.src[start:end]
+
+	if e.Lexeme != "" {
+		if i := strings.Index(lineText, e.Lexeme); i >= 0 {
+			return f.text.rangeOf(start+i, start+i+len(e.Lexeme))
+		}
+	}
+	indent := len(lineText) - len(strings.TrimLeft(lineText, " \t"))
+	return f.text.rangeOf(start+indent, end)
+}
+
+// index collects the Identifiers and declarations in the file.
+func (f *sourceFile) index() {
+	f.callees = map[int]bool{}
+	f.ast.Walk(&indexer{f: f})
+	sort.Slice(f.identifiers, func(i, j int) bool {
+		return f.identifiers[i].Offset < f.identifiers[j].Offset
+	})
+}
+
+// identifierAt returns the Identifier at the given byte offset, or nil if there
+// is none. An offset right after the Identifier counts as being at it.
+func (f *sourceFile) identifierAt(offset int) *ast.Identifier {
+	for _, id := range f.identifiers {
+		if id.Offset <= offset && offset <= id.Offset+len(id.Name) {
+			return id
+		}
+	}
+	return nil
+}
+
+// procedureAt returns the Procedure referenced or declared at the given byte
+// offset, or nil if there is none.
+func (f *sourceFile) procedureAt(offset int) *ast.ProcedureDecl {
+	if id := f.identifierAt(offset); id != nil {
+		return id.Procedure
+	}
+	for _, proc := range f.procedures {
+		if proc.Kind != ast.ProcKindMigration &&
+			proc.NameOffset <= offset && offset <= proc.NameOffset+len(proc.Name) {
+			return proc
+		}
+	}
+	return nil
+}
+
+// declaration returns the location where proc is declared. Returns false if it
+// is not declared in a file of the Storyworld (as is the case for the standard
+// library).
+func (a *analysis) declaration(proc *ast.ProcedureDecl) (location, bool) {
+	f := a.filesByName[proc.SourceFile()]
+	if f == nil || proc.Kind == ast.ProcKindMigration {
+		return location{}, false
+	}
+	return location{
+		URI:   pathToURI(f.path),
+		Range: f.text.rangeOf(proc.NameOffset, proc.NameOffset+len(proc.Name)),
+	}, true
+}
+
+// references returns the locations of all references to proc, sorted by file
+// and offset. The declaration is included if includeDeclaration is true.
+func (a *analysis) references(proc *ast.ProcedureDecl, includeDeclaration bool) []location {
+	locations := []location{}
+	if includeDeclaration {
+		if decl, ok := a.declaration(proc); ok {
+			locations = append(locations, decl)
+		}
+	}
+
+	paths := make([]string, 0, len(a.files))
+	for path := range a.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		f := a.files[path]
+		for _, id := range f.identifiers {
+			if id.Procedure == proc {
+				locations = append(locations, location{
+					URI:   pathToURI(f.path),
+					Range: f.text.rangeOf(id.Offset, id.Offset+len(id.Name)),
+				})
+			}
+		}
+	}
+	return locations
+}
+
+// signature returns the signature of proc, as written in the source code.
+func signature(proc *ast.ProcedureDecl) string {
+	kind := "function"
+	switch proc.Kind {
+	case ast.ProcKindPassage:
+		kind = "passage"
+	case ast.ProcKindExternal:
+		kind = "external function"
+	}
+
+	params := make([]string, len(proc.Parameters))
+	for i, param := range proc.Parameters {
+		params[i] = fmt.Sprintf("%v: %v", param.Name, param.Type.SourceName())
+	}
+	return fmt.Sprintf("%v %v(%v): %v", kind, proc.Name, strings.Join(params, ", "), proc.ReturnType.SourceName())
+}
+
+//
+// The indexer
+//
+
+// indexer is an ast.Visitor that collects the Identifiers and declarations in
+// a source file.
+type indexer struct {
+	f *sourceFile
+}
+
+func (ix *indexer) Enter(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		ix.f.identifiers = append(ix.f.identifiers, n)
+	case *ast.Assignment:
+		// Assignment targets are not visited.
+		ix.f.identifiers = append(ix.f.identifiers, n.Target)
+	case *ast.Call:
+		if id, ok := n.Callee.(*ast.Identifier); ok {
+			ix.f.callees[id.Offset] = true
+		}
+	case *ast.ProcedureDecl:
+		ix.f.procedures = append(ix.f.procedures, n)
+	case *ast.VarDecl:
+		ix.f.globals = append(ix.f.globals, n)
+	}
+}
+
+func (ix *indexer) Leave(node ast.Node) {}
+
+func (ix *indexer) Event(node ast.Node, event ast.EventType) {}
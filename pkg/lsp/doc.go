@@ -0,0 +1,16 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The lsp package implements a Language Server Protocol server for Romualdo
+// source code, giving editors things like diagnostics as you type,
+// go-to-definition and semantic highlighting. It's the machinery behind the
+// `lsp` command.
+//
+// The server is built on the same frontend used by the compiler, so it sees
+// exactly the same errors `romualdo build` would report. Only the parts of the
+// protocol used by these features are implemented.
+package lsp
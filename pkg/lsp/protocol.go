@@ -0,0 +1,146 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+// This file contains the subset of the LSP types used by the server. Names
+// mirror the ones in the LSP specification.
+
+// position is a zero-based position in a text document. Characters are counted
+// in UTF-16 code units, as the LSP specification mandates by default.
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// rng is a range in a text document. The end is exclusive.
+type rng struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+// location is a range in a given document.
+type location struct {
+	URI   string `json:"uri"`
+	Range rng    `json:"range"`
+}
+
+// diagnostic is a problem found in a text document.
+type diagnostic struct {
+	Range    rng    `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// severityError is the severity of diagnostics reporting errors.
+const severityError = 1
+
+// publishDiagnosticsParams are the parameters of the
+// textDocument/publishDiagnostics notification.
+type publishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// initializeParams are the parameters of the initialize request.
+type initializeParams struct {
+	RootURI          string            `json:"rootUri"`
+	RootPath         string            `json:"rootPath"`
+	WorkspaceFolders []workspaceFolder `json:"workspaceFolders"`
+}
+
+// workspaceFolder is a workspace folder open in the client.
+type workspaceFolder struct {
+	URI string `json:"uri"`
+}
+
+// textDocumentIdentifier identifies a text document.
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// textDocumentItem is a text document sent from the client to the server.
+type textDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+// didOpenParams are the parameters of the textDocument/didOpen notification.
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+// didChangeParams are the parameters of the textDocument/didChange
+// notification. The server only supports full document synchronization, so
+// each change contains the whole document.
+type didChangeParams struct {
+	TextDocument   textDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+// didCloseParams are the parameters of the textDocument/didSave and
+// textDocument/didClose notifications.
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+// textDocumentPositionParams are the parameters of requests about a position in
+// a document, like textDocument/definition and textDocument/hover.
+type textDocumentPositionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+// referenceParams are the parameters of the textDocument/references request.
+type referenceParams struct {
+	textDocumentPositionParams
+	Context struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+// documentParams are the parameters of requests about a whole document, like
+// textDocument/documentSymbol.
+type documentParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+// hover is the result of the textDocument/hover request.
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    *rng          `json:"range,omitempty"`
+}
+
+// markupContent is some text to be shown to the user.
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// documentSymbol is a symbol declared in a document.
+type documentSymbol struct {
+	Name           string `json:"name"`
+	Detail         string `json:"detail,omitempty"`
+	Kind           int    `json:"kind"`
+	Range          rng    `json:"range"`
+	SelectionRange rng    `json:"selectionRange"`
+}
+
+// Symbol kinds used by the server.
+const (
+	symbolKindFunction = 12
+	symbolKindVariable = 13
+)
+
+// semanticTokens is the result of the textDocument/semanticTokens/full
+// request.
+type semanticTokens struct {
+	Data []int `json:"data"`
+}
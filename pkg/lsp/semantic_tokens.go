@@ -0,0 +1,164 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/frontend"
+)
+
+// The semantic token types, as indices into semanticTokenTypes.
+const (
+	tokenTypeKeyword = iota
+	tokenTypeType
+	tokenTypeFunction
+	tokenTypeVariable
+	tokenTypeNamespace
+	tokenTypeString
+	tokenTypeOperator
+)
+
+// semanticTokenTypes is the legend of the semantic token types.
+var semanticTokenTypes = []string{"keyword", "type", "function", "variable", "namespace", "string", "operator"}
+
+// The semantic token modifiers, as bits of a bitmask.
+const (
+	// tokenModifierDeclaration marks the names of declared symbols.
+	tokenModifierDeclaration = 1 << iota
+
+	// tokenModifierLecture marks the text of Lectures. They are also typed as
+	// strings, so that they look reasonable in editors that know nothing
+	// about Lectures; but the modifier lets users style them separately from
+	// string literals (and, above all, apart from the backslashed code among
+	// them).
+	tokenModifierLecture
+)
+
+// semanticTokenModifiers is the legend of the semantic token modifiers.
+var semanticTokenModifiers = []string{"declaration", "lecture"}
+
+// semanticTokens returns the semantic tokens of the file, encoded as the LSP
+// specification says.
+func (f *sourceFile) semanticTokens() []int {
+	declarations := map[int]int{}
+	for _, proc := range f.procedures {
+		declarations[proc.NameOffset] = tokenTypeFunction
+	}
+	for _, global := range f.globals {
+		declarations[global.NameOffset] = tokenTypeVariable
+	}
+	references := map[int]int{}
+	for _, id := range f.identifiers {
+		if id.Procedure != nil || f.callees[id.Offset] {
+			references[id.Offset] = tokenTypeFunction
+		} else {
+			references[id.Offset] = tokenTypeVariable
+		}
+	}
+
+	enc := &tokenEncoder{text: f.text, data: []int{}}
+	for i, tok := range f.tokens {
+		switch {
+		case tok.Kind == frontend.TokenKindLecture:
+			enc.add(tok.Start, tok.End, tokenTypeString, tokenModifierLecture, true)
+
+		case tok.Kind == frontend.TokenKindStringLiteral:
+			enc.add(tok.Start, tok.End, tokenTypeString, 0, false)
+
+		case tok.Kind == frontend.TokenKindIdentifier:
+			if i+2 < len(f.tokens) && f.tokens[i+1].Kind == frontend.TokenKindDot &&
+				f.tokens[i+2].Kind == frontend.TokenKindIdentifier {
+				enc.add(tok.Start, tok.End, tokenTypeNamespace, 0, false)
+			} else if tt, ok := declarations[tok.Start]; ok {
+				enc.add(tok.Start, tok.End, tt, tokenModifierDeclaration, false)
+			} else if tt, ok := references[tok.Start]; ok {
+				enc.add(tok.Start, tok.End, tt, 0, false)
+			} else {
+				enc.add(tok.Start, tok.End, tokenTypeVariable, 0, false)
+			}
+
+		case isTypeKeyword(tok.Kind):
+			enc.add(tok.Start, tok.End, tokenTypeType, 0, false)
+
+		case tok.Kind >= frontend.TokenKindAs && tok.Kind <= frontend.TokenKindVoid:
+			// Includes backslashed keywords within Lectures.
+			enc.add(tok.Start, tok.End, tokenTypeKeyword, 0, false)
+
+		case tok.Kind >= frontend.TokenKindEqual && tok.Kind <= frontend.TokenKindLessEqual,
+			tok.Kind == frontend.TokenKindHat, tok.Kind == frontend.TokenKindSlash,
+			tok.Kind == frontend.TokenKindDotDot:
+			enc.add(tok.Start, tok.End, tokenTypeOperator, 0, false)
+		}
+	}
+	return enc.data
+}
+
+// isTypeKeyword checks if kind is a keyword naming a type.
+func isTypeKeyword(kind frontend.TokenKind) bool {
+	switch kind {
+	case frontend.TokenKindBNum, frontend.TokenKindBool, frontend.TokenKindFloat,
+		frontend.TokenKindInt, frontend.TokenKindString, frontend.TokenKindVoid:
+		return true
+	default:
+		return false
+	}
+}
+
+// tokenEncoder encodes semantic tokens using the relative encoding of the LSP
+// specification.
+type tokenEncoder struct {
+	// text is the text of the file the tokens come from.
+	text *text
+
+	// data contains the encoded tokens.
+	data []int
+
+	// prev is the position of the previous token encoded.
+	prev position
+}
+
+// add adds a token spanning from the byte offsets start to end (exclusive).
+// Tokens spanning several lines are split into one token per line, as not all
+// clients support multiline tokens. If trim is true, blanks at the start and
+// end of each line are left out.
+func (enc *tokenEncoder) add(start, end, tokenType, modifiers int, trim bool) {
+	for start < end {
+		line := enc.text.position(start).Line
+		lineEnd := enc.text.lineEnd(line)
+		if lineEnd > end {
+			lineEnd = end
+		}
+		segStart, segEnd := start, lineEnd
+		if trim {
+			segment := enc.text.src[segStart:segEnd]
+			segStart += len(segment) - len(strings.TrimLeft(segment, " \t"))
+			segEnd -= len(segment) - len(strings.TrimRight(segment, " \t\r"))
+		}
+		if segStart < segEnd {
+			enc.emit(segStart, segEnd, tokenType, modifiers)
+		}
+		if line+1 >= enc.text.lineCount() {
+			break
+		}
+		start = enc.text.lineStarts[line+1]
+	}
+}
+
+// emit encodes a token within a single line.
+func (enc *tokenEncoder) emit(start, end, tokenType, modifiers int) {
+	pos := enc.text.position(start)
+	deltaLine := pos.Line - enc.prev.Line
+	deltaChar := pos.Character
+	if deltaLine == 0 {
+		deltaChar -= enc.prev.Character
+	}
+	length := utf16Len(enc.text.src[start:end])
+	enc.data = append(enc.data, deltaLine, deltaChar, length, tokenType, modifiers)
+	enc.prev = pos
+}
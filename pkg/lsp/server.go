@@ -0,0 +1,503 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/ast"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+// Server is a Language Server Protocol server for Romualdo source code. It
+// handles one message at a time, so it is not safe for concurrent use.
+type Server struct {
+	// w is where responses and notifications are written to.
+	w io.Writer
+
+	// writeErr is the first error that happened while writing to w.
+	writeErr error
+
+	// root is the absolute path to the root of the Storyworld. Taken from the
+	// workspace root, or from the first document opened if there is none.
+	root string
+
+	// open maps the absolute paths of the documents open in the client to
+	// their (possibly unsaved) contents.
+	open map[string]string
+
+	// analysis is the latest analysis of the Storyworld. Nil before the first
+	// one.
+	analysis *analysis
+
+	// published contains the absolute paths of the files for which non-empty
+	// diagnostics were published, so that they can be cleared when fixed.
+	published map[string]bool
+}
+
+// NewServer creates a new Server that writes its responses and notifications to
+// w.
+func NewServer(w io.Writer) *Server {
+	return &Server{
+		w:         w,
+		open:      map[string]string{},
+		published: map[string]bool{},
+	}
+}
+
+// Serve reads messages from r and handles them, until the client asks the
+// server to exit or r ends.
+func (s *Server) Serve(r io.Reader) errs.Error {
+	br := bufio.NewReader(r)
+	for {
+		msg, err := romutil.ReadBaseProtocolMessage(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errs.NewRomualdoTool("reading LSP message: %v", err)
+		}
+		keepGoing := s.Handle(msg)
+		if s.writeErr != nil {
+			return errs.NewRomualdoTool("writing LSP message: %v", s.writeErr)
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+}
+
+// Handle handles a single message, given as its JSON content (without the
+// header of the LSP base protocol). Any responses and notifications are
+// written before returning. Returns false once the client asked the server to
+// exit.
+func (s *Server) Handle(content []byte) bool {
+	msg := &incoming{}
+	err := json.Unmarshal(content, msg)
+	if err != nil {
+		s.replyError(json.RawMessage("null"), codeParseError, "parsing message: %v", err)
+		return true
+	}
+
+	switch msg.Method {
+	case "initialize":
+		s.initialize(msg)
+	case "initialized":
+		if s.root != "" {
+			s.refresh()
+		}
+	case "shutdown":
+		s.reply(msg, nil)
+	case "exit":
+		return false
+	case "textDocument/didOpen":
+		s.didOpen(msg)
+	case "textDocument/didChange":
+		s.didChange(msg)
+	case "textDocument/didSave":
+		s.refresh()
+	case "textDocument/didClose":
+		s.didClose(msg)
+	case "textDocument/definition":
+		s.definition(msg)
+	case "textDocument/references":
+		s.references(msg)
+	case "textDocument/hover":
+		s.hover(msg)
+	case "textDocument/documentSymbol":
+		s.documentSymbol(msg)
+	case "textDocument/semanticTokens/full":
+		s.semanticTokens(msg)
+	default:
+		// Notifications we don't know about can be safely ignored.
+		if msg.isRequest() {
+			s.replyError(msg.ID, codeMethodNotFound, "method not supported: %v", msg.Method)
+		}
+	}
+	return true
+}
+
+//
+// Lifecycle and document synchronization
+//
+
+// initialize handles the initialize request.
+func (s *Server) initialize(msg *incoming) {
+	params := &initializeParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	switch {
+	case params.RootURI != "":
+		s.root = uriToPath(params.RootURI)
+	case params.RootPath != "":
+		s.root = filepath.Clean(params.RootPath)
+	case len(params.WorkspaceFolders) > 0:
+		s.root = uriToPath(params.WorkspaceFolders[0].URI)
+	}
+
+	s.reply(msg, map[string]any{
+		"capabilities": map[string]any{
+			"textDocumentSync": map[string]any{
+				"openClose": true,
+				"change":    1, // Full
+				"save":      true,
+			},
+			"definitionProvider":     true,
+			"referencesProvider":     true,
+			"hoverProvider":          true,
+			"documentSymbolProvider": true,
+			"semanticTokensProvider": map[string]any{
+				"legend": map[string]any{
+					"tokenTypes":     semanticTokenTypes,
+					"tokenModifiers": semanticTokenModifiers,
+				},
+				"full": true,
+			},
+		},
+		"serverInfo": map[string]any{
+			"name": "romualdo",
+		},
+	})
+}
+
+// didOpen handles the textDocument/didOpen notification.
+func (s *Server) didOpen(msg *incoming) {
+	params := &didOpenParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	path := uriToPath(params.TextDocument.URI)
+	if path == "" {
+		return
+	}
+	if s.root == "" {
+		s.root = filepath.Dir(path)
+	}
+	s.open[path] = params.TextDocument.Text
+	s.refresh()
+}
+
+// didChange handles the textDocument/didChange notification.
+func (s *Server) didChange(msg *incoming) {
+	params := &didChangeParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	path := uriToPath(params.TextDocument.URI)
+	if path == "" || len(params.ContentChanges) == 0 {
+		return
+	}
+	s.open[path] = params.ContentChanges[len(params.ContentChanges)-1].Text
+	s.refresh()
+}
+
+// didClose handles the textDocument/didClose notification.
+func (s *Server) didClose(msg *incoming) {
+	params := &didCloseParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	delete(s.open, uriToPath(params.TextDocument.URI))
+	s.refresh()
+}
+
+// refresh analyzes the Storyworld again and publishes the diagnostics that
+// changed: the ones of files with problems, and the (now empty) ones of files
+// whose problems were fixed.
+func (s *Server) refresh() {
+	s.analysis = analyze(s.root, s.open)
+
+	paths := []string{}
+	for path := range s.published {
+		if len(s.analysis.diagnostics[path]) == 0 {
+			paths = append(paths, path)
+		}
+	}
+	for path := range s.analysis.diagnostics {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	s.published = map[string]bool{}
+	for _, path := range paths {
+		diagnostics := s.analysis.diagnostics[path]
+		if len(diagnostics) > 0 {
+			s.published[path] = true
+		} else {
+			diagnostics = []diagnostic{}
+		}
+		s.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+			URI:         pathToURI(path),
+			Diagnostics: diagnostics,
+		})
+	}
+}
+
+//
+// Language features
+//
+
+// definition handles the textDocument/definition request.
+func (s *Server) definition(msg *incoming) {
+	params := &textDocumentPositionParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	f, offset := s.fileAt(params.TextDocument, params.Position)
+	if f == nil {
+		s.reply(msg, nil)
+		return
+	}
+	proc := f.procedureAt(offset)
+	if proc == nil {
+		s.reply(msg, nil)
+		return
+	}
+	loc, ok := s.analysis.declaration(proc)
+	if !ok {
+		s.reply(msg, nil)
+		return
+	}
+	s.reply(msg, loc)
+}
+
+// references handles the textDocument/references request.
+func (s *Server) references(msg *incoming) {
+	params := &referenceParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	f, offset := s.fileAt(params.TextDocument, params.Position)
+	if f == nil {
+		s.reply(msg, nil)
+		return
+	}
+	proc := f.procedureAt(offset)
+	if proc == nil {
+		s.reply(msg, nil)
+		return
+	}
+	s.reply(msg, s.analysis.references(proc, params.Context.IncludeDeclaration))
+}
+
+// hover handles the textDocument/hover request, showing the signatures of
+// Procedures.
+func (s *Server) hover(msg *incoming) {
+	params := &textDocumentPositionParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	f, offset := s.fileAt(params.TextDocument, params.Position)
+	if f == nil {
+		s.reply(msg, nil)
+		return
+	}
+	proc := f.procedureAt(offset)
+	if proc == nil {
+		s.reply(msg, nil)
+		return
+	}
+
+	start := proc.NameOffset
+	if id := f.identifierAt(offset); id != nil {
+		start = id.Offset
+	}
+	r := f.text.rangeOf(start, start+len(proc.Name))
+	s.reply(msg, &hover{
+		Contents: markupContent{
+			Kind:  "markdown",
+			Value: fmt.Sprintf("```romualdo\n%v\n```\n\n`%v`", signature(proc), proc.FQN()),
+		},
+		Range: &r,
+	})
+}
+
+// documentSymbol handles the textDocument/documentSymbol request, listing the
+// Procedures and global variables declared in a document.
+func (s *Server) documentSymbol(msg *incoming) {
+	params := &documentParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	f := s.file(params.TextDocument)
+	if f == nil {
+		s.reply(msg, nil)
+		return
+	}
+
+	type symbolAt struct {
+		offset int
+		symbol documentSymbol
+	}
+	var symbols []symbolAt
+	for _, proc := range f.procedures {
+		nameLen := len(proc.Name)
+		if proc.Kind == ast.ProcKindMigration {
+			nameLen = len("migrate")
+		}
+		r := f.text.rangeOf(proc.NameOffset, proc.NameOffset+nameLen)
+		symbols = append(symbols, symbolAt{proc.NameOffset, documentSymbol{
+			Name:           proc.Name,
+			Detail:         procedureDetail(proc),
+			Kind:           symbolKindFunction,
+			Range:          r,
+			SelectionRange: r,
+		}})
+	}
+	for _, global := range f.globals {
+		r := f.text.rangeOf(global.NameOffset, global.NameOffset+len(global.Name))
+		symbols = append(symbols, symbolAt{global.NameOffset, documentSymbol{
+			Name:           global.Name,
+			Detail:         globalDetail(global),
+			Kind:           symbolKindVariable,
+			Range:          r,
+			SelectionRange: r,
+		}})
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].offset < symbols[j].offset
+	})
+
+	result := make([]documentSymbol, len(symbols))
+	for i, sym := range symbols {
+		result[i] = sym.symbol
+	}
+	s.reply(msg, result)
+}
+
+// semanticTokens handles the textDocument/semanticTokens/full request.
+func (s *Server) semanticTokens(msg *incoming) {
+	params := &documentParams{}
+	if !s.decodeParams(msg, params) {
+		return
+	}
+	f := s.file(params.TextDocument)
+	if f == nil {
+		s.reply(msg, nil)
+		return
+	}
+	s.reply(msg, &semanticTokens{Data: f.semanticTokens()})
+}
+
+//
+// Helpers
+//
+
+// file returns the analyzed source file corresponding to the given document,
+// or nil if there is none.
+func (s *Server) file(doc textDocumentIdentifier) *sourceFile {
+	if s.analysis == nil {
+		return nil
+	}
+	return s.analysis.files[uriToPath(doc.URI)]
+}
+
+// fileAt returns the analyzed source file corresponding to the given document,
+// and the byte offset corresponding to pos within it. The file is nil if there
+// is none.
+func (s *Server) fileAt(doc textDocumentIdentifier, pos position) (*sourceFile, int) {
+	f := s.file(doc)
+	if f == nil {
+		return nil, 0
+	}
+	return f, f.text.offset(pos)
+}
+
+// decodeParams decodes the parameters of msg into params. If they cannot be
+// decoded, replies with an error (for requests) and returns false.
+func (s *Server) decodeParams(msg *incoming, params any) bool {
+	if len(msg.Params) == 0 {
+		return true
+	}
+	err := json.Unmarshal(msg.Params, params)
+	if err != nil {
+		if msg.isRequest() {
+			s.replyError(msg.ID, codeInvalidParams, "invalid params for %v: %v", msg.Method, err)
+		}
+		return false
+	}
+	return true
+}
+
+// reply sends a successful response to the request msg.
+func (s *Server) reply(msg *incoming, result any) {
+	s.write(&response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+}
+
+// replyError sends an error response to the request with the given ID.
+func (s *Server) replyError(id json.RawMessage, code int, format string, a ...any) {
+	s.write(&errorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   responseError{Code: code, Message: fmt.Sprintf(format, a...)},
+	})
+}
+
+// notify sends a notification to the client.
+func (s *Server) notify(method string, params any) {
+	s.write(&notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// write writes msg to the client, remembering the first error.
+func (s *Server) write(msg any) {
+	if s.writeErr != nil {
+		return
+	}
+	s.writeErr = writeMessage(s.w, msg)
+}
+
+// procedureDetail returns the detail shown for proc in the document symbols.
+func procedureDetail(proc *ast.ProcedureDecl) string {
+	if proc.Kind == ast.ProcKindMigration {
+		return "migration"
+	}
+	return signature(proc)
+}
+
+// globalDetail returns the detail shown for global in the document symbols.
+func globalDetail(global *ast.VarDecl) string {
+	kind := "global"
+	if global.Profile {
+		kind = "profile"
+	}
+	if name := global.VarType.SourceName(); name != "" {
+		return kind + ": " + name
+	}
+	return kind
+}
+
+// uriToPath converts a file URI to an absolute path. Returns an empty string
+// for anything but file URIs.
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return filepath.Clean(filepath.FromSlash(u.Path))
+}
+
+// pathToURI converts an absolute path to a file URI.
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// isWithin checks if path is within the directory root.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
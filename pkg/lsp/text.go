@@ -0,0 +1,105 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// text is the contents of a source file, along with what is needed to convert
+// between the byte offsets used by the frontend and the positions used by LSP.
+type text struct {
+	// src is the text itself.
+	src string
+
+	// lineStarts contains the byte offset where each line starts.
+	lineStarts []int
+}
+
+// newText creates a new text with the given contents.
+func newText(src string) *text {
+	t := &text{src: src, lineStarts: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			t.lineStarts = append(t.lineStarts, i+1)
+		}
+	}
+	return t
+}
+
+// position converts a byte offset to an LSP position.
+func (t *text) position(offset int) position {
+	if offset > len(t.src) {
+		offset = len(t.src)
+	}
+	line := sort.Search(len(t.lineStarts), func(i int) bool {
+		return t.lineStarts[i] > offset
+	}) - 1
+	return position{Line: line, Character: utf16Len(t.src[t.lineStarts[line]:offset])}
+}
+
+// offset converts an LSP position to a byte offset. Positions beyond the end of
+// a line are taken as the end of the line.
+func (t *text) offset(pos position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(t.lineStarts) {
+		return len(t.src)
+	}
+	offset := t.lineStarts[pos.Line]
+	end := t.lineEnd(pos.Line)
+	for units := 0; offset < end && units < pos.Character; {
+		r, size := utf8.DecodeRuneInString(t.src[offset:])
+		units += utf16RuneLen(r)
+		offset += size
+	}
+	return offset
+}
+
+// rangeOf converts the span between the byte offsets start and end to an LSP
+// range.
+func (t *text) rangeOf(start, end int) rng {
+	return rng{Start: t.position(start), End: t.position(end)}
+}
+
+// lineEnd returns the byte offset where the given line ends, not counting the
+// line break.
+func (t *text) lineEnd(line int) int {
+	if line+1 < len(t.lineStarts) {
+		end := t.lineStarts[line+1] - 1
+		if end > t.lineStarts[line] && t.src[end-1] == '\r' {
+			end--
+		}
+		return end
+	}
+	return len(t.src)
+}
+
+// lineCount returns the number of lines in the text.
+func (t *text) lineCount() int {
+	return len(t.lineStarts)
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+// utf16RuneLen returns the number of UTF-16 code units needed to encode r.
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,12 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The replay package replays recorded playthroughs against a compiled
+// Storyworld, to check if a new build still behaves like the one used to
+// record them. It's the machinery behind the `replay` command, and behind the
+// `--record` and `--replay` flags of the `run` command.
+package replay
@@ -0,0 +1,96 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package replay
+
+import (
+	"os"
+	"path"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// Recording is a recorded playthrough of a Storyworld. It mirrors the
+// recording TOML file format.
+type Recording struct {
+	// StoryworldHash is the hash of the compiled Storyworld the playthrough
+	// was recorded with (see StoryworldHash()). Empty if unknown, like for
+	// recordings written by hand.
+	StoryworldHash string `toml:"storyworldHash,omitempty"`
+
+	// Externals maps the fully-qualified names of the external functions
+	// declared in the Storyworld to the values they returned during the
+	// playthrough. They are bound to the same values when replaying.
+	Externals map[string]any `toml:"externals,omitempty"`
+
+	// Steps contains the steps of the playthrough. The first one corresponds
+	// to the start of the Story, so it has no input.
+	Steps []Step `toml:"step"`
+
+	// dir is the directory the recording was loaded from. Paths to saved
+	// states are relative to it.
+	dir string
+}
+
+// Step is a single step of a recorded playthrough.
+type Step struct {
+	// Input is the input sent to the Storyworld. Ignored for the first step.
+	Input string `toml:"input"`
+
+	// Output is the output the Storyworld generated in response to Input.
+	Output string `toml:"output"`
+
+	// SavedState is the path to a state saved right after this step, if any.
+	SavedState string `toml:"savedState,omitempty"`
+}
+
+// LoadRecording loads a Recording from the TOML file at recPath.
+func LoadRecording(recPath string) (*Recording, errs.Error) {
+	source, err := os.ReadFile(recPath)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("reading recording %v: %v", recPath, err)
+	}
+
+	rec := &Recording{}
+	err = toml.Unmarshal(source, rec)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("parsing recording %v: %v", recPath, err)
+	}
+	if len(rec.Steps) == 0 {
+		return nil, errs.NewRomualdoTool("recording %v has no steps", recPath)
+	}
+
+	rec.dir = path.Dir(recPath)
+	return rec, nil
+}
+
+// Save saves the Recording to a TOML file at recPath. Paths to saved states
+// are written as they are, so they should be relative to the directory of
+// recPath.
+func (rec *Recording) Save(recPath string) errs.Error {
+	data, err := toml.Marshal(rec)
+	if err != nil {
+		return errs.NewRomualdoTool("encoding recording: %v", err)
+	}
+
+	err = os.WriteFile(recPath, data, 0644)
+	if err != nil {
+		return errs.NewRomualdoTool("writing recording %v: %v", recPath, err)
+	}
+	return nil
+}
+
+// savedStatePath returns the path to the saved state of the step with the given
+// index.
+func (rec *Recording) savedStatePath(step int) string {
+	p := rec.Steps[step].SavedState
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(rec.dir, p)
+}
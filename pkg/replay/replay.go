@@ -0,0 +1,208 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package replay
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// Options tells how to replay Recordings.
+type Options struct {
+	// InstructionBudget is the maximum number of instructions the Storyworld
+	// can run between two steps. Runs going over it diverge (it usually means
+	// the new build is stuck in a loop). Zero means no limit.
+	InstructionBudget int
+}
+
+// Report is the result of replaying a Recording.
+type Report struct {
+	// Runs contains the report of each run made while replaying the
+	// Recording: one from the start of the Story, plus one from each saved
+	// state in the Recording.
+	Runs []RunReport
+}
+
+// RunReport is the result of a single run made while replaying a Recording.
+type RunReport struct {
+	// SavedState is the path to the saved state this run started from. Empty
+	// if the run started from the start of the Story.
+	SavedState string
+
+	// FirstStep is the index of the first step replayed on this run.
+	FirstStep int
+
+	// StepsReplayed is the number of steps replayed successfully.
+	StepsReplayed int
+
+	// Divergence describes how the run diverged from the Recording. Nil if it
+	// didn't.
+	Divergence *Divergence
+}
+
+// Divergence describes how a run diverged from the Recording.
+type Divergence struct {
+	// Step is the index of the step where the divergence happened.
+	Step int
+
+	// Message describes the divergence.
+	Message string
+}
+
+// DivergenceCount returns the number of runs that diverged from the Recording.
+func (r *Report) DivergenceCount() int {
+	count := 0
+	for _, run := range r.Runs {
+		if run.Divergence != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// String converts the RunReport to a human-readable string.
+func (r *RunReport) String() string {
+	from := "from the start"
+	if r.SavedState != "" {
+		from = fmt.Sprintf("from %v (after step %v)", r.SavedState, r.FirstStep-1)
+	}
+	if r.Divergence == nil {
+		return fmt.Sprintf("%v: OK, %v step(s) replayed", from, r.StepsReplayed)
+	}
+	return fmt.Sprintf("%v: diverged at step %v: %v", from, r.Divergence.Step, r.Divergence.Message)
+}
+
+// Replay replays rec against the given CompiledStoryworld and (potentially nil)
+// DebugInfo. First, the whole Recording is replayed from the start of the
+// Story. Then, for each saved state in the Recording, the saved state is loaded
+// and the remaining steps are replayed from there.
+//
+// Each run stops at its first divergence, since anything after that would be
+// hardly meaningful.
+func Replay(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, rec *Recording, opts Options) *Report {
+	report := &Report{}
+	theVM, err := newVM(csw, di, rec, opts)
+	if err != nil {
+		report.Runs = append(report.Runs, RunReport{
+			Divergence: &Divergence{Message: err.Error()},
+		})
+	} else {
+		report.Runs = append(report.Runs, replayRun(theVM, rec, 0, ""))
+	}
+
+	for i := range rec.Steps {
+		if rec.Steps[i].SavedState == "" {
+			continue
+		}
+		statePath := rec.savedStatePath(i)
+		theVM, err := newVM(csw, di, rec, opts)
+		if err == nil {
+			err = loadState(theVM, statePath)
+		}
+		if err != nil {
+			report.Runs = append(report.Runs, RunReport{
+				SavedState: rec.Steps[i].SavedState,
+				FirstStep:  i + 1,
+				Divergence: &Divergence{
+					Step:    i,
+					Message: err.Error(),
+				},
+			})
+			continue
+		}
+		report.Runs = append(report.Runs, replayRun(theVM, rec, i+1, rec.Steps[i].SavedState))
+	}
+
+	return report
+}
+
+// replayRun replays the steps of rec starting at firstStep, using theVM. If
+// firstStep is zero, the Story is started anew; otherwise, theVM is expected to
+// have the state saved right after the previous step.
+func replayRun(theVM *vm.VM, rec *Recording, firstStep int, savedState string) RunReport {
+	report := RunReport{
+		SavedState: savedState,
+		FirstStep:  firstStep,
+	}
+
+	for step := firstStep; step < len(rec.Steps); step++ {
+		var output vm.Output
+		var err errs.Error
+		if step == 0 {
+			output, err = theVM.Start(context.Background())
+		} else {
+			if theVM.State != vm.StateWaitingForInput {
+				report.Divergence = &Divergence{
+					Step:    step,
+					Message: "the Story ended, but the recording continues",
+				}
+				return report
+			}
+			output, err = theVM.Step(context.Background(), rec.Steps[step].Input)
+		}
+
+		if err != nil {
+			report.Divergence = &Divergence{
+				Step:    step,
+				Message: fmt.Sprintf("error running the Storyworld: %v", err),
+			}
+			return report
+		}
+		if theVM.State == vm.StateInterrupted {
+			report.Divergence = &Divergence{
+				Step: step,
+				Message: fmt.Sprintf("the Storyworld ran %v instructions without "+
+					"listening to the Player or ending", theVM.InstructionBudget),
+			}
+			return report
+		}
+
+		// Events are part of the output, too: emitting different events is a
+		// divergence just like saying different things.
+		expected := rec.Steps[step].Output
+		actual := output.TextWithEvents()
+		if actual != expected {
+			report.Divergence = &Divergence{
+				Step:    step,
+				Message: fmt.Sprintf("expected output %q, got %q", expected, actual),
+			}
+			return report
+		}
+		report.StepsReplayed++
+	}
+
+	return report
+}
+
+// newVM creates a VM to replay rec against csw, with the external functions
+// bound to the values in rec and configured according to opts.
+func newVM(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, rec *Recording, opts Options) (*vm.VM, errs.Error) {
+	theVM := vm.New(csw, di)
+	theVM.InstructionBudget = opts.InstructionBudget
+	if err := theVM.BindConstantExternals(rec.Externals); err != nil {
+		return nil, err
+	}
+	return theVM, nil
+}
+
+// loadState loads the saved state at statePath into theVM.
+func loadState(theVM *vm.VM, statePath string) errs.Error {
+	file, plainErr := os.Open(statePath)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("opening saved state %v: %v", statePath, plainErr)
+	}
+	defer file.Close()
+
+	_, err := theVM.LoadState(context.Background(), file)
+	return err
+}
@@ -0,0 +1,228 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// StoryworldHash returns the hash of csw, in hexadecimal. It changes whenever
+// anything in the compiled Storyworld changes, so it tells if a Recording was
+// made with the very same build.
+func StoryworldHash(csw *bytecode.CompiledStoryworld) (string, errs.Error) {
+	buf := &bytes.Buffer{}
+	err := csw.Serialize(buf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())), nil
+}
+
+// TranscriptOptions tells NewTranscript() what the Transcript shall do.
+type TranscriptOptions struct {
+	// Record is the path where the playthrough is recorded. Empty means no
+	// recording.
+	Record string
+
+	// Replay is the path of the Recording to replay. Empty means no replaying.
+	Replay string
+
+	// InteractiveFrom is the step the Player takes over from, when replaying
+	// (see NewReplayer()).
+	InteractiveFrom int
+
+	// Warnings is where warnings are written to, like the one about replaying
+	// a Recording made with a different build of the Storyworld.
+	Warnings io.Writer
+}
+
+// NewTranscript creates the vm.Transcript for a run of csw, as opts tell (nil
+// if neither recording nor replaying). When replaying, the external functions
+// return the values recorded in the Recording, unless overridden by the ones in
+// externals; the resulting values are returned.
+func NewTranscript(csw *bytecode.CompiledStoryworld, externals map[string]any, opts TranscriptOptions) (
+	map[string]any, vm.Transcript, errs.Error) {
+
+	var rec *Recording
+	if opts.Replay != "" {
+		var err errs.Error
+		rec, err = LoadRecording(opts.Replay)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash, err := StoryworldHash(csw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.StoryworldHash != "" && rec.StoryworldHash != hash {
+			fmt.Fprintf(opts.Warnings, "Warning: %v was recorded with a different build of the Storyworld.\n",
+				opts.Replay)
+		}
+		merged := map[string]any{}
+		for fqn, value := range rec.Externals {
+			merged[fqn] = value
+		}
+		for fqn, value := range externals {
+			merged[fqn] = value
+		}
+		externals = merged
+	}
+
+	var recorder *Recorder
+	if opts.Record != "" {
+		var err errs.Error
+		recorder, err = NewRecorder(opts.Record, csw, externals)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch {
+	case rec != nil:
+		return externals, NewReplayer(rec, opts.InteractiveFrom, recorder), nil
+	case recorder != nil:
+		return externals, recorder, nil
+	default:
+		return externals, nil, nil
+	}
+}
+
+// Recorder is a vm.Transcript that records a playthrough, saving the Recording
+// after every step (so that it is there even if the Driver Program crashes).
+// Inputs come from the Player.
+type Recorder struct {
+	// rec is the Recording being made.
+	rec *Recording
+
+	// recPath is where the Recording is saved.
+	recPath string
+}
+
+// NewRecorder creates a Recorder saving the Recording to recPath. csw is the
+// Storyworld being played, and externals are the values returned by its
+// external functions.
+func NewRecorder(recPath string, csw *bytecode.CompiledStoryworld, externals map[string]any) (*Recorder, errs.Error) {
+	hash, err := StoryworldHash(csw)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{
+		StoryworldHash: hash,
+		Externals:      externals,
+	}
+	return &Recorder{rec: rec, recPath: recPath}, nil
+}
+
+// Input fulfills the vm.Transcript interface. Inputs always come from the
+// Player.
+func (r *Recorder) Input(step int) (string, vm.InputSource) {
+	return "", vm.InputFromPlayer
+}
+
+// Stepped fulfills the vm.Transcript interface.
+func (r *Recorder) Stepped(step int, input string, out vm.Output) errs.Error {
+	r.rec.Steps = append(r.rec.Steps[:step], Step{
+		Input:  input,
+		Output: out.TextWithEvents(),
+	})
+	return r.rec.Save(r.recPath)
+}
+
+// Undone fulfills the vm.Transcript interface. The undone step is dropped from
+// the Recording, as if the choice had never been made.
+func (r *Recorder) Undone() {
+	r.rec.Steps = r.rec.Steps[:len(r.rec.Steps)-1]
+
+	// Nothing sensible to do if this fails; the next step will try again.
+	_ = r.rec.Save(r.recPath)
+}
+
+// Replayer is a vm.Transcript that feeds the inputs of a Recording, stopping at
+// the first divergence from the recorded outputs. Optionally, the Player takes
+// over from a given step on.
+type Replayer struct {
+	// rec is the Recording being replayed.
+	rec *Recording
+
+	// interactiveFrom is the first step whose input comes from the Player.
+	// Zero means the Player never takes over.
+	interactiveFrom int
+
+	// recorder, if not nil, records the playthrough, replayed steps
+	// included.
+	recorder *Recorder
+}
+
+// NewReplayer creates a Replayer for rec. If interactiveFrom is positive, the
+// Player takes over from this step on (replayed steps are numbered as in the
+// recording, with the start of the Story being step zero). Otherwise, the run
+// stops at the end of the Recording. If recorder is not nil, the whole
+// playthrough is also recorded with it.
+func NewReplayer(rec *Recording, interactiveFrom int, recorder *Recorder) *Replayer {
+	return &Replayer{
+		rec:             rec,
+		interactiveFrom: interactiveFrom,
+		recorder:        recorder,
+	}
+}
+
+// replayed tells if the given step is replayed from the Recording.
+func (r *Replayer) replayed(step int) bool {
+	return step < len(r.rec.Steps) && (r.interactiveFrom <= 0 || step < r.interactiveFrom)
+}
+
+// Input fulfills the vm.Transcript interface.
+func (r *Replayer) Input(step int) (string, vm.InputSource) {
+	switch {
+	case r.replayed(step):
+		return r.rec.Steps[step].Input, vm.InputFromTranscript
+	case r.interactiveFrom > 0:
+		return "", vm.InputFromPlayer
+	default:
+		return "", vm.InputNone
+	}
+}
+
+// Stepped fulfills the vm.Transcript interface.
+func (r *Replayer) Stepped(step int, input string, out vm.Output) errs.Error {
+	if r.recorder != nil {
+		err := r.recorder.Stepped(step, input, out)
+		if err != nil {
+			return err
+		}
+	}
+	if !r.replayed(step) {
+		return nil
+	}
+
+	expected := r.rec.Steps[step].Output
+	actual := out.TextWithEvents()
+	if actual != expected {
+		return errs.NewRomualdoTool("diverged from the recording at step %v: expected output %q, got %q",
+			step, expected, actual)
+	}
+	if out.State == vm.StateEndOfStory && r.replayed(step+1) {
+		return errs.NewRomualdoTool("diverged from the recording at step %v: "+
+			"the Story ended, but the recording continues", step)
+	}
+	return nil
+}
+
+// Undone fulfills the vm.Transcript interface.
+func (r *Replayer) Undone() {
+	if r.recorder != nil {
+		r.recorder.Undone()
+	}
+}
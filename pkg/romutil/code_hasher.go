@@ -9,27 +9,58 @@ package romutil
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash"
 
 	"github.com/stackedboxes/romualdo/pkg/ast"
+	"github.com/stackedboxes/romualdo/pkg/errs"
 )
 
 // CodeHash can store the hash of some code bit.
 type CodeHash [sha256.Size]byte
 
+// MarshalText implements encoding.TextMarshaler, representing the hash in
+// hexadecimal.
+func (h CodeHash) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h[:])), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, reading a hash in
+// hexadecimal.
+func (h *CodeHash) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(h) {
+		return fmt.Errorf("code hash must have %v bytes, got %v", len(h), len(decoded))
+	}
+	copy(h[:], decoded)
+	return nil
+}
+
 // CodeHasher is a node visitor that computes the hash of procedures and
 // globals.
 //
 // Hashing is used to detect meaningful changes to code -- changes that require
 // a new version of the procedure to be created.
 //
-// TODO: This operates at source file level. It should operate at package level,
-// or storyworld level.
+// This is meant to be run over a whole ast.Storyworld, after name resolution:
+// every symbol is hashed by its fully-qualified name, so that, for example,
+// changing the package an import alias refers to changes the hash of every
+// procedure using that alias.
 type CodeHasher struct {
 	// hash is the Hash object used to hash the code contents.
 	hash hash.Hash
 
+	// inGlobal tells if we are visiting a global variable declaration. Global
+	// initializers are not hashed, so we need to know when to ignore nodes.
+	inGlobal bool
+
+	// errors collects the errors found while hashing.
+	errors errs.CompileTimeCollection
+
 	// Hashes stores the code hashes. Maps the fully-qualified symbol names to
 	// their hashes.
 	Hashes map[string]CodeHash
@@ -44,6 +75,10 @@ func NewCodeHasher() *CodeHasher {
 
 // The Visitor interface
 func (hasher *CodeHasher) Enter(node ast.Node) {
+	if hasher.inGlobal {
+		return
+	}
+
 	switch n := node.(type) {
 
 	case *ast.Binary:
@@ -57,11 +92,37 @@ func (hasher *CodeHasher) Enter(node ast.Node) {
 		}
 
 	case *ast.Curlies:
-		hasher.writeToken("}")
+		hasher.writeToken("{")
+
+	case *ast.Emit:
+		hasher.writeToken("emit")
 
 	case *ast.IfStmt:
 		hasher.writeToken("if")
 
+	case *ast.Identifier:
+		hasher.writeIdentifier(n)
+
+	case *ast.Assignment:
+		hasher.writeIdentifier(n.Target)
+		hasher.writeToken("=")
+
+	case *ast.Return:
+		hasher.writeToken("return")
+
+	case *ast.VarDecl:
+		// Entering a brand new global. The type is always hashed (even if it
+		// was inferred), but the initializer is not: changing the initial
+		// value doesn't affect the saved states.
+		hasher.hash.Reset()
+		if n.Profile {
+			hasher.writeToken("profile")
+		}
+		hasher.writeToken(n.FQN())
+		hasher.writeToken(":")
+		hasher.writeToken(typeStringFromTag(n.VarType))
+		hasher.inGlobal = true
+
 	case *ast.Lecture:
 		hasher.writeToken(n.Text)
 
@@ -78,12 +139,17 @@ func (hasher *CodeHasher) Enter(node ast.Node) {
 			hasher.writeToken("function")
 		case ast.ProcKindPassage:
 			hasher.writeToken("passage")
+		case ast.ProcKindMigration:
+			hasher.writeToken("migrate")
+		case ast.ProcKindExternal:
+			hasher.writeToken("external")
+			hasher.writeToken("function")
 		default:
 			panic("Unexpected procedure type")
 		}
 
 		// The procedure name.
-		hasher.writeToken(n.Name)
+		hasher.writeToken(n.FQN())
 
 		// Then the parameters.
 		hasher.writeToken("(")
@@ -109,7 +175,8 @@ func (hasher *CodeHasher) Enter(node ast.Node) {
 	case *ast.StringLiteral:
 		hasher.writeToken("\"" + n.Value + "\"")
 
-	case *ast.Block, *ast.SourceFile, *ast.Storyworld:
+	case *ast.Block, *ast.Call, *ast.ExpressionStmt, *ast.GlobalsBlock, *ast.Import,
+		*ast.SourceFile, *ast.Storyworld:
 		// Nothing to do!
 
 	default:
@@ -119,6 +186,16 @@ func (hasher *CodeHasher) Enter(node ast.Node) {
 }
 
 func (hasher *CodeHasher) Leave(node ast.Node) {
+	if v, ok := node.(*ast.VarDecl); ok {
+		hasher.inGlobal = false
+		hasher.storeHash(v.FQN(), v)
+		return
+	}
+
+	if hasher.inGlobal {
+		return
+	}
+
 	switch n := node.(type) {
 
 	case *ast.Binary:
@@ -127,20 +204,22 @@ func (hasher *CodeHasher) Leave(node ast.Node) {
 	case *ast.Curlies:
 		hasher.writeToken("}")
 
+	case *ast.Emit:
+		hasher.writeToken("}")
+
 	case *ast.IfStmt:
 		hasher.writeToken("end")
 
 	case *ast.ProcedureDecl:
 		hasher.writeToken("end")
+		hasher.storeHash(n.FQN(), n)
 
-		fqn := n.Package + n.Name
-		if _, exists := hasher.Hashes[fqn]; exists {
-			panic(fmt.Sprintf("Duplicate symbol: `%v`", fqn))
-		}
-		hasher.Hashes[fqn] = CodeHash(hasher.hash.Sum(nil))
+	case *ast.Call:
+		hasher.writeToken(")")
 
-	case *ast.Block, *ast.BoolLiteral, *ast.Lecture, *ast.Listen, *ast.Say,
-		*ast.SourceFile, *ast.Storyworld, *ast.StringLiteral:
+	case *ast.Assignment, *ast.Block, *ast.BoolLiteral, *ast.ExpressionStmt,
+		*ast.GlobalsBlock, *ast.Identifier, *ast.Import, *ast.Lecture, *ast.Listen,
+		*ast.Return, *ast.Say, *ast.SourceFile, *ast.Storyworld, *ast.StringLiteral:
 		// Nothing to do!
 
 	default:
@@ -150,6 +229,10 @@ func (hasher *CodeHasher) Leave(node ast.Node) {
 }
 
 func (hasher *CodeHasher) Event(node ast.Node, event ast.EventType) {
+	if hasher.inGlobal {
+		return
+	}
+
 	switch event {
 	case ast.EventAfterIfCondition:
 		hasher.writeToken("then")
@@ -163,9 +246,52 @@ func (hasher *CodeHasher) Event(node ast.Node, event ast.EventType) {
 			panic(fmt.Sprintf("Expected a Binary AST node, got a %T", node))
 		}
 		hasher.writeToken(bop.Operator)
+
+	case ast.EventAfterCallee:
+		hasher.writeToken("(")
+
+	case ast.EventAfterEmitName:
+		hasher.writeToken("{")
 	}
 }
 
+// writeIdentifier writes the token(s) corresponding to an identifier. Symbols
+// are written by their fully-qualified names, so that the hash doesn't depend
+// on the alias used to refer to them. Parameters have no fully-qualified name,
+// so they are written by their plain name.
+func (hasher *CodeHasher) writeIdentifier(id *ast.Identifier) {
+	fqn := id.FQN()
+	if fqn == "" {
+		hasher.writeToken(id.Name)
+		return
+	}
+	hasher.writeToken(fqn)
+}
+
+// storeHash stores the hash computed so far as the hash of the symbol whose
+// fully-qualified name is fqn, declared at node. Reports an error if the
+// symbol was already hashed.
+func (hasher *CodeHasher) storeHash(fqn string, node ast.Node) {
+	if _, exists := hasher.Hashes[fqn]; exists {
+		hasher.errors.Add(&errs.CompileTime{
+			Message:  fmt.Sprintf("Duplicate symbol: `%v`.", fqn),
+			FileName: node.SourceFile(),
+			Line:     node.Line(),
+		})
+		return
+	}
+	hasher.Hashes[fqn] = CodeHash(hasher.hash.Sum(nil))
+}
+
+// Err returns the errors found while hashing, or nil if there were none. Call
+// it after walking the AST.
+func (hasher *CodeHasher) Err() errs.Error {
+	if hasher.errors.IsEmpty() {
+		return nil
+	}
+	return &hasher.errors
+}
+
 // Writes a token so that it gets hashed.
 //
 // Notice that we add a zero byte after the string representation of the token
@@ -186,28 +312,13 @@ func (hasher *CodeHasher) writeToken(token string) {
 	}
 }
 
-// typeStringFromTag is a quick and dirty conversion function to obtain the
-// string representation of a type.
-//
-// TODO: This supports only built-in type (via the type tag), but eventually
-// we'll need to support user-defined types. On this day, we should move this
-// code to the ast package (or something like it), as we'll need to use it in
-// more places (like for naming types in error reporting).
+// typeStringFromTag obtains the string representation of a type. Panics for
+// types that cannot be written in the source code, which can only be hashed by
+// mistake.
 func typeStringFromTag(tag ast.TypeTag) string {
-	switch tag {
-	case ast.TypeVoid:
-		return "void"
-	case ast.TypeInt:
-		return "int"
-	case ast.TypeFloat:
-		return "float"
-	case ast.TypeBNum:
-		return "bnum"
-	case ast.TypeBool:
-		return "bool"
-	case ast.TypeString:
-		return "string"
-	default:
+	name := tag.SourceName()
+	if name == "" {
 		panic(fmt.Sprintf("Unexpected type tag: %T (%v)", tag, tag))
 	}
+	return name
 }
@@ -10,6 +10,7 @@ package romutil
 import (
 	"encoding/binary"
 	"io"
+	"strings"
 
 	"github.com/stackedboxes/romualdo/pkg/errs"
 )
@@ -59,6 +60,81 @@ func DeserializeI32(r io.Reader) (int32, errs.Error) {
 	return int32(binary.LittleEndian.Uint32(u32[:])), nil
 }
 
+// SerializeI64 writes an int64 to the given io.Writer, in little endian format,
+// two's complement.
+func SerializeI64(w io.Writer, v int64) errs.Error {
+	var u64 [8]byte
+	binary.LittleEndian.PutUint64(u64[:], uint64(v))
+	_, err := w.Write(u64[:])
+	if err != nil {
+		return errs.NewRomualdoTool("serializing int64: %v", err)
+	}
+	return nil
+}
+
+// DeserializeI64 reads an int64 from the given io.Reader, in little endian
+// format, two's complement.
+func DeserializeI64(r io.Reader) (int64, errs.Error) {
+	var u64 [8]byte
+	_, err := io.ReadFull(r, u64[:])
+	if err != nil {
+		return 0, errs.NewRomualdoTool("deserializing int64: %v", err)
+	}
+	return int64(binary.LittleEndian.Uint64(u64[:])), nil
+}
+
+// SerializeBool writes a bool to the given io.Writer, as a single byte (0 for
+// false, 1 for true).
+func SerializeBool(w io.Writer, v bool) errs.Error {
+	b := [1]byte{0}
+	if v {
+		b[0] = 1
+	}
+	_, err := w.Write(b[:])
+	if err != nil {
+		return errs.NewRomualdoTool("serializing bool: %v", err)
+	}
+	return nil
+}
+
+// DeserializeBool reads a bool from the given io.Reader, stored as a single
+// byte (0 for false, 1 for true).
+func DeserializeBool(r io.Reader) (bool, errs.Error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return false, errs.NewRomualdoTool("deserializing bool: %v", err)
+	}
+	switch b[0] {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, errs.NewRomualdoTool("deserializing bool: invalid value %v", b[0])
+	}
+}
+
+// SerializeCodeHash writes a CodeHash to the given io.Writer, as raw bytes.
+func SerializeCodeHash(w io.Writer, h CodeHash) errs.Error {
+	_, err := w.Write(h[:])
+	if err != nil {
+		return errs.NewRomualdoTool("serializing code hash: %v", err)
+	}
+	return nil
+}
+
+// DeserializeCodeHash reads a CodeHash from the given io.Reader, stored as raw
+// bytes.
+func DeserializeCodeHash(r io.Reader) (CodeHash, errs.Error) {
+	var h CodeHash
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return h, errs.NewRomualdoTool("deserializing code hash: %v", err)
+	}
+	return h, nil
+}
+
 // SerializeString writes a string to the given io.Writer. It first writes the
 // length of the string (as in uint32, little endian), then the string data
 // itself (UTF-8).
@@ -84,12 +160,17 @@ func DeserializeString(r io.Reader) (string, errs.Error) {
 		return "", err
 	}
 
-	buf := make([]byte, length)
-	_, plainErr := io.ReadFull(r, buf)
+	// Copy instead of allocating length bytes upfront, so that a corrupt length
+	// cannot make us allocate more memory than there is data to read.
+	sb := &strings.Builder{}
+	n, plainErr := io.CopyN(sb, r, int64(length))
+	if plainErr == io.EOF {
+		return "", errs.NewRomualdoTool("deserializing string: expected %v bytes, got %v", length, n)
+	}
 	if plainErr != nil {
 		return "", errs.NewRomualdoTool("deserializing string: %v", plainErr)
 	}
-	return string(buf), nil
+	return sb.String(), nil
 }
 
 // SerializeStringSliceNoLength writes a []string to a given io.Writer. For each
@@ -109,13 +190,13 @@ func SerializeStringSliceNoLength(w io.Writer, ss []string) errs.Error {
 // DeserializeStringSliceNoLength reads a []string from the given io.Reader. The
 // slice length must be provided.
 func DeserializeStringSliceNoLength(r io.Reader, length int) ([]string, errs.Error) {
-	ss := make([]string, length)
+	ss := make([]string, 0, preallocated(length))
 	for i := 0; i < length; i++ {
 		s, err := DeserializeString(r)
 		if err != nil {
 			return nil, err
 		}
-		ss[i] = s
+		ss = append(ss, s)
 	}
 	return ss, nil
 }
@@ -149,13 +230,27 @@ func DeserializeIntSliceAsU32(r io.Reader) ([]int, errs.Error) {
 		return nil, err
 	}
 
-	ii := make([]int, length)
+	ii := make([]int, 0, preallocated(int(length)))
 	for i := uint32(0); i < length; i++ {
 		u32, err := DeserializeU32(r)
 		if err != nil {
 			return nil, err
 		}
-		ii[i] = int(u32)
+		ii = append(ii, int(u32))
 	}
 	return ii, nil
 }
+
+// maxPreallocated is the maximum number of elements preallocated when
+// deserializing a slice. Slice lengths come from the data being read, which may
+// be corrupt: longer slices grow as their elements are actually read.
+const maxPreallocated = 1024
+
+// preallocated returns how many elements to preallocate for a slice of the
+// given length being deserialized.
+func preallocated(length int) int {
+	if length > maxPreallocated {
+		return maxPreallocated
+	}
+	return length
+}
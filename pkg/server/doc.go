@@ -0,0 +1,12 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The server package implements a simple HTTP/JSON story server, which runs
+// any number of Stories (sessions) of a compiled Storyworld on behalf of remote
+// Driver Programs. It's the machinery behind the `serve` command. See
+// doc/server.md for the API.
+package server
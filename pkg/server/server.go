@@ -0,0 +1,695 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// Options configures a Server.
+type Options struct {
+	// Strict makes soft errors behave like runtime errors. Otherwise, they are
+	// reported in the responses.
+	Strict bool
+
+	// InstructionBudget is the maximum number of instructions a Story can run
+	// while handling a single request. Zero means no limit.
+	InstructionBudget int
+
+	// Externals maps the fully-qualified names of the external functions
+	// declared in the Storyworld to the values they shall return.
+	Externals map[string]any
+
+	// HistoryDepth is the number of choices kept in the rewind history of each
+	// session. It only matters for the saved states, as the Server doesn't
+	// offer undoing.
+	HistoryDepth int
+
+	// SavedStateOptions are used for all binary saved states: the ones sent to
+	// and received from clients, and the ones persisted to Dir.
+	SavedStateOptions vm.SavedStateOptions
+
+	// Dir is the directory where sessions are persisted. If not empty, the
+	// state and the Profile of each session are saved there after every
+	// request that changes them, and are loaded back when a Server is created.
+	// If empty, sessions live only in memory.
+	Dir string
+
+	// Warnings is where warnings are written to, like the ones about
+	// persisted sessions that cannot be loaded. If nil, warnings are
+	// discarded.
+	Warnings io.Writer
+}
+
+// Server is an HTTP/JSON story server. It implements http.Handler, so it can
+// be used with net/http (or net/http/httptest, for testing).
+//
+// A Server is safe for concurrent use. Requests for different sessions run
+// concurrently (all of them sharing the same CompiledStoryworld), while
+// requests for the same session are serialized.
+type Server struct {
+	// csw is the Storyworld run by all sessions.
+	csw *bytecode.CompiledStoryworld
+
+	// di is the DebugInfo for csw. Can be nil.
+	di *bytecode.DebugInfo
+
+	// opts are the options this Server was created with.
+	opts Options
+
+	// mu protects sessions.
+	mu sync.Mutex
+
+	// sessions contains all the sessions, keyed by their IDs.
+	sessions map[string]*session
+}
+
+// session is a single Story being run by the Server.
+type session struct {
+	// mu serializes the requests for this session.
+	mu sync.Mutex
+
+	// id is the session ID.
+	id string
+
+	// vm is the VM running the Story.
+	vm *vm.VM
+
+	// output is the latest Output of the Story.
+	output vm.Output
+
+	// deleted tells if the session was deleted. Requests that were waiting for
+	// mu while it was being deleted must not touch it.
+	deleted bool
+}
+
+// Request is the body of the requests sent to the Server. Only the fields
+// relevant to each endpoint are used.
+type Request struct {
+	// Choice is the Player choice, for stepping the Story.
+	Choice string `json:"choice"`
+
+	// SavedState is a binary saved state, encoded in base64.
+	SavedState string `json:"savedState,omitempty"`
+
+	// SavedStateJSON is a saved state in the JSON representation.
+	SavedStateJSON json.RawMessage `json:"savedStateJSON,omitempty"`
+}
+
+// Response is the body of the responses sent by the Server for requests on a
+// single session. Only the fields relevant to each endpoint are set.
+type Response struct {
+	// ID is the session ID.
+	ID string `json:"id,omitempty"`
+
+	// Output is the latest Output of the Story.
+	Output *vm.Output `json:"output,omitempty"`
+
+	// SoftErrors contains the soft errors reported while handling the request.
+	SoftErrors []string `json:"softErrors,omitempty"`
+
+	// SavedState is a binary saved state, encoded in base64.
+	SavedState string `json:"savedState,omitempty"`
+
+	// SavedStateJSON is a saved state in the JSON representation.
+	SavedStateJSON json.RawMessage `json:"savedStateJSON,omitempty"`
+
+	// Error describes what went wrong, if anything.
+	Error string `json:"error,omitempty"`
+}
+
+// SessionList is the body of the response listing all sessions.
+type SessionList struct {
+	// Sessions contains one entry per session, sorted by ID.
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// SessionInfo summarizes a session.
+type SessionInfo struct {
+	// ID is the session ID.
+	ID string `json:"id"`
+
+	// State is the state of the VM running the Story.
+	State vm.State `json:"state"`
+}
+
+// savedStateExt and profileExt are the extensions of the files where sessions
+// are persisted.
+const (
+	savedStateExt = ".sav"
+	profileExt    = ".prf"
+)
+
+// maxRequestSize is the maximum size, in bytes, of a request body. It is
+// generous enough for the largest saved state the VM accepts, even in JSON.
+const maxRequestSize = 256 << 20
+
+// New creates a Server for the given CompiledStoryworld and (potentially nil)
+// DebugInfo. If opts.Dir is not empty, the sessions persisted there are loaded;
+// their latest Outputs have the options, but no text. Sessions that cannot be
+// loaded (say, because their files are corrupt or the Storyworld changed too
+// much) are skipped with a warning, and their files are left alone.
+func New(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, opts Options) (*Server, errs.Error) {
+	s := &Server{
+		csw:      csw,
+		di:       di,
+		opts:     opts,
+		sessions: map[string]*session{},
+	}
+	if opts.Dir == "" {
+		return s, nil
+	}
+
+	entries, plainErr := os.ReadDir(opts.Dir)
+	if plainErr != nil {
+		return nil, errs.NewRomualdoTool("reading sessions directory %v: %v", opts.Dir, plainErr)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), savedStateExt) {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), savedStateExt)
+		sess, err := s.newSession(id)
+		if err != nil {
+			return nil, err
+		}
+		err = s.loadSession(sess)
+		if err != nil {
+			if opts.Warnings != nil {
+				fmt.Fprintf(opts.Warnings, "Warning: skipping session %v: %v\n", id, err)
+			}
+			continue
+		}
+		s.sessions[id] = sess
+	}
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler. See doc/server.md for the endpoints.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "sessions" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "no such endpoint: %v", r.URL.Path)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listSessions(w)
+		case http.MethodPost:
+			s.createSession(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method %v not allowed on %v", r.Method, r.URL.Path)
+		}
+		return
+	}
+
+	id := parts[1]
+	s.mu.Lock()
+	sess := s.sessions[id]
+	s.mu.Unlock()
+	if sess == nil {
+		writeError(w, http.StatusNotFound, "no such session: %v", id)
+		return
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.deleted {
+		writeError(w, http.StatusNotFound, "no such session: %v", id)
+		return
+	}
+
+	endpoint := ""
+	if len(parts) == 3 {
+		endpoint = parts[2]
+	}
+	switch {
+	case endpoint == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, &Response{ID: sess.id, Output: &sess.output})
+	case endpoint == "" && r.Method == http.MethodDelete:
+		s.deleteSession(w, sess)
+	case endpoint == "step" && r.Method == http.MethodPost:
+		s.step(w, r, sess)
+	case endpoint == "state" && r.Method == http.MethodGet:
+		s.saveState(w, r, sess)
+	case endpoint == "state" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		s.loadState(w, r, sess)
+	case endpoint == "" || endpoint == "step" || endpoint == "state":
+		writeError(w, http.StatusMethodNotAllowed, "method %v not allowed on %v", r.Method, r.URL.Path)
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint: %v", r.URL.Path)
+	}
+}
+
+// listSessions handles `GET /sessions`.
+func (s *Server) listSessions(w http.ResponseWriter) {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	list := &SessionList{Sessions: make([]SessionInfo, 0, len(sessions))}
+	for _, sess := range sessions {
+		sess.mu.Lock()
+		list.Sessions = append(list.Sessions, SessionInfo{ID: sess.id, State: sess.vm.State})
+		sess.mu.Unlock()
+	}
+	sort.Slice(list.Sessions, func(i, j int) bool {
+		return list.Sessions[i].ID < list.Sessions[j].ID
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createSession handles `POST /sessions`. The new Story starts from the
+// beginning, or from the saved state in the request body, if any.
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	sess, err := s.newSession(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	var softErrors []string
+	s.collectSoftErrors(sess, &softErrors)
+	if req.SavedState != "" || req.SavedStateJSON != nil {
+		sess.output, err = s.load(r.Context(), sess, req)
+	} else {
+		sess.output, err = sess.vm.Start(r.Context())
+		err = s.checkInterrupted(sess, err)
+	}
+	resp := &Response{ID: id, Output: &sess.output, SoftErrors: softErrors}
+	if err != nil {
+		// The session is not kept.
+		resp.ID = ""
+		resp.Error = err.Error()
+		writeJSON(w, statusFor(err), resp)
+		return
+	}
+
+	err = s.persist(sess)
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// deleteSession handles `DELETE /sessions/{id}`.
+func (s *Server) deleteSession(w http.ResponseWriter, sess *session) {
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+	sess.deleted = true
+
+	if s.opts.Dir != "" {
+		for _, ext := range []string{savedStateExt, profileExt} {
+			plainErr := os.Remove(path.Join(s.opts.Dir, sess.id+ext))
+			if plainErr != nil && !errors.Is(plainErr, os.ErrNotExist) {
+				writeError(w, http.StatusInternalServerError, "removing session %v: %v", sess.id, plainErr)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// step handles `POST /sessions/{id}/step`.
+func (s *Server) step(w http.ResponseWriter, r *http.Request, sess *session) {
+	req, ok := readRequest(w, r, false)
+	if !ok {
+		return
+	}
+	if sess.vm.State != vm.StateWaitingForInput {
+		writeError(w, http.StatusConflict, "session %v is not waiting for input (state: %v)", sess.id, sess.vm.State)
+		return
+	}
+
+	snapshot, err := takeSnapshot(sess)
+	if err != nil {
+		writeError(w, statusFor(err), "%v", err)
+		return
+	}
+
+	var softErrors []string
+	s.collectSoftErrors(sess, &softErrors)
+	out, err := sess.vm.Step(r.Context(), req.Choice)
+	sess.output = out
+	err = s.checkInterrupted(sess, err)
+	if sess.vm.State == vm.StateInterrupted {
+		// Interrupted steps are rolled back, so that a client that went away
+		// (or a Storyworld that ran for too long) doesn't ruin the session.
+		restoreErr := snapshot.restore(sess)
+		if restoreErr != nil {
+			err = restoreErr
+		}
+	}
+	s.respond(w, sess, softErrors, err)
+}
+
+// saveState handles `GET /sessions/{id}/state`. The `format` query parameter
+// selects between a base64-encoded binary saved state (`base64`, the default)
+// and the JSON representation (`json`).
+func (s *Server) saveState(w http.ResponseWriter, r *http.Request, sess *session) {
+	switch sess.vm.State {
+	case vm.StateError, vm.StateInterrupted:
+		writeError(w, http.StatusConflict, "session %v cannot be saved (state: %v)", sess.id, sess.vm.State)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	resp := &Response{ID: sess.id}
+	var err errs.Error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "base64":
+		err = sess.vm.SaveState(buf)
+		resp.SavedState = base64.StdEncoding.EncodeToString(buf.Bytes())
+	case "json":
+		err = sess.vm.SaveStateJSON(buf)
+		resp.SavedStateJSON = buf.Bytes()
+	default:
+		writeError(w, http.StatusBadRequest, "unknown saved state format: %v", format)
+		return
+	}
+	if err != nil {
+		writeError(w, statusFor(err), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// loadState handles `PUT /sessions/{id}/state` (and `POST`, for clients that
+// cannot send `PUT`s).
+func (s *Server) loadState(w http.ResponseWriter, r *http.Request, sess *session) {
+	req, ok := readRequest(w, r, false)
+	if !ok {
+		return
+	}
+	if req.SavedState == "" && req.SavedStateJSON == nil {
+		writeError(w, http.StatusBadRequest, "missing saved state")
+		return
+	}
+
+	var softErrors []string
+	s.collectSoftErrors(sess, &softErrors)
+	out, err := s.load(r.Context(), sess, req)
+	if err == nil {
+		sess.output = out
+	}
+	s.respond(w, sess, softErrors, err)
+}
+
+// load loads the saved state in req into the session. Migrations run under ctx.
+func (s *Server) load(ctx context.Context, sess *session, req *Request) (vm.Output, errs.Error) {
+	if req.SavedState != "" && req.SavedStateJSON != nil {
+		return sess.output, errs.NewBadUsage("Pass either savedState or savedStateJSON, not both.")
+	}
+	if req.SavedStateJSON != nil {
+		return sess.vm.LoadStateJSON(ctx, bytes.NewReader(req.SavedStateJSON))
+	}
+	data, plainErr := base64.StdEncoding.DecodeString(req.SavedState)
+	if plainErr != nil {
+		return sess.output, errs.NewBadUsage("Decoding base64 saved state: %v.", plainErr)
+	}
+	return sess.vm.LoadState(ctx, bytes.NewReader(data))
+}
+
+// respond persists the session (unless err is not nil) and writes the response
+// to a request that may have changed it.
+func (s *Server) respond(w http.ResponseWriter, sess *session, softErrors []string, err errs.Error) {
+	resp := &Response{ID: sess.id, Output: &sess.output, SoftErrors: softErrors}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, statusFor(err), resp)
+		return
+	}
+
+	err = s.persist(sess)
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// checkInterrupted returns err if it is not nil. Otherwise, it returns an error
+// if the session ran out of its instruction budget or its request was
+// cancelled.
+func (s *Server) checkInterrupted(sess *session, err errs.Error) errs.Error {
+	if err == nil && sess.vm.State == vm.StateInterrupted {
+		if sess.output.Interrupt == vm.InterruptCancelled {
+			return errs.NewRomualdoTool("the request was cancelled")
+		}
+		return errs.NewRomualdoTool("the Storyworld ran %v instructions without "+
+			"listening to the Player or ending", s.opts.InstructionBudget)
+	}
+	return err
+}
+
+// collectSoftErrors makes the session append the soft errors it reports to
+// softErrors.
+func (s *Server) collectSoftErrors(sess *session, softErrors *[]string) {
+	sess.vm.SoftErrorSink = func(e vm.SoftError) {
+		*softErrors = append(*softErrors, e.String())
+	}
+}
+
+//
+// Sessions and persistence
+//
+
+// newSession creates a new session with the given ID, with a VM configured
+// according to the Server options.
+func (s *Server) newSession(id string) (*session, errs.Error) {
+	theVM := vm.New(s.csw, s.di)
+	theVM.Strict = s.opts.Strict
+	theVM.InstructionBudget = s.opts.InstructionBudget
+	theVM.HistoryDepth = s.opts.HistoryDepth
+	theVM.SaveHistory = s.opts.HistoryDepth > 0
+	theVM.SavedStateOptions = s.opts.SavedStateOptions
+	if err := theVM.BindConstantExternals(s.opts.Externals); err != nil {
+		return nil, err
+	}
+	return &session{id: id, vm: theVM}, nil
+}
+
+// loadSession loads the session persisted in the sessions directory into sess,
+// a new session with the same ID.
+func (s *Server) loadSession(sess *session) errs.Error {
+	profilePath := path.Join(s.opts.Dir, sess.id+profileExt)
+	data, plainErr := os.ReadFile(profilePath)
+	switch {
+	case errors.Is(plainErr, os.ErrNotExist):
+		// No Profile saved, keep the fresh one.
+	case plainErr != nil:
+		return errs.NewRomualdoTool("reading profile %v: %v", profilePath, plainErr)
+	default:
+		profile, err := vm.LoadProfile(bytes.NewReader(data))
+		if err != nil {
+			return errs.NewRomualdoTool("loading profile %v: %v", profilePath, err)
+		}
+		sess.vm.Profile = profile
+	}
+
+	statePath := path.Join(s.opts.Dir, sess.id+savedStateExt)
+	data, plainErr = os.ReadFile(statePath)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("reading saved state %v: %v", statePath, plainErr)
+	}
+	out, err := sess.vm.LoadState(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		return errs.NewRomualdoTool("loading saved state %v: %v", statePath, err)
+	}
+	sess.output = out
+	return nil
+}
+
+// snapshot is the state of a session at some point, which can be restored
+// later.
+type snapshot struct {
+	state   []byte
+	profile []byte
+}
+
+// takeSnapshot takes a snapshot of the session, which must be waiting for input.
+func takeSnapshot(sess *session) (*snapshot, errs.Error) {
+	state := &bytes.Buffer{}
+	err := sess.vm.SaveState(state)
+	if err != nil {
+		return nil, err
+	}
+	profile := &bytes.Buffer{}
+	err = sess.vm.Profile.Save(profile)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{state: state.Bytes(), profile: profile.Bytes()}, nil
+}
+
+// restore brings the session back to the snapshot. Like when loading a
+// persisted session, the latest Output has the options, but no text.
+func (snap *snapshot) restore(sess *session) errs.Error {
+	profile, err := vm.LoadProfile(bytes.NewReader(snap.profile))
+	if err != nil {
+		return errs.NewICE("restoring session %v: %v", sess.id, err)
+	}
+	out, err := sess.vm.LoadState(context.Background(), bytes.NewReader(snap.state))
+	if err != nil {
+		return errs.NewICE("restoring session %v: %v", sess.id, err)
+	}
+	sess.vm.Profile = profile
+	sess.output = out
+	return nil
+}
+
+// persist saves the state and the Profile of the session to the sessions
+// directory, if there is one. Sessions that cannot be saved (because of an
+// error or an interruption) keep the last state persisted.
+func (s *Server) persist(sess *session) errs.Error {
+	if s.opts.Dir == "" {
+		return nil
+	}
+	switch sess.vm.State {
+	case vm.StateError, vm.StateInterrupted:
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	err := sess.vm.Profile.Save(buf)
+	if err != nil {
+		return err
+	}
+	err = writeFile(path.Join(s.opts.Dir, sess.id+profileExt), buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	buf.Reset()
+	err = sess.vm.SaveState(buf)
+	if err != nil {
+		return err
+	}
+	return writeFile(path.Join(s.opts.Dir, sess.id+savedStateExt), buf.Bytes())
+}
+
+// writeFile writes data to the file at filePath, going through a temporary
+// file so that a crash never leaves a half-written file behind.
+func writeFile(filePath string, data []byte) errs.Error {
+	tmpPath := filePath + ".tmp"
+	plainErr := os.WriteFile(tmpPath, data, 0644)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("writing %v: %v", tmpPath, plainErr)
+	}
+	plainErr = os.Rename(tmpPath, filePath)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("renaming %v: %v", tmpPath, plainErr)
+	}
+	return nil
+}
+
+// newID returns a new, random session ID.
+func newID() (string, errs.Error) {
+	id := make([]byte, 8)
+	_, plainErr := rand.Read(id)
+	if plainErr != nil {
+		return "", errs.NewRomualdoTool("generating session ID: %v", plainErr)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+//
+// Helpers
+//
+
+// readRequest decodes the body of r into a Request. If optional is true, an
+// empty body is taken as an empty Request. In case of errors, writes the
+// response and returns false. Bodies larger than maxRequestSize are rejected.
+func readRequest(w http.ResponseWriter, r *http.Request, optional bool) (*Request, bool) {
+	req := &Request{}
+	plainErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(req)
+	if plainErr == io.EOF && optional {
+		return req, true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(plainErr, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body larger than %v bytes", tooLarge.Limit)
+		return nil, false
+	}
+	if plainErr != nil {
+		writeError(w, http.StatusBadRequest, "decoding request body: %v", plainErr)
+		return nil, false
+	}
+	return req, true
+}
+
+// statusFor returns the HTTP status code corresponding to err. Misuses of the
+// API are the client's fault; internal compiler errors are ours; and anything
+// else (like runtime errors or incompatible saved states) is a request we
+// understood but the Storyworld could not handle.
+func statusFor(err errs.Error) int {
+	switch err.(type) {
+	case *errs.BadUsage:
+		return http.StatusBadRequest
+	case *errs.ICE:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// writeJSON writes a response with the given status code and body encoded as
+// JSON.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+// writeError writes an error response with the given status code.
+func writeError(w http.ResponseWriter, status int, format string, a ...any) {
+	writeJSON(w, status, &Response{Error: fmt.Sprintf(format, a...)})
+}
@@ -0,0 +1,101 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// caseCoverage collects the coverage of the Storyworlds run by a test case.
+// Only the VM of the test case itself is covered; steps that create their own
+// VMs (like run-parallel, serve, replay and debug) don't contribute.
+type caseCoverage struct {
+	// storyworlds contains everything run by the test case, in the order they
+	// were built.
+	storyworlds []*coveredStoryworld
+
+	// current is the Storyworld built by the latest build step.
+	current *coveredStoryworld
+}
+
+// coveredStoryworld is a Storyworld whose coverage is being collected.
+type coveredStoryworld struct {
+	csw        *bytecode.CompiledStoryworld
+	di         *bytecode.DebugInfo
+	sourceRoot string
+	cov        *vm.Coverage
+}
+
+// built tells that csw was just built from the source code at sourceRoot.
+func (cc *caseCoverage) built(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, sourceRoot string) {
+	if csw == nil {
+		return
+	}
+	cc.current = &coveredStoryworld{
+		csw:        csw,
+		di:         di,
+		sourceRoot: sourceRoot,
+		cov:        vm.NewCoverage(csw),
+	}
+	cc.storyworlds = append(cc.storyworlds, cc.current)
+}
+
+// attach makes theVM, which must be running the Storyworld built by the latest
+// build step, record its coverage.
+func (cc *caseCoverage) attach(theVM *vm.VM) {
+	if cc.current == nil || theVM.Coverage != nil {
+		return
+	}
+	theVM.Coverage = cc.current.cov
+}
+
+// data returns the coverage data collected so far. If relative is true, the
+// source files are named relative to their Storyworld roots; otherwise, the
+// roots are included.
+func (cc *caseCoverage) data(relative bool) (*coverage.Data, errs.Error) {
+	data := coverage.NewData()
+	for _, sw := range cc.storyworlds {
+		sourceRoot := sw.sourceRoot
+		if relative {
+			sourceRoot = ""
+		}
+		err := data.Add(sw.csw, sw.di, sw.cov, sourceRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// stepCoverage reports the coverage collected so far by the test case, as one
+// more output (in the text format, or in the LCOV format if step.LCOV is set).
+func (cc *caseCoverage) stepCoverage(step step, story *[]string) errs.Error {
+	data, err := cc.data(true)
+	if err != nil {
+		return err
+	}
+
+	report := &strings.Builder{}
+	var plainErr error
+	if step.LCOV {
+		plainErr = data.WriteLCOV(report)
+	} else {
+		plainErr = data.WriteText(report)
+	}
+	if plainErr != nil {
+		return errs.NewRomualdoTool("writing the coverage report: %v", plainErr)
+	}
+
+	*story = append(*story, report.String())
+	return nil
+}
@@ -0,0 +1,74 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/dap"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// stepDebug starts a debug adapter and sends the requests from step to it. Each
+// request's method is a DAP command, and its body is the JSON arguments. The
+// response regexes are matched against the content of every message the
+// adapter sent back (responses and events), one per line. In both bodies and
+// regexes, {root} is replaced by the absolute path of srcPath.
+func stepDebug(srcPath, testCase string, step step) errs.Error {
+	absPath, plainErr := filepath.Abs(srcPath)
+	if plainErr != nil {
+		return errs.NewTestSuite(testCase, "getting absolute path of %v: %v.", srcPath, plainErr)
+	}
+
+	out := &bytes.Buffer{}
+	srv := dap.NewServer(out)
+
+	for i, req := range step.Requests {
+		msg := map[string]any{
+			"seq":     i + 1,
+			"type":    "request",
+			"command": req.Method,
+		}
+		if req.Body != "" {
+			msg["arguments"] = json.RawMessage(strings.ReplaceAll(req.Body, "{root}", absPath))
+		}
+		content, plainErr := json.Marshal(msg)
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: encoding: %v.", i, plainErr)
+		}
+
+		out.Reset()
+		keepGoing := srv.Handle(content)
+		received, err := protocolContents(out.Bytes())
+		if err != nil {
+			return errs.NewTestSuite(testCase, "request %v: %v.", i, err)
+		}
+
+		for _, expected := range req.Response {
+			expected = strings.ReplaceAll(expected, "{root}", regexp.QuoteMeta(absPath))
+			re, plainErr := regexp.Compile(expected)
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "compiling regexp '%v': %v.", expected, plainErr)
+			}
+			if !re.MatchString(received) {
+				return errs.NewTestSuite(testCase, "request %v: expected response matching '%v', got '%v'.",
+					i, expected, received)
+			}
+		}
+
+		if !keepGoing {
+			break
+		}
+	}
+
+	return nil
+}
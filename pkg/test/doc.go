@@ -14,4 +14,9 @@
 //
 //	go test -coverpkg=github.com/stackedboxes/romualdo/... -covermode=count -coverprofile=cover.out ./...
 //	go tool cover -html=cover.out
+//
+// Some test cases run many VMs concurrently, so it's worth running the test
+// suite with the race detector, too:
+//
+//	go test -race ./pkg/test
 package test
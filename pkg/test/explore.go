@@ -0,0 +1,58 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"path"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/explore"
+)
+
+// stepExplore explores csw, which is the Storyworld built by a previous step,
+// and appends the text report to story. Problems found by the exploration are
+// not errors: they are checked as part of the report.
+func stepExplore(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, testCase, testPath string,
+	step step, story *[]string) errs.Error {
+
+	if csw == nil {
+		return errs.NewTestSuite(testCase, "explore steps must come after some build step.")
+	}
+
+	var inputs *explore.Inputs
+	if step.InputDictionary != "" {
+		var err errs.Error
+		inputs, err = explore.LoadInputs(path.Join(testPath, step.InputDictionary))
+		if err != nil {
+			return err
+		}
+	}
+
+	report, err := explore.Explore(csw, di, explore.Options{
+		Inputs:            inputs,
+		MaxDepth:          step.MaxDepth,
+		MaxStates:         step.MaxStates,
+		DepthFirst:        step.DepthFirst,
+		InstructionBudget: step.InstructionBudget,
+		EndingEvent:       step.EndingEvent,
+		Externals:         step.Externals,
+	})
+	if err != nil {
+		return err
+	}
+
+	text := &strings.Builder{}
+	plainErr := report.WriteText(text)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("writing the exploration report: %v", plainErr)
+	}
+	*story = append(*story, text.String())
+	return nil
+}
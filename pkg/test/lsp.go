@@ -0,0 +1,109 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/lsp"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+// stepLSP starts a language server rooted at srcPath and sends the requests
+// from step to it. Each request's method is an LSP method, and its body is the
+// JSON parameters. Requests to methods that are notifications in LSP
+// (initialized, exit and textDocument/did*) are sent as notifications. The
+// response regexes are matched against the content of every message the server
+// sent back (including notifications like diagnostics), one per line. In both
+// bodies and regexes, {root} is replaced by the URI of srcPath.
+func stepLSP(srcPath, testCase string, step step) errs.Error {
+	absPath, plainErr := filepath.Abs(srcPath)
+	if plainErr != nil {
+		return errs.NewTestSuite(testCase, "getting absolute path of %v: %v.", srcPath, plainErr)
+	}
+	rootURI := (&url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}).String()
+
+	out := &bytes.Buffer{}
+	srv := lsp.NewServer(out)
+
+	for i, req := range step.Requests {
+		msg := map[string]any{
+			"jsonrpc": "2.0",
+			"method":  req.Method,
+		}
+		if !isLSPNotification(req.Method) {
+			msg["id"] = i + 1
+		}
+		if req.Body != "" {
+			msg["params"] = json.RawMessage(strings.ReplaceAll(req.Body, "{root}", rootURI))
+		}
+		content, plainErr := json.Marshal(msg)
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: encoding: %v.", i, plainErr)
+		}
+
+		out.Reset()
+		keepGoing := srv.Handle(content)
+		received, err := protocolContents(out.Bytes())
+		if err != nil {
+			return errs.NewTestSuite(testCase, "request %v: %v.", i, err)
+		}
+
+		for _, expected := range req.Response {
+			expected = strings.ReplaceAll(expected, "{root}", regexp.QuoteMeta(rootURI))
+			re, plainErr := regexp.Compile(expected)
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "compiling regexp '%v': %v.", expected, plainErr)
+			}
+			if !re.MatchString(received) {
+				return errs.NewTestSuite(testCase, "request %v: expected response matching '%v', got '%v'.",
+					i, expected, received)
+			}
+		}
+
+		if !keepGoing {
+			break
+		}
+	}
+
+	return nil
+}
+
+// isLSPNotification checks if method is an LSP notification sent from the
+// client to the server.
+func isLSPNotification(method string) bool {
+	return method == "initialized" || method == "exit" || strings.HasPrefix(method, "textDocument/did")
+}
+
+// protocolContents extracts the contents of the messages in data, encoded with
+// the base protocol shared by LSP and DAP, returning them one per line.
+func protocolContents(data []byte) (string, error) {
+	var contents []string
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		content, err := romutil.ReadBaseProtocolMessage(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("malformed message: %v", err)
+		}
+		contents = append(contents, string(content))
+	}
+	return strings.Join(contents, "\n"), nil
+}
@@ -0,0 +1,75 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// observer is a vm.Observer that describes everything it sees as strings, so
+// that test cases can check them.
+type observer struct {
+	vm.NopObserver
+
+	// observations is where the descriptions are appended to.
+	observations *[]string
+}
+
+func (o *observer) OnProcedureEnter(where errs.StackFrame) {
+	o.observe("enter %v", location(where))
+}
+
+func (o *observer) OnProcedureExit(where errs.StackFrame) {
+	o.observe("exit %v", location(where))
+}
+
+func (o *observer) OnSay(where errs.StackFrame, text string) {
+	o.observe("say %v %q", location(where), text)
+}
+
+func (o *observer) OnEmit(where errs.StackFrame, event vm.Event) {
+	o.observe("emit %v %v", location(where), event)
+}
+
+func (o *observer) OnListen(where errs.StackFrame, options string) {
+	o.observe("listen %v %q", location(where), options)
+}
+
+func (o *observer) OnChoice(choice string) {
+	o.observe("choice %q", choice)
+}
+
+func (o *observer) OnSoftError(e vm.SoftError) {
+	o.observe("soft error %v:%v %v", e.Procedure, e.Line, e.Message)
+}
+
+func (o *observer) OnSaveState() {
+	o.observe("save")
+}
+
+func (o *observer) OnLoadState(migrations []string) {
+	o.observe("load [%v]", strings.Join(migrations, ", "))
+}
+
+func (o *observer) OnUndo(n int) {
+	o.observe("undo %v", n)
+}
+
+// observe appends an observation, described by fmt.Printf-like arguments.
+func (o *observer) observe(format string, a ...any) {
+	*o.observations = append(*o.observations, fmt.Sprintf(format, a...))
+}
+
+// location returns a compact description of where, like "/pkg/proc:12".
+func location(where errs.StackFrame) string {
+	return fmt.Sprintf("%v:%v", where.Procedure, where.Line)
+}
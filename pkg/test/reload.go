@@ -0,0 +1,76 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// playedStory is what was played since the current Story started. It is what
+// reload steps need to replay the Story on a new build.
+type playedStory struct {
+	// inputs contains the choices made since the Story started.
+	inputs []string
+
+	// profile is the Profile as it was when the Story started, serialized.
+	profile []byte
+}
+
+// starting tells that the Story running on theVM may be about to start. If it
+// is indeed new, starts recording it afresh.
+func (ps *playedStory) starting(theVM *vm.VM) errs.Error {
+	if theVM.State != vm.StateNew {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	err := theVM.Profile.Save(buf)
+	if err != nil {
+		return err
+	}
+	ps.inputs = nil
+	ps.profile = buf.Bytes()
+	return nil
+}
+
+// undone tells that the latest n choices were undone.
+func (ps *playedStory) undone(n int) {
+	if n > len(ps.inputs) {
+		n = len(ps.inputs)
+	}
+	ps.inputs = ps.inputs[:len(ps.inputs)-n]
+}
+
+// stepReload moves the Story running on oldVM to newVM, which runs a new build
+// of the Storyworld, just like `romualdo run --watch` does. Appends what the
+// Player would see to story, and returns the VM running the Story from now on.
+func stepReload(oldVM, newVM *vm.VM, step step, played *playedStory, story *[]string,
+	softErrors *[]string) (*vm.VM, errs.Error) {
+
+	err := setUpRun(newVM, step, softErrors)
+	if err != nil {
+		return nil, err
+	}
+	profile := vm.NewProfile()
+	if played.profile != nil {
+		profile, err = vm.LoadProfile(bytes.NewReader(played.profile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := vm.Reload(context.Background(), oldVM, newVM, played.inputs, profile)
+	if !result.Transferred {
+		played.inputs = played.inputs[:result.Replayed]
+	}
+	*story = append(*story, result.String()+"\n"+result.Output.TextWithEvents())
+	return newVM, err
+}
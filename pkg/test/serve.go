@@ -0,0 +1,192 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/server"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// request is the structure mirroring a single request made by a serve step.
+type request struct {
+	Method   string
+	Path     string
+	Body     string
+	Status   int
+	Response []string
+	Timeout  string
+}
+
+// serveState is what the serve steps of a test case remember across steps.
+type serveState struct {
+	// dir is the directory where sessions are persisted. Created by the first
+	// serve step that asks for persistence.
+	dir string
+
+	// id is the ID of the latest session created.
+	id string
+
+	// savedState is the latest base64-encoded saved state received.
+	savedState string
+
+	// savedStateJSON is the latest JSON saved state received.
+	savedStateJSON string
+}
+
+// cleanup removes the sessions directory, if any.
+func (ss *serveState) cleanup() {
+	if ss.dir != "" {
+		os.RemoveAll(ss.dir)
+	}
+}
+
+// stepServe starts a story server for csw and (potentially nil) di, and makes
+// the requests from step to it. The text of every Output received is appended
+// to story (and whether it was seen before to seen), and the soft errors
+// received are appended to softErrors. served keeps what must be remembered
+// across serve steps.
+func stepServe(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, testCase string, step step,
+	served *serveState, story *[]string, seen *[]bool, softErrors *[]string) errs.Error {
+
+	if csw == nil {
+		return errs.NewTestSuite(testCase, "serve steps must come after some build step.")
+	}
+
+	opts := server.Options{
+		Strict:            step.Strict,
+		InstructionBudget: step.InstructionBudget,
+		Externals:         step.Externals,
+		HistoryDepth:      step.HistoryDepth,
+		SavedStateOptions: vm.SavedStateOptions{
+			Compress:         step.Compress,
+			RequireSignature: step.RequireSignature,
+			AllowUnsigned:    step.AllowUnsigned,
+		},
+	}
+	if step.SigningKey != "" {
+		opts.SavedStateOptions.Key = []byte(step.SigningKey)
+	}
+	if step.Persist {
+		if served.dir == "" {
+			dir, plainErr := os.MkdirTemp("", "romualdo-serve-")
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "creating sessions directory: %v.", plainErr)
+			}
+			served.dir = dir
+		}
+		opts.Dir = served.dir
+	}
+
+	srv, err := server.New(csw, di, opts)
+	if err != nil {
+		return err
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for i, req := range step.Requests {
+		url := ts.URL + strings.ReplaceAll(req.Path, "{id}", served.id)
+		body := strings.NewReplacer(
+			"{savedState}", served.savedState,
+			"{savedStateJSON}", served.savedStateJSON).Replace(req.Body)
+
+		ctx := context.Background()
+		if req.Timeout != "" {
+			timeout, plainErr := time.ParseDuration(req.Timeout)
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "request %v: parsing timeout: %v.", i, plainErr)
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		httpReq, plainErr := http.NewRequestWithContext(ctx, req.Method, url, strings.NewReader(body))
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: %v.", i, plainErr)
+		}
+		httpResp, plainErr := http.DefaultClient.Do(httpReq)
+		if req.Timeout != "" {
+			// The client gives up on the request, so there is no response to
+			// check.
+			if plainErr == nil {
+				httpResp.Body.Close()
+			}
+			if !errors.Is(plainErr, context.DeadlineExceeded) {
+				return errs.NewTestSuite(testCase, "request %v: expected a timeout, got %v.", i, plainErr)
+			}
+			continue
+		}
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: %v.", i, plainErr)
+		}
+		respBody, plainErr := io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: reading response: %v.", i, plainErr)
+		}
+
+		expectedStatus := req.Status
+		if expectedStatus == 0 {
+			expectedStatus = http.StatusOK
+		}
+		if httpResp.StatusCode != expectedStatus {
+			return errs.NewTestSuite(testCase, "request %v: expected status %v, got %v: %s",
+				i, expectedStatus, httpResp.StatusCode, respBody)
+		}
+		for _, expected := range req.Response {
+			re, plainErr := regexp.Compile(expected)
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "compiling regexp '%v': %v.", expected, plainErr)
+			}
+			if !re.Match(respBody) {
+				return errs.NewTestSuite(testCase, "request %v: expected response matching '%v', got '%s'.",
+					i, expected, respBody)
+			}
+		}
+
+		if len(respBody) == 0 {
+			continue
+		}
+		resp := &server.Response{}
+		plainErr = json.Unmarshal(respBody, resp)
+		if plainErr != nil {
+			return errs.NewTestSuite(testCase, "request %v: decoding response: %v.", i, plainErr)
+		}
+		if req.Method == http.MethodPost && strings.Trim(req.Path, "/") == "sessions" && resp.ID != "" {
+			served.id = resp.ID
+		}
+		if resp.SavedState != "" {
+			served.savedState = resp.SavedState
+		}
+		if resp.SavedStateJSON != nil {
+			served.savedStateJSON = string(resp.SavedStateJSON)
+		}
+		if resp.Output != nil {
+			if text := resp.Output.TextWithEvents(); text != "" {
+				*story = append(*story, text)
+				*seen = append(*seen, resp.Output.Seen)
+			}
+		}
+		*softErrors = append(*softErrors, resp.SoftErrors...)
+	}
+
+	return nil
+}
@@ -15,7 +15,7 @@ import (
 // but instead a simple way to run our end-to-end tests and, more importantly,
 // to get code coverage reports for them.
 func TestRunSuite(t *testing.T) {
-	err := ExecuteSuite("../../test/suite")
+	err := ExecuteSuite("../../test/suite", nil)
 	if err != nil {
 		t.Fatalf("Error running test suite: %v", err)
 	}
@@ -9,56 +9,146 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
 	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/stackedboxes/romualdo/pkg/backend"
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/coverage"
 	"github.com/stackedboxes/romualdo/pkg/errs"
 	"github.com/stackedboxes/romualdo/pkg/frontend"
+	"github.com/stackedboxes/romualdo/pkg/replay"
 	"github.com/stackedboxes/romualdo/pkg/romutil"
 	"github.com/stackedboxes/romualdo/pkg/vm"
 )
 
 // config is the structure mirroring the test case TOML file.
 type config struct {
-	Type          string
-	SourceDir     string
-	Input         []string
-	Output        []string
-	ExitCode      int
-	ErrorMessages []string
-	Hashes        map[string]string
+	Type              string
+	SourceDir         string
+	Input             []string
+	Output            []string
+	ExitCode          int
+	ErrorMessages     []string
+	Hashes            map[string]string
+	Tag               string
+	Versions          map[string]int
+	Recording         string
+	Strict            bool
+	SoftErrors        []string
+	InstructionBudget int
+	Externals         map[string]any
+	SetGlobals        map[string]any
+	Globals           map[string]any
+	Observations      []string
+	HistoryDepth      int
+	SaveHistory       bool
+	Undo              int
+	SaveFields        map[string]string
+	Metadata          *metadata
+	JSON              bool
+	Compress          bool
+	SigningKey        string
+	RequireSignature  bool
+	AllowUnsigned     bool
+	StripSignature    bool
+	Seen              []bool
+	Sessions          int
+	Persist           bool
+	LCOV              bool
+	InputDictionary   string
+	MaxDepth          int
+	MaxStates         int
+	EndingEvent       string
+	DepthFirst        bool
+	State             string
+	Record            bool
+	Replay            bool
+	InteractiveFrom   int
 
 	Steps []step `toml:"step"`
 }
 
 // step is the structure mirroring a single step in a test case TOML file.
 type step struct {
-	Type          string
-	SourceDir     string
-	Input         []string
-	Output        []string
-	ExitCode      int
-	ErrorMessages []string
-	Hashes        map[string]string
+	Type              string
+	SourceDir         string
+	Input             []string
+	Output            []string
+	ExitCode          int
+	ErrorMessages     []string
+	Hashes            map[string]string
+	Tag               string
+	Versions          map[string]int
+	Recording         string
+	Strict            bool
+	SoftErrors        []string
+	InstructionBudget int
+	Externals         map[string]any
+	SetGlobals        map[string]any
+	Globals           map[string]any
+	Observations      []string
+	HistoryDepth      int
+	SaveHistory       bool
+	Undo              int
+	SaveFields        map[string]string
+	Metadata          *metadata
+	JSON              bool
+	Compress          bool
+	SigningKey        string
+	RequireSignature  bool
+	AllowUnsigned     bool
+	StripSignature    bool
+	Seen              []bool
+	Sessions          int
+	Persist           bool
+	LCOV              bool
+	InputDictionary   string
+	MaxDepth          int
+	MaxStates         int
+	EndingEvent       string
+	DepthFirst        bool
+	State             string
+	Record            bool
+	Replay            bool
+	InteractiveFrom   int
+	Requests          []request `toml:"request"`
 }
 
-// ExecuteSuite runs the test suite at suitePath.
-func ExecuteSuite(suitePath string) errs.Error {
+// metadata is the structure mirroring the saved state metadata expected by a
+// test case.
+type metadata struct {
+	ReleaseTag string
+	Chapter    string
+	Preview    string
+	Fields     map[string]string
+}
+
+// ExecuteSuite runs the test suite at suitePath. If cov is not nil, the
+// coverage of the Storyworlds run by the test cases is added to it.
+func ExecuteSuite(suitePath string, cov *coverage.Data) errs.Error {
 	// TODO: Run tests concurrently. Like we do Storyworld parsing.
 	err := romutil.ForEachMatchingFileRecursive(suitePath, regexp.MustCompile("test.toml"),
 		func(configPath string) errs.Error {
-			return runCase(configPath)
+			return runCase(configPath, cov)
 		},
 	)
 
 	return err
 }
 
-// runCase runs the test case defined in configPath using the given runner.
-func runCase(configPath string) errs.Error {
+// runCase runs the test case defined in configPath using the given runner. If
+// suiteCov is not nil, the coverage of the Storyworlds run by the test case is
+// added to it.
+func runCase(configPath string, suiteCov *coverage.Data) errs.Error {
 	testPath := path.Dir(configPath)
 	testCase := testPath
 
@@ -74,41 +164,199 @@ func runCase(configPath string) errs.Error {
 
 	var theVM *vm.VM
 	var savedState []byte
+	var savedStateIsJSON bool
+	var savedProfile []byte
+
+	// What the serve steps remember across steps.
+	var served serveState
+	defer served.cleanup()
+
+	// The Storyworld built by the latest build step. Subsequent builds are made
+	// on top of it, just like the `romualdo` tool does with its output file.
+	var csw *bytecode.CompiledStoryworld
+	var di *bytecode.DebugInfo
+
+	// The coverage of everything run by the test case.
+	var cov caseCoverage
+
+	// What was played since the current Story started, for the reload steps.
+	var played playedStory
+
+	// What the run-interactive steps remember across steps.
+	var transcripts transcriptState
+	defer transcripts.cleanup()
 
 	for i, step := range testConf.Steps {
 		srcPath := path.Join(testPath, step.SourceDir)
 
-		var story []string // the VM output
+		var story []string        // the VM output
+		var seen []bool           // whether each output was seen before
+		var softErrors []string   // the soft errors reported by the VM
+		var observations []string // what the VM Observer saw
+		if theVM != nil {
+			prepareVM(theVM, step, &observations, &cov)
+		}
 		var err errs.Error = nil
 
 		switch step.Type {
 		case "build":
-			theVM, err = stepBuild(srcPath)
+			csw, di, theVM, err = stepBuild(srcPath, csw, di)
+			cov.built(csw, di, srcPath)
 
 		case "run":
-			err = stepRun(theVM, testCase, step.Input, &story)
+			err = played.starting(theVM)
+			if err != nil {
+				return err
+			}
+			played.inputs = append(played.inputs, step.Input...)
+			err = stepRun(theVM, testCase, step, &story, &seen, &softErrors)
 
 		case "build-and-run":
-			theVM, err = stepBuild(srcPath)
+			csw, di, theVM, err = stepBuild(srcPath, csw, di)
+			if err != nil {
+				return err
+			}
+			cov.built(csw, di, srcPath)
+			prepareVM(theVM, step, &observations, &cov)
+			err = played.starting(theVM)
+			if err != nil {
+				return err
+			}
+			played.inputs = append(played.inputs, step.Input...)
+			err = stepRun(theVM, testCase, step, &story, &seen, &softErrors)
+
+		case "reload":
+			if theVM == nil {
+				return errs.NewTestSuite(testCase, "reload steps must come after some build step.")
+			}
+			newCSW, newDI, newVM, buildErr := stepBuild(srcPath, nil, nil)
+			if buildErr != nil {
+				// Just like in watch mode, the previous build keeps running.
+				story = append(story, buildErr.Error()+"\n-- Build failed; still running the previous build --\n")
+				break
+			}
+			csw, di = newCSW, newDI
+			cov.built(csw, di, srcPath)
+			prepareVM(newVM, step, &observations, &cov)
+			theVM, err = stepReload(theVM, newVM, step, &played, &story, &softErrors)
+
+		case "release":
+			csw, di, theVM, err = stepRelease(srcPath, step.Tag, csw, di)
+			cov.built(csw, di, srcPath)
+
+		case "run-parallel":
+			theVM, err = stepRunParallel(csw, di, testCase, step, savedState, savedStateIsJSON, &story, &seen, &softErrors)
+
+		case "serve":
+			err = stepServe(csw, di, testCase, step, &served, &story, &seen, &softErrors)
+
+		case "lsp":
+			err = stepLSP(srcPath, testCase, step)
+
+		case "debug":
+			err = stepDebug(srcPath, testCase, step)
+
+		case "new-story":
+			if theVM == nil {
+				return errs.NewTestSuite(testCase, "new-story steps must come after some build step.")
+			}
+			profile := theVM.Profile
+			theVM = vm.New(csw, di)
+			theVM.Profile = profile
+			prepareVM(theVM, step, &observations, &cov)
+
+		case "save-profile":
+			bw := &bytes.Buffer{}
+			err = theVM.Profile.Save(bw)
+			if err != nil {
+				return err
+			}
+			savedProfile = bw.Bytes()
+
+		case "load-profile":
+			theVM.Profile, err = vm.LoadProfile(bytes.NewReader(savedProfile))
 			if err != nil {
 				return err
 			}
-			err = stepRun(theVM, testCase, step.Input, &story)
 
 		case "save-state":
+			theVM.SaveHistory = step.SaveHistory
+			if step.SaveFields != nil {
+				theVM.SaveFields = step.SaveFields
+			}
 			bw := &bytes.Buffer{}
-			err = theVM.Serialize(bw)
+			if step.JSON {
+				err = saveStateJSON(theVM, csw, di, testCase, bw)
+			} else {
+				err = theVM.SaveState(bw)
+			}
 			if err != nil {
 				return err
 			}
 			savedState = bw.Bytes()
+			savedStateIsJSON = step.JSON
 
 		case "load-state":
-			br := bytes.NewReader(savedState)
-			err = theVM.Deserialize(br)
+			err = theVM.BindConstantExternals(step.Externals)
 			if err != nil {
 				return err
 			}
+			theVM.InstructionBudget = step.InstructionBudget
+			br := bytes.NewReader(savedState)
+			if savedStateIsJSON {
+				_, err = theVM.LoadStateJSON(context.Background(), br)
+			} else {
+				_, err = theVM.LoadState(context.Background(), br)
+			}
+
+		case "tamper-state":
+			if len(savedState) == 0 {
+				return errs.NewTestSuite(testCase, "tamper-state steps must come after some save-state step.")
+			}
+			tampered := append([]byte{}, savedState...)
+			if step.StripSignature {
+				if savedStateIsJSON {
+					return errs.NewTestSuite(testCase, "JSON saved states are never signed.")
+				}
+				tampered, err = stripSignature(testCase, tampered)
+				if err != nil {
+					return err
+				}
+			} else {
+				tampered[len(tampered)/2] ^= 0xFF
+			}
+			savedState = tampered
+
+		case "choose":
+			err = stepChoose(theVM, testCase, step, &story, &seen, &softErrors)
+
+		case "undo":
+			_, err = theVM.Undo(context.Background(), step.Undo)
+			if err == nil {
+				played.undone(step.Undo)
+			}
+
+		case "set-globals":
+			err = stepSetGlobals(theVM, step.SetGlobals)
+
+		case "replay":
+			recPath := path.Join(testPath, step.Recording)
+			if step.Recording == "" && transcripts.recorded {
+				recPath = transcripts.path()
+			}
+			err = stepReplay(csw, di, testCase, recPath, step.InstructionBudget)
+
+		case "run-interactive":
+			err = stepRunInteractive(csw, di, testCase, testPath, step, &transcripts, &story)
+
+		case "coverage":
+			err = cov.stepCoverage(step, &story)
+
+		case "explore":
+			err = stepExplore(csw, di, testCase, testPath, step, &story)
+
+		case "diff-releases":
+			err = stepDiffReleases(srcPath, step.Tag, csw, di, testCase, &story)
 
 		case "hash":
 			err = stepHash(srcPath, testCase, step.Hashes)
@@ -128,7 +376,7 @@ func runCase(configPath string) errs.Error {
 				exitCode = err.ExitCode()
 			}
 			if exitCode != step.ExitCode {
-				return errs.NewTestSuite(testCase, "expected exit code %v, got %v.", step.ExitCode, err.ExitCode())
+				return errs.NewTestSuite(testCase, "expected exit code %v, got %v.", step.ExitCode, exitCode)
 			}
 
 			// Check error messages
@@ -146,8 +394,13 @@ func runCase(configPath string) errs.Error {
 
 			// If we had errors and reached this point, it means the error was
 			// expected for this test case. So we must skip the following
-			// checks, as the outputs don't matter.
+			// checks, as the outputs don't matter. The VM state still does,
+			// though: errors must leave the VM in a consistent state.
 			if stepErrs != nil {
+				err = checkState(theVM, testCase, step.State)
+				if err != nil {
+					return err
+				}
 				break
 			}
 		} else {
@@ -157,6 +410,20 @@ func runCase(configPath string) errs.Error {
 			}
 		}
 
+		// Check versions
+		if step.Type == "build" || step.Type == "build-and-run" || step.Type == "release" {
+			err = checkVersions(csw, testCase, step.Versions)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Check VM state
+		err = checkState(theVM, testCase, step.State)
+		if err != nil {
+			return err
+		}
+
 		// Check output
 		if len(step.Output) != len(story) {
 			return errs.NewTestSuite(testCase, "got %v outputs, expected %v.", len(story), len(step.Output))
@@ -166,46 +433,519 @@ func runCase(configPath string) errs.Error {
 				return errs.NewTestSuite(testCase, "at index %v: expected output '%v', got '%v'.", i, step.Output[0], actualOutput)
 			}
 		}
+
+		// Check seen-flags. Like observations, this is done only if the test
+		// case asks for it.
+		if step.Seen != nil {
+			if len(step.Seen) != len(seen) {
+				return errs.NewTestSuite(testCase, "got %v seen-flags, expected %v.", len(seen), len(step.Seen))
+			}
+			for i, expected := range step.Seen {
+				if seen[i] != expected {
+					return errs.NewTestSuite(testCase, "at index %v: expected seen-flag %v, got %v.", i, expected, seen[i])
+				}
+			}
+		}
+
+		// Check saved state metadata
+		if step.Type == "save-state" && step.Metadata != nil {
+			err = checkMetadata(savedState, savedStateIsJSON, testCase, step.Metadata)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Check globals
+		err = checkGlobals(theVM, testCase, step.Globals)
+		if err != nil {
+			return err
+		}
+
+		// Check observations. Unlike most other checks, this is done only if
+		// the test case asks for it.
+		if step.Observations != nil {
+			if len(step.Observations) != len(observations) {
+				return errs.NewTestSuite(testCase, "got %v observations, expected %v: %q.",
+					len(observations), len(step.Observations), observations)
+			}
+			for i, expected := range step.Observations {
+				if observations[i] != expected {
+					return errs.NewTestSuite(testCase, "at index %v: expected observation '%v', got '%v'.",
+						i, expected, observations[i])
+				}
+			}
+		}
+
+		// Check soft errors
+		if len(step.SoftErrors) != len(softErrors) {
+			return errs.NewTestSuite(testCase, "got %v soft errors, expected %v.", len(softErrors), len(step.SoftErrors))
+		}
+		for i, expectedSoftError := range step.SoftErrors {
+			re, err := regexp.Compile(expectedSoftError)
+			if err != nil {
+				return errs.NewTestSuite(testCase, "compiling regexp '%v': %v.", expectedSoftError, err.Error())
+			}
+			if !re.MatchString(softErrors[i]) {
+				return errs.NewTestSuite(testCase, "at index %v: expected soft error '%v', got '%v'.", i, expectedSoftError, softErrors[i])
+			}
+		}
+	}
+
+	if suiteCov != nil {
+		caseData, err := cov.data(false)
+		if err != nil {
+			return err
+		}
+		suiteCov.Merge(caseData)
 	}
 
 	fmt.Printf("Test case passed: %v.\n", testPath)
 	return nil
 }
 
-func stepBuild(srcPath string) (*vm.VM, errs.Error) {
-	csw, di, err := vm.CSWFromPath(srcPath)
+// stripSignature removes the signature from the signed (binary) saved state ss,
+// and clears the header flag telling it is signed, like someone wanting to
+// modify a signed saved state would do.
+func stripSignature(testCase string, ss []byte) ([]byte, errs.Error) {
+	const flagsOffset = 12 // after the magic number and the version
+	const flagSigned = 1 << 1
+	if len(ss) < flagsOffset+4+sha256.Size {
+		return nil, errs.NewTestSuite(testCase, "saved state too short to be signed.")
+	}
+	flags := binary.LittleEndian.Uint32(ss[flagsOffset:])
+	if flags&flagSigned == 0 {
+		return nil, errs.NewTestSuite(testCase, "saved state is not signed.")
+	}
+	ss = ss[:len(ss)-sha256.Size]
+	binary.LittleEndian.PutUint32(ss[flagsOffset:], flags&^flagSigned)
+	return ss, nil
+}
+
+// prepareVM sets up theVM for running step, making its Observer append what it
+// sees to observations, and making it record its coverage into cov.
+func prepareVM(theVM *vm.VM, step step, observations *[]string, cov *caseCoverage) {
+	theVM.Observer = &observer{observations: observations}
+	cov.attach(theVM)
+	theVM.HistoryDepth = step.HistoryDepth
+	theVM.SavedStateOptions = vm.SavedStateOptions{
+		Compress:         step.Compress,
+		RequireSignature: step.RequireSignature,
+		AllowUnsigned:    step.AllowUnsigned,
+	}
+	if step.SigningKey != "" {
+		theVM.SavedStateOptions.Key = []byte(step.SigningKey)
+	}
+}
+
+// stepBuild builds the Storyworld at srcPath on top of base (which can be
+// nil), and creates a VM to run it.
+func stepBuild(srcPath string, base *bytecode.CompiledStoryworld, baseDI *bytecode.DebugInfo) (
+	*bytecode.CompiledStoryworld, *bytecode.DebugInfo, *vm.VM, errs.Error) {
+
+	csw, di, err := vm.BuildCSW(srcPath, base, baseDI)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	theVM := vm.New(csw, di)
-	return theVM, nil
+	return csw, di, theVM, nil
 }
 
-func stepRun(theVM *vm.VM, testCase string, inputs []string, story *[]string) errs.Error {
+// stepRelease builds the Storyworld at srcPath on top of base (which can be
+// nil), releases it with the given tag, and creates a VM to run it.
+func stepRelease(srcPath, tag string, base *bytecode.CompiledStoryworld, baseDI *bytecode.DebugInfo) (
+	*bytecode.CompiledStoryworld, *bytecode.DebugInfo, *vm.VM, errs.Error) {
+
+	csw, di, _, err := stepBuild(srcPath, base, baseDI)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = backend.Release(csw, di, tag)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	theVM := vm.New(csw, di)
+	return csw, di, theVM, nil
+}
+
+// stepDiffReleases builds the Storyworld at srcPath on top of csw (releasing it
+// with the given tag, unless it is empty), and appends the report of what
+// changed between them to story. The new build is discarded.
+func stepDiffReleases(srcPath, tag string, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo,
+	testCase string, story *[]string) errs.Error {
+
+	if csw == nil {
+		return errs.NewTestSuite(testCase, "diff-releases steps must come after some build step.")
+	}
+	var newCSW *bytecode.CompiledStoryworld
+	var err errs.Error
+	if tag == "" {
+		newCSW, _, _, err = stepBuild(srcPath, csw, di)
+	} else {
+		newCSW, _, _, err = stepRelease(srcPath, tag, csw, di)
+	}
+	if err != nil {
+		return err
+	}
+
+	text := &strings.Builder{}
+	plainErr := bytecode.Diff(csw, newCSW).WriteText(text)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("writing the diff report: %v", plainErr)
+	}
+	*story = append(*story, text.String())
+	return nil
+}
+
+// checkVersions checks if csw contains the expected number of versions (i.e.,
+// Chunks) of each Procedure listed in expectedVersions.
+func checkVersions(csw *bytecode.CompiledStoryworld, testCase string, expectedVersions map[string]int) errs.Error {
+	for fqn, expected := range expectedVersions {
+		actual := csw.VersionsCount(fqn)
+		if actual != expected {
+			return errs.NewTestSuite(testCase, "wrong number of versions for %v: got %v, expected %v.", fqn, actual, expected)
+		}
+	}
+	return nil
+}
+
+// stepRun runs theVM with the inputs from step, appending its outputs to story
+// (and whether they were seen before to seen) and the soft errors it reports to
+// softErrors.
+func stepRun(theVM *vm.VM, testCase string, step step, story *[]string, seen *[]bool, softErrors *[]string) errs.Error {
+	err := setUpRun(theVM, step, softErrors)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
 	if theVM.State == vm.StateNew {
-		output := theVM.Start()
-		if output != "" {
-			*story = append(*story, output)
+		output, err := theVM.Start(ctx)
+		if text := output.TextWithEvents(); text != "" {
+			*story = append(*story, text)
+			*seen = append(*seen, output.Seen)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	for _, choice := range inputs {
+	for _, choice := range step.Input {
 		if theVM.State == vm.StateEndOfStory {
 			return errs.NewTestSuite(testCase, "Reached end of story but there are still unused inputs.")
 		}
 
+		if theVM.State == vm.StateInterrupted {
+			break
+		}
+
 		if theVM.State != vm.StateWaitingForInput {
 			return errs.NewICE("Inconsistent VM state: not waiting for input after Start() or Step()")
 		}
 
-		output := theVM.Step(choice)
-		if output != "" {
-			*story = append(*story, output)
+		output, err := theVM.Step(ctx, choice)
+		if text := output.TextWithEvents(); text != "" {
+			*story = append(*story, text)
+			*seen = append(*seen, output.Seen)
+		}
+		if err != nil {
+			return err
 		}
 	}
+
+	if theVM.State == vm.StateInterrupted {
+		return errs.NewRomualdoTool("the Storyworld ran %v instructions without "+
+			"listening to the Player or ending", step.InstructionBudget)
+	}
 	return nil
 }
 
+// stepChoose sends the inputs from step to theVM, without checking first if it
+// is waiting for input, like a careless Driver Program would. Outputs are
+// appended to story (and whether they were seen before to seen), and soft
+// errors to softErrors.
+func stepChoose(theVM *vm.VM, testCase string, step step, story *[]string, seen *[]bool,
+	softErrors *[]string) errs.Error {
+
+	if theVM == nil {
+		return errs.NewTestSuite(testCase, "choose steps must come after some build step.")
+	}
+	err := setUpRun(theVM, step, softErrors)
+	if err != nil {
+		return err
+	}
+
+	for _, choice := range step.Input {
+		output, err := theVM.Step(context.Background(), choice)
+		if text := output.TextWithEvents(); text != "" {
+			*story = append(*story, text)
+			*seen = append(*seen, output.Seen)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkState checks if theVM is in the expected state, given by its name (as
+// used in the JSON representation of saved states). An empty expected state
+// matches anything.
+func checkState(theVM *vm.VM, testCase, expected string) errs.Error {
+	if expected == "" {
+		return nil
+	}
+	if theVM == nil {
+		return errs.NewTestSuite(testCase, "expected VM state %v, but there is no VM.", expected)
+	}
+	if theVM.State.String() != expected {
+		return errs.NewTestSuite(testCase, "expected VM state %v, got %v.", expected, theVM.State)
+	}
+	return nil
+}
+
+// setUpRun sets theVM up for running step, making it append the soft errors
+// it reports to softErrors.
+func setUpRun(theVM *vm.VM, step step, softErrors *[]string) errs.Error {
+	theVM.Strict = step.Strict
+	theVM.InstructionBudget = step.InstructionBudget
+	theVM.SoftErrorSink = func(e vm.SoftError) {
+		*softErrors = append(*softErrors, e.String())
+	}
+	return theVM.BindConstantExternals(step.Externals)
+}
+
+// stepRunParallel runs step.Sessions Stories of csw concurrently, each one on
+// its own VM, with the inputs from step. If savedState is not nil, each Story
+// starts by loading it (isJSON tells if it is in the JSON representation).
+// After running, each Story is saved and loaded back into yet another VM. All Stories must produce the same
+// outputs, which are appended to story and seen (and the soft errors reported
+// by the first Story are appended to softErrors). Returns the final VM of the
+// first Story, so that the usual checks can be made on it.
+//
+// Run with the race detector (`go test -race`) to check that a
+// CompiledStoryworld and its DebugInfo can be shared by concurrent VMs.
+func stepRunParallel(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, testCase string,
+	step step, savedState []byte, isJSON bool, story *[]string, seen *[]bool, softErrors *[]string) (*vm.VM, errs.Error) {
+
+	if csw == nil {
+		return nil, errs.NewTestSuite(testCase, "run-parallel steps must come after some build step.")
+	}
+	if step.Sessions < 1 {
+		return nil, errs.NewTestSuite(testCase, "run-parallel steps need a positive number of sessions.")
+	}
+
+	type session struct {
+		vm      *vm.VM
+		story   []string
+		seen    []bool
+		softErr []string
+		err     errs.Error
+	}
+	sessions := make([]session, step.Sessions)
+
+	var wg sync.WaitGroup
+	for i := range sessions {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			theVM := vm.New(csw, di)
+			theVM.HistoryDepth = step.HistoryDepth
+			theVM.SaveHistory = step.SaveHistory
+			if savedState != nil {
+				s.err = theVM.BindConstantExternals(step.Externals)
+				if s.err != nil {
+					return
+				}
+				if isJSON {
+					_, s.err = theVM.LoadStateJSON(context.Background(), bytes.NewReader(savedState))
+				} else {
+					_, s.err = theVM.LoadState(context.Background(), bytes.NewReader(savedState))
+				}
+				if s.err != nil {
+					return
+				}
+			}
+			s.err = stepRun(theVM, testCase, step, &s.story, &s.seen, &s.softErr)
+			if s.err != nil {
+				return
+			}
+
+			bw := &bytes.Buffer{}
+			s.err = theVM.SaveState(bw)
+			if s.err != nil {
+				return
+			}
+			s.vm = vm.New(csw, di)
+			s.vm.HistoryDepth = step.HistoryDepth
+			s.err = s.vm.BindConstantExternals(step.Externals)
+			if s.err != nil {
+				return
+			}
+			_, s.err = s.vm.LoadState(context.Background(), bw)
+		}(&sessions[i])
+	}
+	wg.Wait()
+
+	for i, s := range sessions {
+		if s.err != nil {
+			return nil, s.err
+		}
+		if strings.Join(s.story, "\x00") != strings.Join(sessions[0].story, "\x00") {
+			return nil, errs.NewTestSuite(testCase, "session %v output differs from session 0: %q vs. %q.",
+				i, s.story, sessions[0].story)
+		}
+	}
+
+	*story = append(*story, sessions[0].story...)
+	*seen = append(*seen, sessions[0].seen...)
+	*softErrors = append(*softErrors, sessions[0].softErr...)
+	return sessions[0].vm, nil
+}
+
+// stepSetGlobals sets the global variables of the Storyworld running on theVM.
+// globals maps fully-qualified names to the values to set.
+func stepSetGlobals(theVM *vm.VM, globals map[string]any) errs.Error {
+	for fqn, value := range globals {
+		err := theVM.SetGlobal(fqn, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGlobals checks if the global variables of the Storyworld running on
+// theVM have the expected values. expectedGlobals maps fully-qualified names to
+// values.
+func checkGlobals(theVM *vm.VM, testCase string, expectedGlobals map[string]any) errs.Error {
+	if len(expectedGlobals) > 0 && theVM == nil {
+		return errs.NewTestSuite(testCase, "cannot check globals without a Storyworld to run.")
+	}
+	for fqn, expected := range expectedGlobals {
+		actual, err := theVM.Global(fqn)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return errs.NewTestSuite(testCase, "wrong value for global %v: got %v, expected %v.", fqn, actual, expected)
+		}
+	}
+	return nil
+}
+
+// saveStateJSON saves the state of theVM to w in the JSON representation, and
+// checks that converting it to the binary format and back yields the very same
+// JSON. csw and di are the Storyworld running on theVM and its DebugInfo.
+func saveStateJSON(theVM *vm.VM, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo,
+	testCase string, w *bytes.Buffer) errs.Error {
+
+	err := theVM.SaveStateJSON(w)
+	if err != nil {
+		return err
+	}
+
+	ss, err := vm.DecodeSavedStateJSON(bytes.NewReader(w.Bytes()))
+	if err != nil {
+		return err
+	}
+	binary := &bytes.Buffer{}
+	err = ss.Encode(binary, vm.SavedStateOptions{})
+	if err != nil {
+		return err
+	}
+	ss, err = vm.DecodeSavedState(binary, vm.SavedStateOptions{})
+	if err != nil {
+		return err
+	}
+	ss.Annotate(csw, di)
+	roundTrip := &bytes.Buffer{}
+	err = ss.EncodeJSON(roundTrip)
+	if err != nil {
+		return err
+	}
+
+	if roundTrip.String() != w.String() {
+		return errs.NewTestSuite(testCase, "saved state JSON changed after a round trip through the binary format:\n%v\nvs.\n%v",
+			w.String(), roundTrip.String())
+	}
+	return nil
+}
+
+// checkMetadata checks if the metadata of savedState matches the expected one.
+// isJSON tells if savedState is in the JSON representation.
+func checkMetadata(savedState []byte, isJSON bool, testCase string, expected *metadata) errs.Error {
+	if isJSON {
+		ss, err := vm.DecodeSavedStateJSON(bytes.NewReader(savedState))
+		if err != nil {
+			return err
+		}
+		bw := &bytes.Buffer{}
+		err = ss.Encode(bw, vm.SavedStateOptions{})
+		if err != nil {
+			return err
+		}
+		savedState = bw.Bytes()
+	}
+
+	md, err := vm.ReadSaveMetadata(bytes.NewReader(savedState))
+	if err != nil {
+		return err
+	}
+	if md.Timestamp.IsZero() {
+		return errs.NewTestSuite(testCase, "saved state metadata has no timestamp.")
+	}
+	if md.ReleaseTag != expected.ReleaseTag {
+		return errs.NewTestSuite(testCase, "wrong release tag in metadata: got '%v', expected '%v'.",
+			md.ReleaseTag, expected.ReleaseTag)
+	}
+	if md.Chapter != expected.Chapter {
+		return errs.NewTestSuite(testCase, "wrong chapter in metadata: got '%v', expected '%v'.",
+			md.Chapter, expected.Chapter)
+	}
+	if md.Preview != expected.Preview {
+		return errs.NewTestSuite(testCase, "wrong preview in metadata: got '%v', expected '%v'.",
+			md.Preview, expected.Preview)
+	}
+	if len(md.Fields) != len(expected.Fields) {
+		return errs.NewTestSuite(testCase, "got %v custom fields in metadata, expected %v.",
+			len(md.Fields), len(expected.Fields))
+	}
+	for k, v := range expected.Fields {
+		if md.Fields[k] != v {
+			return errs.NewTestSuite(testCase, "wrong value for custom metadata field %v: got '%v', expected '%v'.",
+				k, md.Fields[k], v)
+		}
+	}
+	return nil
+}
+
+// stepReplay replays the recording at recPath against csw, which is the
+// Storyworld built by a previous step, with the given instruction budget.
+func stepReplay(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, testCase, recPath string,
+	instructionBudget int) errs.Error {
+	if csw == nil {
+		return errs.NewTestSuite(testCase, "replay steps must come after some build step.")
+	}
+
+	rec, err := replay.LoadRecording(recPath)
+	if err != nil {
+		return err
+	}
+
+	report := replay.Replay(csw, di, rec, replay.Options{InstructionBudget: instructionBudget})
+	if report.DivergenceCount() == 0 {
+		return nil
+	}
+
+	msgs := []string{}
+	for _, run := range report.Runs {
+		if run.Divergence != nil {
+			msgs = append(msgs, run.String())
+		}
+	}
+	return errs.NewRomualdoTool("%v", strings.Join(msgs, "\n"))
+}
+
 func stepHash(srcPath, testCase string, expectedHashes map[string]string) errs.Error {
 	// Parse.
 	swAST, err := frontend.ParseStoryworld(srcPath)
@@ -216,6 +956,10 @@ func stepHash(srcPath, testCase string, expectedHashes map[string]string) errs.E
 	// Hash.
 	hasher := romutil.NewCodeHasher()
 	swAST.Walk(hasher)
+	err = hasher.Err()
+	if err != nil {
+		return err
+	}
 
 	// Check.
 	for sym, expHash := range expectedHashes {
@@ -282,17 +1026,57 @@ func canonicalizeConfig(testConf *config) {
 	if testConf.Hashes == nil {
 		testConf.Hashes = map[string]string{}
 	}
+	if testConf.Versions == nil {
+		testConf.Versions = map[string]int{}
+	}
+	if testConf.SoftErrors == nil {
+		testConf.SoftErrors = []string{}
+	}
 
 	// Make sure we have one step.
 	if len(testConf.Steps) == 0 {
 		testConf.Steps = append(testConf.Steps, step{
-			Type:          testConf.Type,
-			SourceDir:     testConf.SourceDir,
-			Input:         testConf.Input,
-			Output:        testConf.Output,
-			ExitCode:      testConf.ExitCode,
-			ErrorMessages: testConf.ErrorMessages,
-			Hashes:        testConf.Hashes,
+			Type:              testConf.Type,
+			SourceDir:         testConf.SourceDir,
+			Input:             testConf.Input,
+			Output:            testConf.Output,
+			ExitCode:          testConf.ExitCode,
+			ErrorMessages:     testConf.ErrorMessages,
+			Hashes:            testConf.Hashes,
+			Tag:               testConf.Tag,
+			Versions:          testConf.Versions,
+			Recording:         testConf.Recording,
+			Strict:            testConf.Strict,
+			SoftErrors:        testConf.SoftErrors,
+			InstructionBudget: testConf.InstructionBudget,
+			Externals:         testConf.Externals,
+			SetGlobals:        testConf.SetGlobals,
+			Globals:           testConf.Globals,
+			Observations:      testConf.Observations,
+			HistoryDepth:      testConf.HistoryDepth,
+			SaveHistory:       testConf.SaveHistory,
+			Undo:              testConf.Undo,
+			SaveFields:        testConf.SaveFields,
+			Metadata:          testConf.Metadata,
+			JSON:              testConf.JSON,
+			Compress:          testConf.Compress,
+			SigningKey:        testConf.SigningKey,
+			RequireSignature:  testConf.RequireSignature,
+			AllowUnsigned:     testConf.AllowUnsigned,
+			State:             testConf.State,
+			Record:            testConf.Record,
+			Replay:            testConf.Replay,
+			InteractiveFrom:   testConf.InteractiveFrom,
+			StripSignature:    testConf.StripSignature,
+			Seen:              testConf.Seen,
+			Sessions:          testConf.Sessions,
+			Persist:           testConf.Persist,
+			LCOV:              testConf.LCOV,
+			InputDictionary:   testConf.InputDictionary,
+			MaxDepth:          testConf.MaxDepth,
+			MaxStates:         testConf.MaxStates,
+			EndingEvent:       testConf.EndingEvent,
+			DepthFirst:        testConf.DepthFirst,
 		})
 	}
 
@@ -319,6 +1103,99 @@ func canonicalizeConfig(testConf *config) {
 		if step.Hashes == nil && testConf.Hashes != nil {
 			step.Hashes = testConf.Hashes
 		}
+		if step.Tag == "" {
+			step.Tag = testConf.Tag
+		}
+		if step.Versions == nil {
+			step.Versions = testConf.Versions
+		}
+		if step.Recording == "" {
+			step.Recording = testConf.Recording
+		}
+		if !step.Strict {
+			step.Strict = testConf.Strict
+		}
+		if step.SoftErrors == nil {
+			step.SoftErrors = testConf.SoftErrors
+		}
+		if step.InstructionBudget == 0 {
+			step.InstructionBudget = testConf.InstructionBudget
+		}
+		if step.Externals == nil {
+			step.Externals = testConf.Externals
+		}
+		if step.SetGlobals == nil {
+			step.SetGlobals = testConf.SetGlobals
+		}
+		if step.Globals == nil {
+			step.Globals = testConf.Globals
+		}
+		if step.Observations == nil {
+			step.Observations = testConf.Observations
+		}
+		if step.HistoryDepth == 0 {
+			step.HistoryDepth = testConf.HistoryDepth
+		}
+		if !step.SaveHistory {
+			step.SaveHistory = testConf.SaveHistory
+		}
+		if step.Undo == 0 {
+			step.Undo = testConf.Undo
+		}
+		if step.Undo == 0 {
+			step.Undo = 1
+		}
+		if step.SaveFields == nil {
+			step.SaveFields = testConf.SaveFields
+		}
+		if step.Metadata == nil {
+			step.Metadata = testConf.Metadata
+		}
+		if !step.JSON {
+			step.JSON = testConf.JSON
+		}
+		if !step.Compress {
+			step.Compress = testConf.Compress
+		}
+		if step.SigningKey == "" {
+			step.SigningKey = testConf.SigningKey
+		}
+		if !step.RequireSignature {
+			step.RequireSignature = testConf.RequireSignature
+		}
+		if !step.AllowUnsigned {
+			step.AllowUnsigned = testConf.AllowUnsigned
+		}
+		if !step.StripSignature {
+			step.StripSignature = testConf.StripSignature
+		}
+		if step.Seen == nil {
+			step.Seen = testConf.Seen
+		}
+		if step.Sessions == 0 {
+			step.Sessions = testConf.Sessions
+		}
+		if !step.Persist {
+			step.Persist = testConf.Persist
+		}
+		if !step.LCOV {
+			step.LCOV = testConf.LCOV
+		}
+		if step.InputDictionary == "" {
+			step.InputDictionary = testConf.InputDictionary
+		}
+		if step.MaxDepth == 0 {
+			step.MaxDepth = testConf.MaxDepth
+		}
+		if step.MaxStates == 0 {
+			step.MaxStates = testConf.MaxStates
+		}
+		if step.EndingEvent == "" {
+			step.EndingEvent = testConf.EndingEvent
+		}
+		if !step.DepthFirst {
+			step.DepthFirst = testConf.DepthFirst
+		}
 
 		testConf.Steps[i] = step
 	}
@@ -328,11 +1205,30 @@ func canonicalizeConfig(testConf *config) {
 // format. Returns nil if the configuration is valid, or an error otherwise.
 func validateConfig(testCase string, testConf *config) errs.Error {
 	var supportedTypes = map[string]bool{
-		"build":         true,
-		"build-and-run": true,
-		"save-state":    true,
-		"load-state":    true,
-		"hash":          true,
+		"build":           true,
+		"run":             true,
+		"run-parallel":    true,
+		"serve":           true,
+		"lsp":             true,
+		"debug":           true,
+		"build-and-run":   true,
+		"save-state":      true,
+		"load-state":      true,
+		"new-story":       true,
+		"save-profile":    true,
+		"load-profile":    true,
+		"hash":            true,
+		"release":         true,
+		"replay":          true,
+		"set-globals":     true,
+		"tamper-state":    true,
+		"undo":            true,
+		"choose":          true,
+		"run-interactive": true,
+		"coverage":        true,
+		"explore":         true,
+		"diff-releases":   true,
+		"reload":          true,
 	}
 	for _, step := range testConf.Steps {
 		// Validate step type
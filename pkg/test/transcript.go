@@ -0,0 +1,106 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package test
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/replay"
+	"github.com/stackedboxes/romualdo/pkg/vm"
+)
+
+// transcriptState is what the run-interactive steps of a test case remember
+// across steps.
+type transcriptState struct {
+	// dir is the directory where transcripts are recorded. Created by the
+	// first step that records one.
+	dir string
+
+	// recorded tells if a transcript was recorded already.
+	recorded bool
+}
+
+// path returns the path of the latest transcript recorded.
+func (ts *transcriptState) path() string {
+	return path.Join(ts.dir, "transcript.toml")
+}
+
+// cleanup removes the transcripts directory, if any.
+func (ts *transcriptState) cleanup() {
+	if ts.dir != "" {
+		os.RemoveAll(ts.dir)
+	}
+}
+
+// stepRunInteractive runs csw and (potentially nil) di like `romualdo run`
+// does, with the inputs from step typed by the Player. Everything printed is
+// appended to story as a single output, with paths shown relative to the test
+// case directory (testPath). transcripts keeps the transcripts recorded across
+// steps.
+func stepRunInteractive(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, testCase, testPath string,
+	step step, transcripts *transcriptState, story *[]string) errs.Error {
+
+	if csw == nil {
+		return errs.NewTestSuite(testCase, "run-interactive steps must come after some build step.")
+	}
+
+	text := &strings.Builder{}
+	transcriptOpts := replay.TranscriptOptions{
+		InteractiveFrom: step.InteractiveFrom,
+		Warnings:        text,
+	}
+	if step.Replay {
+		switch {
+		case step.Recording != "":
+			transcriptOpts.Replay = path.Join(testPath, step.Recording)
+		case transcripts.recorded:
+			transcriptOpts.Replay = transcripts.path()
+		default:
+			return errs.NewTestSuite(testCase, "nothing to replay: no recording given, and no transcript recorded.")
+		}
+	}
+	if step.Record {
+		if transcripts.dir == "" {
+			dir, plainErr := os.MkdirTemp("", "romualdo-transcript-")
+			if plainErr != nil {
+				return errs.NewTestSuite(testCase, "creating transcripts directory: %v.", plainErr)
+			}
+			transcripts.dir = dir
+		}
+		transcriptOpts.Record = transcripts.path()
+		transcripts.recorded = true
+	}
+
+	externals, transcript, err := replay.NewTranscript(csw, step.Externals, transcriptOpts)
+	if err != nil {
+		return err
+	}
+
+	input := ""
+	if len(step.Input) > 0 {
+		input = strings.Join(step.Input, "\n") + "\n"
+	}
+	err = vm.RunCSW(csw, di, vm.RunOptions{
+		Strict:            step.Strict,
+		InstructionBudget: step.InstructionBudget,
+		Externals:         externals,
+		HistoryDepth:      step.HistoryDepth,
+		Transcript:        transcript,
+		Stdin:             strings.NewReader(input),
+		Stdout:            text,
+		Stderr:            text,
+	})
+
+	relative := strings.NewReplacer(testPath+"/", "", transcripts.dir+"/", "")
+	*story = append(*story, relative.Replace(text.String()))
+	return err
+}
@@ -0,0 +1,41 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+)
+
+// Coverage records how many times each instruction of a Storyworld was run.
+// Attach it to a VM (see VM.Coverage) to find out which parts of the
+// Storyworld were exercised; the coverage package turns this into reports.
+//
+// The same Coverage can be attached to any number of VMs running the same
+// Storyworld one after another, accumulating their hits. It is not safe for
+// concurrent use, though: give each VM running concurrently its own Coverage.
+type Coverage struct {
+	// Hits contains the number of times each instruction was run.
+	// Hits[chunkIndex][codeIndex] counts the runs of the instruction starting
+	// at CompiledStoryworld.Chunks[chunkIndex].Code[codeIndex]. Entries for
+	// bytes in the middle of instructions (immediate operands) are always zero.
+	Hits [][]int
+}
+
+// NewCoverage creates a new Coverage for csw, with no hits.
+func NewCoverage(csw *bytecode.CompiledStoryworld) *Coverage {
+	hits := make([][]int, len(csw.Chunks))
+	for i, chunk := range csw.Chunks {
+		hits[i] = make([]int, len(chunk.Code))
+	}
+	return &Coverage{Hits: hits}
+}
+
+// hit records one run of the instruction at ip of the given chunk.
+func (c *Coverage) hit(chunk, ip int) {
+	c.Hits[chunk][ip]++
+}
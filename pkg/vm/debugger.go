@@ -0,0 +1,280 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// StopReason tells why a Debugger stopped the execution of a Storyworld.
+type StopReason int
+
+const (
+	// StopNone means the Debugger didn't stop the execution. If the VM is
+	// interrupted, it was for some other reason, like a cancelled context.
+	StopNone StopReason = iota
+
+	// StopBreakpoint means the execution reached a line with a breakpoint.
+	StopBreakpoint
+
+	// StopStep means a step (into, over or out) was completed.
+	StopStep
+)
+
+// stepMode tells what kind of step the Debugger is running.
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepInto
+	stepOver
+	stepOut
+)
+
+// Debugger lets a Driver Program stop the execution of a Storyworld at given
+// source code lines, step through it line by line, and inspect the call stack
+// and the variables while stopped. It's the machinery behind the `debug`
+// command.
+//
+// The Debugger stops the execution by interrupting the VM: VM.Start(),
+// VM.Step() or VM.Resume() return with the VM in StateInterrupted, and
+// StopReason() tells it was the Debugger. To carry on, call one of Continue(),
+// StepInto(), StepOver() or StepOut(), and then VM.Resume().
+//
+// The Debugger works with lines, not with instructions: it considers stopping
+// only before the first instruction of each line the execution runs into.
+type Debugger struct {
+	// vm is the VM being debugged.
+	vm *VM
+
+	// breakpoints maps source files (relative to the Storyworld root, like in
+	// DebugInfo) to the lines with breakpoints in them.
+	breakpoints map[string]map[int]bool
+
+	// mode is the kind of step running, if any.
+	mode stepMode
+
+	// stepDepth is the depth of the call stack when the current step started.
+	stepDepth int
+
+	// reason is why the Debugger stopped the execution last time.
+	reason StopReason
+
+	// frameLines contains the line of the latest instruction run by each
+	// call frame, indexed like VM.frames. Used to tell when the execution
+	// runs into a new line.
+	frameLines []int
+
+	// resuming is true right after the Debugger stopped the execution, so that
+	// it doesn't stop again at the same place when resumed.
+	resuming bool
+}
+
+// DebugFrame describes a call frame, as seen by the Debugger.
+type DebugFrame struct {
+	// Procedure is the name of the Procedure running on the frame, as in
+	// DebugInfo.ChunksNames.
+	Procedure string
+
+	// SourceFile is the source file of the Procedure, relative to the
+	// Storyworld root.
+	SourceFile string
+
+	// Line is the line being run. For the innermost frame of an interrupted
+	// VM, this is the line about to run.
+	Line int
+}
+
+// Variable is a variable inspected by the Debugger.
+type Variable struct {
+	// Name is the variable name. Fully-qualified for global variables.
+	Name string
+
+	// Value is the current variable value.
+	Value bytecode.Value
+}
+
+// NewDebugger creates a new Debugger and attaches it to theVM, which must have
+// DebugInfo.
+func NewDebugger(theVM *VM) (*Debugger, errs.Error) {
+	if theVM.debugInfo == nil {
+		return nil, errs.NewBadUsage("Debugging requires DebugInfo.")
+	}
+	d := &Debugger{
+		vm:          theVM,
+		breakpoints: map[string]map[int]bool{},
+	}
+	theVM.debugger = d
+	return d, nil
+}
+
+// SetBreakpoints replaces the breakpoints in sourceFile (relative to the
+// Storyworld root) with breakpoints at the given lines. Returns, for each of
+// these lines, whether it has any code. Breakpoints at lines without code are
+// kept, but are never hit.
+func (d *Debugger) SetBreakpoints(sourceFile string, lines []int) []bool {
+	di := d.vm.debugInfo
+	codeLines := map[int]bool{}
+	for chunk, file := range di.ChunksSourceFiles {
+		if file != sourceFile {
+			continue
+		}
+		for _, line := range di.ChunksLines[chunk] {
+			codeLines[line] = true
+		}
+	}
+
+	breakpoints := map[int]bool{}
+	verified := make([]bool, len(lines))
+	for i, line := range lines {
+		breakpoints[line] = true
+		verified[i] = codeLines[line]
+	}
+	d.breakpoints[sourceFile] = breakpoints
+	return verified
+}
+
+// Continue makes the execution go on until it hits a breakpoint.
+func (d *Debugger) Continue() {
+	d.startStep(stepNone)
+}
+
+// StepInto makes the execution stop at the next line, even if it is in a
+// Procedure called from the current line. Calling this before starting the
+// Story makes it stop at its very first line.
+func (d *Debugger) StepInto() {
+	d.startStep(stepInto)
+}
+
+// StepOver makes the execution stop at the next line of the current Procedure
+// (or of its caller, if it returns), not stopping within the Procedures it
+// calls. Breakpoints are still hit, though.
+func (d *Debugger) StepOver() {
+	d.startStep(stepOver)
+}
+
+// StepOut makes the execution stop after the current Procedure returns.
+// Breakpoints are still hit, though.
+func (d *Debugger) StepOut() {
+	d.startStep(stepOut)
+}
+
+// StopReason tells why the Debugger stopped the execution last time. Returns
+// StopNone if it didn't stop the execution since the last call to Continue()
+// or to one of the step functions.
+func (d *Debugger) StopReason() StopReason {
+	return d.reason
+}
+
+// CallStack returns the call stack, from the innermost call frame (the one
+// running) to the outermost one.
+func (d *Debugger) CallStack() []DebugFrame {
+	vm := d.vm
+	di := vm.debugInfo
+	stack := make([]DebugFrame, 0, len(vm.frames))
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		ip := frame.ip
+		if i == len(vm.frames)-1 && vm.State == StateInterrupted {
+			// Points to the instruction about to run; sourceLocation() expects
+			// it to point to the one after the last that ran.
+			ip++
+		}
+		sourceFile, line := sourceLocation(di, frame.chunk, ip)
+		stack = append(stack, DebugFrame{
+			Procedure:  di.ChunksNames[frame.chunk],
+			SourceFile: sourceFile,
+			Line:       line,
+		})
+	}
+	return stack
+}
+
+// Locals returns the local variables of a call frame. depth identifies the
+// frame like the indices into the slice returned by CallStack() do: zero is
+// the innermost frame. Returns nil if there is no such frame.
+func (d *Debugger) Locals(depth int) []Variable {
+	vm := d.vm
+	i := len(vm.frames) - 1 - depth
+	if i < 0 || depth < 0 {
+		return nil
+	}
+	frame := vm.frames[i]
+	names := vm.debugInfo.ChunksLocals[frame.chunk]
+	locals := make([]Variable, len(names))
+	for j, name := range names {
+		// Index zero is the callee.
+		locals[j] = Variable{Name: name, Value: frame.stack.at(j + 1)}
+	}
+	return locals
+}
+
+// Globals returns all global variables, including the profile variables.
+func (d *Debugger) Globals() []Variable {
+	vm := d.vm
+	globals := make([]Variable, len(vm.csw.Globals))
+	for i, g := range vm.csw.Globals {
+		globals[i] = Variable{Name: g.FQN, Value: vm.globalValue(i)}
+	}
+	return globals
+}
+
+// shouldStop tells if the execution shall stop before running the next
+// instruction. Called by the VM before every instruction.
+func (d *Debugger) shouldStop() bool {
+	vm := d.vm
+	depth := len(vm.frames)
+	chunk, ip := vm.frame.chunk, vm.frame.ip
+
+	sourceFile := vm.debugInfo.ChunksSourceFiles[chunk]
+	line := 0
+	if lines := vm.debugInfo.ChunksLines[chunk]; ip < len(lines) {
+		line = lines[ip]
+	}
+
+	// Did we run into a new line? Procedures always start at a new line, even
+	// when called from a line with the same number.
+	for len(d.frameLines) < depth {
+		d.frameLines = append(d.frameLines, 0)
+	}
+	d.frameLines = d.frameLines[:depth]
+	newLine := ip == 0 || line != d.frameLines[depth-1]
+	d.frameLines[depth-1] = line
+
+	if d.resuming {
+		d.resuming = false
+		return false
+	}
+	if !newLine || line == 0 {
+		return false
+	}
+
+	switch {
+	case d.breakpoints[sourceFile][line]:
+		d.reason = StopBreakpoint
+	case d.mode == stepInto,
+		d.mode == stepOver && depth <= d.stepDepth,
+		d.mode == stepOut && depth < d.stepDepth:
+		d.reason = StopStep
+	default:
+		return false
+	}
+
+	d.mode = stepNone
+	d.resuming = true
+	return true
+}
+
+// startStep starts a step of the given kind (which may be stepNone, meaning to
+// just continue).
+func (d *Debugger) startStep(mode stepMode) {
+	d.mode = mode
+	d.stepDepth = len(d.vm.frames)
+	d.reason = StopNone
+}
@@ -0,0 +1,98 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Event is something the Storyworld `emit`s to tell the Driver Program to do
+// something other than showing text, like playing a sound or unlocking an
+// achievement.
+type Event struct {
+	// Name is the event name.
+	Name string `json:"name"`
+
+	// Payload contains the data sent along with the event, as plain Go values
+	// (bools and strings). Never nil.
+	Payload map[string]any `json:"payload"`
+
+	// Offset is the position within the Output.Text at which the event was
+	// emitted. In other words, the event happened after the Storyworld said
+	// Output.Text[:Offset] and before it said Output.Text[Offset:].
+	Offset int `json:"offset"`
+}
+
+// String converts the Event to a string, using a syntax similar to the one
+// used to emit it. Payload keys are sorted, so that the result is stable.
+func (e Event) String() string {
+	keys := make([]string, 0, len(e.Payload))
+	for k := range e.Payload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]string, len(keys))
+	for i, k := range keys {
+		v := e.Payload[k]
+		if s, ok := v.(string); ok {
+			entries[i] = fmt.Sprintf("%v = %q", k, s)
+		} else {
+			entries[i] = fmt.Sprintf("%v = %v", k, v)
+		}
+	}
+
+	return fmt.Sprintf("%v {%v}", e.Name, strings.Join(entries, ", "))
+}
+
+// emit pops an event name and entryCount key/value pairs from the stack, and
+// adds the corresponding Event to the output.
+func (vm *VM) emit(entryCount int) {
+	payload := make(map[string]any, entryCount)
+	for i := 0; i < entryCount; i++ {
+		value := vm.peek(2*(entryCount-i) - 2)
+		key := vm.peek(2*(entryCount-i) - 1)
+		payload[key.AsString()] = value.Value
+	}
+	vm.stack.popN(2 * entryCount)
+
+	name := vm.pop()
+	if !name.IsString() {
+		vm.runtimeError("Expected a string as the event name, got %T", name.Value)
+	}
+
+	event := Event{
+		Name:    name.AsString(),
+		Payload: payload,
+		Offset:  vm.outBuffer.Len(),
+	}
+	vm.events = append(vm.events, event)
+	if vm.Observer != nil {
+		vm.Observer.OnEmit(vm.currentLocation(), event)
+	}
+}
+
+// TextWithEvents returns the Output text with the Events rendered inline, each
+// one in a line of its own, like `[name {key = "value"}]`. This is how the
+// Romualdo tool shows Events to the user.
+func (out Output) TextWithEvents() string {
+	sb := strings.Builder{}
+	pos := 0
+	for _, e := range out.Events {
+		sb.WriteString(out.Text[pos:e.Offset])
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("[" + e.String() + "]\n")
+		pos = e.Offset
+	}
+	sb.WriteString(out.Text[pos:])
+	return sb.String()
+}
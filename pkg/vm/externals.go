@@ -0,0 +1,127 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// ExternalFunction is the Go implementation of an external function declared
+// in a Storyworld. It gets the arguments as plain Go values (bool or string,
+// according to the parameter types) and returns its result in the same way.
+// Results returned by void external functions are ignored.
+//
+// Returning an error is a soft error: the Story goes on, with the external
+// function returning the default value of its return type.
+type ExternalFunction func(args []any) (any, error)
+
+// BindExternal binds the Go function f to the external function with the given
+// fully-qualified name. All external functions declared in the Storyworld must
+// be bound before calling Start() or LoadState().
+func (vm *VM) BindExternal(fqn string, f ExternalFunction) errs.Error {
+	index := vm.csw.ProcedureByFQN(fqn)
+	if index < 0 || !vm.csw.Procedures[index].External {
+		return errs.NewBadUsage("The Storyworld has no external function `%v`.", fqn)
+	}
+	if _, isStd := stdFunctions[fqn]; isStd {
+		return errs.NewBadUsage("`%v` is part of the standard library and cannot be bound.", fqn)
+	}
+	vm.externals[index] = f
+	return nil
+}
+
+// BindConstantExternals binds each external function in values (which maps
+// fully-qualified names to values) to a Go function that always returns the
+// corresponding value. This is what Driver Programs with no real game behind
+// them (like the romualdo tool itself) use. Functions are bound in FQN order,
+// so that the error reported for bad bindings is deterministic.
+func (vm *VM) BindConstantExternals(values map[string]any) errs.Error {
+	fqns := make([]string, 0, len(values))
+	for fqn := range values {
+		fqns = append(fqns, fqn)
+	}
+	sort.Strings(fqns)
+	for _, fqn := range fqns {
+		value := values[fqn]
+		err := vm.BindExternal(fqn, func(args []any) (any, error) {
+			return value, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExternals checks if all external functions declared in the Storyworld
+// are bound. (Except for the standard library ones, which are always
+// available.)
+func (vm *VM) checkExternals() errs.Error {
+	unbound := []string{}
+	for i, p := range vm.csw.Procedures {
+		if _, isStd := stdFunctions[p.FQN]; isStd {
+			continue
+		}
+		if p.External && vm.externals[i] == nil {
+			unbound = append(unbound, p.FQN)
+		}
+	}
+	if len(unbound) > 0 {
+		return errs.NewBadUsage("External functions not bound: %v.", strings.Join(unbound, ", "))
+	}
+	return nil
+}
+
+// callExternal calls the Go implementation of the external function whose stub
+// is currently running. If wantsResult is true, the stub is expected to have
+// pushed the default result, to be used if the Go implementation fails; the
+// actual result is pushed in its place. The stub frame itself is never on the
+// call stack of a saved state, as this all happens within a single
+// instruction.
+func (vm *VM) callExternal(wantsResult bool) {
+	var defaultResult bytecode.Value
+	if wantsResult {
+		defaultResult = vm.pop()
+	}
+
+	proc := vm.currentChunk().Procedure
+	fqn := vm.csw.Procedures[proc].FQN
+	args := make([]any, vm.frame.stack.size()-1) // local 0 is the callee
+	for i := range args {
+		args[i] = vm.frame.stack.at(i + 1).Value
+	}
+
+	var result any
+	var err error
+	if f, isStd := stdFunctions[fqn]; isStd {
+		result, err = f(vm, args)
+	} else {
+		result, err = vm.externals[proc](args)
+	}
+
+	switch {
+	case err != nil:
+		vm.softError("External function `%v` failed: %v.", fqn, err)
+		if wantsResult {
+			vm.push(defaultResult)
+		}
+	case !wantsResult:
+		// Nothing to push. Whatever was returned is ignored.
+	case reflect.TypeOf(result) != reflect.TypeOf(defaultResult.Value):
+		vm.softError("External function `%v` should return a %T, got a %T; using the default value.",
+			fqn, defaultResult.Value, result)
+		vm.push(defaultResult)
+	default:
+		vm.push(bytecode.Value{Value: result})
+	}
+}
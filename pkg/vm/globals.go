@@ -0,0 +1,111 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// GlobalInfo describes a global variable of the Storyworld running on a VM.
+type GlobalInfo struct {
+	// FQN is the fully-qualified name of the global variable.
+	FQN string
+
+	// Type is the declared type of the global variable.
+	Type bytecode.ValueKind
+
+	// Profile tells if this is a profile variable, whose value is stored in
+	// the VM Profile.
+	Profile bool
+}
+
+// Globals returns information about all global variables of the Storyworld.
+func (vm *VM) Globals() []GlobalInfo {
+	infos := make([]GlobalInfo, len(vm.csw.Globals))
+	for i, g := range vm.csw.Globals {
+		infos[i] = GlobalInfo{
+			FQN:     g.FQN,
+			Type:    g.InitialValue.Kind(),
+			Profile: g.Profile,
+		}
+	}
+	return infos
+}
+
+// Global returns the current value of the global variable with the given
+// fully-qualified name, as a plain Go value (a bool or a string, according to
+// its type). Returns an *errs.GlobalAccess if there is no such global. Works for
+// profile variables, too.
+func (vm *VM) Global(fqn string) (any, errs.Error) {
+	index, err := vm.globalIndex(fqn)
+	if err != nil {
+		return nil, err
+	}
+	return vm.globalValue(index).Value, nil
+}
+
+// SetGlobal sets the value of the global variable with the given
+// fully-qualified name. value is a plain Go value, which must match the
+// declared type of the global (a bool or a string). Returns an
+// *errs.GlobalAccess if there is no such global or if the types don't match.
+//
+// This is allowed only when vm.State is either StateNew or
+// StateWaitingForInput (in other words, when the Storyworld is not in the
+// middle of something). Profile variables are set in vm.Profile. When waiting
+// for input, the current rewind checkpoint is updated too, so that undoing back
+// to this choice point keeps the new value.
+func (vm *VM) SetGlobal(fqn string, value any) errs.Error {
+	if vm.State != StateNew && vm.State != StateWaitingForInput {
+		return errs.NewBadUsage("Global variables can only be set on new VMs or VMs waiting for input.")
+	}
+
+	index, err := vm.globalIndex(fqn)
+	if err != nil {
+		return err
+	}
+
+	current := vm.globalValue(index)
+	newValue := bytecode.Value{Value: value}
+	switch value.(type) {
+	case bool, string:
+		if newValue.Kind() == current.Kind() {
+			if g := &vm.csw.Globals[index]; g.Profile {
+				vm.Profile.set(g, newValue)
+				return nil
+			}
+			vm.globals[index] = newValue
+			return vm.retakeCheckpoint()
+		}
+		return errs.NewGlobalAccess(fqn, errs.GlobalAccessTypeMismatch,
+			"Cannot set global `%v`, which is a %v, to a %v.", fqn, current.Kind(), newValue.Kind())
+	default:
+		return errs.NewGlobalAccess(fqn, errs.GlobalAccessTypeMismatch,
+			"Cannot set global `%v`, which is a %v, to a %T.", fqn, current.Kind(), value)
+	}
+}
+
+// globalValue returns the value of the global variable with the given index
+// into vm.globals, looking into vm.Profile for profile variables.
+func (vm *VM) globalValue(index int) bytecode.Value {
+	if g := &vm.csw.Globals[index]; g.Profile {
+		return vm.Profile.get(g)
+	}
+	return vm.globals[index]
+}
+
+// globalIndex returns the index into vm.globals of the global variable with the
+// given fully-qualified name.
+func (vm *VM) globalIndex(fqn string) (int, errs.Error) {
+	for i, g := range vm.csw.Globals {
+		if g.FQN == fqn {
+			return i, nil
+		}
+	}
+	return -1, errs.NewGlobalAccess(fqn, errs.GlobalAccessUnknown, "Unknown global `%v`.", fqn)
+}
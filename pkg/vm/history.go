@@ -0,0 +1,160 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// ChoicePoint describes a point of the Story in which the Storyworld listened
+// to the Player, as kept in the rewind history.
+type ChoicePoint struct {
+	// Options contains the options offered to the Player.
+	Options string `json:"options"`
+
+	// Choice is the choice the Player made. Only meaningful if Chosen is true.
+	Choice string `json:"choice"`
+
+	// Chosen tells if the Player already made a choice at this point. This is
+	// false only for the choice point the Story is currently waiting at.
+	Chosen bool `json:"chosen"`
+}
+
+// checkpoint is an entry of the rewind history: a choice point, along with a
+// snapshot of the VM state at that point.
+type checkpoint struct {
+	ChoicePoint
+
+	// snapshot is the VM state at this choice point, as saved by
+	// VM.SaveState() (but without the rewind history).
+	snapshot []byte
+}
+
+// ChoicePoints returns the choice points in the rewind history, from the oldest
+// to the most recent one.
+func (vm *VM) ChoicePoints() []ChoicePoint {
+	points := make([]ChoicePoint, len(vm.history))
+	for i, cp := range vm.history {
+		points[i] = cp.ChoicePoint
+	}
+	return points
+}
+
+// Undo rewinds the Story to the point right before the Player made the n-th
+// most recent choice, so that the Player can choose again. Undo(1) goes back
+// one choice. Returns an Output with the state and options (but no text).
+//
+// Only the choices still in the rewind history can be undone (see
+// HistoryDepth). Undoing is not possible on a VM that was not started yet, but
+// is fine in all other cases, including after the end of the Story or a
+// runtime error. ctx is handled like in LoadState().
+func (vm *VM) Undo(ctx context.Context, n int) (Output, errs.Error) {
+	if vm.State == StateNew || vm.State == stateRunning {
+		return vm.output(), errs.NewBadUsage("VM.Undo() called on a VM that is not started")
+	}
+
+	choices := len(vm.history)
+	if choices > 0 && !vm.history[choices-1].Chosen {
+		choices--
+	}
+	if n < 1 || n > choices {
+		return vm.output(), errs.NewBadUsage("Cannot undo %v choice(s): there are %v in the history.", n, choices)
+	}
+
+	target := choices - n
+	_, _, err := vm.restoreState(ctx, bytes.NewReader(vm.history[target].snapshot), SavedStateOptions{})
+	if err != nil {
+		return vm.output(), err
+	}
+
+	vm.history = vm.history[:target+1]
+	vm.history[target].Choice = ""
+	vm.history[target].Chosen = false
+
+	if vm.Observer != nil {
+		vm.Observer.OnUndo(n)
+	}
+
+	return vm.output(), nil
+}
+
+// takeCheckpoint adds the current VM state to the rewind history, dropping the
+// oldest entries if needed. Must be called when the VM is waiting for input.
+func (vm *VM) takeCheckpoint() errs.Error {
+	if vm.HistoryDepth <= 0 {
+		return nil
+	}
+
+	snapshot, err := vm.snapshot()
+	if err != nil {
+		return err
+	}
+
+	vm.history = append(vm.history, checkpoint{
+		ChoicePoint: ChoicePoint{Options: vm.Options},
+		snapshot:    snapshot,
+	})
+	vm.trimHistory()
+	return nil
+}
+
+// retakeCheckpoint replaces the snapshot of the choice point the Story is
+// currently waiting at with the current VM state. This way, changes made while
+// waiting for input (like a host setting global variables) are not reverted
+// when rewinding to this point. Does nothing if there is no such checkpoint.
+func (vm *VM) retakeCheckpoint() errs.Error {
+	last := len(vm.history) - 1
+	if vm.State != StateWaitingForInput || last < 0 || vm.history[last].Chosen {
+		return nil
+	}
+
+	snapshot, err := vm.snapshot()
+	if err != nil {
+		return err
+	}
+	vm.history[last].snapshot = snapshot
+	return nil
+}
+
+// snapshot returns the current VM state, encoded as a rewind checkpoint
+// snapshot.
+func (vm *VM) snapshot() ([]byte, errs.Error) {
+	buf := &bytes.Buffer{}
+	err := vm.savedState(false).Encode(buf, SavedStateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// trimHistory drops the oldest entries of the rewind history, so that no more
+// than vm.HistoryDepth choices can be undone. That is, it keeps no more than
+// vm.HistoryDepth chosen entries, plus the one the Story is currently waiting
+// at, if any.
+func (vm *VM) trimHistory() {
+	depth := vm.HistoryDepth
+	if depth <= 0 {
+		vm.history = nil
+		return
+	}
+	if len(vm.history) > 0 && !vm.history[len(vm.history)-1].Chosen {
+		depth++
+	}
+	if len(vm.history) <= depth {
+		return
+	}
+
+	// Copy to a new slice, so that the dropped snapshots can be garbage
+	// collected.
+	trimmed := make([]checkpoint, depth)
+	copy(trimmed, vm.history[len(vm.history)-depth:])
+	vm.history = trimmed
+}
@@ -0,0 +1,174 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+// maxPreviewLength is the maximum length, in runes, of SaveMetadata.Preview.
+const maxPreviewLength = 100
+
+// SaveMetadata is the information about a saved state that a save menu would
+// want to show. It is stored at the start of saved states, so that
+// ReadSaveMetadata() can get it without going through the whole thing.
+type SaveMetadata struct {
+	// Timestamp is the moment the state was saved.
+	Timestamp time.Time `json:"timestamp"`
+
+	// ReleaseTag is the tag of the latest release of the Storyworld the state
+	// was saved with. Empty if the Storyworld was never released.
+	ReleaseTag string `json:"releaseTag"`
+
+	// Chapter is the name of the chapter the Story is in, as last set by the
+	// Storyworld with std.SetChapter(). Empty if never set.
+	Chapter string `json:"chapter"`
+
+	// Preview is the beginning of the last Lecture said before saving.
+	Preview string `json:"preview"`
+
+	// Fields contains the custom fields set by the Driver Program (see
+	// VM.SaveFields).
+	Fields map[string]string `json:"fields"`
+}
+
+// ReadSaveMetadata reads only the header and the metadata of the saved state
+// from the given io.Reader. This is much faster than loading the saved state,
+// but the saved state is not validated in any way (in particular, it may not
+// even be compatible with the Storyworld, and its signature is not verified).
+// Saved states created before the metadata was added to the format yield an
+// empty SaveMetadata.
+func ReadSaveMetadata(r io.Reader) (SaveMetadata, errs.Error) {
+	version, flags, err := deserializeHeader(r)
+	if err != nil {
+		return SaveMetadata{}, err
+	}
+	if version <= savedStateVersionNoMetadata {
+		return SaveMetadata{}, nil
+	}
+	if flags&savedStateFlagCompressed != 0 {
+		zr, plainErr := gzip.NewReader(r)
+		if plainErr != nil {
+			return SaveMetadata{}, errs.NewRomualdoTool("decompressing VM saved state: %v", plainErr)
+		}
+		r = io.LimitReader(zr, maxSavedStatePayloadSize)
+	}
+	return deserializeSaveMetadata(r)
+}
+
+// saveMetadata returns the metadata describing the current VM state.
+func (vm *VM) saveMetadata() SaveMetadata {
+	md := SaveMetadata{
+		Timestamp: time.Now(),
+		Chapter:   vm.chapter,
+		Preview:   vm.lastLecture,
+		Fields:    vm.SaveFields,
+	}
+	if len(vm.csw.Releases) > 0 {
+		md.ReleaseTag = vm.csw.Releases[len(vm.csw.Releases)-1].Tag
+	}
+	return md
+}
+
+// recordLecture takes note of a Lecture said by the Storyworld, so that it can
+// be used as the preview in the saved state metadata.
+func (vm *VM) recordLecture(text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if utf8.RuneCountInString(text) > maxPreviewLength {
+		text = string([]rune(text)[:maxPreviewLength-1]) + "…"
+	}
+	vm.lastLecture = text
+}
+
+// Serialize serializes the metadata to the given io.Writer.
+func (md *SaveMetadata) Serialize(w io.Writer) errs.Error {
+	err := romutil.SerializeI64(w, md.Timestamp.UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	for _, s := range []string{md.ReleaseTag, md.Chapter, md.Preview} {
+		err = romutil.SerializeString(w, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(md.Fields))
+	for k := range md.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	err = romutil.SerializeU32(w, uint32(len(keys)))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = romutil.SerializeString(w, k)
+		if err != nil {
+			return err
+		}
+		err = romutil.SerializeString(w, md.Fields[k])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deserializeSaveMetadata deserializes saved state metadata from the given
+// io.Reader.
+func deserializeSaveMetadata(r io.Reader) (SaveMetadata, errs.Error) {
+	md := SaveMetadata{}
+
+	millis, err := romutil.DeserializeI64(r)
+	if err != nil {
+		return md, err
+	}
+	md.Timestamp = time.UnixMilli(millis)
+
+	for _, s := range []*string{&md.ReleaseTag, &md.Chapter, &md.Preview} {
+		*s, err = romutil.DeserializeString(r)
+		if err != nil {
+			return md, err
+		}
+	}
+
+	fieldCount, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return md, err
+	}
+	if fieldCount > 0 {
+		md.Fields = map[string]string{}
+	}
+	for i := 0; i < int(fieldCount); i++ {
+		k, err := romutil.DeserializeString(r)
+		if err != nil {
+			return md, err
+		}
+		v, err := romutil.DeserializeString(r)
+		if err != nil {
+			return md, err
+		}
+		md.Fields[k] = v
+	}
+
+	return md, nil
+}
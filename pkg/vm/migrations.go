@@ -0,0 +1,112 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"context"
+	"sort"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// allMigrations returns the fully-qualified names of all migrations in the
+// Storyworld.
+func (vm *VM) allMigrations() []string {
+	migrations := []string{}
+	for _, p := range vm.csw.Procedures {
+		if p.IsMigration() {
+			migrations = append(migrations, p.FQN)
+		}
+	}
+	return migrations
+}
+
+// pendingMigrations returns the indices into csw.Procedures of the migrations
+// not applied yet, in the order they must be run: in release order, with
+// migrations for unreleased tags coming last. Migrations for the same release
+// run in the order they were declared.
+func (vm *VM) pendingMigrations() []int {
+	applied := make(map[string]bool, len(vm.appliedMigrations))
+	for _, fqn := range vm.appliedMigrations {
+		applied[fqn] = true
+	}
+
+	pending := []int{}
+	for i, p := range vm.csw.Procedures {
+		if p.IsMigration() && !applied[p.FQN] {
+			pending = append(pending, i)
+		}
+	}
+
+	releaseOrder := func(proc int) int {
+		release := vm.csw.ReleaseByTag(vm.csw.Procedures[proc].MigrationTag)
+		if release < 0 {
+			return len(vm.csw.Releases)
+		}
+		return release
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return releaseOrder(pending[i]) < releaseOrder(pending[j])
+	})
+
+	return pending
+}
+
+// runPendingMigrations runs all migrations that were not applied to the current
+// Story yet, and records them as applied. Anything they say or emit is
+// discarded.
+//
+// Migrations share the instruction budget of the VM, and are stopped if ctx is
+// cancelled. Since a half-applied migration cannot be resumed, this is a
+// runtime error.
+func (vm *VM) runPendingMigrations(ctx context.Context) {
+	vm.migrating = true
+	defer func() { vm.migrating = false }()
+	done := ctx.Done()
+	executed := 0
+	for _, proc := range vm.pendingMigrations() {
+		vm.runMigration(proc, done, &executed)
+		vm.appliedMigrations = append(vm.appliedMigrations, vm.csw.Procedures[proc].FQN)
+	}
+	vm.outBuffer.Reset()
+	vm.events = nil
+}
+
+// runMigration runs the migration at index proc into csw.Procedures to
+// completion, leaving the VM state as it was before (except for the global
+// variables, of course). The compiler guarantees that migrations never
+// suspend.
+//
+// done and executed are used to check for interruptions, just like in
+// runStep(); executed is updated with the number of instructions run.
+func (vm *VM) runMigration(proc int, done <-chan struct{}, executed *int) {
+	savedState := vm.State
+	savedOptions := vm.Options
+	depth := len(vm.frames)
+
+	vm.State = stateRunning
+	vm.push(bytecode.NewValueProcedure(proc))
+	vm.callProcedure(vm.csw.Procedures[proc].Chunk, 0)
+	for ; len(vm.frames) > depth; *executed++ {
+		if reason := vm.interruption(done, *executed); reason != InterruptNone {
+			vm.runtimeError("Migration %v was interrupted (%v)", vm.csw.Procedures[proc].FQN, reason)
+		}
+		vm.runInstruction()
+		if vm.State == StateWaitingForInput {
+			panic(errs.NewICE("migration %v suspended the execution", vm.csw.Procedures[proc].FQN))
+		}
+	}
+
+	vm.State = savedState
+	vm.Options = savedOptions
+	vm.frame = nil
+	if len(vm.frames) > 0 {
+		vm.frame = vm.frames[len(vm.frames)-1]
+	}
+}
@@ -0,0 +1,124 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// Observer gets notified about interesting things happening in a VM. This is
+// the way to build analytics, debuggers, achievement trackers and the like
+// without touching the VM itself.
+//
+// Observers are called synchronously from the VM, so they should be quick.
+// They must not call VM methods that run the Storyworld (like Step()) or change
+// its state (like SetGlobal()).
+//
+// Most callbacks receive the location where the thing happened. Source files
+// and line numbers are available only if the VM has DebugInfo.
+//
+// Embed NopObserver to implement only the callbacks you care about.
+type Observer interface {
+	// OnInstruction is called right before each instruction is executed. chunk
+	// and ip identify the instruction (ip is an index into the chunk code);
+	// stack contains the whole VM stack, and must not be changed.
+	OnInstruction(chunk, ip int, stack []bytecode.Value)
+
+	// OnProcedureEnter is called when a Procedure is called. where is the
+	// location of the Procedure start.
+	OnProcedureEnter(where errs.StackFrame)
+
+	// OnProcedureExit is called when a Procedure returns. where is the
+	// location of the return.
+	OnProcedureExit(where errs.StackFrame)
+
+	// OnSay is called when the Storyworld says some text.
+	OnSay(where errs.StackFrame, text string)
+
+	// OnEmit is called when the Storyworld emits an Event.
+	OnEmit(where errs.StackFrame, event Event)
+
+	// OnListen is called when the Storyworld starts listening to the Player.
+	OnListen(where errs.StackFrame, options string)
+
+	// OnChoice is called when the Player's choice is passed to the Storyworld.
+	OnChoice(choice string)
+
+	// OnSoftError is called for every soft error (even when no SoftErrorSink
+	// is set). Not called in strict mode, as soft errors are runtime errors
+	// then.
+	OnSoftError(e SoftError)
+
+	// OnSaveState is called after the VM state was successfully saved.
+	OnSaveState()
+
+	// OnLoadState is called after a VM state was successfully loaded.
+	// migrations contains the fully-qualified names of the migrations that
+	// were run while loading it, if any.
+	OnLoadState(migrations []string)
+
+	// OnUndo is called after n choices were undone.
+	OnUndo(n int)
+}
+
+// NopObserver is an Observer that does nothing. Embed it in your own Observers
+// so that you don't need to implement every single callback.
+type NopObserver struct{}
+
+func (NopObserver) OnInstruction(chunk, ip int, stack []bytecode.Value) {}
+func (NopObserver) OnProcedureEnter(where errs.StackFrame)              {}
+func (NopObserver) OnProcedureExit(where errs.StackFrame)               {}
+func (NopObserver) OnSay(where errs.StackFrame, text string)            {}
+func (NopObserver) OnEmit(where errs.StackFrame, event Event)           {}
+func (NopObserver) OnListen(where errs.StackFrame, options string)      {}
+func (NopObserver) OnChoice(choice string)                              {}
+func (NopObserver) OnSoftError(e SoftError)                             {}
+func (NopObserver) OnSaveState()                                        {}
+func (NopObserver) OnLoadState(migrations []string)                     {}
+func (NopObserver) OnUndo(n int)                                        {}
+
+// TraceObserver is an Observer that writes a trace of the execution (the stack
+// and the disassembly of each instruction) to an io.Writer.
+type TraceObserver struct {
+	NopObserver
+
+	// w is where the trace is written to.
+	w io.Writer
+
+	// csw is the Storyworld being traced.
+	csw *bytecode.CompiledStoryworld
+
+	// di is the DebugInfo of csw. Can be nil.
+	di *bytecode.DebugInfo
+}
+
+// NewTraceObserver creates a new TraceObserver writing to w a trace of the
+// execution of csw. di is optional; if not nil, it is used to make the trace
+// more readable.
+func NewTraceObserver(w io.Writer, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) *TraceObserver {
+	return &TraceObserver{
+		w:   w,
+		csw: csw,
+		di:  di,
+	}
+}
+
+// OnInstruction writes the stack and the disassembled instruction.
+func (t *TraceObserver) OnInstruction(chunk, ip int, stack []bytecode.Value) {
+	fmt.Fprint(t.w, "Stack: ")
+	for _, v := range stack {
+		fmt.Fprintf(t.w, "[ %v ]", v.DebugString(t.di))
+	}
+	fmt.Fprint(t.w, "\n")
+
+	t.csw.DisassembleInstruction(t.csw.Chunks[chunk], t.w, ip, t.di, chunk)
+}
@@ -0,0 +1,263 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+// profileVersion is the current version of a Romualdo profile.
+const profileVersion uint32 = 0
+
+// profileMagic is the "magic number" identifying a Romualdo profile. It is
+// comprised of the "RmldPrf" string followed by a SUB character (which in times
+// long gone used to represent a "soft end-of-file").
+var profileMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x50, 0x72, 0x66, 0x1A}
+
+// Profile contains the data that persists across playthroughs of a Storyworld,
+// as opposed to the data of a single Story (which goes into saved states). This
+// is the values of the profile variables and the seen-flags of Lectures (which
+// tell which Lectures the Player has already seen, in any playthrough).
+//
+// A Profile is independent of the VM that uses it, and is loaded and saved
+// independently of saved states. To carry it over to a new playthrough, just
+// assign it to the new VM. A Profile is not safe for concurrent use: don't
+// share one among VMs running concurrently.
+type Profile struct {
+	// vars contains the values of the profile variables set so far, keyed by
+	// their code hashes (so that they survive changes to the Storyworld, just
+	// like the globals in saved states). Profile variables not in here have
+	// their initial values.
+	vars map[romutil.CodeHash]profileVar
+
+	// seen contains the identities of all Lectures seen so far. See
+	// lectureIdentity().
+	seen map[romutil.CodeHash]bool
+}
+
+// profileVar is the value of a profile variable, as stored in a Profile.
+type profileVar struct {
+	// fqn is the fully-qualified name of the profile variable. Not used to
+	// match variables, just to make the serialized Profile easier to inspect.
+	fqn string
+
+	// value is the value of the profile variable.
+	value bytecode.Value
+}
+
+// NewProfile creates a new, empty Profile, like the one of a Player who never
+// played the Storyworld.
+func NewProfile() *Profile {
+	return &Profile{
+		vars: map[romutil.CodeHash]profileVar{},
+		seen: map[romutil.CodeHash]bool{},
+	}
+}
+
+// Seen checks if the Lecture with the given text, said by the Procedure with the
+// given fully-qualified name, was already seen.
+func (p *Profile) Seen(procedure, text string) bool {
+	return p.seen[lectureIdentity(procedure, text)]
+}
+
+// get returns the value of the profile variable g.
+func (p *Profile) get(g *bytecode.Global) bytecode.Value {
+	if v, ok := p.vars[g.Hash]; ok {
+		return v.value
+	}
+	return g.InitialValue
+}
+
+// set sets the value of the profile variable g.
+func (p *Profile) set(g *bytecode.Global, value bytecode.Value) {
+	p.vars[g.Hash] = profileVar{fqn: g.FQN, value: value}
+}
+
+// markSeen marks the Lecture with the given text, said by the Procedure with the
+// given fully-qualified name, as seen. Returns whether it was already seen
+// before.
+func (p *Profile) markSeen(procedure, text string) bool {
+	id := lectureIdentity(procedure, text)
+	wasSeen := p.seen[id]
+	p.seen[id] = true
+	return wasSeen
+}
+
+// lectureIdentity returns the identity of the Lecture with the given text, said
+// by the Procedure with the given fully-qualified name. This is stable across
+// builds of the Storyworld: it changes only if the text itself changes, or if it
+// moves to a different Procedure.
+func lectureIdentity(procedure, text string) romutil.CodeHash {
+	return sha256.Sum256([]byte(procedure + "\x00" + text))
+}
+
+// isBlank checks if text contains only whitespace. Blank Lectures are not worth
+// tracking as seen or unseen.
+func isBlank(text string) bool {
+	return strings.TrimSpace(text) == ""
+}
+
+//
+// Serialization
+//
+
+// Save serializes the Profile to the given io.Writer.
+func (p *Profile) Save(w io.Writer) errs.Error {
+	_, plainErr := w.Write(profileMagic)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("serializing profile magic: %v", plainErr)
+	}
+	err := romutil.SerializeU32(w, profileVersion)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(w, crc)
+
+	// Profile variables, sorted to make the output deterministic.
+	hashes := make([]romutil.CodeHash, 0, len(p.vars))
+	for h := range p.vars {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := p.vars[hashes[i]], p.vars[hashes[j]]
+		if a.fqn != b.fqn {
+			return a.fqn < b.fqn
+		}
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	err = romutil.SerializeU32(mw, uint32(len(hashes)))
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		err = romutil.SerializeString(mw, p.vars[h].fqn)
+		if err != nil {
+			return err
+		}
+		err = romutil.SerializeCodeHash(mw, h)
+		if err != nil {
+			return err
+		}
+		err = p.vars[h].value.Serialize(mw)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Seen Lectures, also sorted.
+	seen := make([]romutil.CodeHash, 0, len(p.seen))
+	for id := range p.seen {
+		seen = append(seen, id)
+	}
+	sort.Slice(seen, func(i, j int) bool {
+		return bytes.Compare(seen[i][:], seen[j][:]) < 0
+	})
+	err = romutil.SerializeU32(mw, uint32(len(seen)))
+	if err != nil {
+		return err
+	}
+	for _, id := range seen {
+		err = romutil.SerializeCodeHash(mw, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return romutil.SerializeU32(w, crc.Sum32())
+}
+
+// LoadProfile deserializes a Profile from the given io.Reader.
+func LoadProfile(r io.Reader) (*Profile, errs.Error) {
+	readMagic := make([]byte, len(profileMagic))
+	_, plainErr := io.ReadFull(r, readMagic)
+	if plainErr != nil {
+		return nil, errs.NewRomualdoTool("deserializing profile magic: %v", plainErr)
+	}
+	if !bytes.Equal(readMagic, profileMagic) {
+		return nil, errs.NewRomualdoTool("invalid profile magic number")
+	}
+	version, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != profileVersion {
+		return nil, errs.NewRomualdoTool("unsupported profile version: %v", version)
+	}
+
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	p := NewProfile()
+
+	// Profile variables
+	lenVars, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < lenVars; i++ {
+		fqn, err := romutil.DeserializeString(tr)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := romutil.DeserializeCodeHash(tr)
+		if err != nil {
+			return nil, err
+		}
+		value, err := bytecode.DeserializeValue(tr)
+		if err != nil {
+			return nil, err
+		}
+		p.vars[hash] = profileVar{fqn: fqn, value: value}
+	}
+
+	// Seen Lectures
+	lenSeen, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < lenSeen; i++ {
+		id, err := romutil.DeserializeCodeHash(tr)
+		if err != nil {
+			return nil, err
+		}
+		p.seen[id] = true
+	}
+
+	readCRC32, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return nil, err
+	}
+	if readCRC32 != crc.Sum32() {
+		return nil, errs.NewRomualdoTool("profile CRC32 mismatch")
+	}
+
+	return p, nil
+}
+
+// markSeen marks a Lecture just said as seen, taking note of whether it was
+// seen before, for the sake of Output.Seen.
+func (vm *VM) markSeen(text string) {
+	if vm.migrating || isBlank(text) {
+		return
+	}
+	fqn := vm.csw.Procedures[vm.currentChunk().Procedure].FQN
+	if !vm.Profile.markSeen(fqn, text) {
+		vm.outUnseen = true
+	}
+	vm.outSaid = true
+}
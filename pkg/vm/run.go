@@ -9,7 +9,10 @@ package vm
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
@@ -40,14 +43,24 @@ func CSWFromPath(path string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo
 // cswFromSource compiles the Storyworld source located at path and returns the
 // CompiledStoryworld and DebugInfo.
 func cswFromSource(path string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo, errs.Error) {
+	return BuildCSW(path, nil, nil)
+}
+
+// BuildCSW compiles the Storyworld source located at swPath and returns the
+// CompiledStoryworld and DebugInfo. If base is not nil, the Storyworld is
+// compiled on top of it, retaining everything released in base; in this case,
+// baseDI must be the DebugInfo corresponding to base.
+func BuildCSW(swPath string, base *bytecode.CompiledStoryworld, baseDI *bytecode.DebugInfo) (
+	*bytecode.CompiledStoryworld, *bytecode.DebugInfo, errs.Error) {
+
 	// Parse
-	swAST, err := frontend.ParseStoryworld(path)
+	swAST, err := frontend.ParseStoryworld(swPath)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Generate code
-	return backend.GenerateCode(swAST)
+	return backend.GenerateCode(swAST, base, baseDI)
 }
 
 // cswFromFile loads the CompiledStoryworld and DebugInfo from the given
@@ -60,53 +73,258 @@ func cswFromFile(path string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo
 	return csw, di, nil
 }
 
+// RunOptions contains the options for RunCSW.
+type RunOptions struct {
+	// Trace makes the VM print a trace/disassembly of the execution to stdout
+	// as it goes.
+	Trace bool
+
+	// Strict makes soft errors behave like runtime errors. Otherwise, they are
+	// reported to stderr.
+	Strict bool
+
+	// InstructionBudget is the maximum number of instructions the Storyworld
+	// can run between two Player inputs. Zero means no limit.
+	InstructionBudget int
+
+	// Externals maps the fully-qualified names of the external functions
+	// declared in the Storyworld to the values they shall return. (There is no
+	// real game to query here, so constant values will have to do.)
+	Externals map[string]any
+
+	// HistoryDepth is the number of choices the Player can undo, by entering
+	// UndoCommand instead of a choice. Zero disables undoing.
+	HistoryDepth int
+
+	// ProfilePath is the file where the Profile is kept. If not empty, the
+	// Profile is loaded from it (if it exists) before starting, and saved back
+	// to it whenever the Storyworld stops to listen to the Player or ends.
+	ProfilePath string
+
+	// Coverage, if not nil, records which instructions were run. It must have
+	// been created for the Storyworld being run.
+	Coverage *Coverage
+
+	// Transcript, if not nil, takes part in the run: it is told about every
+	// step, and can provide the inputs instead of the Player.
+	Transcript Transcript
+
+	// Stdin, Stdout and Stderr are where RunCSW reads the Player input from,
+	// and writes the output and the errors to. If nil, os.Stdin, os.Stdout and
+	// os.Stderr are used. (Watch mode always uses these.)
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// stdio returns the Stdin, Stdout and Stderr from opts, replacing nil ones with
+// their os counterparts.
+func (opts RunOptions) stdio() (io.Reader, io.Writer, io.Writer) {
+	var stdin io.Reader = os.Stdin
+	var stdout io.Writer = os.Stdout
+	var stderr io.Writer = os.Stderr
+	if opts.Stdin != nil {
+		stdin = opts.Stdin
+	}
+	if opts.Stdout != nil {
+		stdout = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		stderr = opts.Stderr
+	}
+	return stdin, stdout, stderr
+}
+
+// InputSource tells where the input for a step of RunCSW comes from.
+type InputSource int
+
+const (
+	// InputFromPlayer means the input is read from the Player.
+	InputFromPlayer InputSource = iota
+
+	// InputFromTranscript means the input comes from the Transcript.
+	InputFromTranscript
+
+	// InputNone means there is no input: the run stops here.
+	InputNone
+)
+
+// Transcript takes part in a run of RunCSW, recording the playthrough or
+// feeding the inputs of a recorded one. Steps are counted from the start of the
+// Story, which is step zero. See the replay package for implementations.
+type Transcript interface {
+	// Input tells where the input for the given step comes from and, if it
+	// comes from the Transcript, what it is.
+	Input(step int) (string, InputSource)
+
+	// Stepped is called after each step runs, with its input (empty for step
+	// zero) and its output, even if the step failed. Returning an error stops
+	// the run with this error.
+	Stepped(step int, input string, out Output) errs.Error
+
+	// Undone is called after the Player undoes the latest choice, which takes
+	// the Story back to the previous step.
+	Undone()
+}
+
+// UndoCommand is what the Player enters in RunCSW to undo the last choice.
+const UndoCommand = "\\undo"
+
 // RunCSW interprets the given CompiledStoryworld and (potentially nil)
-// DebugInfo. If trace is true, it prints a trace/disassembly of the execution
-// to stdout as it goes.
-func RunCSW(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, trace bool) (err errs.Error) {
-	defer func() {
-		if r := recover(); r != nil {
-			switch e := r.(type) {
-			case *errs.CompileTime:
-				err = e
-				return
-			case error:
-				err = errs.NewICE("Unexpected error: %v", e)
-				return
-			default:
-				err = errs.NewICE("unexpected error type: %T (%v)", r, r)
-				return
-			}
+// DebugInfo, interacting with the Player through stdin and stdout (see
+// opts.Stdin and opts.Stdout). The run ends when the Story ends, or when the
+// input ends while the Story is listening to the Player.
+func RunCSW(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, opts RunOptions) errs.Error {
+	theVM, err := newRunVM(csw, di, opts)
+	if err != nil {
+		return err
+	}
+	if opts.ProfilePath != "" {
+		profile, err := loadProfileFile(opts.ProfilePath)
+		if err != nil {
+			return err
 		}
-	}()
+		theVM.Profile = profile
+	}
 
-	theVM := New(csw, di)
-	theVM.DebugTraceExecution = trace
+	// stepped tells the Transcript (if any) about a step that just ran, and
+	// returns the error that shall stop the run, if any.
+	stepped := func(step int, input string, out Output, err errs.Error) errs.Error {
+		if opts.Transcript == nil {
+			return err
+		}
+		transcriptErr := opts.Transcript.Stepped(step, input, out)
+		if err != nil {
+			return err
+		}
+		return transcriptErr
+	}
 
-	out := theVM.Start()
+	// A single Scanner for the whole run, as it reads ahead.
+	in, stdout, stderr := opts.stdio()
+	stdin := bufio.NewScanner(in)
+
+	ctx := context.Background()
+	step := 0
+	out, err := theVM.Start(ctx)
+	err = stepped(step, "", out, err)
 	for {
-		fmt.Print(out)
+		fmt.Fprint(stdout, out.TextWithEvents())
+		if err != nil {
+			return err
+		}
+		if opts.ProfilePath != "" {
+			err = saveProfileFile(theVM.Profile, opts.ProfilePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch out.State {
+		case StateEndOfStory:
+			fmt.Fprintln(stdout, "-- The End --")
+			return nil
+		case StateWaitingForInput:
+			// Fine, keep going.
+		case StateInterrupted:
+			if out.Interrupt == InterruptCancelled {
+				return errs.NewRomualdoTool("the run was cancelled")
+			}
+			return errs.NewRomualdoTool("the Storyworld ran %v instructions without "+
+				"listening to the Player or ending; giving up", opts.InstructionBudget)
+		default:
+			return errs.NewICE("unexpected VM state after running: %v", out.State)
+		}
 
-		if theVM.State == StateEndOfStory {
-			fmt.Println("-- The End --")
+		input := ""
+		source := InputFromPlayer
+		if opts.Transcript != nil {
+			input, source = opts.Transcript.Input(step + 1)
+		}
+		if source == InputNone {
+			fmt.Fprintln(stdout, "-- End of the Transcript --")
 			return nil
 		}
 
-		if theVM.State != StateWaitingForInput {
-			// TODO: Get rid of this assert-like check? Or at least make it
-			// "throw" an errs.Runtime.
-			panic("Should be waiting for input, right?")
+		fmt.Fprintln(stdout, out.Options)
+		fmt.Fprint(stdout, "> ")
+
+		if source == InputFromTranscript {
+			fmt.Fprintln(stdout, input)
+		} else {
+			if !stdin.Scan() {
+				// No more input; the Player is gone.
+				fmt.Fprintln(stdout)
+				return nil
+			}
+			input = stdin.Text()
 		}
 
-		fmt.Println(theVM.Options)
-		fmt.Print("> ")
+		if opts.HistoryDepth > 0 && input == UndoCommand {
+			undone, undoErr := theVM.Undo(ctx, 1)
+			if undoErr != nil {
+				// Nothing to undo; just ask again.
+				fmt.Fprintln(stderr, undoErr)
+				out = Output{Options: out.Options, State: out.State}
+				continue
+			}
+			out = undone
+			step--
+			if opts.Transcript != nil {
+				opts.Transcript.Undone()
+			}
+			continue
+		}
 
-		s := bufio.NewScanner(os.Stdin)
-		s.Scan()
-		input := s.Text()
+		step++
+		out, err = theVM.Step(ctx, input)
+		err = stepped(step, input, out, err)
+	}
+}
 
-		out = theVM.Step(input)
+// newRunVM creates a VM to run csw and di, set up as opts tell (except for the
+// Profile, which is left to the caller).
+func newRunVM(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, opts RunOptions) (*VM, errs.Error) {
+	_, stdout, stderr := opts.stdio()
+	theVM := New(csw, di)
+	if opts.Trace {
+		theVM.Observer = NewTraceObserver(stdout, csw, di)
+	}
+	theVM.Strict = opts.Strict
+	theVM.InstructionBudget = opts.InstructionBudget
+	theVM.HistoryDepth = opts.HistoryDepth
+	theVM.Coverage = opts.Coverage
+	theVM.SoftErrorSink = func(e SoftError) {
+		fmt.Fprintln(stderr, e)
+	}
+	if err := theVM.BindConstantExternals(opts.Externals); err != nil {
+		return nil, err
+	}
+	return theVM, nil
+}
+
+// loadProfileFile loads the Profile from the file at profilePath. Returns a new,
+// empty Profile if the file doesn't exist.
+func loadProfileFile(profilePath string) (*Profile, errs.Error) {
+	f, err := os.Open(profilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewProfile(), nil
+	}
+	if err != nil {
+		return nil, errs.NewRomualdoTool("opening profile file %v: %v", profilePath, err)
 	}
+	defer f.Close()
+	return LoadProfile(bufio.NewReader(f))
+}
+
+// saveProfileFile saves profile to the file at profilePath.
+func saveProfileFile(profile *Profile, profilePath string) errs.Error {
+	f, err := os.Create(profilePath)
+	if err != nil {
+		return errs.NewRomualdoTool("creating profile file %v: %v", profilePath, err)
+	}
+	defer f.Close()
+	return profile.Save(f)
 }
 
 // LoadCompiledStoryworldBinaries loads the CompiledStoryworld from cwPath. It
@@ -118,6 +336,7 @@ func LoadCompiledStoryworldBinaries(cswPath string, diRequired bool) (*bytecode.
 	if err != nil {
 		return nil, nil, errs.NewRomualdoTool("opening compiled storyworld file %v: %v", cswPath, err)
 	}
+	defer cswFile.Close()
 
 	csw := &bytecode.CompiledStoryworld{}
 	err = csw.Deserialize(cswFile)
@@ -135,14 +354,47 @@ func LoadCompiledStoryworldBinaries(cswPath string, diRequired bool) (*bytecode.
 		return csw, nil, nil
 	}
 
+	defer diFile.Close()
+
+	// A DebugInfo that fails to load (say, because it is from an older version
+	// of Romualdo) is as good as none: don't use what was read before failing.
+	// The same goes for one left over from a different build.
 	di := &bytecode.DebugInfo{}
 	err = di.Deserialize(diFile)
-	if diRequired && err != nil {
-		return nil, nil, errs.NewRomualdoTool("reading debug info from %v: %v", diPath, err)
+	if err == nil {
+		err = di.CheckMatches(csw)
+	}
+	if err != nil {
+		if diRequired {
+			return nil, nil, errs.NewRomualdoTool("reading debug info from %v: %v", diPath, err)
+		}
+		return csw, nil, nil
 	}
-
-	// TODO: Check for compatibility between the CompiledStoryworld and the
-	// DebugInfo.
 
 	return csw, di, nil
 }
+
+// SaveCompiledStoryworldBinaries saves the CompiledStoryworld csw to cswPath,
+// and the corresponding DebugInfo di to a file with the same name, but with a
+// .rad extension.
+func SaveCompiledStoryworldBinaries(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, cswPath string) errs.Error {
+	cswFile, err := os.Create(cswPath)
+	if err != nil {
+		return errs.NewRomualdoTool("creating compiled storyworld file %v: %v", cswPath, err)
+	}
+	defer cswFile.Close()
+
+	rErr := csw.Serialize(cswFile)
+	if rErr != nil {
+		return rErr
+	}
+
+	diPath := cswPath[:len(cswPath)-len(path.Ext(cswPath))] + ".rad"
+	diFile, err := os.Create(diPath)
+	if err != nil {
+		return errs.NewRomualdoTool("creating debug info file %v: %v", diPath, err)
+	}
+	defer diFile.Close()
+
+	return di.Serialize(diFile)
+}
@@ -0,0 +1,810 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
+	"github.com/stackedboxes/romualdo/pkg/errs"
+	"github.com/stackedboxes/romualdo/pkg/romutil"
+)
+
+const (
+	// savedStateVersion is the current version of a Romualdo saved state.
+	// Bump it whenever the layout changes.
+	savedStateVersion uint32 = 4
+
+	// savedStateVersionNoFlags is the version of saved states written before
+	// the header flags were added (and therefore before saved states could be
+	// compressed or signed). These can still be loaded.
+	savedStateVersionNoFlags uint32 = 3
+
+	// savedStateVersionNoMetadata is the version of saved states written
+	// before the metadata was added. These can still be loaded.
+	savedStateVersionNoMetadata uint32 = 2
+
+	// savedStateVersionNoHistory is the version of saved states written before
+	// the rewind history was added. These can still be loaded, and are the
+	// oldest ones that can: version 0 saved states were written before
+	// Storyworlds were versioned, and lack the code hashes needed to load them.
+	savedStateVersionNoHistory uint32 = 1
+)
+
+// Flags used in the header of saved states.
+const (
+	// savedStateFlagCompressed tells that the payload is gzip-compressed.
+	savedStateFlagCompressed uint32 = 1 << iota
+
+	// savedStateFlagSigned tells that the saved state ends with an
+	// HMAC-SHA256 signature.
+	savedStateFlagSigned
+
+	// savedStateKnownFlags contains all flags we know about.
+	savedStateKnownFlags = savedStateFlagCompressed | savedStateFlagSigned
+)
+
+// savedStateCRCSize is the size, in bytes, of the CRC32 at the end of the
+// payload.
+const savedStateCRCSize = 4
+
+// maxSavedStatePayloadSize is the maximum size, in bytes, of a (decompressed)
+// saved state payload. Larger uncompressed payloads are refused; for compressed
+// ones, anything beyond that is not read, so that a small compressed saved
+// state cannot expand into an arbitrarily large one.
+const maxSavedStatePayloadSize = 64 << 20
+
+// SavedStateOptions tells how saved states are encoded and decoded.
+type SavedStateOptions struct {
+	// Compress makes encoded saved states compressed. Not used when decoding,
+	// as the header tells if the saved state is compressed.
+	Compress bool
+
+	// Key is the key used to sign saved states with HMAC-SHA256. If not nil,
+	// encoded saved states are signed, and the saved states being decoded
+	// must be signed (unless they were created before signatures were
+	// supported, or AllowUnsigned is set); their signatures are verified
+	// before anything else is done with them. If nil, signatures are not
+	// verified.
+	Key []byte
+
+	// Set RequireSignature to true to refuse decoding saved states that are
+	// not signed, even those created before signatures were supported. Needs
+	// a Key.
+	RequireSignature bool
+
+	// Set AllowUnsigned to true to accept unsigned saved states even if a Key
+	// is set. Meant for development only, as anyone can modify unsigned saved
+	// states. Ignored if RequireSignature is set.
+	AllowUnsigned bool
+}
+
+// savedStateMagic is the "magic number" identifying a Romualdo VM saved state.
+// It is comprised of the "RmldSav" string followed by a SUB character (which in
+// times long gone used to represent a "soft end-of-file").
+var savedStateMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x53, 0x61, 0x76, 0x1A}
+
+// SavedState is the contents of a VM saved state, field by field, as described
+// in the file formats documentation. Unlike a VM, it doesn't need a Storyworld,
+// so it can represent any well-formed saved state (even one that cannot be
+// loaded with the Storyworld at hand).
+//
+// This is what the VM goes through when saving and loading its state, and what
+// the JSON representation of saved states is based on.
+type SavedState struct {
+	// Version is the version of the saved state format. Sections that didn't
+	// exist in this version are not encoded.
+	Version uint32 `json:"version"`
+
+	// Metadata is the save-slot metadata. Nil for saved states older than the
+	// metadata.
+	Metadata *SaveMetadata `json:"metadata,omitempty"`
+
+	// State is the VM state.
+	State State `json:"state"`
+
+	// Options contains the options the Story is waiting for.
+	Options string `json:"options"`
+
+	// Procedures contains the fully-qualified names of all Procedures of the
+	// Storyworld the state was saved with. Procedure Values on the Stack are
+	// indices into this.
+	Procedures []string `json:"procedures"`
+
+	// AppliedMigrations contains the fully-qualified names of the migrations
+	// already applied to the Story, in the order they were applied.
+	AppliedMigrations []string `json:"appliedMigrations"`
+
+	// Globals contains the global variables.
+	Globals []SavedGlobal `json:"globals"`
+
+	// Stack contains the values on the VM stack, from bottom to top.
+	Stack []bytecode.Value `json:"stack"`
+
+	// Frames contains the call frames, from bottom to top.
+	Frames []SavedFrame `json:"frames"`
+
+	// History is the rewind history, from the oldest to the most recent choice
+	// point.
+	History []SavedCheckpoint `json:"history"`
+}
+
+// SavedGlobal is a global variable in a SavedState.
+type SavedGlobal struct {
+	// FQN is the fully-qualified name of the global variable.
+	FQN string `json:"fqn"`
+
+	// Hash is the code hash of the global variable.
+	Hash romutil.CodeHash `json:"hash"`
+
+	// Value is the value of the global variable.
+	Value bytecode.Value `json:"value"`
+}
+
+// SavedFrame is a call frame in a SavedState.
+type SavedFrame struct {
+	// FQN is the fully-qualified name of the Procedure running.
+	FQN string `json:"fqn"`
+
+	// Hash is the code hash of the Procedure version running.
+	Hash romutil.CodeHash `json:"hash"`
+
+	// IP is the instruction pointer.
+	IP int `json:"ip"`
+
+	// StackBase is the index into the stack of the base of the stack view
+	// used by this call frame.
+	StackBase int `json:"stackBase"`
+
+	// SourceFile and Line tell where in the source code the frame is. These
+	// are not part of the saved state proper: they are only filled by
+	// Annotate(), to make the JSON representation more useful.
+	SourceFile string `json:"sourceFile,omitempty"`
+	Line       int    `json:"line,omitempty"`
+}
+
+// SavedCheckpoint is an entry of the rewind history in a SavedState.
+type SavedCheckpoint struct {
+	ChoicePoint
+
+	// Snapshot is the VM state at this choice point.
+	Snapshot *SavedState `json:"snapshot"`
+
+	// encoded is Snapshot in the binary format. If not nil, this is what gets
+	// encoded, and Snapshot may be nil (this spares the VM from decoding every
+	// snapshot in the rewind history whenever it saves its state).
+	encoded []byte
+}
+
+// DecodeSavedState decodes a saved state in the binary format from the given
+// io.Reader. This checks that the saved state is well-formed (and, depending on
+// opts, properly signed), not that it is compatible with any Storyworld.
+func DecodeSavedState(r io.Reader, opts SavedStateOptions) (*SavedState, errs.Error) {
+	if opts.RequireSignature && opts.Key == nil {
+		return nil, errs.NewBadUsage("Cannot require signed saved states without a key.")
+	}
+
+	data, plainErr := io.ReadAll(r)
+	if plainErr != nil {
+		return nil, errs.NewRomualdoTool("reading VM saved state: %v", plainErr)
+	}
+
+	hr := bytes.NewReader(data)
+	version, flags, err := deserializeHeader(hr)
+	if err != nil {
+		return nil, err
+	}
+	body := data[len(data)-hr.Len():]
+
+	// Verify the signature before anything else.
+	if flags&savedStateFlagSigned != 0 {
+		if len(body) < sha256.Size {
+			return nil, errs.NewRomualdoTool("VM saved state is truncated")
+		}
+		signature := body[len(body)-sha256.Size:]
+		body = body[:len(body)-sha256.Size]
+		if opts.Key != nil && !hmac.Equal(signature, sign(data[:len(data)-sha256.Size], opts.Key)) {
+			return nil, errs.NewRomualdoTool("VM saved state signature mismatch: " +
+				"it was modified, or signed with a different key")
+		}
+	} else if opts.RequireSignature || (opts.Key != nil && !opts.AllowUnsigned && version > savedStateVersionNoFlags) {
+		return nil, errs.NewRomualdoTool("VM saved state is not signed")
+	}
+
+	if len(body) < savedStateCRCSize {
+		return nil, errs.NewRomualdoTool("VM saved state is truncated")
+	}
+	footer := body[len(body)-savedStateCRCSize:]
+	body = body[:len(body)-savedStateCRCSize]
+
+	var payload io.Reader = bytes.NewReader(body)
+	if flags&savedStateFlagCompressed == 0 && len(body) > maxSavedStatePayloadSize {
+		return nil, errs.NewRomualdoTool("VM saved state is larger than %v bytes", maxSavedStatePayloadSize)
+	}
+	if flags&savedStateFlagCompressed != 0 {
+		zr, plainErr := gzip.NewReader(payload)
+		if plainErr != nil {
+			return nil, errs.NewRomualdoTool("decompressing VM saved state: %v", plainErr)
+		}
+		payload = io.LimitReader(zr, maxSavedStatePayloadSize)
+	}
+
+	ss := &SavedState{Version: version}
+	crc32, err := ss.deserializePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	err = deserializeFooter(bytes.NewReader(footer), crc32)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// Encode encodes the saved state in the binary format to the given io.Writer,
+// compressing and signing it as requested by opts.
+func (ss *SavedState) Encode(w io.Writer, opts SavedStateOptions) errs.Error {
+	flags := uint32(0)
+	if opts.Compress {
+		flags |= savedStateFlagCompressed
+	}
+	if opts.Key != nil {
+		flags |= savedStateFlagSigned
+	}
+	if flags != 0 && ss.Version <= savedStateVersionNoFlags {
+		return errs.NewBadUsage("Saved states of version %v cannot be compressed or signed.", ss.Version)
+	}
+
+	buf := &bytes.Buffer{}
+	err := serializeHeader(buf, ss.Version, flags)
+	if err != nil {
+		return err
+	}
+
+	var crc32 uint32
+	if opts.Compress {
+		zw := gzip.NewWriter(buf)
+		crc32, err = ss.serializePayload(zw)
+		if err != nil {
+			return err
+		}
+		plainErr := zw.Close()
+		if plainErr != nil {
+			return errs.NewRomualdoTool("compressing VM saved state: %v", plainErr)
+		}
+	} else {
+		crc32, err = ss.serializePayload(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = serializeFooter(buf, crc32)
+	if err != nil {
+		return err
+	}
+
+	if opts.Key != nil {
+		buf.Write(sign(buf.Bytes(), opts.Key))
+	}
+
+	_, plainErr := w.Write(buf.Bytes())
+	if plainErr != nil {
+		return errs.NewRomualdoTool("writing VM saved state: %v", plainErr)
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 signature of data, using the given key.
+func sign(data, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// DecodeSavedStateJSON decodes a saved state in the JSON format from the given
+// io.Reader.
+func DecodeSavedStateJSON(r io.Reader) (*SavedState, errs.Error) {
+	ss := &SavedState{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(ss)
+	if err != nil {
+		return nil, errs.NewRomualdoTool("decoding saved state JSON: %v", err)
+	}
+	if ss.Version < savedStateVersionNoHistory || ss.Version > savedStateVersion {
+		return nil, errs.NewRomualdoTool("unsupported VM state version: %v", ss.Version)
+	}
+	return ss, nil
+}
+
+// EncodeJSON encodes the saved state in the (indented) JSON format to the given
+// io.Writer.
+func (ss *SavedState) EncodeJSON(w io.Writer) errs.Error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(ss)
+	if err != nil {
+		return errs.NewRomualdoTool("encoding saved state JSON: %v", err)
+	}
+	return nil
+}
+
+// Annotate fills the source code locations of the call frames (including the
+// ones in the rewind history), using the given Storyworld and its DebugInfo.
+// Frames running Procedure versions not in csw are left alone.
+func (ss *SavedState) Annotate(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) {
+	if di == nil {
+		return
+	}
+
+	for i := range ss.Frames {
+		f := &ss.Frames[i]
+		chunk := csw.ChunkByHash(f.Hash)
+		if chunk < 0 {
+			continue
+		}
+		f.SourceFile, f.Line = sourceLocation(di, chunk, f.IP)
+	}
+
+	for _, cp := range ss.History {
+		if cp.Snapshot != nil {
+			cp.Snapshot.Annotate(csw, di)
+		}
+	}
+}
+
+// serializeHeader writes the header of a VM saved state of the given version
+// and with the given flags to the given io.Writer.
+func serializeHeader(w io.Writer, version, flags uint32) errs.Error {
+	_, plainErr := w.Write(savedStateMagic)
+	if plainErr != nil {
+		return errs.NewRomualdoTool("serializing VM state magic: %v", plainErr)
+	}
+
+	err := romutil.SerializeU32(w, version)
+	if err != nil {
+		return err
+	}
+
+	// Flags. Not present in older saved states.
+	if version <= savedStateVersionNoFlags {
+		return nil
+	}
+	err = romutil.SerializeU32(w, flags)
+	return err
+}
+
+// serializePayload writes the payload of the saved state to the given
+// io.Writer. In other words, this the function doing the actual serialization.
+// Returns the CRC32 of the data written to w, and an error.
+func (ss *SavedState) serializePayload(w io.Writer) (uint32, errs.Error) {
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(w, crc)
+
+	// Metadata. Comes first so that it can be read quickly.
+	if ss.Version > savedStateVersionNoMetadata {
+		md := ss.Metadata
+		if md == nil {
+			md = &SaveMetadata{}
+		}
+		err := md.Serialize(mw)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// VM State
+	err := romutil.SerializeU32(mw, uint32(ss.State))
+	if err != nil {
+		return 0, err
+	}
+
+	// Options
+	err = romutil.SerializeString(mw, ss.Options)
+	if err != nil {
+		return 0, err
+	}
+
+	// Procedures
+	err = romutil.SerializeU32(mw, uint32(len(ss.Procedures)))
+	if err != nil {
+		return 0, err
+	}
+	for _, fqn := range ss.Procedures {
+		err = romutil.SerializeString(mw, fqn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Applied migrations
+	err = romutil.SerializeU32(mw, uint32(len(ss.AppliedMigrations)))
+	if err != nil {
+		return 0, err
+	}
+	for _, fqn := range ss.AppliedMigrations {
+		err = romutil.SerializeString(mw, fqn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Globals
+	err = romutil.SerializeU32(mw, uint32(len(ss.Globals)))
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range ss.Globals {
+		err = romutil.SerializeString(mw, g.FQN)
+		if err != nil {
+			return 0, err
+		}
+		err = romutil.SerializeCodeHash(mw, g.Hash)
+		if err != nil {
+			return 0, err
+		}
+		err = g.Value.Serialize(mw)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Stack
+	stack := &Stack{data: ss.Stack}
+	err = stack.Serialize(mw)
+	if err != nil {
+		return 0, err
+	}
+
+	// Frames
+	err = romutil.SerializeU32(mw, uint32(len(ss.Frames)))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range ss.Frames {
+		err = f.Serialize(mw)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Rewind history
+	if ss.Version > savedStateVersionNoHistory {
+		err = romutil.SerializeU32(mw, uint32(len(ss.History)))
+		if err != nil {
+			return 0, err
+		}
+		for _, cp := range ss.History {
+			err = cp.Serialize(mw)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Voilà!
+	return crc.Sum32(), nil
+}
+
+// serializeFooter writes the footer of a VM saved state to the given io.Writer.
+func serializeFooter(w io.Writer, crc32 uint32) errs.Error {
+	err := romutil.SerializeU32(w, crc32)
+	return err
+}
+
+// deserializeHeader reads and checks the header of a VM saved state from the
+// given io.Reader. If everything is OK, it returns the saved state version and
+// flags, otherwise it returns an error.
+func deserializeHeader(r io.Reader) (uint32, uint32, errs.Error) {
+	// Magic
+	readMagic := make([]byte, len(savedStateMagic))
+	_, err := io.ReadFull(r, readMagic)
+	if err != nil {
+		// TODO: This isn't really a Romualdo tool error. But also not really a
+		// Runtime error. And I am not sure I want to create a brand new error
+		// type just for this. Think about it. And the same for other cases in
+		// this file. *And*, all generic serialization stuff in romutil that
+		// gets used here indirectly! (Maybe those should return normal Go
+		// errors? So that callers need to add more context in an errs.Error?)
+		return 0, 0, errs.NewRomualdoTool("deserializing VM state header magic: %v", err)
+	}
+	for i, b := range readMagic {
+		if b != savedStateMagic[i] {
+			// TODO: Could be friendlier here, by comparing readMagic with other
+			// Romualdo magic numbers and reporting a more meaningful error.
+			return 0, 0, errs.NewRomualdoTool("invalid VM state magic number")
+		}
+	}
+
+	// Version
+	readVersion, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return 0, 0, errs.NewRomualdoTool("deserializing VM state header version: %v", err)
+	}
+	if readVersion < savedStateVersionNoHistory || readVersion > savedStateVersion {
+		return 0, 0, errs.NewRomualdoTool("unsupported VM state version: %v", readVersion)
+	}
+
+	// Flags. Not present in older saved states.
+	if readVersion <= savedStateVersionNoFlags {
+		return readVersion, 0, nil
+	}
+	flags, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return 0, 0, errs.NewRomualdoTool("deserializing VM state header flags: %v", err)
+	}
+	if flags&^savedStateKnownFlags != 0 {
+		return 0, 0, errs.NewRomualdoTool("unsupported VM state flags: %#x", flags)
+	}
+
+	// Header is OK
+	return readVersion, flags, nil
+}
+
+// deserializePayload reads the payload of a saved state from the given
+// io.Reader. In other words, this the function doing the actual
+// deserialization. ss.Version must be already set. Returns the CRC32 of the
+// data read from r, and an error.
+func (ss *SavedState) deserializePayload(r io.Reader) (uint32, errs.Error) {
+	crcSummer := crc32.NewIEEE()
+	tr := io.TeeReader(r, crcSummer)
+
+	// Metadata. Not present in older saved states.
+	if ss.Version > savedStateVersionNoMetadata {
+		md, err := deserializeSaveMetadata(tr)
+		if err != nil {
+			return 0, err
+		}
+		ss.Metadata = &md
+	}
+
+	// VM State
+	vmState, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.State = State(vmState)
+
+	// Options
+	ss.Options, err = romutil.DeserializeString(tr)
+	if err != nil {
+		return 0, err
+	}
+
+	// Procedures
+	procCount, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.Procedures, err = romutil.DeserializeStringSliceNoLength(tr, int(procCount))
+	if err != nil {
+		return 0, err
+	}
+
+	// Applied migrations
+	migrationCount, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.AppliedMigrations, err = romutil.DeserializeStringSliceNoLength(tr, int(migrationCount))
+	if err != nil {
+		return 0, err
+	}
+
+	// Globals
+	globalCount, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.Globals = []SavedGlobal{}
+	for i := 0; i < int(globalCount); i++ {
+		g := SavedGlobal{}
+		g.FQN, err = romutil.DeserializeString(tr)
+		if err != nil {
+			return 0, err
+		}
+		g.Hash, err = romutil.DeserializeCodeHash(tr)
+		if err != nil {
+			return 0, err
+		}
+		g.Value, err = bytecode.DeserializeValue(tr)
+		if err != nil {
+			return 0, err
+		}
+		ss.Globals = append(ss.Globals, g)
+	}
+
+	// Stack
+	stack, err := DeserializeStack(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.Stack = stack.data
+
+	// Frames
+	frameCount, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.Frames = []SavedFrame{}
+	for i := 0; i < int(frameCount); i++ {
+		f, err := deserializeSavedFrame(tr)
+		if err != nil {
+			return 0, err
+		}
+		ss.Frames = append(ss.Frames, f)
+	}
+
+	// Rewind history. Not present in older saved states.
+	if ss.Version == savedStateVersionNoHistory {
+		return crcSummer.Sum32(), nil
+	}
+	checkpointCount, err := romutil.DeserializeU32(tr)
+	if err != nil {
+		return 0, err
+	}
+	ss.History = []SavedCheckpoint{}
+	for i := 0; i < int(checkpointCount); i++ {
+		cp, err := deserializeSavedCheckpoint(tr)
+		if err != nil {
+			return 0, err
+		}
+		ss.History = append(ss.History, cp)
+	}
+
+	// Voilà!
+	return crcSummer.Sum32(), nil
+}
+
+// deserializeFooter reads and checks the footer of a VM saved state from the
+// given io.Reader. You must pass the CRC32 of the payload previously read from
+// r.
+func deserializeFooter(r io.Reader, crc32 uint32) errs.Error {
+	readCRC32, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return err
+	}
+	if readCRC32 != crc32 {
+		return errs.NewRomualdoTool("VM saved state CRC32 mismatch")
+	}
+	return nil
+}
+
+// Serialize serializes the SavedFrame to the given io.Writer. (The source code
+// location is not serialized.)
+func (f *SavedFrame) Serialize(w io.Writer) errs.Error {
+	// The FQN is used just for better error messages. Chunk indices change
+	// between builds, so the running Procedure version is identified by its
+	// code hash.
+	err := romutil.SerializeString(w, f.FQN)
+	if err != nil {
+		return err
+	}
+
+	err = romutil.SerializeCodeHash(w, f.Hash)
+	if err != nil {
+		return err
+	}
+
+	err = romutil.SerializeU32(w, uint32(f.IP))
+	if err != nil {
+		return err
+	}
+
+	// Need only the stack base; the stack pointer is always the one and only
+	// stack we have, which is serialized elsewhere.
+	err = romutil.SerializeU32(w, uint32(f.StackBase))
+	return err
+}
+
+// deserializeSavedFrame deserializes a SavedFrame from the given io.Reader.
+func deserializeSavedFrame(r io.Reader) (SavedFrame, errs.Error) {
+	f := SavedFrame{}
+	var err errs.Error
+
+	f.FQN, err = romutil.DeserializeString(r)
+	if err != nil {
+		return f, err
+	}
+
+	f.Hash, err = romutil.DeserializeCodeHash(r)
+	if err != nil {
+		return f, err
+	}
+
+	ip, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return f, err
+	}
+	f.IP = int(ip)
+
+	stackBase, err := romutil.DeserializeU32(r)
+	if err != nil {
+		return f, err
+	}
+	f.StackBase = int(stackBase)
+
+	return f, nil
+}
+
+// Serialize serializes the SavedCheckpoint to the given io.Writer.
+func (cp *SavedCheckpoint) Serialize(w io.Writer) errs.Error {
+	err := romutil.SerializeString(w, cp.Options)
+	if err != nil {
+		return err
+	}
+	err = romutil.SerializeBool(w, cp.Chosen)
+	if err != nil {
+		return err
+	}
+	err = romutil.SerializeString(w, cp.Choice)
+	if err != nil {
+		return err
+	}
+	snapshot, err := cp.encodedSnapshot()
+	if err != nil {
+		return err
+	}
+	return romutil.SerializeString(w, string(snapshot))
+}
+
+// encodedSnapshot returns the snapshot in the binary format.
+func (cp *SavedCheckpoint) encodedSnapshot() ([]byte, errs.Error) {
+	if cp.encoded != nil {
+		return cp.encoded, nil
+	}
+	if cp.Snapshot == nil {
+		return nil, errs.NewRomualdoTool("rewind history checkpoint without a snapshot")
+	}
+	buf := &bytes.Buffer{}
+	err := cp.Snapshot.Encode(buf, SavedStateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deserializeSavedCheckpoint deserializes a SavedCheckpoint from the given
+// io.Reader.
+func deserializeSavedCheckpoint(r io.Reader) (SavedCheckpoint, errs.Error) {
+	cp := SavedCheckpoint{}
+	var err errs.Error
+
+	cp.Options, err = romutil.DeserializeString(r)
+	if err != nil {
+		return cp, err
+	}
+	cp.Chosen, err = romutil.DeserializeBool(r)
+	if err != nil {
+		return cp, err
+	}
+	cp.Choice, err = romutil.DeserializeString(r)
+	if err != nil {
+		return cp, err
+	}
+	snapshot, err := romutil.DeserializeString(r)
+	if err != nil {
+		return cp, err
+	}
+	cp.encoded = []byte(snapshot)
+	cp.Snapshot, err = DecodeSavedState(bytes.NewReader(cp.encoded), SavedStateOptions{})
+	if err != nil {
+		return cp, err
+	}
+	return cp, nil
+}
@@ -0,0 +1,66 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"fmt"
+)
+
+// SoftError describes a soft error: a fault found while running a Storyworld
+// that didn't stop the Story. (Stories don't crash, so the VM just uses some
+// sensible default and keeps going.)
+type SoftError struct {
+	// Procedure is the fully-qualified name of the Procedure running when the
+	// soft error happened.
+	Procedure string
+
+	// SourceFile is the file where Procedure is defined. Empty if not known
+	// (e.g., if no debug information is available).
+	SourceFile string
+
+	// Line is the line where the soft error happened. Zero if not known.
+	Line int
+
+	// Message contains a message explaining what happened.
+	Message string
+}
+
+// String converts the SoftError to a string.
+func (e SoftError) String() string {
+	if e.Line <= 0 {
+		return fmt.Sprintf("Soft error: %v [unknown line] in %v", e.Message, e.Procedure)
+	}
+	return fmt.Sprintf("Soft error: %v [%v:%v] in %v", e.Message, e.SourceFile, e.Line, e.Procedure)
+}
+
+// softError reports a soft error with a given message and fmt.Printf-like
+// arguments to the soft error sink and the Observer. In strict mode, this
+// behaves just like runtimeError() instead.
+func (vm *VM) softError(format string, a ...interface{}) {
+	if vm.Strict {
+		vm.runtimeError(format, a...)
+	}
+
+	if vm.SoftErrorSink == nil && vm.Observer == nil {
+		return
+	}
+
+	where := vm.currentLocation()
+	e := SoftError{
+		Procedure:  where.Procedure,
+		SourceFile: where.SourceFile,
+		Line:       where.Line,
+		Message:    fmt.Sprintf(format, a...),
+	}
+	if vm.SoftErrorSink != nil {
+		vm.SoftErrorSink(e)
+	}
+	if vm.Observer != nil {
+		vm.Observer.OnSoftError(e)
+	}
+}
@@ -0,0 +1,30 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"github.com/stackedboxes/romualdo/pkg/frontend"
+)
+
+// stdFunction is the Go implementation of a function from the Romualdo standard
+// library. The standard library is declared as a set of external functions,
+// but these are implemented by the VM itself instead of by the Driver Program.
+// Works just like an ExternalFunction, but with access to the VM.
+type stdFunction func(vm *VM, args []any) (any, error)
+
+// stdFunctions maps the fully-qualified names of the standard library
+// functions to their implementations.
+var stdFunctions = map[string]stdFunction{
+	frontend.StdPackage + "/SetChapter": stdSetChapter,
+}
+
+// stdSetChapter implements std.SetChapter(name: string): void.
+func stdSetChapter(vm *VM, args []any) (any, error) {
+	vm.chapter = args[0].(string)
+	return nil, nil
+}
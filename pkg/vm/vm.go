@@ -8,14 +8,12 @@
 package vm
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"os"
 	"strings"
 
 	"github.com/stackedboxes/romualdo/pkg/bytecode"
 	"github.com/stackedboxes/romualdo/pkg/errs"
-	"github.com/stackedboxes/romualdo/pkg/romutil"
 )
 
 // State represents the state of a VM.
@@ -34,10 +32,23 @@ const (
 
 	// StateEndOfStory is the state of a VM that has finished executing the
 	// Storyworld. From here, the Driver Program could simply exit, but calling
-	// VM.LoadState() or VM.Start() are also valid. VM.SaveState() is also
-	// possible, but a bit odd.
+	// VM.LoadState() is also valid. VM.SaveState() is also possible, but a bit
+	// odd.
 	StateEndOfStory
 
+	// StateInterrupted is the state of a VM that stopped executing the
+	// Storyworld before reaching a Listen instruction or the end of the Story,
+	// either because it ran out of its instruction budget, because its context
+	// was cancelled, or because its Debugger stopped it. The typical next
+	// action is to call VM.Resume().
+	// VM.LoadState() is also valid (effectively aborting the execution).
+	StateInterrupted
+
+	// StateError is the state of a VM that found an error while executing the
+	// Storyworld. The Story cannot continue from here, and its state cannot be
+	// saved; the only valid action is calling VM.LoadState().
+	StateError
+
 	// stateRunning is the state of a VM that is executing the Storyworld. Users
 	// shall never see a VM on this state (which explains why the constant is
 	// not exported), as it's used only internally by the VM. It is used to help
@@ -45,6 +56,86 @@ const (
 	stateRunning = -1
 )
 
+// String converts the State to a string, which is also used in the JSON
+// representation of saved states.
+func (state State) String() string {
+	switch state {
+	case StateNew:
+		return "new"
+	case StateWaitingForInput:
+		return "waitingForInput"
+	case StateEndOfStory:
+		return "endOfStory"
+	case StateInterrupted:
+		return "interrupted"
+	case StateError:
+		return "error"
+	case stateRunning:
+		return "running"
+	default:
+		return fmt.Sprintf("<Unknown State: %d>", int(state))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (state State) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (state *State) UnmarshalText(text []byte) error {
+	for _, s := range []State{StateNew, StateWaitingForInput, StateEndOfStory, StateInterrupted, StateError} {
+		if s.String() == string(text) {
+			*state = s
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown VM state %q", text)
+}
+
+// InterruptReason tells why a VM went to StateInterrupted.
+type InterruptReason int
+
+const (
+	// InterruptNone means the VM was not interrupted.
+	InterruptNone InterruptReason = iota
+
+	// InterruptBudget means the VM ran out of its instruction budget.
+	InterruptBudget
+
+	// InterruptCancelled means the context passed to the VM was cancelled.
+	InterruptCancelled
+
+	// InterruptDebugger means the Debugger stopped the VM.
+	InterruptDebugger
+)
+
+// String converts the InterruptReason to a string, which is also used in the
+// JSON representation of Outputs.
+func (reason InterruptReason) String() string {
+	switch reason {
+	case InterruptNone:
+		return "none"
+	case InterruptBudget:
+		return "budget"
+	case InterruptCancelled:
+		return "cancelled"
+	case InterruptDebugger:
+		return "debugger"
+	default:
+		return fmt.Sprintf("<Unknown InterruptReason: %d>", int(reason))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (reason InterruptReason) MarshalText() ([]byte, error) {
+	return []byte(reason.String()), nil
+}
+
+// contextCheckInterval is the number of instructions executed between checks
+// for a cancelled context.
+const contextCheckInterval = 1024
+
 // VM is a Romualdo Virtual Machine.
 type VM struct {
 	//
@@ -65,6 +156,16 @@ type VM struct {
 	// that has started running and hasn't returned yet.
 	frames []*callFrame
 
+	// globals contains the current values of the global variables. Indexed
+	// just like csw.Globals.
+	globals []bytecode.Value
+
+	// appliedMigrations contains the fully-qualified names of the migrations
+	// already applied to the current Story. Stories started with a given
+	// release don't need the migrations it contains, so these are considered
+	// applied right from the start.
+	appliedMigrations []string
+
 	//
 	// State that is not serialized
 	//
@@ -75,6 +176,14 @@ type VM struct {
 	// VM.frames[len(VM.frames)-1].
 	frame *callFrame
 
+	// curliesDepth is the number of curlies expressions being evaluated. When
+	// positive, `say`s and `listen`s are soft errors.
+	//
+	// Doesn't need to be serialized because `listen`s never suspend the
+	// execution while evaluating curlies, so this is always zero whenever the
+	// driver program has a chance to serialize the VM state.
+	curliesDepth int
+
 	// outBuffer is where the VM sends its output to during the execution of a
 	// step.
 	//
@@ -84,6 +193,10 @@ type VM struct {
 	// outBuffer is empty (because its contents have been just returned).
 	outBuffer strings.Builder
 
+	// events contains the Events emitted during the execution of a step. Just
+	// like outBuffer, this doesn't need to be serialized.
+	events []Event
+
 	// csw is the compiled storyworld we are executing.
 	//
 	// This is not serialized along with the VM state, but instead as a separate
@@ -92,14 +205,22 @@ type VM struct {
 	// usable with a later version of the same Storyworld.
 	csw *bytecode.CompiledStoryworld
 
+	// externals contains the Go implementations of the external functions
+	// declared in the Storyworld. Indexed like csw.Procedures, with nil
+	// entries for Procedures that are not external functions (and for
+	// external functions not bound yet).
+	//
+	// Not serialized, because these are provided by the Driver Program.
+	externals []ExternalFunction
+
 	// debugInfo contains the debug information corresponding to csw.
 	//
 	// This is not serialized for the same reasons a the Storyworld (field csw)
 	// is not serialized (note that the debugInfo is directly associated with a
 	// given CompiledStoryworld).
 	//
-	// TODO: Make this optional. If nil, issue less friendly error messages,
-	// etc.
+	// This is optional. If nil, runtime errors will not include source file
+	// names and line numbers.
 	debugInfo *bytecode.DebugInfo
 
 	//
@@ -109,100 +230,355 @@ type VM struct {
 	// independent of the Storyworld being executed.
 	//
 
-	// Set DebugTraceExecution to true to make the VM disassemble the code as it
+	// Observer, if not nil, gets notified about what happens while running the
+	// Storyworld. Use a TraceObserver to make the VM disassemble the code as it
 	// runs through it.
-	DebugTraceExecution bool
+	Observer Observer
+
+	// debugger, if not nil, is the Debugger attached to the VM, which gets to
+	// stop the execution before every instruction. See NewDebugger().
+	debugger *Debugger
+
+	// Coverage, if not nil, records which instructions were run. It must have
+	// been created for the same Storyworld the VM runs.
+	Coverage *Coverage
+
+	//
+	// Limits
+	//
+	// Not serialized, as these are about how the Driver Program wants to run
+	// the Storyworld.
+	//
+
+	// InstructionBudget is the maximum number of instructions executed by each
+	// call to VM.Start(), VM.Step() or VM.Resume(). When it runs out, the VM
+	// goes to StateInterrupted. Also limits the instructions executed by the
+	// migrations run by each call to VM.LoadState(); exceeding it there is an
+	// error. Zero means no limit.
+	InstructionBudget int
+
+	// interrupt tells why the VM was interrupted. Only meaningful in
+	// StateInterrupted.
+	interrupt InterruptReason
+
+	//
+	// Rewind history
+	//
+	// The history itself is serialized only if SaveHistory is true. The
+	// settings are not serialized, as they are about how the Driver Program
+	// wants to run the Storyworld.
+	//
+
+	// history is the rewind history: a snapshot of the VM state at each of
+	// the most recent choice points, from the oldest to the most recent one.
+	history []checkpoint
+
+	// HistoryDepth is the maximum number of choices that can be undone. The
+	// rewind history keeps that many choice points, plus the one the Story is
+	// waiting at; each one costs roughly the size of a saved state. Zero
+	// disables the history.
+	HistoryDepth int
+
+	// Set SaveHistory to true to include the rewind history in saved states.
+	SaveHistory bool
+
+	// SavedStateOptions tells whether saved states are compressed and signed
+	// when saving, and how signatures are checked when loading. Snapshots in
+	// the rewind history are never compressed nor signed on their own (they
+	// are covered by the signature of the saved state that contains them).
+	SavedStateOptions SavedStateOptions
+
+	//
+	// Save-slot metadata
+	//
+	// Stored in the metadata section of saved states. See SaveMetadata.
+	//
+
+	// chapter is the name of the current chapter, as set by the Storyworld.
+	chapter string
+
+	// lastLecture is the (possibly truncated) last Lecture said by the
+	// Storyworld, used as the preview of saved states.
+	lastLecture string
+
+	// SaveFields contains custom fields the Driver Program wants to store in
+	// the metadata of saved states (say, the Player's level or the total play
+	// time). Loading a state replaces it with the fields stored in the state.
+	SaveFields map[string]string
+
+	//
+	// Profile
+	//
+	// Not serialized along with the VM state, as the Profile is about the
+	// Player, not about the Story. The Driver Program saves and loads it
+	// independently.
+	//
+
+	// Profile contains the profile variables and the seen-flags of Lectures.
+	// New VMs get a fresh, empty Profile; the Driver Program can replace it
+	// with a loaded one (or with the one from a previous playthrough) before
+	// starting the Story.
+	Profile *Profile
+
+	// outSaid tells if anything (other than whitespace) was said since the
+	// last Output was returned, and outUnseen tells if any of it was not seen
+	// before. Used to fill Output.Seen.
+	outSaid   bool
+	outUnseen bool
+
+	// migrating is true while running migrations. What migrations say is
+	// discarded, so it is not marked as seen.
+	migrating bool
+
+	//
+	// Soft errors
+	//
+	// These are not serialized either, because how to handle soft errors is
+	// a decision of the Driver Program, not of the Story.
+	//
+
+	// SoftErrorSink, if not nil, gets called for every soft error found while
+	// running the Storyworld.
+	SoftErrorSink func(SoftError)
+
+	// Set Strict to true to make soft errors behave like runtime errors.
+	Strict bool
 }
 
 // New returns a new Virtual Machine capable of executing the given Storyworld
 // csw. If not nil, the VM will use the given DebugInfo di to provide better
 // error messages.
+//
+// The VM never modifies csw nor di, so any number of VMs (running on any number
+// of goroutines) can share them. The VM doesn't copy them either: the only
+// per-VM state is the Story itself (stack, call frames and global variables)
+// plus whatever the Driver Program sets on it.
 func New(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) *VM {
+	globals := make([]bytecode.Value, len(csw.Globals))
+	for i, g := range csw.Globals {
+		globals[i] = g.InitialValue
+	}
+
 	return &VM{
 		stack:     &Stack{},
+		globals:   globals,
 		csw:       csw,
+		externals: make([]ExternalFunction, len(csw.Procedures)),
 		debugInfo: di,
+		Profile:   NewProfile(),
 	}
 }
 
+// Output is what the VM returns to the Driver Program whenever it stops
+// running the Storyworld. Its JSON representation is the one used by the story
+// server (see the server package).
+type Output struct {
+	// Text is the text said by the Storyworld.
+	Text string `json:"text"`
+
+	// Events contains the Events emitted by the Storyworld, in the order they
+	// were emitted. Each Event knows its position within Text.
+	Events []Event `json:"events,omitempty"`
+
+	// Options contains the options available to the Player. Only meaningful if
+	// State is StateWaitingForInput.
+	Options string `json:"options"`
+
+	// State is the state of the VM.
+	State State `json:"state"`
+
+	// Interrupt tells why the VM was interrupted. Only meaningful if State is
+	// StateInterrupted.
+	Interrupt InterruptReason `json:"interrupt,omitempty"`
+
+	// Seen tells if all of Text had already been seen by the Player (in this
+	// or in any previous playthrough sharing the same Profile) before this
+	// Output. Driver Programs can use this to offer skipping already-read
+	// text. Always false if Text is blank.
+	Seen bool `json:"seen"`
+}
+
 // Start starts the execution of the Storyworld, running until the first Listen
 // instruction or the end of the Story (whatever comes first). Returns the first
 // output generated by the Storyworld.
 //
-// Must be called when vm.State == StateNew, otherwise it panics.
-func (vm *VM) Start() string {
+// Must be called when vm.State == StateNew. If an error happens while running
+// the Storyworld, the VM goes to StateError and the error is returned (along
+// with whatever was said before the error). Runtime errors are returned as
+// *errs.Runtime.
+//
+// The execution is interrupted (and the VM goes to StateInterrupted) if ctx is
+// cancelled or if vm.InstructionBudget runs out. This is not an error: the
+// output generated so far is returned, and the execution can be continued by
+// calling Resume(). The Output tells why the execution was interrupted.
+func (vm *VM) Start(ctx context.Context) (Output, errs.Error) {
 	if vm.State != StateNew {
-		panic(errs.NewICE("Called Start() with the VM already started"))
+		return vm.output(), errs.NewBadUsage("VM.Start() called with the VM already started")
+	}
+	if err := vm.checkExternals(); err != nil {
+		return vm.output(), err
 	}
 	vm.State = stateRunning
-
-	// Normal Procedure calls start by pushing the callable thing. Here we have
-	// an implicit call to the initial Procedure, so we push it. This keeps this
-	// implicit call consistent with calls made by the user, and avoid having to
-	// treat it as a special case elsewhere.
-	vm.push(bytecode.NewValueProcedure(vm.csw.InitialChunk))
-	proc := bytecode.Procedure{ChunkIndex: vm.csw.InitialChunk}
-	vm.callProcedure(proc, 0)
-	vm.frame = vm.frames[0]
-
-	vm.runStep()
-	output := vm.outBuffer.String()
-	vm.outBuffer.Reset()
-	return output
+	vm.appliedMigrations = vm.allMigrations()
+
+	return vm.run(func() {
+		// Normal Procedure calls start by pushing the callable thing. Here we
+		// have an implicit call to the initial Procedure, so we push it. This
+		// keeps this implicit call consistent with calls made by the user, and
+		// avoid having to treat it as a special case elsewhere.
+		initialChunk := vm.csw.InitialChunk
+		vm.push(bytecode.NewValueProcedure(vm.csw.Chunks[initialChunk].Procedure))
+		vm.callProcedure(initialChunk, 0)
+
+		vm.runStep(ctx)
+	})
 }
 
 // Step executes the Storyworld until the next Listen instruction or the end of
 // the Story (whatever comes first). Returns the output generated by the
 // Storyworld.
 //
-// Must be called when VM.WaitingForInput is true, otherwise it panics.
-func (vm *VM) Step(choice string) string {
+// Must be called when vm.State == StateWaitingForInput. Errors and
+// interruptions are handled just like in Start().
+func (vm *VM) Step(ctx context.Context, choice string) (Output, errs.Error) {
 	if vm.State != StateWaitingForInput {
-		panic(errs.NewICE("VM.Step() called while not waiting for input"))
+		return vm.output(), errs.NewBadUsage("VM.Step() called while not waiting for input")
 	}
 
+	if vm.Observer != nil {
+		vm.Observer.OnChoice(choice)
+	}
+	if len(vm.history) > 0 {
+		last := &vm.history[len(vm.history)-1]
+		last.Choice = choice
+		last.Chosen = true
+		vm.trimHistory()
+	}
 	vm.push(bytecode.NewValueString(choice))
 	vm.State = stateRunning
 
-	vm.runStep()
-	output := vm.outBuffer.String()
+	return vm.run(func() { vm.runStep(ctx) })
+}
+
+// Resume continues an interrupted execution of the Storyworld, until the next
+// Listen instruction or the end of the Story (whatever comes first). Returns
+// the output generated by the Storyworld since the interruption.
+//
+// Must be called when vm.State == StateInterrupted. Errors and interruptions
+// are handled just like in Start(); in particular, a new instruction budget is
+// available for this call.
+func (vm *VM) Resume(ctx context.Context) (Output, errs.Error) {
+	if vm.State != StateInterrupted {
+		return vm.output(), errs.NewBadUsage("VM.Resume() called while not interrupted")
+	}
+
+	vm.State = stateRunning
+
+	return vm.run(func() { vm.runStep(ctx) })
+}
+
+// run calls f, which is expected to run the Storyworld, and returns the output
+// generated by it. If anything goes wrong (the VM reports runtime errors by
+// panicking), the VM goes to StateError and the error is returned.
+func (vm *VM) run(f func()) (out Output, err errs.Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			vm.State = StateError
+			switch e := r.(type) {
+			case errs.Error:
+				err = e
+			default:
+				err = errs.NewICE("unexpected error while running the Storyworld: %v", r)
+			}
+			out = vm.output()
+		}
+	}()
+
+	f()
+
+	if vm.State == StateWaitingForInput {
+		err = vm.takeCheckpoint()
+		if err != nil {
+			vm.State = StateError
+		}
+	}
+	return vm.output(), err
+}
+
+// output returns the current output of the VM, and resets the output buffer.
+func (vm *VM) output() Output {
+	out := Output{
+		Text:   vm.outBuffer.String(),
+		Events: vm.events,
+		State:  vm.State,
+		Seen:   vm.outSaid && !vm.outUnseen,
+	}
+	if vm.State == StateWaitingForInput {
+		out.Options = vm.Options
+	}
+	if vm.State == StateInterrupted {
+		out.Interrupt = vm.interrupt
+	}
 	vm.outBuffer.Reset()
-	return output
+	vm.events = nil
+	vm.outSaid = false
+	vm.outUnseen = false
+	return out
 }
 
 // currentChunk returns the chunk currently being executed.
 func (vm *VM) currentChunk() *bytecode.Chunk {
-	return vm.csw.Chunks[vm.frame.proc.ChunkIndex]
+	return vm.csw.Chunks[vm.frame.chunk]
 }
 
 // runStep runs the VM until it reaches either a Listen instruction or the end
-// of the Story.
-func (vm *VM) runStep() {
-	for vm.State != StateWaitingForInput && vm.State != StateEndOfStory {
+// of the Story. Stops earlier, leaving the VM in StateInterrupted, if ctx is
+// cancelled, the instruction budget runs out, or the Debugger says so.
+func (vm *VM) runStep(ctx context.Context) {
+	done := ctx.Done()
+	for executed := 0; vm.State == stateRunning; executed++ {
+		if reason := vm.interruption(done, executed); reason != InterruptNone {
+			vm.State = StateInterrupted
+			vm.interrupt = reason
+			return
+		}
 		vm.runInstruction()
 	}
 }
 
-// runInstruction runs the next instruction.
-func (vm *VM) runInstruction() {
-	// TODO: Temporary hack to detect the of end of a Story. Eventually, this
-	// will be done by the return instruction.
-	if vm.frame.ip >= len(vm.currentChunk().Code) {
-		vm.State = StateEndOfStory
-		return
+// interruption tells if the execution shall stop before running the next
+// instruction, and why. done is the Done channel of the context the VM runs
+// under, and executed is the number of instructions run so far in the current
+// call.
+func (vm *VM) interruption(done <-chan struct{}, executed int) InterruptReason {
+	if vm.InstructionBudget > 0 && executed >= vm.InstructionBudget {
+		return InterruptBudget
 	}
 
-	if vm.DebugTraceExecution {
-		fmt.Print("Stack: ")
-
-		for _, v := range vm.stack.data {
-			fmt.Printf("[ %v ]", v.DebugString(vm.debugInfo))
+	// Checking the context is relatively expensive, so do it only once in a
+	// while.
+	if done != nil && executed%contextCheckInterval == 0 {
+		select {
+		case <-done:
+			return InterruptCancelled
+		default:
 		}
+	}
 
-		fmt.Print("\n")
+	if vm.debugger != nil && vm.debugger.shouldStop() {
+		return InterruptDebugger
+	}
+
+	return InterruptNone
+}
 
-		chunkIndex := vm.frame.proc.ChunkIndex
-		vm.csw.DisassembleInstruction(vm.currentChunk(), os.Stdout, vm.frame.ip, vm.debugInfo, chunkIndex)
+// runInstruction runs the next instruction.
+func (vm *VM) runInstruction() {
+	if vm.Observer != nil {
+		vm.Observer.OnInstruction(vm.frame.chunk, vm.frame.ip, vm.stack.data)
+	}
+	if vm.Coverage != nil {
+		vm.Coverage.hit(vm.frame.chunk, vm.frame.ip)
 	}
 
 	currentChunk := vm.currentChunk()
@@ -222,13 +598,47 @@ func (vm *VM) runInstruction() {
 		if !value.IsLecture() {
 			vm.runtimeError("Expected a Lecture, got %T", value.Value)
 		}
+		if vm.curliesDepth > 0 {
+			vm.softError("Cannot say things while evaluating curlies; ignoring %q.", value.AsLecture().Text)
+			break
+		}
 		vm.outBuffer.WriteString(value.AsLecture().Text)
+		vm.recordLecture(value.AsLecture().Text)
+		vm.markSeen(value.AsLecture().Text)
+		if vm.Observer != nil {
+			vm.Observer.OnSay(vm.currentLocation(), value.AsLecture().Text)
+		}
 
 	case bytecode.OpListen:
+		options := vm.pop().AsString()
+		if vm.curliesDepth > 0 {
+			vm.softError("Cannot listen while evaluating curlies; using an empty string as the choice.")
+			vm.push(bytecode.NewValueString(""))
+			break
+		}
 		vm.State = StateWaitingForInput
-		vm.Options = vm.pop().AsString()
+		vm.Options = options
+		if vm.Observer != nil {
+			vm.Observer.OnListen(vm.currentLocation(), options)
+		}
 		return
 
+	case bytecode.OpBeginCurlies:
+		vm.curliesDepth++
+
+	case bytecode.OpEndCurlies:
+		vm.curliesDepth--
+
+	case bytecode.OpExternal:
+		vm.callExternal(true)
+
+	case bytecode.OpExternalVoid:
+		vm.callExternal(false)
+
+	case bytecode.OpEmit:
+		entryCount := vm.readUInt31()
+		vm.emit(entryCount)
+
 	case bytecode.OpTrue:
 		vm.push(bytecode.NewValueBool(true))
 
@@ -285,6 +695,46 @@ func (vm *VM) runInstruction() {
 		s := v.String()
 		vm.push(bytecode.NewValueLecture(s))
 
+	case bytecode.OpGetGlobal:
+		index := vm.readUInt31()
+		vm.push(vm.globalValue(index))
+
+	case bytecode.OpSetGlobal:
+		index := vm.readUInt31()
+		if g := &vm.csw.Globals[index]; g.Profile {
+			vm.Profile.set(g, vm.pop())
+			break
+		}
+		vm.globals[index] = vm.pop()
+
+	case bytecode.OpGetLocal:
+		index := vm.readUInt31()
+		vm.push(vm.frame.stack.at(index))
+
+	case bytecode.OpSetLocal:
+		index := vm.readUInt31()
+		vm.frame.stack.setAt(index, vm.pop())
+
+	case bytecode.OpCall:
+		argCount := vm.readUInt31()
+		callee := vm.peek(argCount)
+		if !callee.IsProcedure() {
+			vm.runtimeError("Expected a Procedure, got %T", callee.Value)
+		}
+		// Calls always run the latest version of the Procedure.
+		chunk := vm.csw.Procedures[callee.AsProcedure().Index].Chunk
+		vm.callProcedure(chunk, argCount)
+
+	case bytecode.OpReturnValue:
+		result := vm.pop()
+		vm.returnFromProcedure()
+		if vm.State != StateEndOfStory {
+			vm.push(result)
+		}
+
+	case bytecode.OpReturnVoid:
+		vm.returnFromProcedure()
+
 	default:
 		vm.runtimeError("Unexpected instruction: %v", instruction)
 	}
@@ -300,6 +750,14 @@ func (vm *VM) readConstant() bytecode.Value {
 	return constant
 }
 
+// readUInt31 reads a 31-bit unsigned integer operand from the chunk bytecode.
+func (vm *VM) readUInt31() int {
+	chunk := vm.currentChunk()
+	v := bytecode.DecodeUInt31(chunk.Code[vm.frame.ip:])
+	vm.frame.ip += 4
+	return v
+}
+
 // push pushes a value into the VM stack.
 func (vm *VM) push(value bytecode.Value) {
 	vm.stack.push(value)
@@ -323,98 +781,101 @@ func (vm *VM) peek(distance int) bytecode.Value {
 	return vm.stack.peek(distance)
 }
 
-// callProcedure calls Procedure proc. Assumes that the function and its arguments
-// were pushed into the stack. Pushes a new frame into vm.frames.
-func (vm *VM) callProcedure(proc bytecode.Procedure, argCount int) {
+// callProcedure calls the Procedure version whose bytecode is at the given
+// chunk. Assumes that the function and its arguments were pushed into the
+// stack. Pushes a new frame into vm.frames and makes it the current one.
+func (vm *VM) callProcedure(chunk int, argCount int) {
 	vm.frames = append(vm.frames, &callFrame{
-		proc:  proc,
+		chunk: chunk,
 		stack: vm.stack.createView(argCount + 1), // "+1" is the callee, which is on the stack
 	})
+	vm.frame = vm.frames[len(vm.frames)-1]
+
+	if vm.Observer != nil {
+		vm.Observer.OnProcedureEnter(vm.currentLocation())
+	}
 }
 
-// runtimeError stops the execution and reports a runtime error with a given
-// message and fmt.Printf-like arguments.
-//
-// TODO: Return errors Go-style instead?
-func (vm *VM) runtimeError(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", a...)
+// returnFromProcedure returns from the currently running Procedure. Pops the
+// callee, its arguments and locals from the stack, and pops its frame from
+// vm.frames. Returning from the initial Procedure ends the Story.
+func (vm *VM) returnFromProcedure() {
+	if vm.Observer != nil {
+		vm.Observer.OnProcedureExit(vm.currentLocation())
+	}
 
-	stackTrace := strings.Builder{}
-	for i := len(vm.frames) - 1; i >= 0; i-- {
-		frame := vm.frames[i]
-		proc := frame.proc
-		instructionOffset := frame.ip - 1
-		chunkIndex := proc.ChunkIndex
-		lineNumber := vm.debugInfo.ChunksLines[chunkIndex][instructionOffset]
-		functionName := vm.debugInfo.ChunksNames[chunkIndex]
-		stackTrace.WriteString(fmt.Sprintf("[line %v] in %v\n", lineNumber, functionName))
+	vm.stack.popN(vm.frame.stack.size())
+	vm.frames = vm.frames[:len(vm.frames)-1]
+
+	if len(vm.frames) == 0 {
+		vm.frame = nil
+		vm.State = StateEndOfStory
+		return
 	}
 
-	stackTrace.WriteRune('\n')
-	panic(errs.NewRuntime(stackTrace.String()))
+	vm.frame = vm.frames[len(vm.frames)-1]
 }
 
-// callFrame contains the information needed at runtime about an ongoing
-// Procedure call.
-type callFrame struct {
-	// proc is the Procedure running.
-	proc bytecode.Procedure
+// runtimeError stops the execution and reports a runtime error with a given
+// message and fmt.Printf-like arguments. The error (with a stack trace) is
+// eventually returned by whatever public method was running the Storyworld.
+func (vm *VM) runtimeError(format string, a ...interface{}) {
+	err := errs.NewRuntime(format, a...)
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		err.StackTrace = append(err.StackTrace, vm.stackFrame(i))
+	}
 
-	// ip is the instruction pointer, which points to the next instruction to be
-	// executed (it's an index into proc's chunk).
-	ip int
+	panic(err)
+}
 
-	// stack is a read/write view into the VM stack, and represents the stack
-	// that this Procedure can use.
-	stack *StackView
+// currentLocation returns the description of the current call frame, which
+// tells where the VM is.
+func (vm *VM) currentLocation() errs.StackFrame {
+	return vm.stackFrame(len(vm.frames) - 1)
 }
 
-// Serialize serializes the callFrame to the given io.Writer.
-func (cf *callFrame) Serialize(w io.Writer) errs.Error {
-	err := romutil.SerializeU32(w, uint32(cf.proc.ChunkIndex))
-	if err != nil {
-		return err
+// stackFrame returns the description of the call frame at index i into
+// vm.frames.
+func (vm *VM) stackFrame(i int) errs.StackFrame {
+	frame := vm.frames[i]
+	chunk := vm.csw.Chunks[frame.chunk]
+	stackFrame := errs.StackFrame{
+		Procedure: vm.csw.Procedures[chunk.Procedure].FQN,
 	}
-
-	err = romutil.SerializeU32(w, uint32(cf.ip))
-	if err != nil {
-		return err
+	if vm.debugInfo != nil {
+		stackFrame.SourceFile, stackFrame.Line = sourceLocation(vm.debugInfo, frame.chunk, frame.ip)
 	}
-
-	// Need only the stack base; the stack pointer is always the one and only
-	// stack we have, which is serialized elsewhere.
-	err = romutil.SerializeU32(w, uint32(cf.stack.base))
-	return err
+	return stackFrame
 }
 
-// DeserializeCallFrame deserializes a callFrame from the given io.Reader. The
-// stack parameter will be used for callFrame.stack.stack; you can technically
-// pass a nil here and fill the field later, but things will look much tidier if
-// you pass the right stack here.
-func DeserializeCallFrame(r io.Reader, stack *Stack) (*callFrame, errs.Error) {
-	chunkIndex, err := romutil.DeserializeU32(r)
-	if err != nil {
-		return nil, err
+// sourceLocation returns the source file and line of a call frame running the
+// given Chunk, with the given instruction pointer.
+func sourceLocation(di *bytecode.DebugInfo, chunk, ip int) (string, int) {
+	// The ip points to the instruction after the one running, except when the
+	// Procedure was just called.
+	instructionOffset := ip - 1
+	if instructionOffset < 0 {
+		instructionOffset = 0
 	}
-
-	ip, err := romutil.DeserializeU32(r)
-	if err != nil {
-		return nil, err
+	lines := di.ChunksLines[chunk]
+	if instructionOffset >= len(lines) {
+		return di.ChunksSourceFiles[chunk], 0
 	}
+	return di.ChunksSourceFiles[chunk], lines[instructionOffset]
+}
 
-	stackBase, err := romutil.DeserializeU32(r)
-	if err != nil {
-		return nil, err
-	}
+// callFrame contains the information needed at runtime about an ongoing
+// Procedure call.
+type callFrame struct {
+	// chunk is the index into CompiledStoryworld.Chunks of the Procedure
+	// version running.
+	chunk int
+
+	// ip is the instruction pointer, which points to the next instruction to be
+	// executed (it's an index into the chunk).
+	ip int
 
-	return &callFrame{
-		proc: bytecode.Procedure{
-			ChunkIndex: int(chunkIndex),
-		},
-		ip: int(ip),
-		stack: &StackView{
-			stack: stack,
-			base:  int(stackBase),
-		},
-	}, nil
+	// stack is a read/write view into the VM stack, and represents the stack
+	// that this Procedure can use.
+	stack *StackView
 }
@@ -8,225 +8,341 @@
 package vm
 
 import (
-	"hash/crc32"
+	"bytes"
+	"context"
 	"io"
 
+	"github.com/stackedboxes/romualdo/pkg/bytecode"
 	"github.com/stackedboxes/romualdo/pkg/errs"
-	"github.com/stackedboxes/romualdo/pkg/romutil"
 )
 
-const (
-	// savedStateVersion is the current version of a Romualdo saved state.
-	savedStateVersion uint32 = 0
-)
-
-// savedStateMagic is the "magic number" identifying a Romualdo VM saved state.
-// It is comprised of the "RmldSav" string followed by a SUB character (which in
-// times long gone used to represent a "soft end-of-file").
-var savedStateMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x53, 0x61, 0x76, 0x1A}
+// SaveState serializes the VM state to the given io.Writer. The VM must not be
+// in StateError or StateInterrupted.
+func (vm *VM) SaveState(w io.Writer) errs.Error {
+	switch vm.State {
+	case StateError:
+		return errs.NewBadUsage("VM.SaveState() called on a VM in an error state")
+	case StateInterrupted:
+		return errs.NewBadUsage("VM.SaveState() called on an interrupted VM")
+	}
 
-// Serialize serializes the VM state to the given io.Writer.
-func (vm *VM) Serialize(w io.Writer) errs.Error {
-	err := vm.serializeHeader(w)
+	err := vm.savedState(vm.SaveHistory).Encode(w, vm.SavedStateOptions)
 	if err != nil {
 		return err
 	}
 
-	crc32, err := vm.serializePayload(w)
+	if vm.Observer != nil {
+		vm.Observer.OnSaveState()
+	}
+	return nil
+}
+
+// SaveStateJSON is like SaveState(), but uses the JSON representation of saved
+// states. Call frames are annotated with source code locations if the VM has
+// DebugInfo.
+func (vm *VM) SaveStateJSON(w io.Writer) errs.Error {
+	buf := &bytes.Buffer{}
+	err := vm.SaveState(buf)
 	if err != nil {
 		return err
 	}
 
-	err = vm.serializeFooter(w, crc32)
-	return err
+	ss, err := DecodeSavedState(buf, vm.SavedStateOptions)
+	if err != nil {
+		return err
+	}
+	ss.Annotate(vm.csw, vm.debugInfo)
+	return ss.EncodeJSON(w)
 }
 
-// serializedHeader writes the header of a VM saved state to the given
-// io.Writer.
-func (vm *VM) serializeHeader(w io.Writer) errs.Error {
-	_, plainErr := w.Write(savedStateMagic)
-	if plainErr != nil {
-		return errs.NewRomualdoTool("serializing VM state magic: %v", plainErr)
+// LoadStateJSON is like LoadState(), but uses the JSON representation of saved
+// states. Loading the JSON representation of a saved state is exactly the same
+// as loading the saved state itself. The JSON representation is never signed,
+// so this fails if vm.SavedStateOptions requires a signature (which, for saved
+// states of the current version, a Key alone does, unless AllowUnsigned is
+// set).
+func (vm *VM) LoadStateJSON(ctx context.Context, r io.Reader) (Output, errs.Error) {
+	ss, err := DecodeSavedStateJSON(r)
+	if err != nil {
+		return vm.output(), err
+	}
+
+	if vm.SavedStateOptions.RequireSignature {
+		return vm.output(), errs.NewRomualdoTool("VM saved state is not signed")
 	}
 
-	err := romutil.SerializeU32(w, savedStateVersion)
-	return err
+	buf := &bytes.Buffer{}
+	err = ss.Encode(buf, SavedStateOptions{})
+	if err != nil {
+		return vm.output(), err
+	}
+
+	return vm.LoadState(ctx, buf)
 }
 
-// serializePayload writes the payload of a VM saved state to the given
-// io.Writer. In other words, this the function doing the actual serialization.
-// Returns the CRC32 of the data written to w, and an error.
-func (vm *VM) serializePayload(w io.Writer) (uint32, errs.Error) {
-	crc := crc32.NewIEEE()
-	mw := io.MultiWriter(w, crc)
+// savedState returns the current VM state as a SavedState. The rewind history
+// is included only if withHistory is true.
+func (vm *VM) savedState(withHistory bool) *SavedState {
+	md := vm.saveMetadata()
+	ss := &SavedState{
+		Version:           savedStateVersion,
+		Metadata:          &md,
+		State:             vm.State,
+		Options:           vm.Options,
+		AppliedMigrations: vm.appliedMigrations,
+		Stack:             vm.stack.data,
+	}
 
-	// VM State
-	err := romutil.SerializeU32(mw, uint32(vm.State))
-	if err != nil {
-		return 0, err
+	// Procedure values refer to Procedures by index, and these indices may
+	// differ between builds. So we save the names of all Procedures, to allow
+	// remapping the indices when loading.
+	for _, p := range vm.csw.Procedures {
+		ss.Procedures = append(ss.Procedures, p.FQN)
 	}
 
-	// Options
-	err = romutil.SerializeString(mw, vm.Options)
-	if err != nil {
-		return 0, err
+	// Profile variables are not part of the Story, so they are not saved.
+	for i, v := range vm.globals {
+		g := vm.csw.Globals[i]
+		if g.Profile {
+			continue
+		}
+		ss.Globals = append(ss.Globals, SavedGlobal{FQN: g.FQN, Hash: g.Hash, Value: v})
 	}
 
-	// Stack
-	err = vm.stack.Serialize(mw)
-	if err != nil {
-		return 0, err
+	for _, f := range vm.frames {
+		chunk := vm.csw.Chunks[f.chunk]
+		ss.Frames = append(ss.Frames, SavedFrame{
+			FQN:       vm.csw.Procedures[chunk.Procedure].FQN,
+			Hash:      chunk.Hash,
+			IP:        f.ip,
+			StackBase: f.stack.base,
+		})
+	}
+
+	if withHistory {
+		for _, cp := range vm.history {
+			ss.History = append(ss.History, SavedCheckpoint{
+				ChoicePoint: cp.ChoicePoint,
+				encoded:     cp.snapshot,
+			})
+		}
 	}
 
-	// Frames
-	err = romutil.SerializeU32(mw, uint32(len(vm.frames)))
+	return ss
+}
+
+// LoadState deserializes a VM state from the given io.Reader, replacing the
+// current state of the VM. This is valid in any VM state. If the saved state was
+// created with an older release of the Storyworld, any pending migrations are
+// run (and anything they say or emit is discarded). Migrations that run out of
+// vm.InstructionBudget or get interrupted by ctx make the load fail.
+//
+// The rewind history is replaced by the one in the saved state, if any.
+//
+// If anything goes wrong, an error is returned and the VM is left exactly as it
+// was before the call. On success, returns an Output with the loaded state and
+// options (but no text).
+func (vm *VM) LoadState(ctx context.Context, r io.Reader) (Output, errs.Error) {
+	history, migrations, err := vm.restoreState(ctx, r, vm.SavedStateOptions)
 	if err != nil {
-		return 0, err
+		return vm.output(), err
 	}
-	for _, f := range vm.frames {
-		err = f.Serialize(mw)
+
+	vm.history = history
+	vm.trimHistory()
+	if len(vm.history) == 0 && vm.State == StateWaitingForInput {
+		err = vm.takeCheckpoint()
 		if err != nil {
-			return 0, err
+			return vm.output(), err
 		}
 	}
 
-	// Voilà!
-	return crc.Sum32(), nil
-}
+	if vm.Observer != nil {
+		vm.Observer.OnLoadState(migrations)
+	}
 
-// serializeFooter writes the footer of a VM saved state to the given io.Writer.
-func (vm *VM) serializeFooter(w io.Writer, crc32 uint32) errs.Error {
-	err := romutil.SerializeU32(w, crc32)
-	return err
+	return vm.output(), nil
 }
 
-// Deserialize deserializes a VM state from the given io.Reader.
-func (vm *VM) Deserialize(r io.Reader) errs.Error {
-	err := vm.deserializeHeader(r)
+// restoreState deserializes a VM state from the given io.Reader, replacing the
+// current state of the VM (except for the rewind history, which is returned
+// instead). Also returns the fully-qualified names of the migrations run while
+// restoring it.
+//
+// The saved state is decoded using the given options. Migrations run under ctx
+// and vm.InstructionBudget.
+//
+// If anything goes wrong, an error is returned and the VM is left exactly as it
+// was before the call.
+func (vm *VM) restoreState(ctx context.Context, r io.Reader, opts SavedStateOptions) ([]checkpoint, []string, errs.Error) {
+	// Deserialize into a fresh VM, and only adopt its state if everything went
+	// fine.
+	loaded := New(vm.csw, vm.debugInfo)
+	loaded.Observer = vm.Observer
+	loaded.externals = vm.externals
+	loaded.SoftErrorSink = vm.SoftErrorSink
+	loaded.Strict = vm.Strict
+	loaded.Profile = vm.Profile
+	loaded.InstructionBudget = vm.InstructionBudget
+
+	err := vm.checkExternals()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	crc32, err := vm.deserializePayload(r)
+	ss, err := DecodeSavedState(r, opts)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	err = vm.deserializeFooter(r, crc32)
+	err = loaded.applySavedState(ss)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Post-deserialization adjustments
-	vm.frame = nil
-	if len(vm.frames) > 0 {
-		vm.frame = vm.frames[len(vm.frames)-1]
+	switch loaded.State {
+	case StateNew, StateWaitingForInput, StateEndOfStory:
+		// Fine, these are the only states that can be saved.
+	default:
+		return nil, nil, errs.NewRomualdoTool("invalid VM state in saved state: %v", loaded.State)
 	}
-	vm.outBuffer.Reset()
 
-	return nil
+	// Post-deserialization adjustments
+	loaded.frame = nil
+	if len(loaded.frames) > 0 {
+		loaded.frame = loaded.frames[len(loaded.frames)-1]
+	}
 
-}
+	// Anything said by migrations is discarded, so it shall not change the
+	// preview.
+	lastLecture := loaded.lastLecture
 
-// deserializeHeader reads and checks the header of a VM saved state from the
-// given io.Reader. If everything is OK, it returns nil, otherwise it returns an
-// error.
-func (vm *VM) deserializeHeader(r io.Reader) errs.Error {
-	// Magic
-	readMagic := make([]byte, len(savedStateMagic))
-	_, err := io.ReadFull(r, readMagic)
-	if err != nil {
-		// TODO: This isn't really a Romualdo tool error. But also not really a
-		// Runtime error. And I am not sure I want to create a brand new error
-		// type just for this. Think about it. And the same for other cases in
-		// this file. *And*, all generic serialization stuff in romutil that
-		// gets used here indirectly! (Maybe those should return normal Go
-		// errors? So that callers need to add more context in an errs.Error?)
-		return errs.NewRomualdoTool("deserializing VM state header magic: %v", err)
-	}
-	for i, b := range readMagic {
-		if b != savedStateMagic[i] {
-			// TODO: Could be friendlier here, by comparing readMagic with other
-			// Romualdo magic numbers and reporting a more meaningful error.
-			return errs.NewRomualdoTool("invalid VM state magic number")
+	// Bring the Story up to date with the Storyworld. A Story that was not
+	// started yet will be started with the current release, so it doesn't need
+	// migrations.
+	alreadyApplied := len(loaded.appliedMigrations)
+	if loaded.State != StateNew {
+		_, err = loaded.run(func() { loaded.runPendingMigrations(ctx) })
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
-	// Version
-	readVersion, err := romutil.DeserializeU32(r)
-	if err != nil {
-		return errs.NewRomualdoTool("deserializing VM state header version: %v", err)
-	}
-	if readVersion != savedStateVersion {
-		return errs.NewRomualdoTool("unsupported VM state version: %v", readVersion)
-	}
+	vm.State = loaded.State
+	vm.Options = loaded.Options
+	vm.stack = loaded.stack
+	vm.frames = loaded.frames
+	vm.globals = loaded.globals
+	vm.appliedMigrations = loaded.appliedMigrations
+	vm.frame = loaded.frame
+	vm.chapter = loaded.chapter
+	vm.lastLecture = lastLecture
+	vm.SaveFields = loaded.SaveFields
+	vm.curliesDepth = 0
+	vm.outBuffer.Reset()
+	vm.events = nil
 
-	// Header is OK
-	return nil
+	return loaded.history, vm.appliedMigrations[alreadyApplied:], nil
 }
 
-// deserializePayload reads the payload of a VM saved state from the given
-// io.Reader. In other words, this the function doing the actual
-// deserialization. Returns the CRC32 of the data read from r, and an error. It
-// updates the VM state with the deserialized data as it goes.
-func (vm *VM) deserializePayload(r io.Reader) (uint32, errs.Error) {
-	crcSummer := crc32.NewIEEE()
-	tr := io.TeeReader(r, crcSummer)
-
-	// TODO: Check for compatibility between the saved state and the Storyworld
-	// loaded into the VM.
-
-	// VM State
-	vmState, err := romutil.DeserializeU32(tr)
-	if err != nil {
-		return 0, err
+// applySavedState sets the VM state to the one in ss (including the rewind
+// history). This is meant to be called on a fresh VM.
+//
+// Compatibility between the saved state and the Storyworld loaded into the VM
+// is checked as we go: every global and every Procedure version on the call
+// stack must be present in the Storyworld.
+func (vm *VM) applySavedState(ss *SavedState) errs.Error {
+	// Metadata. Not present in older saved states.
+	if ss.Metadata != nil {
+		vm.chapter = ss.Metadata.Chapter
+		vm.lastLecture = ss.Metadata.Preview
+		vm.SaveFields = ss.Metadata.Fields
 	}
-	vm.State = State(vmState)
 
-	// Options
-	options, err := romutil.DeserializeString(tr)
-	if err != nil {
-		return 0, err
+	vm.State = ss.State
+	vm.Options = ss.Options
+	vm.appliedMigrations = append([]string{}, ss.AppliedMigrations...)
+
+	// Globals. Any global not in the saved state (i.e., added by a newer
+	// release) gets its initial value.
+	for _, g := range ss.Globals {
+		index := vm.csw.GlobalByHash(g.Hash)
+		if index < 0 {
+			return errs.NewRomualdoTool("saved state is incompatible with the Storyworld: "+
+				"global `%v` is not available", g.FQN)
+		}
+		vm.globals[index] = g.Value
 	}
-	vm.Options = options
 
 	// Stack
-	stack, err := DeserializeStack(tr)
+	stack := &Stack{data: append([]bytecode.Value{}, ss.Stack...)}
+	err := vm.remapProcedures(stack, ss.Procedures)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	vm.stack = stack
 
-	// Frames
-	frameCount, err := romutil.DeserializeU32(tr)
-	if err != nil {
-		return 0, err
+	// Frames. Each one must point into its chunk and into the stack, above the
+	// frame that called it.
+	vm.frames = make([]*callFrame, 0, len(ss.Frames))
+	minBase := 0
+	for _, f := range ss.Frames {
+		chunk := vm.csw.ChunkByHash(f.Hash)
+		if chunk < 0 {
+			return errs.NewRomualdoTool("saved state is incompatible with the Storyworld: "+
+				"the version of `%v` it was running is not available", f.FQN)
+		}
+		if f.IP < 0 || f.IP >= len(vm.csw.Chunks[chunk].Code) {
+			return errs.NewRomualdoTool("invalid instruction pointer in saved state: %v", f.IP)
+		}
+		if f.StackBase < minBase || f.StackBase >= stack.size() {
+			return errs.NewRomualdoTool("invalid stack base in saved state: %v", f.StackBase)
+		}
+		minBase = f.StackBase + 1
+		vm.frames = append(vm.frames, &callFrame{
+			chunk: chunk,
+			ip:    f.IP,
+			stack: &StackView{
+				stack: vm.stack,
+				base:  f.StackBase,
+			},
+		})
 	}
 
-	frames := make([]*callFrame, frameCount)
-	for i := 0; i < int(frameCount); i++ {
-		frame, err := DeserializeCallFrame(tr, vm.stack)
+	// Rewind history
+	vm.history = make([]checkpoint, 0, len(ss.History))
+	for _, cp := range ss.History {
+		snapshot, err := cp.encodedSnapshot()
 		if err != nil {
-			return 0, err
+			return err
 		}
-		frames = append(frames, frame)
+		vm.history = append(vm.history, checkpoint{
+			ChoicePoint: cp.ChoicePoint,
+			snapshot:    snapshot,
+		})
 	}
-	vm.frames = frames
 
-	// Voilà!
-	return crcSummer.Sum32(), nil
+	return nil
 }
 
-// deserializeFooter reads and checks the footer of a CompiledStoryworld from
-// the given io.Reader. You must pass the CRC32 of the payload previously read
-// from r.
-func (vm *VM) deserializeFooter(r io.Reader, crc32 uint32) errs.Error {
-	readCRC32, err := romutil.DeserializeU32(r)
-	if err != nil {
-		return err
-	}
-	if readCRC32 != crc32 {
-		return errs.NewRomualdoTool("compiled storyworld CRC32 mismatch")
+// remapProcedures updates all Procedure values on stack so that they refer to
+// the Procedures of the Storyworld loaded into the VM. procNames are the
+// fully-qualified names of the Procedures, as indexed in the saved state.
+func (vm *VM) remapProcedures(stack *Stack, procNames []string) errs.Error {
+	for i, v := range stack.data {
+		if !v.IsProcedure() {
+			continue
+		}
+		savedIndex := v.AsProcedure().Index
+		if savedIndex >= len(procNames) {
+			return errs.NewRomualdoTool("invalid procedure index in saved state: %v", savedIndex)
+		}
+		index := vm.csw.ProcedureByFQN(procNames[savedIndex])
+		if index < 0 {
+			return errs.NewRomualdoTool("saved state is incompatible with the Storyworld: "+
+				"procedure `%v` is not available", procNames[savedIndex])
+		}
+		stack.data[i] = bytecode.NewValueProcedure(index)
 	}
 	return nil
 }
@@ -0,0 +1,308 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2025 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stackedboxes/romualdo/pkg/errs"
+)
+
+// watchInterval is how often WatchCSW checks the source files for changes.
+const watchInterval = 500 * time.Millisecond
+
+// ReloadResult tells how Reload() moved a Story to a new build.
+type ReloadResult struct {
+	// Transferred tells if the state of the Story was transferred to the new
+	// build. If false, the Story was started anew, and the inputs were
+	// replayed.
+	Transferred bool
+
+	// Replayed is the number of inputs replayed. Zero if Transferred.
+	Replayed int
+
+	// Output is the output of the last step replayed, which tells where the
+	// Story is. Contains only the options if Transferred.
+	Output Output
+}
+
+// String converts the ReloadResult to a human-readable string.
+func (r ReloadResult) String() string {
+	if r.Transferred {
+		return "-- Reloaded; the Story goes on from the same point --"
+	}
+	return fmt.Sprintf("-- Reloaded; replayed %v choice(s) from the start --", r.Replayed)
+}
+
+// Reload moves the Story running on from to the VM to, which must be new and
+// set up to run a new build of the same Storyworld. inputs are the choices
+// made since the start of the Story.
+//
+// If from is waiting for input and its state is compatible with the new build
+// (according to the usual rules for loading saved states), the state is just
+// transferred, and the Story goes on from the same choice point. Otherwise,
+// the Story is started anew on to, with initialProfile as its Profile, and the
+// inputs are replayed. Replaying stops early if the Story stops listening to
+// the Player (because it ended or because of an error).
+//
+// If the state is transferred, to gets the Profile of from. The rewind
+// history is not transferred.
+func Reload(ctx context.Context, from, to *VM, inputs []string, initialProfile *Profile) (ReloadResult, errs.Error) {
+	if from.State == StateWaitingForInput {
+		buf := &bytes.Buffer{}
+		err := from.SaveState(buf)
+		if err != nil {
+			return ReloadResult{}, err
+		}
+		to.Profile = from.Profile
+		out, err := to.LoadState(ctx, buf)
+		if err == nil {
+			return ReloadResult{Transferred: true, Output: out}, nil
+		}
+	}
+
+	to.Profile = initialProfile
+	result := ReloadResult{}
+	out, err := to.Start(ctx)
+	for _, input := range inputs {
+		if err != nil || out.State != StateWaitingForInput {
+			break
+		}
+		out, err = to.Step(ctx, input)
+		result.Replayed++
+	}
+	result.Output = out
+	return result, err
+}
+
+// WatchCSW is like RunCSW(), but for the Storyworld source code at swPath,
+// which is watched for changes. Whenever it changes, the Storyworld is rebuilt
+// and the Story is moved to the new build (see Reload()). Problems (compile
+// errors, runtime errors, the Story ending) don't stop the run: the Player can
+// fix the source code and go on. The run stops when the input ends.
+//
+// Coverage and Transcripts are not supported, as they are tied to a single
+// build.
+func WatchCSW(swPath string, opts RunOptions) errs.Error {
+	if opts.Coverage != nil || opts.Transcript != nil {
+		return errs.NewBadUsage("Watch mode supports neither coverage nor transcripts.")
+	}
+
+	w := &watcher{swPath: swPath, opts: opts}
+	var err errs.Error
+	w.profile = NewProfile()
+	if opts.ProfilePath != "" {
+		w.profile, err = loadProfileFile(opts.ProfilePath)
+		if err != nil {
+			return err
+		}
+	}
+	w.initialProfile, err = copyProfile(w.profile)
+	if err != nil {
+		return err
+	}
+
+	lines := make(chan string)
+	go func() {
+		stdin := bufio.NewScanner(os.Stdin)
+		for stdin.Scan() {
+			lines <- stdin.Text()
+		}
+		close(lines)
+	}()
+
+	w.sources = w.fingerprint()
+	err = w.reload()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				fmt.Println()
+				return nil
+			}
+			err = w.input(line)
+
+		case <-ticker.C:
+			sources := w.fingerprint()
+			if sources == w.sources {
+				continue
+			}
+			w.sources = sources
+			err = w.reload()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watcher is the state of WatchCSW.
+type watcher struct {
+	// swPath is the path to the Storyworld source code.
+	swPath string
+
+	// opts are the options to run the Storyworld with.
+	opts RunOptions
+
+	// sources is the fingerprint of the source files, as of the latest build.
+	sources string
+
+	// theVM is the VM running the Story. Nil until the Storyworld is built
+	// for the first time.
+	theVM *VM
+
+	// inputs contains the choices made since the start of the Story.
+	inputs []string
+
+	// profile is the Profile being used, and initialProfile is a copy of it
+	// as it was before the Story started, used to replay the inputs.
+	profile        *Profile
+	initialProfile *Profile
+}
+
+// reload (re)builds the Storyworld and moves the Story to the new build. On
+// compile errors, the Story keeps running on the previous build. The returned
+// error is about things going wrong with the run itself; problems with the
+// Storyworld are just reported.
+func (w *watcher) reload() errs.Error {
+	csw, di, err := CSWFromPath(w.swPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if w.theVM == nil {
+			fmt.Println("-- Build failed; waiting for changes --")
+		} else {
+			fmt.Println("-- Build failed; still running the previous build --")
+			w.prompt(w.theVM.State)
+		}
+		return nil
+	}
+
+	theVM, err := newRunVM(csw, di, w.opts)
+	if err != nil {
+		return err
+	}
+
+	if w.theVM == nil {
+		theVM.Profile = w.profile
+		out, err := theVM.Start(context.Background())
+		w.theVM = theVM
+		return w.show(out, err)
+	}
+
+	// Replay on a copy, so that the initial Profile survives for the next one.
+	initialProfile, err := copyProfile(w.initialProfile)
+	if err != nil {
+		return err
+	}
+	result, err := Reload(context.Background(), w.theVM, theVM, w.inputs, initialProfile)
+	if !result.Transferred {
+		w.inputs = w.inputs[:result.Replayed]
+	}
+	w.theVM = theVM
+	w.profile = theVM.Profile
+	fmt.Println(result)
+	return w.show(result.Output, err)
+}
+
+// input handles a line of input from the Player.
+func (w *watcher) input(line string) errs.Error {
+	if w.theVM == nil || w.theVM.State != StateWaitingForInput {
+		fmt.Println("-- Not listening; waiting for changes --")
+		return nil
+	}
+
+	if w.opts.HistoryDepth > 0 && line == UndoCommand {
+		out, err := w.theVM.Undo(context.Background(), 1)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			w.prompt(w.theVM.State)
+			return nil
+		}
+		w.inputs = w.inputs[:len(w.inputs)-1]
+		return w.show(out, nil)
+	}
+
+	w.inputs = append(w.inputs, line)
+	out, err := w.theVM.Step(context.Background(), line)
+	return w.show(out, err)
+}
+
+// show shows out (and err, if not nil) to the Player, and prompts for input if
+// the Story is listening.
+func (w *watcher) show(out Output, err errs.Error) errs.Error {
+	fmt.Print(out.TextWithEvents())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if w.opts.ProfilePath != "" {
+		saveErr := saveProfileFile(w.theVM.Profile, w.opts.ProfilePath)
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+	w.prompt(out.State)
+	return nil
+}
+
+// prompt tells the Player what happens next, given the state of the VM.
+func (w *watcher) prompt(state State) {
+	switch state {
+	case StateWaitingForInput:
+		fmt.Println(w.theVM.Options)
+		fmt.Print("> ")
+	case StateEndOfStory:
+		fmt.Println("-- The End; waiting for changes --")
+	case StateInterrupted:
+		fmt.Printf("-- The Storyworld ran %v instructions without listening to the Player or "+
+			"ending; waiting for changes --\n", w.opts.InstructionBudget)
+	default:
+		fmt.Println("-- Waiting for changes --")
+	}
+}
+
+// fingerprint returns a string that changes whenever any source file of the
+// Storyworld changes.
+func (w *watcher) fingerprint() string {
+	b := &strings.Builder{}
+	_ = filepath.WalkDir(w.swPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".ral") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fmt.Fprintf(b, "%v %v %v\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return b.String()
+}
+
+// copyProfile returns a deep copy of profile.
+func copyProfile(profile *Profile) (*Profile, errs.Error) {
+	buf := &bytes.Buffer{}
+	err := profile.Save(buf)
+	if err != nil {
+		return nil, err
+	}
+	return LoadProfile(buf)
+}